@@ -10,10 +10,13 @@ require (
 	github.com/cheekybits/genny v1.0.0
 	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/function61/gokit v0.0.0-20200923114939-f8d7e065a5c3
+	github.com/fxamacker/cbor/v2 v2.2.0
 	github.com/gorilla/mux v1.8.0
 	github.com/jpillora/backoff v1.0.0
+	github.com/klauspost/compress v1.11.0
 	github.com/kr/pretty v0.2.0 // indirect
 	github.com/mattn/go-runewidth v0.0.9 // indirect
+	github.com/mattn/go-sqlite3 v1.14.4
 	github.com/prometheus/client_golang v1.4.1
 	github.com/scylladb/termtables v1.0.0
 	github.com/spf13/cobra v0.0.5
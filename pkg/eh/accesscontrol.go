@@ -10,6 +10,8 @@ var (
 	ActionStreamCreate   = policy.NewAction("eventhorizon:stream:Create")
 	ActionStreamRead     = policy.NewAction("eventhorizon:stream:Read")
 	ActionStreamAppend   = policy.NewAction("eventhorizon:stream:Append")
+	ActionStreamClose    = policy.NewAction("eventhorizon:stream:Close")
+	ActionStreamShred    = policy.NewAction("eventhorizon:stream:Shred")
 	ActionSnapshotRead   = policy.NewAction("eventhorizon:snapshot:Read")
 	ActionSnapshotWrite  = policy.NewAction("eventhorizon:snapshot:Write")
 	ActionSnapshotDelete = policy.NewAction("eventhorizon:snapshot:Delete")
@@ -0,0 +1,121 @@
+package eh
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// positions in multiple streams, for processors that follow many streams at once. at most one
+// cursor per stream. immutable. sorted by stream name so serialization is deterministic.
+type CursorVector struct {
+	cursors []Cursor
+}
+
+// panics if there are multiple cursors for the same stream (= programming error)
+func NewCursorVector(cursors ...Cursor) CursorVector {
+	sorted := append([]Cursor{}, cursors...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].stream < sorted[j].stream })
+
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].stream == sorted[i-1].stream {
+			panic(fmt.Errorf("NewCursorVector: multiple cursors for %s", sorted[i].stream))
+		}
+	}
+
+	return CursorVector{sorted}
+}
+
+func (v CursorVector) Cursors() []Cursor {
+	return append([]Cursor{}, v.cursors...)
+}
+
+// 2nd return is false if the vector doesn't have the stream
+func (v CursorVector) Cursor(stream StreamName) (Cursor, bool) {
+	for _, cur := range v.cursors {
+		if cur.stream == stream.String() {
+			return cur, true
+		}
+	}
+
+	return Cursor{}, false
+}
+
+// copy of the vector, with cursor of *cur*'s stream replaced (or added)
+func (v CursorVector) With(cur Cursor) CursorVector {
+	cursors := []Cursor{cur}
+	for _, existing := range v.cursors {
+		if existing.stream != cur.stream {
+			cursors = append(cursors, existing)
+		}
+	}
+
+	return NewCursorVector(cursors...)
+}
+
+func (v CursorVector) Equal(other CursorVector) bool {
+	if len(v.cursors) != len(other.cursors) {
+		return false
+	}
+
+	for idx := range v.cursors {
+		if !v.cursors[idx].Equal(other.cursors[idx]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// number of log entries the cursors are past, across all streams. only grows as cursors move
+// forward (or streams are added), so it works as the version of something derived from the streams.
+func (v CursorVector) TotalEntries() int64 {
+	total := int64(0)
+	for _, cur := range v.cursors {
+		total += cur.version + 1
+	}
+
+	return total
+}
+
+// looks like "/a@3,/b@-1"
+func (v CursorVector) Serialize() string {
+	serialized := []string{}
+	for _, cur := range v.cursors {
+		serialized = append(serialized, cur.Serialize())
+	}
+
+	return strings.Join(serialized, ",")
+}
+
+func (v CursorVector) MarshalJSON() ([]byte, error) {
+	cursors := []CursorCompact{}
+	for _, cur := range v.cursors {
+		cursors = append(cursors, NewCursorCompact(cur))
+	}
+
+	return json.Marshal(cursors)
+}
+
+func (v *CursorVector) UnmarshalJSON(data []byte) error {
+	cursorsCompact := []CursorCompact{}
+	if err := json.Unmarshal(data, &cursorsCompact); err != nil {
+		return err
+	}
+
+	cursors := []Cursor{}
+	seen := map[string]bool{}
+	for _, cur := range cursorsCompact {
+		if seen[cur.stream] {
+			return fmt.Errorf("CursorVector.UnmarshalJSON(): multiple cursors for %s", cur.stream)
+		}
+		seen[cur.stream] = true
+
+		cursors = append(cursors, cur.Cursor)
+	}
+
+	*v = NewCursorVector(cursors...)
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package eh
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestCursorVector(t *testing.T) {
+	bar := RootName.Child("bar")
+
+	vector := NewCursorVector(fooAt, bar.Beginning())
+	assert.EqualString(t, vector.Serialize(), "/bar@-1,/foo@314")
+	assert.Assert(t, vector.TotalEntries() == 315)
+
+	cur, found := vector.Cursor(foo)
+	assert.Assert(t, found)
+	assert.Assert(t, cur.Equal(fooAt))
+
+	_, found = vector.Cursor(RootName.Child("baz"))
+	assert.Assert(t, !found)
+
+	advanced := vector.With(bar.At(2))
+	assert.EqualString(t, advanced.Serialize(), "/bar@2,/foo@314")
+	assert.EqualString(t, vector.Serialize(), "/bar@-1,/foo@314") // original not mutated
+	assert.Assert(t, !advanced.Equal(vector))
+	assert.Assert(t, advanced.Equal(NewCursorVector(bar.At(2), fooAt)))
+
+	added := vector.With(RootName.Child("baz").At(0))
+	assert.EqualString(t, added.Serialize(), "/bar@-1,/baz@0,/foo@314")
+}
+
+func TestCursorVectorJSON(t *testing.T) {
+	vector := NewCursorVector(fooAt, RootName.Child("bar").At(3))
+
+	serialized, err := json.Marshal(vector)
+	assert.Ok(t, err)
+	assert.EqualString(t, string(serialized), `["/bar@3","/foo@314"]`)
+
+	deserialized := CursorVector{}
+	assert.Ok(t, json.Unmarshal(serialized, &deserialized))
+	assert.Assert(t, deserialized.Equal(vector))
+
+	assert.EqualString(
+		t,
+		json.Unmarshal([]byte(`["/foo@1","/foo@2"]`), &deserialized).Error(),
+		"CursorVector.UnmarshalJSON(): multiple cursors for /foo")
+}
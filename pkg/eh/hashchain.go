@@ -0,0 +1,82 @@
+package eh
+
+// Log entries are hash-chained: each entry's hash covers the previous entry's hash, so
+// modifying, removing or reordering entries breaks the chain from that point onwards.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+)
+
+// hash of entry at "cursor". prevHash is hash of the entry before it (nil for the first entry,
+// or if the previous entry was written before hash chaining)
+//
+// meta entries with DEK envelopes are hashed in the canonical form they have after shredding (only
+// a commitment to the envelope, see ShredDEKEnvelopes()), so shredded streams still verify. the
+// canonical form is derived from the stored bytes, not by re-serializing events.
+func EntryHash(prevHash []byte, cursor Cursor, data LogData) []byte {
+	// malformed meta entry can't have envelopes committed to, so it's hashed as-is
+	if shredded, err := ShredDEKEnvelopes(data); err == nil && shredded != nil {
+		data = *shredded
+	}
+
+	hash := sha256.New()
+	hash.Write(prevHash)
+	hash.Write([]byte(cursor.Serialize()))
+	hash.Write([]byte{0, byte(data.Kind)}) // separator, because serialized cursor is variable-length
+	hash.Write(data.Raw)
+	return hash.Sum(nil)
+}
+
+type VerifyHashChainResult struct {
+	Entries  int     // entries whose hash was checked
+	Unhashed int     // entries written before hash chaining, which can't be verified
+	BrokenAt *Cursor // first entry whose hash doesn't match. nil if chain is intact
+}
+
+// walks the whole stream and reports the first broken link. shredded streams verify, because
+// shredding keeps a commitment to each destroyed DEK envelope (see EntryHash()).
+func VerifyHashChain(ctx context.Context, stream StreamName, reader Reader) (*VerifyHashChainResult, error) {
+	result := &VerifyHashChainResult{}
+
+	var prevHash []byte
+
+	for after := stream.Beginning(); ; {
+		res, err := reader.Read(ctx, after)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range res.Entries {
+			if len(entry.Hash) == 0 {
+				// writers chain all entries once they support it, so an unhashed entry after a
+				// hashed one means someone removed its hash
+				if prevHash != nil {
+					cur := entry.Cursor
+					result.BrokenAt = &cur
+					return result, nil
+				}
+
+				result.Unhashed++
+				continue
+			}
+
+			result.Entries++
+
+			if !bytes.Equal(entry.Hash, EntryHash(prevHash, entry.Cursor, entry.Data)) {
+				cur := entry.Cursor
+				result.BrokenAt = &cur
+				return result, nil
+			}
+
+			prevHash = entry.Hash
+		}
+
+		if !res.More {
+			return result, nil
+		}
+
+		after = res.LastEntry
+	}
+}
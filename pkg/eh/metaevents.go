@@ -3,7 +3,14 @@ package eh
 // These are all the Event Horizon -internal metadata events
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+
 	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/eheventencryption"
 	"github.com/function61/gokit/crypto/envelopeenc"
 )
 
@@ -19,10 +26,16 @@ func LogDataMeta(events ...ehevent.Event) *LogData {
 //   (b/c they can't appear anywhere else)
 // - please have a very good reason if you use this from outside of this package.
 var MetaTypes = ehevent.Types{
-	"$stream.ChildStreamCreated": func() ehevent.Event { return &StreamChildStreamCreated{} },
-	"$stream.Started":            func() ehevent.Event { return &StreamStarted{} },
-	"$subscription.Subscribed":   func() ehevent.Event { return &SubscriptionSubscribed{} },
-	"$subscription.Unsubscribed": func() ehevent.Event { return &SubscriptionUnsubscribed{} },
+	"$stream.ChildStreamCreated":  func() ehevent.Event { return &StreamChildStreamCreated{} },
+	"$stream.ChildStreamShredded": func() ehevent.Event { return &StreamChildStreamShredded{} },
+	"$stream.Closed":              func() ehevent.Event { return &StreamClosed{} },
+	"$stream.Shredded":            func() ehevent.Event { return &StreamShredded{} },
+	"$stream.Started":             func() ehevent.Event { return &StreamStarted{} },
+	"$stream.DEKRotated":          func() ehevent.Event { return &StreamDEKRotated{} },
+	"$stream.DEKRewrapped":        func() ehevent.Event { return &StreamDEKRewrapped{} },
+	"$stream.CompressionSet":      func() ehevent.Event { return &StreamCompressionSet{} },
+	"$subscription.Subscribed":    func() ehevent.Event { return &SubscriptionSubscribed{} },
+	"$subscription.Unsubscribed":  func() ehevent.Event { return &SubscriptionUnsubscribed{} },
 }
 
 // ------
@@ -41,16 +54,122 @@ func NewStreamChildStreamCreated(stream StreamName, meta ehevent.EventMeta) *Str
 
 // ------
 
+type StreamChildStreamShredded struct {
+	meta   ehevent.EventMeta
+	Stream StreamName
+}
+
+func (e *StreamChildStreamShredded) MetaType() string         { return "$stream.ChildStreamShredded" }
+func (e *StreamChildStreamShredded) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewStreamChildStreamShredded(stream StreamName, meta ehevent.EventMeta) *StreamChildStreamShredded {
+	return &StreamChildStreamShredded{meta, stream}
+}
+
+// ------
+
+// last entry of a closed stream (if not shredded afterwards). storage refuses further appends.
+type StreamClosed struct {
+	meta   ehevent.EventMeta
+	Reason string // "GDPR request" | "archived" | ...
+}
+
+func (e *StreamClosed) MetaType() string         { return "$stream.Closed" }
+func (e *StreamClosed) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewStreamClosed(reason string, meta ehevent.EventMeta) *StreamClosed {
+	return &StreamClosed{meta, reason}
+}
+
+// ------
+
+// stream's DEK envelopes were destroyed (crypto-shredding). encrypted data can no longer be read.
+type StreamShredded struct {
+	meta ehevent.EventMeta
+}
+
+func (e *StreamShredded) MetaType() string         { return "$stream.Shredded" }
+func (e *StreamShredded) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewStreamShredded(meta ehevent.EventMeta) *StreamShredded {
+	return &StreamShredded{meta}
+}
+
+// ------
+
 type StreamStarted struct {
-	meta  ehevent.EventMeta
-	DEKv0 envelopeenc.EnvelopeBundle // Data Encryption Key (DEK) envelope (see pkg envelopeenc)
+	meta        ehevent.EventMeta
+	DEKv0       envelopeenc.EnvelopeBundle // Data Encryption Key (DEK) envelope (see pkg envelopeenc)
+	KeyGroup    string                     `json:",omitempty"` // key group whose KEKs control access to the stream
+	ShreddedDEK []byte                     `json:",omitempty"` // see ShredDEKEnvelopes()
 }
 
 func (e *StreamStarted) MetaType() string         { return "$stream.Started" }
 func (e *StreamStarted) Meta() *ehevent.EventMeta { return &e.meta }
 
-func NewStreamStarted(dek envelopeenc.EnvelopeBundle, meta ehevent.EventMeta) *StreamStarted {
-	return &StreamStarted{meta, dek}
+func NewStreamStarted(dek envelopeenc.EnvelopeBundle, keyGroupId string, meta ehevent.EventMeta) *StreamStarted {
+	return &StreamStarted{meta, dek, keyGroupId, nil}
+}
+
+// ------
+
+// new data in the stream gets encrypted with the new DEK. older data stays decryptable with
+// the previous DEK versions
+type StreamDEKRotated struct {
+	meta        ehevent.EventMeta
+	Version     uint64                     // previous version + 1 (v0 was in StreamStarted)
+	DEK         envelopeenc.EnvelopeBundle // envelope for the new DEK
+	ShreddedDEK []byte                     `json:",omitempty"` // see ShredDEKEnvelopes()
+}
+
+func (e *StreamDEKRotated) MetaType() string         { return "$stream.DEKRotated" }
+func (e *StreamDEKRotated) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewStreamDEKRotated(version uint64, dek envelopeenc.EnvelopeBundle, meta ehevent.EventMeta) *StreamDEKRotated {
+	return &StreamDEKRotated{meta, version, dek, nil}
+}
+
+// ------
+
+// existing DEK sealed again for a new set of KEKs (e.g. when a KEK was retired).
+// the DEK itself doesn't change, so data doesn't need to be re-encrypted.
+type StreamDEKRewrapped struct {
+	meta        ehevent.EventMeta
+	Version     uint64                     // which DEK version was re-wrapped
+	DEK         envelopeenc.EnvelopeBundle // replaces the previous envelope of the same version
+	ShreddedDEK []byte                     `json:",omitempty"` // see ShredDEKEnvelopes()
+}
+
+func (e *StreamDEKRewrapped) MetaType() string         { return "$stream.DEKRewrapped" }
+func (e *StreamDEKRewrapped) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewStreamDEKRewrapped(version uint64, dek envelopeenc.EnvelopeBundle, meta ehevent.EventMeta) *StreamDEKRewrapped {
+	return &StreamDEKRewrapped{meta, version, dek, nil}
+}
+
+// ------
+
+// how data appended to the stream from now on gets compressed. older data stays as it was, so
+// dictionaries of earlier $stream.CompressionSet are still needed for reading it.
+type StreamCompressionSet struct {
+	meta         ehevent.EventMeta
+	Method       eheventencryption.CompressionMethod
+	DictionaryID uint32 `json:",omitempty"` // 0 = no dictionary
+	// encrypted with the stream's DEK, because it's made from the stream's data.
+	// (so crypto-shredding also makes dictionaries unreadable)
+	Dictionary []byte `json:",omitempty"`
+}
+
+func (e *StreamCompressionSet) MetaType() string         { return "$stream.CompressionSet" }
+func (e *StreamCompressionSet) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewStreamCompressionSet(
+	method eheventencryption.CompressionMethod,
+	dictionaryID uint32,
+	dictionaryEncrypted []byte,
+	meta ehevent.EventMeta,
+) *StreamCompressionSet {
+	return &StreamCompressionSet{meta, method, dictionaryID, dictionaryEncrypted}
 }
 
 // ------
@@ -80,3 +199,116 @@ func (e *SubscriptionUnsubscribed) Meta() *ehevent.EventMeta { return &e.meta }
 func NewSubscriptionUnsubscribed(id SubscriberID, meta ehevent.EventMeta) *SubscriptionUnsubscribed {
 	return &SubscriptionUnsubscribed{meta, id}
 }
+
+// ------
+
+// for storage implementations when shredding a stream. returns nil if "data" contains no DEK envelopes.
+// otherwise returns "data" with the DEK envelopes destroyed (other meta events are left as-is).
+//
+// each destroyed envelope is replaced with a commitment to it (ShreddedDEK), which is also what
+// EntryHash() covers instead of the envelope. that way shredding doesn't break the stream's hash
+// chain. the lines are transformed on the JSON level (see shredDEKEnvelope()) instead of via the
+// event structs, so the result depends only on the stored bytes.
+func ShredDEKEnvelopes(data LogData) (*LogData, error) {
+	if data.Kind != LogDataKindMeta {
+		return nil, nil
+	}
+
+	shredded := false
+
+	lines := []string{}
+	for _, line := range ehevent.DeserializeLines(data.Raw) {
+		shreddedLine, err := shredDEKEnvelope(line)
+		if err != nil {
+			return nil, err
+		}
+
+		if shreddedLine == nil {
+			lines = append(lines, line)
+			continue
+		}
+
+		shredded = true
+
+		lines = append(lines, *shreddedLine)
+	}
+
+	if !shredded {
+		return nil, nil
+	}
+
+	return &LogData{
+		Kind: LogDataKindMeta,
+		Raw:  ehevent.SerializeLines(lines),
+	}, nil
+}
+
+// payload field of the DEK envelope, by event type
+var dekEnvelopeFields = map[string]string{
+	(&StreamStarted{}).MetaType():      "DEKv0",
+	(&StreamDEKRotated{}).MetaType():   "DEK",
+	(&StreamDEKRewrapped{}).MetaType(): "DEK",
+}
+
+// returns nil if the line's event type doesn't carry a DEK envelope. canonical form of the
+// shredded line:
+//
+//	<event meta as-is> <payload>
+//
+// where the payload is a JSON object with keys sorted and values compacted (encoding/json's
+// marshaling of map[string]json.RawMessage), without the envelope field and with ShreddedDEK
+// = SHA-256 of the compacted envelope JSON. already shredded line keeps its ShreddedDEK.
+func shredDEKEnvelope(line string) (*string, error) {
+	var metaJSON, payloadJSON json.RawMessage
+
+	dec := json.NewDecoder(strings.NewReader(line))
+	if err := dec.Decode(&metaJSON); err != nil {
+		return nil, fmt.Errorf("shredDEKEnvelope: meta: %w", err)
+	}
+	if err := dec.Decode(&payloadJSON); err != nil {
+		return nil, fmt.Errorf("shredDEKEnvelope: payload: %w", err)
+	}
+
+	meta := struct {
+		Type string `json:"_"`
+	}{}
+	if err := json.Unmarshal(metaJSON, &meta); err != nil {
+		return nil, fmt.Errorf("shredDEKEnvelope: meta: %w", err)
+	}
+
+	envelopeField, carriesEnvelope := dekEnvelopeFields[meta.Type]
+	if !carriesEnvelope {
+		return nil, nil
+	}
+
+	payload := map[string]json.RawMessage{}
+	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
+		return nil, fmt.Errorf("shredDEKEnvelope: payload: %w", err)
+	}
+
+	if envelopeJSON, has := payload[envelopeField]; has {
+		// envelope wins over (a possibly forged) ShreddedDEK
+		envelopeCompacted := &bytes.Buffer{}
+		if err := json.Compact(envelopeCompacted, envelopeJSON); err != nil {
+			return nil, err
+		}
+
+		commitment := sha256.Sum256(envelopeCompacted.Bytes())
+
+		commitmentJSON, err := json.Marshal(commitment[:])
+		if err != nil {
+			return nil, err
+		}
+
+		payload["ShreddedDEK"] = commitmentJSON
+		delete(payload, envelopeField)
+	}
+
+	shreddedPayloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	shredded := string(metaJSON) + " " + string(shreddedPayloadJSON)
+	return &shredded, nil
+}
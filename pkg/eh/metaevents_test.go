@@ -0,0 +1,40 @@
+package eh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/crypto/envelopeenc"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestShredDEKEnvelopes(t *testing.T) {
+	meta := ehevent.MetaSystemUser(time.Date(2020, 2, 20, 14, 2, 0, 0, time.UTC))
+
+	nothingToShred, err := ShredDEKEnvelopes(*LogDataMeta(NewStreamClosed("GDPR request", meta)))
+	assert.Ok(t, err)
+	assert.Assert(t, nothingToShred == nil)
+
+	encrypted, err := ShredDEKEnvelopes(LogData{Kind: LogDataKindEncryptedData, Raw: []byte("garbage")})
+	assert.Ok(t, err)
+	assert.Assert(t, encrypted == nil)
+
+	shredded, err := ShredDEKEnvelopes(*LogDataMeta(
+		NewStreamStarted(envelopeenc.EnvelopeBundle{}, "default", meta),
+		NewStreamClosed("GDPR request", meta)))
+	assert.Ok(t, err)
+	assert.Assert(t, shredded != nil)
+
+	lines := ehevent.DeserializeLines(shredded.Raw)
+	assert.Assert(t, len(lines) == 2)
+
+	started, err := ehevent.Deserialize(lines[0], MetaTypes)
+	assert.Ok(t, err)
+	assert.EqualString(t, started.(*StreamStarted).KeyGroup, "default")
+
+	// events without DEK envelopes are left as-is
+	closed, err := ehevent.Deserialize(lines[1], MetaTypes)
+	assert.Ok(t, err)
+	assert.EqualString(t, closed.(*StreamClosed).Reason, "GDPR request")
+}
@@ -2,6 +2,7 @@ package eh
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 
@@ -20,6 +21,10 @@ func NewSnapshot(cursor Cursor, data []byte, perspective SnapshotPerspective) *S
 	return &Snapshot{cursor, data, perspective}
 }
 
+// how snapshots are compressed. snapshots can be large, and zstd is faster than deflate.
+var SnapshotCompression = eheventencryption.Compression{Method: eheventencryption.CompressionMethodZstd}
+
+// prefer Compressed(). kept for readability of small snapshots (and tests)
 func (s *Snapshot) Unencrypted() *PersistedSnapshot {
 	return &PersistedSnapshot{
 		Cursor:      s.Cursor,
@@ -28,8 +33,23 @@ func (s *Snapshot) Unencrypted() *PersistedSnapshot {
 	}
 }
 
-func (s *Snapshot) Encrypted(dek []byte) (*PersistedSnapshot, error) {
-	ciphertext, err := eheventencryption.Encrypt(s.Data, dek)
+// for processors that don't consume encrypted data (and thus have nothing to protect)
+func (s *Snapshot) Compressed() (*PersistedSnapshot, error) {
+	compressed, method, err := eheventencryption.Compress(s.Data, SnapshotCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PersistedSnapshot{
+		Cursor:      s.Cursor,
+		Perspective: s.Perspective,
+		RawData:     append([]byte{byte(PersistedSnapshotKindCompressed), byte(method)}, compressed...),
+	}, nil
+}
+
+// use the stream's newest DEK
+func (s *Snapshot) Encrypted(dek []byte, dekVersion uint64) (*PersistedSnapshot, error) {
+	ciphertext, err := eheventencryption.EncryptWithCompression(s.Data, dek, dekVersion, SnapshotCompression)
 	if err != nil {
 		return nil, err
 	}
@@ -44,7 +64,13 @@ func (s *Snapshot) Encrypted(dek []byte) (*PersistedSnapshot, error) {
 type ReadSnapshotInput struct {
 	Stream          StreamName
 	Perspective     SnapshotPerspective
-	PreferEagerRead bool // requests EagerRead to be filled to optimize performance (contains events occurred after the snapshot)
+	PreferEagerRead bool    // requests EagerRead to be filled to optimize performance (contains events occurred after the snapshot)
+	AtOrBefore      *Cursor // nil = newest version. otherwise newest version that is at or before this
+}
+
+// whether a stored version satisfies AtOrBefore
+func (r ReadSnapshotInput) Accepts(version int64) bool {
+	return r.AtOrBefore == nil || version <= r.AtOrBefore.Version()
 }
 
 type ReadSnapshotOutput struct {
@@ -52,13 +78,38 @@ type ReadSnapshotOutput struct {
 	EagerRead *ReadResult // might be filled if PreferEagerRead=true requested
 }
 
+// stores keep multiple versions (by cursor) of a snapshot, so a bad snapshot (e.g. from a buggy
+// release) can be rolled back.
 type SnapshotStore interface {
 	// NOTE: returns os.ErrNotExist if snapshot is not found (which MUST not be
 	//       considered an actual error)
 	ReadSnapshot(ctx context.Context, input ReadSnapshotInput) (*ReadSnapshotOutput, error)
+	// stores a new version. writes that aren't newer than the newest stored version are ignored.
+	// versions beyond the store's retention are deleted.
 	WriteSnapshot(ctx context.Context, snapshot PersistedSnapshot) error
-	// returns os.ErrNotExist if snapshot-to-delete not found
+	// deletes all versions. returns os.ErrNotExist if snapshot-to-delete not found
 	DeleteSnapshot(ctx context.Context, stream StreamName, perspective SnapshotPerspective) error
+	// cursors of stored versions, newest first
+	ListSnapshots(ctx context.Context, stream StreamName, perspective SnapshotPerspective) ([]Cursor, error)
+	// deletes versions newer than *to*, so that it becomes the newest version.
+	// returns os.ErrNotExist if there's no version at *to*.
+	RollbackSnapshot(ctx context.Context, to Cursor, perspective SnapshotPerspective) error
+}
+
+// how many versions stores keep of each snapshot (= stream + perspective)
+type SnapshotRetention struct {
+	KeepVersions int // 0 = keep all
+}
+
+var DefaultSnapshotRetention = SnapshotRetention{KeepVersions: 5}
+
+// returns versions that should be deleted. *versions* must be newest first.
+func (r SnapshotRetention) Expired(versions []int64) []int64 {
+	if r.KeepVersions == 0 || len(versions) <= r.KeepVersions {
+		return nil
+	}
+
+	return versions[r.KeepVersions:]
 }
 
 type PersistedSnapshotKind uint8
@@ -66,6 +117,7 @@ type PersistedSnapshotKind uint8
 const (
 	PersistedSnapshotKindUnencrypted PersistedSnapshotKind = 1 // plaintext
 	PersistedSnapshotKindEncrypted   PersistedSnapshotKind = 2 // 16 bytes IV || AES256_CTR(plaintext, dek)
+	PersistedSnapshotKindCompressed  PersistedSnapshotKind = 3 // eheventencryption.CompressionMethod || compressed(plaintext)
 )
 
 func (k PersistedSnapshotKind) String() string {
@@ -74,6 +126,8 @@ func (k PersistedSnapshotKind) String() string {
 		return "Unencrypted"
 	case PersistedSnapshotKindEncrypted:
 		return "Encrypted"
+	case PersistedSnapshotKindCompressed:
+		return "Compressed"
 	default:
 		panic(fmt.Errorf("unknown PersistedSnapshotKind: %d", k))
 	}
@@ -92,12 +146,17 @@ func (e *PersistedSnapshot) Kind() PersistedSnapshotKind {
 	return PersistedSnapshotKind(e.RawData[0])
 }
 
-func (e *PersistedSnapshot) DecryptIfRequired(loadDEKv0 func() ([]byte, error)) (*Snapshot, error) {
+func (e *PersistedSnapshot) DecryptIfRequired(loadDEK func(dekVersion uint64) ([]byte, error)) (*Snapshot, error) {
 	switch e.Kind() {
 	case PersistedSnapshotKindUnencrypted:
 		return NewSnapshot(e.Cursor, e.RawData[1:], e.Perspective), nil
 	case PersistedSnapshotKindEncrypted:
-		dek, err := loadDEKv0()
+		dekVersion, err := eheventencryption.DEKVersion(e.RawData[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		dek, err := loadDEK(dekVersion)
 		if err != nil {
 			return nil, err
 		}
@@ -107,6 +166,19 @@ func (e *PersistedSnapshot) DecryptIfRequired(loadDEKv0 func() ([]byte, error))
 			return nil, err
 		}
 
+		return NewSnapshot(e.Cursor, plaintextSnapshot, e.Perspective), nil
+	case PersistedSnapshotKindCompressed:
+		if len(e.RawData) < 2 {
+			return nil, errors.New("compressed snapshot: no compression method")
+		}
+
+		plaintextSnapshot, err := eheventencryption.Decompress(
+			e.RawData[2:],
+			eheventencryption.CompressionMethod(e.RawData[1]))
+		if err != nil {
+			return nil, err
+		}
+
 		return NewSnapshot(e.Cursor, plaintextSnapshot, e.Perspective), nil
 	default:
 		return nil, fmt.Errorf("unknown PersistedSnapshotKind: %d", e.Kind())
@@ -144,6 +216,10 @@ func (p SnapshotPerspective) IsEmpty() bool {
 	return p.AppID == "" && p.Version == ""
 }
 
+// ehstreammeta's perspective. defined here because shredding a stream has to delete its
+// snapshots (they contain the stream's DEK envelopes).
+var StreamMetaPerspective = NewV1Perspective("eh.streammeta")
+
 // helper for the most common use case - v1 (or first version) of a processor's perspective.
 func NewV1Perspective(appID string) SnapshotPerspective {
 	return NewPerspective(appID, "v1")
@@ -0,0 +1,45 @@
+package eh
+
+// Snapshots can be larger than what a store (DynamoDB: 400 KB items) or a transport (Lambda:
+// 6 MB responses) accepts in one piece, so they're split into chunks. The digest of the whole
+// RawData is stored alongside, so reassembly detects missing, reordered or mixed-up chunks.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// splits *raw* into chunks of at most *size* bytes. always returns at least one chunk.
+// the chunks share memory with *raw*.
+func SnapshotChunks(raw []byte, size int) [][]byte {
+	chunks := [][]byte{}
+
+	for len(raw) > size {
+		chunks = append(chunks, raw[:size])
+		raw = raw[size:]
+	}
+
+	return append(chunks, raw)
+}
+
+func SnapshotDigest(raw []byte) string {
+	digest := sha256.Sum256(raw)
+	return hex.EncodeToString(digest[:])
+}
+
+// joins chunks made by SnapshotChunks() and verifies the result against SnapshotDigest() of the original
+func ReassembleSnapshotChunks(chunks [][]byte, digest string) ([]byte, error) {
+	raw := bytes.Join(chunks, nil)
+
+	if actual := SnapshotDigest(raw); actual != digest {
+		return nil, fmt.Errorf(
+			"ReassembleSnapshotChunks: digest mismatch (%d chunks): expected %s, got %s",
+			len(chunks),
+			digest,
+			actual)
+	}
+
+	return raw, nil
+}
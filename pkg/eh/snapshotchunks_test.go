@@ -0,0 +1,51 @@
+package eh
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestSnapshotChunks(t *testing.T) {
+	raw := []byte("0123456789")
+	digest := SnapshotDigest(raw)
+
+	chunks := SnapshotChunks(raw, 4)
+	assert.Assert(t, len(chunks) == 3)
+	assert.EqualString(t, string(chunks[2]), "89")
+
+	reassembled, err := ReassembleSnapshotChunks(chunks, digest)
+	assert.Ok(t, err)
+	assert.EqualString(t, string(reassembled), "0123456789")
+
+	assert.Assert(t, len(SnapshotChunks(raw, 10)) == 1)
+	assert.Assert(t, len(SnapshotChunks([]byte{}, 10)) == 1)
+
+	// chunks in wrong order
+	_, err = ReassembleSnapshotChunks([][]byte{chunks[1], chunks[0], chunks[2]}, digest)
+	assert.EqualString(
+		t,
+		err.Error(),
+		"ReassembleSnapshotChunks: digest mismatch (3 chunks): expected 84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882, got 3d0bd68f97048e0fe77ea99a5c394ca808799b69e05e87b9b11e0c5a3afac9e0")
+
+	// missing chunk
+	_, err = ReassembleSnapshotChunks(chunks[:2], digest)
+	assert.Assert(t, err != nil)
+}
+
+func TestCompressedSnapshot(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"message":"hello world"}`), 1000)
+
+	persisted, err := NewSnapshot(fooAt, data, NewV1Perspective("test")).Compressed()
+	assert.Ok(t, err)
+	assert.EqualString(t, persisted.Kind().String(), "Compressed")
+	assert.Assert(t, len(persisted.RawData) < len(data)/10)
+
+	snap, err := persisted.DecryptIfRequired(func(_ uint64) ([]byte, error) {
+		panic("should not be called")
+	})
+	assert.Ok(t, err)
+	assert.Assert(t, bytes.Equal(snap.Data, data))
+	assert.EqualString(t, snap.Cursor.Serialize(), "/foo@314")
+}
@@ -2,6 +2,8 @@ package eh
 
 import (
 	"context"
+	"errors"
+	"fmt"
 
 	"github.com/function61/gokit/crypto/envelopeenc"
 )
@@ -28,6 +30,12 @@ type AppendResult struct {
 	Cursor Cursor
 }
 
+// one stream's part of AppendMany()
+type AppendAfterItem struct {
+	After Cursor  `json:"After"`
+	Data  LogData `json:"Data"`
+}
+
 // interface for reading log entries from a stream
 type Reader interface {
 	Read(ctx context.Context, after Cursor) (*ReadResult, error)
@@ -35,11 +43,21 @@ type Reader interface {
 
 // interface for writing to an event log
 type Writer interface {
-	CreateStream(ctx context.Context, stream StreamName, dekEnvelope envelopeenc.Envelope, data *LogData) (*AppendResult, error)
+	// keyGroupId is recorded in the stream's $stream.Started event
+	CreateStream(ctx context.Context, stream StreamName, dekEnvelope envelopeenc.Envelope, keyGroupId string, data *LogData) (*AppendResult, error)
 	Append(ctx context.Context, stream StreamName, data LogData) (*AppendResult, error)
 	// used for transactional writes
 	// returns *ErrOptimisticLockingFailed if stream had writes after you read it
 	AppendAfter(ctx context.Context, after Cursor, data LogData) (*AppendResult, error)
+	// like AppendAfter(), but for multiple streams: either all of the appends succeed or none do.
+	// returns *ErrOptimisticLockingFailed if any of the streams had writes after you read it.
+	// results are in the same order as appends.
+	AppendMany(ctx context.Context, appends []AppendAfterItem) ([]AppendResult, error)
+	// appends $stream.Closed. after that appends return *ErrStreamClosed
+	CloseStream(ctx context.Context, stream StreamName, reason string) (*AppendResult, error)
+	// destroys DEK envelopes of a closed stream (making its encrypted data unreadable) and
+	// appends $stream.Shredded. parent gets $stream.ChildStreamShredded.
+	ShredStream(ctx context.Context, stream StreamName) (*AppendResult, error)
 }
 
 type ReaderWriter interface {
@@ -57,6 +75,7 @@ type ReadResult struct {
 type LogEntry struct {
 	Cursor Cursor  `json:"Cursor"`
 	Data   LogData `json:"Data"`
+	Hash   []byte  `json:"Hash,omitempty"` // see EntryHash(). empty for entries written before hash chaining
 }
 
 type LogData struct {
@@ -73,6 +92,56 @@ func NewErrOptimisticLockingFailed(err error) *ErrOptimisticLockingFailed {
 	return &ErrOptimisticLockingFailed{err}
 }
 
+// validation shared by AppendMany() implementations
+func ValidateAppendMany(appends []AppendAfterItem) error {
+	if len(appends) == 0 {
+		return errors.New("AppendMany: no appends")
+	}
+
+	seen := map[string]bool{}
+
+	for _, item := range appends {
+		stream := item.After.Stream().String()
+
+		if next := item.After.Next(); next.Version() == 0 {
+			// see AppendAfter()
+			return fmt.Errorf("AppendMany: refusing @0 for %s, since stream should start with StreamStarted", stream)
+		}
+
+		// would conflict with itself anyway
+		if seen[stream] {
+			return fmt.Errorf("AppendMany: stream more than once: %s", stream)
+		}
+		seen[stream] = true
+	}
+
+	return nil
+}
+
+type ErrStreamClosed struct {
+	error
+	stream StreamName
+}
+
+func NewErrStreamClosed(stream StreamName) *ErrStreamClosed {
+	return &ErrStreamClosed{fmt.Errorf("stream closed: %s", stream.String()), stream}
+}
+
+// the stream that was closed (interesting for AppendMany())
+func (e *ErrStreamClosed) Stream() StreamName {
+	return e.stream
+}
+
+// we can't get the stream's DEK, because the stream was shredded or we don't have access to any
+// of the KEKs that its envelope is sealed for. other errors (network etc.) are not this.
+type ErrDEKUnavailable struct {
+	error
+}
+
+func NewErrDEKUnavailable(err error) *ErrDEKUnavailable {
+	return &ErrDEKUnavailable{err}
+}
+
 // sent over MQTT
 type MqttActivityNotification struct {
 	Activity []CursorCompact `json:"a"` // abbreviated to conserve space
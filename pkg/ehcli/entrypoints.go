@@ -3,11 +3,13 @@ package ehcli
 
 import (
 	"context"
+	"fmt"
 	"log"
 
 	"github.com/function61/eventhorizon/pkg/ehclient"
 	"github.com/function61/eventhorizon/pkg/ehclientfactory"
 	"github.com/function61/eventhorizon/pkg/ehserver"
+	"github.com/function61/eventhorizon/pkg/ehserver/ehbolt"
 	"github.com/function61/eventhorizon/pkg/ehserver/ehdynamodb"
 	"github.com/function61/gokit/log/logex"
 	"github.com/function61/gokit/os/osutil"
@@ -97,5 +99,12 @@ func bootstrap(ctx context.Context, logger *log.Logger) error {
 		return err
 	}
 
-	return ehdynamodb.Bootstrap(ctx, client.EventLog.(*ehdynamodb.Client))
+	switch eventLog := client.EventLog.(type) {
+	case *ehdynamodb.Client:
+		return ehdynamodb.Bootstrap(ctx, eventLog)
+	case *ehbolt.Client:
+		return ehbolt.Bootstrap(ctx, eventLog)
+	default:
+		return fmt.Errorf("bootstrap not supported for event log type %T", client.EventLog)
+	}
 }
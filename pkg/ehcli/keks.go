@@ -3,12 +3,19 @@ package ehcli
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"time"
 
+	"github.com/function61/eventhorizon/pkg/eh"
 	"github.com/function61/eventhorizon/pkg/ehclient"
 	"github.com/function61/eventhorizon/pkg/ehclientfactory"
+	"github.com/function61/eventhorizon/pkg/ehdekrewrap"
+	"github.com/function61/eventhorizon/pkg/ehevent"
 	"github.com/function61/eventhorizon/pkg/system/ehsettings"
+	"github.com/function61/eventhorizon/pkg/system/ehsettingsdomain"
+	"github.com/function61/gokit/crypto/cryptoutil"
+	"github.com/function61/gokit/crypto/envelopeenc"
 	"github.com/function61/gokit/log/logex"
 	"github.com/function61/gokit/os/osutil"
 	"github.com/function61/gokit/time/timeutil"
@@ -35,6 +42,69 @@ func kekEntrypoint() *cobra.Command {
 		},
 	})
 
+	parentCmd.AddCommand(&cobra.Command{
+		Use:   "register [label] [publicKeyPemPath]",
+		Short: "Register a new KEK (RSA public key)",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			rootLogger := logex.StandardLogger()
+
+			osutil.ExitIfError(kekRegister(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				args[0],
+				args[1],
+				rootLogger))
+		},
+	})
+
+	parentCmd.AddCommand(&cobra.Command{
+		Use:   "add-to-group [kekId] [keyGroupId]",
+		Short: "Add KEK to a key group (gives the KEK access to new DEKs of the group's streams)",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			rootLogger := logex.StandardLogger()
+
+			osutil.ExitIfError(kekAddToGroup(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				args[0],
+				args[1],
+				rootLogger))
+		},
+	})
+
+	parentCmd.AddCommand(&cobra.Command{
+		Use:   "retire [kekId] [reason]",
+		Short: "Retire KEK (removes it from key groups). Run rewrap afterwards",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			rootLogger := logex.StandardLogger()
+
+			osutil.ExitIfError(kekRetire(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				args[0],
+				args[1],
+				rootLogger))
+		},
+	})
+
+	dryRun := false
+
+	rewrapCmd := &cobra.Command{
+		Use:   "rewrap",
+		Short: "Re-wrap streams' DEK envelopes for the current KEKs of their key groups (rotates DEKs of retired KEKs)",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			rootLogger := logex.StandardLogger()
+
+			osutil.ExitIfError(kekRewrap(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				dryRun,
+				rootLogger))
+		},
+	}
+	rewrapCmd.Flags().BoolVarP(&dryRun, "dry-run", "n", dryRun, "Only report what would be re-wrapped")
+	parentCmd.AddCommand(rewrapCmd)
+
 	return parentCmd
 }
 
@@ -45,13 +115,19 @@ func kekList(ctx context.Context, logger *log.Logger) error {
 	}
 
 	view := termtables.CreateTable()
-	view.AddHeaders("Id", "Kind", "Registered", "Label")
+	view.AddHeaders("Id", "Kind", "Registered", "Retired", "Label")
 
 	for _, kek := range settings.State.KEKs() {
+		retired := ""
+		if kek.Retired != nil {
+			retired = timeutil.HumanizeDuration(time.Since(*kek.Retired))
+		}
+
 		view.AddRow(
 			kek.Id,
 			kek.Kind,
 			timeutil.HumanizeDuration(time.Since(kek.Registered)),
+			retired,
 			kek.Label,
 		)
 	}
@@ -61,6 +137,122 @@ func kekList(ctx context.Context, logger *log.Logger) error {
 	return nil
 }
 
+func kekRegister(ctx context.Context, label string, publicKeyPemPath string, logger *log.Logger) error {
+	publicKeyPem, err := ioutil.ReadFile(publicKeyPemPath)
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := cryptoutil.ParsePemPkcs1EncodedRsaPublicKey(publicKeyPem)
+	if err != nil {
+		return err
+	}
+
+	// ID is the public key's fingerprint, same as what ends up in the envelopes' key slots
+	kekId := envelopeenc.RsaOaepSha256Encrypter(publicKey).KekId()
+
+	settings, client, err := loadSettings(ctx, logger)
+	if err != nil {
+		return err
+	}
+
+	if settings.State.KEK(kekId) != nil {
+		return fmt.Errorf("KEK already registered: %s", kekId)
+	}
+
+	if err := client.AppendAfter(
+		ctx,
+		settings.State.Version(),
+		ehsettingsdomain.NewKekRegistered(
+			kekId,
+			"rsa",
+			label,
+			string(publicKeyPem),
+			ehevent.MetaSystemUser(time.Now())),
+	); err != nil {
+		return err
+	}
+
+	fmt.Println(kekId)
+
+	return nil
+}
+
+func kekAddToGroup(ctx context.Context, kekId string, keyGroupId string, logger *log.Logger) error {
+	settings, client, err := loadSettings(ctx, logger)
+	if err != nil {
+		return err
+	}
+
+	kek := settings.State.KEK(kekId)
+	if kek == nil {
+		return fmt.Errorf("KEK not found: %s", kekId)
+	}
+
+	if kek.Retired != nil {
+		return fmt.Errorf("KEK is retired: %s", kekId)
+	}
+
+	if settings.State.KeyGroup(keyGroupId) == nil {
+		return fmt.Errorf("key group not found: %s", keyGroupId)
+	}
+
+	return client.AppendAfter(
+		ctx,
+		settings.State.Version(),
+		ehsettingsdomain.NewKeygroupKekAdded(keyGroupId, kekId, ehevent.MetaSystemUser(time.Now())))
+}
+
+func kekRetire(ctx context.Context, kekId string, reason string, logger *log.Logger) error {
+	settings, client, err := loadSettings(ctx, logger)
+	if err != nil {
+		return err
+	}
+
+	kek := settings.State.KEK(kekId)
+	if kek == nil {
+		return fmt.Errorf("KEK not found: %s", kekId)
+	}
+
+	if kek.Retired != nil {
+		return fmt.Errorf("KEK already retired: %s", kekId)
+	}
+
+	// otherwise we'd make it impossible to create new streams (or re-wrap) for the group
+	for _, keyGroup := range settings.State.Data().KeyGroups {
+		if len(keyGroup.KEKs) == 1 && keyGroup.KEKs[0] == kekId {
+			return fmt.Errorf("KEK is the last one in key group %s; add a new KEK first", keyGroup.ID)
+		}
+	}
+
+	return client.AppendAfter(
+		ctx,
+		settings.State.Version(),
+		ehsettingsdomain.NewKekRetired(kekId, reason, ehevent.MetaSystemUser(time.Now())))
+}
+
+func kekRewrap(ctx context.Context, dryRun bool, logger *log.Logger) error {
+	client, err := ehclientfactory.SystemClientFrom(ehclient.ConfigFromENV, logger)
+	if err != nil {
+		return err
+	}
+
+	stats, err := ehdekrewrap.Rewrap(ctx, eh.RootName, dryRun, client, logger)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf(
+		"streams=%d rewrapped=%d rotated=%d skipped=%d dryRun=%v\n",
+		stats.Streams,
+		stats.Rewrapped,
+		stats.Rotated,
+		stats.Skipped,
+		dryRun)
+
+	return nil
+}
+
 func loadSettings(ctx context.Context, logger *log.Logger) (*ehsettings.App, *ehclient.SystemClient, error) {
 	client, err := ehclientfactory.SystemClientFrom(ehclient.ConfigFromENV, logger)
 	if err != nil {
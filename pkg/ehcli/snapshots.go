@@ -22,7 +22,9 @@ func snapshotEntrypoint() *cobra.Command {
 		Short: "Snapshot management",
 	}
 
-	parentCmd.AddCommand(&cobra.Command{
+	atOrBefore := ""
+
+	snapshotCatCmd := &cobra.Command{
 		Use:   "cat [streamName] [context]",
 		Short: "Inspect a snapshot",
 		Args:  cobra.ExactArgs(2),
@@ -30,6 +32,39 @@ func snapshotEntrypoint() *cobra.Command {
 			rootLogger := logex.StandardLogger()
 
 			osutil.ExitIfError(snapshotCat(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				args[0],
+				args[1],
+				atOrBefore,
+				rootLogger))
+		},
+	}
+	snapshotCatCmd.Flags().StringVarP(&atOrBefore, "at", "", atOrBefore, "Newest version at or before this cursor (instead of newest)")
+	parentCmd.AddCommand(snapshotCatCmd)
+
+	parentCmd.AddCommand(&cobra.Command{
+		Use:   "ls [streamName] [context]",
+		Short: "List stored versions of a snapshot",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			rootLogger := logex.StandardLogger()
+
+			osutil.ExitIfError(snapshotLs(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				args[0],
+				args[1],
+				rootLogger))
+		},
+	})
+
+	parentCmd.AddCommand(&cobra.Command{
+		Use:   "rollback [cursor] [context]",
+		Short: "Delete snapshot versions newer than cursor (dangerous)",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			rootLogger := logex.StandardLogger()
+
+			osutil.ExitIfError(snapshotRollback(
 				osutil.CancelOnInterruptOrTerminate(rootLogger),
 				args[0],
 				args[1],
@@ -80,6 +115,7 @@ func snapshotCat(
 	ctx context.Context,
 	streamNameRaw string,
 	perspective string,
+	atOrBeforeSerialized string,
 	logger *log.Logger,
 ) error {
 	client, err := ehclientfactory.SystemClientFrom(ehclient.ConfigFromENV, logger)
@@ -92,13 +128,21 @@ func snapshotCat(
 		return err
 	}
 
-	// the Beginning() is non-important, as the store only uses the stream component of Cursor
-	snapOutput, err := client.SnapshotStore.ReadSnapshot(
-		ctx,
-		eh.ReadSnapshotInput{
-			Stream:      streamName,
-			Perspective: eh.ParseSnapshotPerspective(perspective),
-		})
+	input := eh.ReadSnapshotInput{
+		Stream:      streamName,
+		Perspective: eh.ParseSnapshotPerspective(perspective),
+	}
+
+	if atOrBeforeSerialized != "" {
+		atOrBefore, err := eh.DeserializeCursor(atOrBeforeSerialized)
+		if err != nil {
+			return err
+		}
+
+		input.AtOrBefore = &atOrBefore
+	}
+
+	snapOutput, err := client.SnapshotStore.ReadSnapshot(ctx, input)
 	if err != nil {
 		return err
 	}
@@ -111,8 +155,8 @@ func snapshotCat(
 		snapPersisted.Kind().String(),
 		snapPersisted.Cursor.Serialize())
 
-	snap, err := snapPersisted.DecryptIfRequired(func() ([]byte, error) {
-		return client.LoadDEKv0(ctx, snapPersisted.Cursor.Stream())
+	snap, err := snapPersisted.DecryptIfRequired(func(dekVersion uint64) ([]byte, error) {
+		return client.LoadDEK(ctx, snapPersisted.Cursor.Stream(), dekVersion)
 	})
 	if err != nil {
 		return err
@@ -153,14 +197,14 @@ func snapshotPut(
 
 	persisted, err := func() (*eh.PersistedSnapshot, error) {
 		if encrypted {
-			dek, err := client.LoadDEKv0(ctx, cursor.Stream())
+			dek, dekVersion, err := client.LoadNewestDEK(ctx, cursor.Stream())
 			if err != nil {
 				return nil, err
 			}
 
-			return snapshot.Encrypted(dek)
+			return snapshot.Encrypted(dek, dekVersion)
 		} else {
-			return snapshot.Unencrypted(), nil
+			return snapshot.Compressed()
 		}
 	}()
 	if err != nil {
@@ -188,3 +232,58 @@ func snapshotRm(
 
 	return client.SnapshotStore.DeleteSnapshot(ctx, stream, eh.ParseSnapshotPerspective(perspective))
 }
+
+func snapshotLs(
+	ctx context.Context,
+	streamName string,
+	perspective string,
+	logger *log.Logger,
+) error {
+	client, err := ehclientfactory.SystemClientFrom(ehclient.ConfigFromENV, logger)
+	if err != nil {
+		return err
+	}
+
+	stream, err := eh.DeserializeStreamName(streamName)
+	if err != nil {
+		return err
+	}
+
+	cursors, err := client.SnapshotStore.ListSnapshots(ctx, stream, eh.ParseSnapshotPerspective(perspective))
+	if err != nil {
+		return err
+	}
+
+	for _, cursor := range cursors {
+		fmt.Println(cursor.Serialize())
+	}
+
+	return nil
+}
+
+func snapshotRollback(
+	ctx context.Context,
+	cursorSerialized string,
+	perspective string,
+	logger *log.Logger,
+) error {
+	client, err := ehclientfactory.SystemClientFrom(ehclient.ConfigFromENV, logger)
+	if err != nil {
+		return err
+	}
+
+	to, err := eh.DeserializeCursor(cursorSerialized)
+	if err != nil {
+		return err
+	}
+
+	if err := client.SnapshotStore.RollbackSnapshot(ctx, to, eh.ParseSnapshotPerspective(perspective)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no snapshot version at %s (see snap ls)", to.Serialize())
+		}
+
+		return err
+	}
+
+	return nil
+}
@@ -2,18 +2,28 @@ package ehcli
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/function61/eventhorizon/pkg/eh"
 	"github.com/function61/eventhorizon/pkg/ehclient"
 	"github.com/function61/eventhorizon/pkg/ehclientfactory"
 	"github.com/function61/eventhorizon/pkg/ehdebug"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/eheventencryption"
+	"github.com/function61/eventhorizon/pkg/system/ehsettingsdomain"
+	"github.com/function61/eventhorizon/pkg/system/ehstreamchildren"
 	"github.com/function61/eventhorizon/pkg/system/ehstreammeta"
+	"github.com/function61/eventhorizon/pkg/system/ehstreamstats"
 	"github.com/function61/gokit/log/logex"
 	"github.com/function61/gokit/os/osutil"
+	"github.com/scylladb/termtables"
 	"github.com/spf13/cobra"
 )
 
@@ -23,7 +33,9 @@ func streamEntrypoint() *cobra.Command {
 		Short: "Stream management",
 	}
 
-	parentCmd.AddCommand(&cobra.Command{
+	keyGroup := ""
+
+	mkCmd := &cobra.Command{
 		Use:   "mk [path]",
 		Short: "Create new stream, as a child of parent",
 		Args:  cobra.ExactArgs(1),
@@ -31,6 +43,23 @@ func streamEntrypoint() *cobra.Command {
 			rootLogger := logex.StandardLogger()
 
 			osutil.ExitIfError(streamCreate(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				args[0],
+				keyGroup,
+				rootLogger))
+		},
+	}
+	mkCmd.Flags().StringVarP(&keyGroup, "key-group", "", keyGroup, "Key group whose KEKs control access to the stream (default: cluster's default)")
+	parentCmd.AddCommand(mkCmd)
+
+	parentCmd.AddCommand(&cobra.Command{
+		Use:   "info [stream]",
+		Short: "Display stream's metadata",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			rootLogger := logex.StandardLogger()
+
+			osutil.ExitIfError(streamInfo(
 				osutil.CancelOnInterruptOrTerminate(rootLogger),
 				args[0],
 				rootLogger))
@@ -84,6 +113,160 @@ func streamEntrypoint() *cobra.Command {
 		},
 	})
 
+	parentCmd.AddCommand(&cobra.Command{
+		Use:   "rotate-dek [stream]",
+		Short: "Rotate stream's data encryption key (DEK). New data will be encrypted with the new DEK",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			rootLogger := logex.StandardLogger()
+
+			osutil.ExitIfError(streamRotateDEK(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				args[0],
+				rootLogger))
+		},
+	})
+
+	treeDepth := ehstreamchildren.DefaultTreeDepth
+	treeGlob := ""
+
+	treeCmd := &cobra.Command{
+		Use:   "tree [stream]",
+		Short: "List stream's descendants recursively",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			rootLogger := logex.StandardLogger()
+
+			osutil.ExitIfError(streamTree(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				args[0],
+				treeDepth,
+				treeGlob,
+				rootLogger))
+		},
+	}
+	treeCmd.Flags().IntVarP(&treeDepth, "depth", "", treeDepth, "How many levels to descend (1 = only direct children)")
+	treeCmd.Flags().StringVarP(&treeGlob, "glob", "", treeGlob, "Only list streams matching this pattern (example: /t-*/users/*)")
+	parentCmd.AddCommand(treeCmd)
+
+	childStreamsAfter := ""
+	childStreamsLimit := ehstreamstats.DefaultChildStreamsLimit
+
+	statsCmd := &cobra.Command{
+		Use:   "stats [stream]",
+		Short: "Display stream's statistics and a page of its child streams",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			rootLogger := logex.StandardLogger()
+
+			osutil.ExitIfError(streamStats(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				args[0],
+				childStreamsAfter,
+				childStreamsLimit,
+				rootLogger))
+		},
+	}
+	statsCmd.Flags().StringVarP(&childStreamsAfter, "after", "", childStreamsAfter, "List child streams after this child's name (for pagination)")
+	statsCmd.Flags().IntVarP(&childStreamsLimit, "limit", "", childStreamsLimit, "Max child streams to list")
+	parentCmd.AddCommand(statsCmd)
+
+	parentCmd.AddCommand(&cobra.Command{
+		Use:   "set-encoding [streamOrPattern] [lines|cbor]",
+		Short: "Set how events get serialized for matching streams (existing data is left as-is)",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			rootLogger := logex.StandardLogger()
+
+			osutil.ExitIfError(streamSetEncoding(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				args[0],
+				args[1],
+				rootLogger))
+		},
+	})
+
+	parentCmd.AddCommand(&cobra.Command{
+		Use:   "set-compression [stream] [none|deflate|zstd]",
+		Short: "Set how data appended to the stream gets compressed (existing data is left as-is)",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			rootLogger := logex.StandardLogger()
+
+			osutil.ExitIfError(streamSetCompression(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				args[0],
+				args[1],
+				rootLogger))
+		},
+	})
+
+	compressionPickEntries := 200
+	compressionPickApply := false
+
+	compressionPickCmd := &cobra.Command{
+		Use:   "pick-compression [stream]",
+		Short: "Measure compression methods (incl. a trained dictionary) on stream's recent data & pick the best",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			rootLogger := logex.StandardLogger()
+
+			osutil.ExitIfError(streamPickCompression(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				args[0],
+				compressionPickEntries,
+				compressionPickApply,
+				rootLogger))
+		},
+	}
+	compressionPickCmd.Flags().IntVarP(&compressionPickEntries, "entries", "", compressionPickEntries, "How many of the most recent encrypted entries to measure with")
+	compressionPickCmd.Flags().BoolVarP(&compressionPickApply, "apply", "", compressionPickApply, "Set the picked compression for the stream")
+	parentCmd.AddCommand(compressionPickCmd)
+
+	parentCmd.AddCommand(&cobra.Command{
+		Use:   "verify [stream]",
+		Short: "Verify stream's hash chain (detects modified, removed or reordered entries)",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			rootLogger := logex.StandardLogger()
+
+			osutil.ExitIfError(streamVerify(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				args[0],
+				rootLogger))
+		},
+	})
+
+	parentCmd.AddCommand(&cobra.Command{
+		Use:   "close [stream] [reason]",
+		Short: "Close stream so it doesn't accept any more appends",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			rootLogger := logex.StandardLogger()
+
+			osutil.ExitIfError(streamClose(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				args[0],
+				args[1],
+				rootLogger))
+		},
+	})
+
+	parentCmd.AddCommand(&cobra.Command{
+		Use:   "shred [stream] [reason]",
+		Short: "Close stream and destroy its DEKs, making its encrypted data permanently unreadable",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			rootLogger := logex.StandardLogger()
+
+			osutil.ExitIfError(streamShred(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				args[0],
+				args[1],
+				rootLogger))
+		},
+	})
+
 	return parentCmd
 }
 
@@ -115,7 +298,41 @@ func listChildStreams(ctx context.Context, streamNameRaw string, logger *log.Log
 	return nil
 }
 
-func streamCreate(ctx context.Context, streamPath string, logger *log.Logger) error {
+func streamTree(
+	ctx context.Context,
+	streamNameRaw string,
+	maxDepth int,
+	glob string,
+	logger *log.Logger,
+) error {
+	client, err := ehclientfactory.SystemClientFrom(ehclient.ConfigFromENV, logger)
+	if err != nil {
+		return err
+	}
+
+	streamName, err := eh.DeserializeStreamName(streamNameRaw)
+	if err != nil {
+		return err
+	}
+
+	// not cached, since we visit each stream only once
+	_, err = ehstreamchildren.WalkTree(ctx, streamName, ehstreamchildren.TreeQuery{
+		MaxDepth: maxDepth,
+		Glob:     glob,
+	}, client, nil, func(stream eh.StreamName, depth int) error {
+		if glob != "" {
+			// indentation would be confusing when intermediate streams are filtered out
+			fmt.Println(stream.String())
+			return nil
+		}
+
+		fmt.Printf("%s%s\n", strings.Repeat("  ", depth-1), stream.String())
+		return nil
+	})
+	return err
+}
+
+func streamCreate(ctx context.Context, streamPath string, keyGroup string, logger *log.Logger) error {
 	stream, err := eh.DeserializeStreamName(streamPath)
 	if err != nil {
 		return err
@@ -132,10 +349,275 @@ func streamCreate(ctx context.Context, streamPath string, logger *log.Logger) er
 		return err
 	}
 
-	_, err = client.CreateStream(ctx, stream, nil)
+	_, err = client.CreateStream(ctx, stream, keyGroup, nil)
 	return err
 }
 
+func streamInfo(ctx context.Context, streamNameRaw string, logger *log.Logger) error {
+	client, err := ehclientfactory.SystemClientFrom(ehclient.ConfigFromENV, logger)
+	if err != nil {
+		return err
+	}
+
+	streamName, err := eh.DeserializeStreamName(streamNameRaw)
+	if err != nil {
+		return err
+	}
+
+	streamMeta, err := ehstreammeta.LoadUntilRealtime(ctx, streamName, client, ehstreammeta.GlobalCache)
+	if err != nil {
+		return err
+	}
+
+	keyGroup := streamMeta.State.KeyGroupID()
+	if keyGroup == "" {
+		keyGroup = "(not recorded)"
+	}
+
+	data := streamMeta.State.Data()
+	version := streamMeta.State.Version()
+
+	fmt.Printf("Stream:        %s\n", streamName.String())
+	fmt.Printf("Version:       %s\n", version.Serialize())
+	fmt.Printf("Created:       %s\n", data.Created.Format(time.RFC3339))
+	fmt.Printf("Key group:     %s\n", keyGroup)
+	fmt.Printf("Newest DEK:    v%d\n", streamMeta.State.NewestDEKVersion())
+	fmt.Printf("Compression:   %s\n", compressionDescription(streamMeta.State.Compression()))
+	fmt.Printf("Subscriptions: %d\n", len(data.Subscriptions))
+	fmt.Printf("Total bytes:   %d\n", data.TotalBytes)
+
+	if data.Closed != nil {
+		fmt.Printf("Closed:        %s\n", data.Closed.Format(time.RFC3339))
+	}
+
+	if data.Shredded != nil {
+		fmt.Printf("Shredded:      %s\n", data.Shredded.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func streamStats(
+	ctx context.Context,
+	streamNameRaw string,
+	childStreamsAfter string,
+	childStreamsLimit int,
+	logger *log.Logger,
+) error {
+	if childStreamsLimit < 1 {
+		return errors.New("limit must be at least 1")
+	}
+
+	client, err := ehclientfactory.SystemClientFrom(ehclient.ConfigFromENV, logger)
+	if err != nil {
+		return err
+	}
+
+	streamName, err := eh.DeserializeStreamName(streamNameRaw)
+	if err != nil {
+		return err
+	}
+
+	streamStats, err := ehstreamstats.LoadUntilRealtime(ctx, streamName, client, ehstreamstats.GlobalCache)
+	if err != nil {
+		return err
+	}
+
+	// computed with our own credentials, so it only includes what we could decrypt anyway
+	output := streamStats.State.Output(childStreamsAfter, childStreamsLimit, true)
+
+	formatTime := func(ts *time.Time) string {
+		if ts == nil {
+			return "-"
+		}
+		return ts.Format(time.RFC3339)
+	}
+
+	fmt.Printf("Stream:              %s\n", streamName.String())
+	fmt.Printf("Version:             %s\n", output.Version.Serialize())
+	fmt.Printf("First event:         %s\n", formatTime(output.Stats.FirstEvent))
+	fmt.Printf("Last event:          %s\n", formatTime(output.Stats.LastEvent))
+	fmt.Printf("Meta entries:        %d (%d bytes)\n",
+		output.Stats.EntriesByKind[eh.LogDataKindMeta],
+		output.Stats.BytesByKind[eh.LogDataKindMeta])
+	fmt.Printf("Encrypted entries:   %d (%d bytes)\n",
+		output.Stats.EntriesByKind[eh.LogDataKindEncryptedData],
+		output.Stats.BytesByKind[eh.LogDataKindEncryptedData])
+	fmt.Printf("Undecryptable:       %d\n", output.Stats.UndecryptableEntries)
+	fmt.Printf("Child streams:       %d\n", output.Stats.TotalChildStreams)
+
+	eventTypes := []string{}
+	for eventType := range output.Stats.EventsByType {
+		eventTypes = append(eventTypes, eventType)
+	}
+	sort.Strings(eventTypes)
+
+	fmt.Println("\nEvents by type:")
+	for _, eventType := range eventTypes {
+		fmt.Printf("  %-40s %d\n", eventType, output.Stats.EventsByType[eventType])
+	}
+
+	fmt.Println("\nChild streams:")
+	for _, childStream := range output.ChildStreams {
+		fmt.Printf("  %s\n", childStream.String())
+	}
+
+	if output.MoreChildStreams {
+		last := output.ChildStreams[len(output.ChildStreams)-1]
+		fmt.Fprintf(os.Stderr, "More child streams available, continue with --after=%s\n", last.Base())
+	}
+
+	return nil
+}
+
+func streamSetEncoding(ctx context.Context, streams string, encodingRaw string, logger *log.Logger) error {
+	encoding, err := ehevent.ParseEncoding(encodingRaw)
+	if err != nil {
+		return err
+	}
+
+	settings, client, err := loadSettings(ctx, logger)
+	if err != nil {
+		return err
+	}
+
+	return client.AppendAfter(
+		ctx,
+		settings.State.Version(),
+		ehsettingsdomain.NewEventEncodingSet(streams, string(encoding), ehevent.MetaSystemUser(time.Now())))
+}
+
+func streamSetCompression(ctx context.Context, streamNameRaw string, methodRaw string, logger *log.Logger) error {
+	method, err := eheventencryption.ParseCompressionMethod(methodRaw)
+	if err != nil {
+		return err
+	}
+
+	client, err := ehclientfactory.SystemClientFrom(ehclient.ConfigFromENV, logger)
+	if err != nil {
+		return err
+	}
+
+	streamName, err := eh.DeserializeStreamName(streamNameRaw)
+	if err != nil {
+		return err
+	}
+
+	return client.SetCompression(ctx, streamName, eheventencryption.Compression{Method: method})
+}
+
+func streamPickCompression(
+	ctx context.Context,
+	streamNameRaw string,
+	entries int,
+	apply bool,
+	logger *log.Logger,
+) error {
+	if entries < 2 {
+		return errors.New("entries must be at least 2")
+	}
+
+	client, err := ehclientfactory.SystemClientFrom(ehclient.ConfigFromENV, logger)
+	if err != nil {
+		return err
+	}
+
+	streamName, err := eh.DeserializeStreamName(streamNameRaw)
+	if err != nil {
+		return err
+	}
+
+	samples, err := recentPlaintexts(ctx, streamName, entries, client)
+	if err != nil {
+		return err
+	}
+
+	dictionaryID, err := eheventencryption.NewDictionaryID()
+	if err != nil {
+		return err
+	}
+
+	picked, results, err := eheventencryption.PickCompression(samples, dictionaryID)
+	if err != nil {
+		return err
+	}
+
+	view := termtables.CreateTable()
+	view.AddHeaders("Method", "Input bytes", "Output bytes", "Ratio", "Duration")
+
+	for _, result := range results {
+		view.AddRow(
+			result.Name(),
+			result.InputBytes,
+			result.OutputBytes,
+			fmt.Sprintf("%.3f", result.Ratio()),
+			result.Duration.String())
+	}
+
+	fmt.Println(view.Render())
+
+	if !apply {
+		fmt.Printf("picked %s (set it with --apply)\n", results[0].Name())
+		return nil
+	}
+
+	if err := client.SetCompression(ctx, streamName, *picked); err != nil {
+		return err
+	}
+
+	fmt.Printf("set %s compression to %s\n", streamName.String(), results[0].Name())
+
+	return nil
+}
+
+// plaintexts of stream's (at most) *entries* most recent encrypted entries, oldest first
+func recentPlaintexts(
+	ctx context.Context,
+	stream eh.StreamName,
+	entries int,
+	client *ehclient.SystemClient,
+) ([][]byte, error) {
+	streamMeta, err := ehstreammeta.LoadUntilRealtime(ctx, stream, client, ehstreammeta.GlobalCache)
+	if err != nil {
+		return nil, err
+	}
+
+	// some of these entries are meta entries, so we might get a bit less than asked for
+	version := streamMeta.State.Version()
+	after := stream.Beginning()
+	if from := version.Version() - int64(entries); from > after.Version() {
+		after = stream.At(from)
+	}
+
+	plaintexts := [][]byte{}
+
+	for {
+		res, err := client.EventLog.Read(ctx, after)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range res.Entries {
+			if entry.Data.Kind != eh.LogDataKindEncryptedData {
+				continue
+			}
+
+			plaintext, err := client.Decrypt(ctx, stream, entry.Data.Raw)
+			if err != nil {
+				return nil, err
+			}
+
+			plaintexts = append(plaintexts, plaintext)
+		}
+
+		if !res.More {
+			return plaintexts, nil
+		}
+
+		after = res.LastEntry
+	}
+}
+
 func streamReadDebug(ctx context.Context, streamNameRaw string, version int64, logger *log.Logger) error {
 	client, err := ehclientfactory.SystemClientFrom(ehclient.ConfigFromENV, logger)
 	if err != nil {
@@ -163,3 +645,102 @@ func streamAppend(ctx context.Context, streamNameRaw string, event string, logge
 
 	return client.AppendStrings(ctx, streamName, []string{event})
 }
+
+func streamRotateDEK(ctx context.Context, streamNameRaw string, logger *log.Logger) error {
+	client, err := ehclientfactory.SystemClientFrom(ehclient.ConfigFromENV, logger)
+	if err != nil {
+		return err
+	}
+
+	streamName, err := eh.DeserializeStreamName(streamNameRaw)
+	if err != nil {
+		return err
+	}
+
+	dekVersion, err := client.RotateDEK(ctx, streamName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("rotated %s to DEK v%d\n", streamName.String(), dekVersion)
+
+	return nil
+}
+
+func streamClose(ctx context.Context, streamNameRaw string, reason string, logger *log.Logger) error {
+	client, err := ehclientfactory.SystemClientFrom(ehclient.ConfigFromENV, logger)
+	if err != nil {
+		return err
+	}
+
+	streamName, err := eh.DeserializeStreamName(streamNameRaw)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.EventLog.CloseStream(ctx, streamName, reason)
+	return err
+}
+
+func streamShred(ctx context.Context, streamNameRaw string, reason string, logger *log.Logger) error {
+	client, err := ehclientfactory.SystemClientFrom(ehclient.ConfigFromENV, logger)
+	if err != nil {
+		return err
+	}
+
+	streamName, err := eh.DeserializeStreamName(streamNameRaw)
+	if err != nil {
+		return err
+	}
+
+	if _, err := client.ShredStream(ctx, streamName, reason); err != nil {
+		return err
+	}
+
+	fmt.Printf("shredded %s\n", streamName.String())
+
+	return nil
+}
+
+func streamVerify(ctx context.Context, streamNameRaw string, logger *log.Logger) error {
+	client, err := ehclientfactory.SystemClientFrom(ehclient.ConfigFromENV, logger)
+	if err != nil {
+		return err
+	}
+
+	streamName, err := eh.DeserializeStreamName(streamNameRaw)
+	if err != nil {
+		return err
+	}
+
+	result, err := eh.VerifyHashChain(ctx, streamName, client.EventLog)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Verified entries: %d\n", result.Entries)
+
+	if result.Unhashed > 0 {
+		fmt.Printf("Unhashed entries: %d (written before hash chaining; can't be verified)\n", result.Unhashed)
+	}
+
+	if result.BrokenAt == nil {
+		fmt.Println("Hash chain OK")
+		return nil
+	}
+
+	streamMeta, err := ehstreammeta.LoadUntilRealtime(ctx, streamName, client, ehstreammeta.GlobalCache)
+	if err == nil && streamMeta.State.Shredded() {
+		fmt.Fprintln(os.Stderr, "NOTE: stream is shredded, which destroys DEK envelopes in-place")
+	}
+
+	return fmt.Errorf("hash chain broken at %s", result.BrokenAt.Serialize())
+}
+
+func compressionDescription(method eheventencryption.CompressionMethod, dictionaryID uint32) string {
+	if dictionaryID != 0 {
+		return fmt.Sprintf("%s (dictionary %d)", method.String(), dictionaryID)
+	}
+
+	return method.String()
+}
@@ -118,7 +118,7 @@ func subscriptionCreateStream(ctx context.Context, name string, logger *log.Logg
 		return err
 	}
 
-	if _, err := client.CreateStream(ctx, id.BackingStream(), nil); err != nil {
+	if _, err := client.CreateStream(ctx, id.BackingStream(), "", nil); err != nil {
 		return err
 	}
 
@@ -0,0 +1,89 @@
+package ehclient
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient/ehclienttest"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestBatching(t *testing.T) {
+	ctx := context.Background()
+
+	eventLog := ehclienttest.NewEventLog()
+	client := NewSystemClient(
+		eventLog,
+		ehclienttest.NewSnapshotStore(),
+		ehclienttest.NewSystemConnector(eventLog),
+		nil)
+
+	stream := eh.RootName.Child("chatrooms").Child("offtopic")
+
+	_, err := client.CreateStream(ctx, stream, "default", nil)
+	assert.Ok(t, err)
+
+	for i, msg := range []string{"a", "b", "c", "d", "e"} {
+		assert.Ok(t, client.Append(ctx, stream, NewChatMessage(i+1, msg, ehevent.Meta(t0, "joonas"))))
+	}
+
+	load := func(batching Batching) *messagesProjection {
+		projection := &messagesProjection{cur: stream.Beginning()}
+
+		reader := NewReader(projection, client)
+		reader.SetBatching(batching)
+
+		assert.Ok(t, reader.LoadUntilRealtime(ctx))
+		assert.EqualString(t, strings.Join(projection.messages, ", "), "a, b, c, d, e")
+		assert.EqualString(t, projection.cur.Serialize(), "/chatrooms/offtopic@5")
+
+		return projection
+	}
+
+	assert.EqualInt(t, load(BatchingPerEntry).commits, 6) // +1 for the stream's creation entry
+	assert.EqualInt(t, load(BatchingPerPage).commits, 1)
+	assert.EqualInt(t, load(Batching{MaxEntries: 4}).commits, 2)
+}
+
+func TestBatchingStrictModeCommitsEntriesBeforeFailure(t *testing.T) {
+	ctx := context.Background()
+
+	eventLog := ehclienttest.NewEventLog()
+	client := NewSystemClient(
+		eventLog,
+		ehclienttest.NewSnapshotStore(),
+		ehclienttest.NewSystemConnector(eventLog),
+		nil)
+
+	stream := eh.RootName.Child("chatrooms").Child("offtopic")
+
+	_, err := client.CreateStream(ctx, stream, "default", nil)
+	assert.Ok(t, err)
+
+	assert.Ok(t, client.Append(ctx, stream, NewChatMessage(1, "Hello", ehevent.Meta(t0, "joonas"))))
+	assert.Ok(t, client.Append(ctx, stream, &ChatReactionAdded{ehevent.Meta(t0, "joonas"), 1}))
+	assert.Ok(t, client.Append(ctx, stream, NewChatMessage(2, "Bye", ehevent.Meta(t0, "joonas"))))
+
+	projection := &messagesProjection{cur: stream.Beginning()}
+
+	reader := NewReader(projection, client)
+	reader.SetBatching(BatchingPerPage)
+	reader.SetStrict(FailOnIgnoredEvent)
+
+	assert.EqualString(
+		t,
+		reader.LoadUntilRealtime(ctx).Error(),
+		"LoadUntilRealtime: strict mode: unknown_type in /chatrooms/offtopic@2: unsupported event: chat.ReactionAdded")
+
+	// entries before the failing one were committed in one batch
+	assert.EqualString(t, strings.Join(projection.messages, ", "), "Hello")
+	assert.EqualString(t, projection.cur.Serialize(), "/chatrooms/offtopic@1")
+	assert.EqualInt(t, projection.commits, 1)
+
+	// retrying doesn't commit anything
+	assert.Assert(t, reader.LoadUntilRealtime(ctx) != nil)
+	assert.EqualInt(t, projection.commits, 1)
+}
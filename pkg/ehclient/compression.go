@@ -0,0 +1,174 @@
+package ehclient
+
+// Per-stream compression of encrypted data (see eheventencryption.Compression)
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/eheventencryption"
+	"github.com/function61/gokit/sync/syncutil"
+)
+
+// decrypts (and decompresses) data of a LogDataKindEncryptedData entry
+func (e *SystemClient) Decrypt(ctx context.Context, stream eh.StreamName, ciphertext []byte) ([]byte, error) {
+	dekVersion, err := eheventencryption.DEKVersion(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	dek, err := e.LoadDEK(ctx, stream, dekVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	dictionaryID, err := eheventencryption.CompressionDictionaryID(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	var dictionary []byte
+	if dictionaryID != 0 {
+		dictionary, err = e.LoadCompressionDictionary(ctx, stream, dictionaryID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return eheventencryption.DecryptWithDictionary(ciphertext, dek, dictionary)
+}
+
+// how data appended to the stream should be compressed
+func (e *SystemClient) LoadCompression(ctx context.Context, stream eh.StreamName) (*eheventencryption.Compression, error) {
+	method, dictionaryID, err := e.sysConn.Compression(ctx, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	compression := &eheventencryption.Compression{Method: method}
+
+	if dictionaryID != 0 {
+		compression.Dictionary, err = e.LoadCompressionDictionary(ctx, stream, dictionaryID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return compression, nil
+}
+
+// loads (and decrypts) one of the stream's compression dictionaries
+func (e *SystemClient) LoadCompressionDictionary(
+	ctx context.Context,
+	stream eh.StreamName,
+	dictionaryID uint32,
+) ([]byte, error) {
+	key := compressionDictionaryCacheKey(stream, dictionaryID)
+
+	if dictionary := func() []byte {
+		defer syncutil.LockAndUnlock(&e.dictsCacheMu)()
+
+		return e.dictsCache[key]
+	}(); dictionary != nil {
+		return dictionary, nil
+	}
+
+	dictionaryEncrypted, err := e.sysConn.CompressionDictionaryEncrypted(ctx, stream, dictionaryID)
+	if err != nil {
+		return nil, err
+	}
+
+	// dictionaries are not compressed with dictionaries, so this doesn't recurse
+	dictionary, err := e.Decrypt(ctx, stream, dictionaryEncrypted)
+	if err != nil {
+		return nil, fmt.Errorf("compression dictionary %d: %w", dictionaryID, err)
+	}
+
+	defer syncutil.LockAndUnlock(&e.dictsCacheMu)()
+
+	e.dictsCache[key] = dictionary
+
+	return dictionary, nil
+}
+
+// changes how data appended to the stream from now on gets compressed. the dictionary (if any)
+// gets stored in the stream's metadata, encrypted with the stream's newest DEK.
+//
+// NOTE: writers who have the stream's metadata cached keep using the previous compression for a few seconds.
+func (e *SystemClient) SetCompression(
+	ctx context.Context,
+	stream eh.StreamName,
+	compression eheventencryption.Compression,
+) error {
+	dictionaryID := uint32(0)
+	var dictionaryEncrypted []byte
+
+	if compression.Dictionary != nil {
+		if compression.Method != eheventencryption.CompressionMethodZstd {
+			return errors.New("SetCompression: dictionary is only supported for zstd")
+		}
+
+		var err error
+		dictionaryID, err = eheventencryption.DictionaryID(compression.Dictionary)
+		if err != nil {
+			return fmt.Errorf("SetCompression: %w", err)
+		}
+
+		// compressed data refers to its dictionary by ID, so an ID can never mean different bytes
+		existing, err := e.LoadCompressionDictionary(ctx, stream, dictionaryID)
+		switch {
+		case err == nil:
+			if !bytes.Equal(existing, compression.Dictionary) {
+				return fmt.Errorf("SetCompression: stream already has different dictionary with ID %d", dictionaryID)
+			}
+			// same dictionary can be taken back into use without repeating it
+		case errors.Is(err, os.ErrNotExist):
+			dek, dekVersion, err := e.LoadNewestDEK(ctx, stream)
+			if err != nil {
+				return fmt.Errorf("SetCompression: %w", err)
+			}
+
+			dictionaryEncrypted, err = eheventencryption.EncryptWithDEKVersion(compression.Dictionary, dek, dekVersion)
+			if err != nil {
+				return fmt.Errorf("SetCompression: %w", err)
+			}
+		default:
+			return fmt.Errorf("SetCompression: %w", err)
+		}
+	}
+
+	if _, err := e.EventLog.Append(ctx, stream, *eh.LogDataMeta(eh.NewStreamCompressionSet(
+		compression.Method,
+		dictionaryID,
+		dictionaryEncrypted,
+		ehevent.MetaSystemUser(time.Now()),
+	))); err != nil {
+		return fmt.Errorf("SetCompression: %w", err)
+	}
+
+	return nil
+}
+
+// removes stream's compression dictionaries from our cache
+func (e *SystemClient) forgetCompressionDictionaries(stream eh.StreamName) {
+	defer syncutil.LockAndUnlock(&e.dictsCacheMu)()
+
+	prefix := stream.String() + "#" // see compressionDictionaryCacheKey()
+
+	for key := range e.dictsCache {
+		if strings.HasPrefix(key, prefix) {
+			delete(e.dictsCache, key)
+		}
+	}
+}
+
+func compressionDictionaryCacheKey(stream eh.StreamName, dictionaryID uint32) string {
+	return fmt.Sprintf("%s#%d", stream.String(), dictionaryID)
+}
@@ -0,0 +1,56 @@
+package ehclient
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient/ehclienttest"
+	"github.com/function61/eventhorizon/pkg/eheventencryption"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestSetCompressionDictionaryIDReuse(t *testing.T) {
+	ctx := context.Background()
+
+	eventLog := ehclienttest.NewEventLog()
+	client := NewSystemClient(
+		eventLog,
+		ehclienttest.NewSnapshotStore(),
+		ehclienttest.NewSystemConnector(eventLog),
+		nil)
+
+	stream := eh.RootName.Child("sensors")
+
+	_, err := client.CreateStream(ctx, stream, "default", nil)
+	assert.Ok(t, err)
+
+	zstdWith := func(dictionary []byte) eheventencryption.Compression {
+		return eheventencryption.Compression{Method: eheventencryption.CompressionMethodZstd, Dictionary: dictionary}
+	}
+
+	assert.Ok(t, client.SetCompression(ctx, stream, zstdWith(fakeDictionary(40000, "first"))))
+	assert.Ok(t, client.SetCompression(ctx, stream, zstdWith(fakeDictionary(40001, "second"))))
+
+	// taking the first one back into use is fine
+	assert.Ok(t, client.SetCompression(ctx, stream, zstdWith(fakeDictionary(40000, "first"))))
+
+	compression, err := client.LoadCompression(ctx, stream)
+	assert.Ok(t, err)
+	assert.EqualString(t, string(compression.Dictionary), string(fakeDictionary(40000, "first")))
+
+	// .. but not with different content, because existing data compressed with it would become unreadable
+	assert.EqualString(
+		t,
+		client.SetCompression(ctx, stream, zstdWith(fakeDictionary(40000, "impostor"))).Error(),
+		"SetCompression: stream already has different dictionary with ID 40000")
+}
+
+// has the zstd dictionary header, which is enough for SetCompression()
+func fakeDictionary(id uint32, content string) []byte {
+	header := []byte{0x37, 0xa4, 0x30, 0xec, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(header[4:], id)
+
+	return append(header, content...)
+}
@@ -5,11 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"strings"
 	"sync"
 
 	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/eheventencryption"
+	"github.com/function61/eventhorizon/pkg/ehserver/ehbolt"
 	"github.com/function61/eventhorizon/pkg/ehserver/ehdynamodb"
 	"github.com/function61/eventhorizon/pkg/ehserver/ehserverclient"
 	"github.com/function61/gokit/crypto/envelopeenc"
@@ -23,8 +27,23 @@ import (
 // which depend on Reader interface). this is also the reason for "ehclientfactory" package
 // TODO: extract the interfaces the stores depend on, so we don't need this?
 type SystemConnector interface {
-	DEKv0EnvelopeForNewStream(context.Context, eh.StreamName) (*envelopeenc.EnvelopeBundle, error)
-	ResolveDEK(context.Context, eh.StreamName) ([]byte, error)
+	// key group to use when stream creator didn't specify one
+	DefaultKeyGroupID(context.Context, eh.StreamName) (string, error)
+	// key group the stream was created with. "" for streams created before key groups were recorded
+	KeyGroupID(context.Context, eh.StreamName) (string, error)
+	// envelope whose recipients are the key group's KEKs
+	DEKv0EnvelopeForNewStream(ctx context.Context, stream eh.StreamName, keyGroupId string) (*envelopeenc.EnvelopeBundle, error)
+	// envelope for the next DEK version of an existing stream. also returns the DEK version and
+	// the stream's version that the envelope was made for (append the rotation after it).
+	DEKEnvelopeForRotation(ctx context.Context, stream eh.StreamName) (*envelopeenc.EnvelopeBundle, uint64, *eh.Cursor, error)
+	ResolveDEK(ctx context.Context, stream eh.StreamName, dekVersion uint64) ([]byte, error)
+	NewestDEKVersion(context.Context, eh.StreamName) (uint64, error)
+	// how to serialize events appended to the stream
+	EventEncoding(context.Context, eh.StreamName) (ehevent.Encoding, error)
+	// how to compress data appended to the stream. dictionary ID 0 = no dictionary
+	Compression(context.Context, eh.StreamName) (eheventencryption.CompressionMethod, uint32, error)
+	// encrypted with the stream's DEK. error wraps os.ErrNotExist if the stream doesn't have the dictionary
+	CompressionDictionaryEncrypted(ctx context.Context, stream eh.StreamName, dictionaryID uint32) ([]byte, error)
 }
 
 type Tenant struct {
@@ -66,6 +85,8 @@ type SystemClient struct {
 	deksCache         map[string][]byte
 	deksCacheMu       sync.Mutex
 	deksCacheStreamMu *syncutil.MutexMap
+	dictsCache        map[string][]byte
+	dictsCacheMu      sync.Mutex
 }
 
 func ClientFrom(
@@ -94,44 +115,67 @@ func SystemClientFrom(
 		return nil, err
 	}
 
-	if conf.url != "" {
-		// implements EventLog, SnapshotStore
-		serverClient, err := ehserverclient.New(conf.url, logex.Prefix("network", logger))
-		if err != nil {
-			return nil, err
+	eventLog, snapshotStore, err := func() (eh.ReaderWriter, eh.SnapshotStore, error) {
+		switch conf.backend {
+		case backendServer:
+			// implements EventLog, SnapshotStore
+			serverClient, err := ehserverclient.New(conf.url, logex.Prefix("network", logger))
+			if err != nil {
+				return nil, nil, err
+			}
+
+			return serverClient, serverClient, nil
+		case backendDynamoDb:
+			snapshots, err := NewDynamoDbSnapshotStore(
+				conf.SnapshotsDynamoDbOptions(),
+				eh.DefaultSnapshotRetention)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			return ehdynamodb.New(conf.ClientDynamoDbOptions()), snapshots, nil
+		case backendFile:
+			// implements EventLog, SnapshotStore
+			fileClient, err := ehbolt.Open(conf.filePath)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			return fileClient, fileClient, nil
+		default:
+			return nil, nil, fmt.Errorf("unsupported backend: %d", conf.backend)
 		}
+	}()
+	if err != nil {
+		return nil, err
+	}
 
-		return &SystemClient{
-			EventLog:          serverClient,
-			SnapshotStore:     serverClient,
-			conf:              *conf,
-			logger:            logger,
-			sysConn:           sysConn,
-			deksCache:         map[string][]byte{},
-			deksCacheStreamMu: syncutil.NewMutexMap(),
-		}, nil
-	} else {
-		snapshots, err := NewDynamoDbSnapshotStore(
-			conf.SnapshotsDynamoDbOptions())
-		if err != nil {
-			return nil, err
-		}
+	systemClient := NewSystemClient(eventLog, snapshotStore, sysConn, logger)
+	systemClient.conf = *conf
 
-		eventLog := ehdynamodb.New(conf.ClientDynamoDbOptions())
+	return systemClient, nil
+}
 
-		return &SystemClient{
-			EventLog:          eventLog,
-			SnapshotStore:     snapshots,
-			conf:              *conf,
-			logger:            logger,
-			sysConn:           sysConn,
-			deksCache:         map[string][]byte{},
-			deksCacheStreamMu: syncutil.NewMutexMap(),
-		}, nil
+// client for storage that you already have. SystemClientFrom() is the usual way to make one,
+// this is for tests and for tools that bring their own storage.
+func NewSystemClient(
+	eventLog eh.ReaderWriter,
+	snapshotStore eh.SnapshotStore,
+	sysConn SystemConnector,
+	logger *log.Logger,
+) *SystemClient {
+	return &SystemClient{
+		EventLog:          eventLog,
+		SnapshotStore:     snapshotStore,
+		logger:            logger,
+		sysConn:           sysConn,
+		deksCache:         map[string][]byte{},
+		deksCacheStreamMu: syncutil.NewMutexMap(),
+		dictsCache:        map[string][]byte{},
 	}
 }
 
-// returns empty if running at server side
+// returns empty if we have direct access to storage (running at server side or local backend)
 func (s *SystemClient) GetServerUrl() string {
 	return s.conf.url
 }
@@ -143,14 +187,25 @@ func ConfigFromENV() (string, error) {
 	return osutil.GetenvRequired("EVENTHORIZON")
 }
 
+type backend int
+
+const (
+	backendServer   backend = iota // talks to EventHorizon server over HTTP(S)
+	backendDynamoDb                // direct access to DynamoDB (= running at server side)
+	backendFile                    // local BoltDB file
+)
+
 type Config struct {
+	backend         backend
 	tenantId        string
 	accessKeyId     string // AWS_ACCESS_KEY_ID
 	accessKeySecret string // AWS_SECRET_ACCESS_KEY
 	accessKeyToken  string // AWS_SESSION_TOKEN (only needed in Lambda)
 	regionId        string
+	endpoint        string // custom DynamoDB endpoint (e.g. DynamoDB Local). empty = AWS default
 	env             environment
 	url             string
+	filePath        string
 }
 
 func (c *Config) ClientDynamoDbOptions() ehdynamodb.DynamoDbOptions {
@@ -168,6 +223,7 @@ func (c *Config) dynamoDbOptions(tableName string) ehdynamodb.DynamoDbOptions {
 		AccessKeyToken:  c.accessKeyToken,
 		RegionId:        c.regionId,
 		TableName:       tableName,
+		Endpoint:        c.endpoint,
 	}
 }
 
@@ -180,10 +236,16 @@ func getConfig(getter ConfigStringGetter) (*Config, error) {
 	// works for "http://" | "https://"
 	if strings.HasPrefix(confString, "http") {
 		return &Config{
-			url: confString,
+			backend: backendServer,
+			url:     confString,
 		}, nil
 	}
 
+	// the legacy format below uses ":" as separator, but never "://"
+	if strings.Contains(confString, "://") {
+		return getConfigFromUrl(confString)
+	}
+
 	// format:
 	//   <"prod" | "dev">:<tenant>:<accessKeyId>:<accessKeySecret>:<regionId>
 	parts := strings.Split(confString, ":")
@@ -194,56 +256,136 @@ func getConfig(getter ConfigStringGetter) (*Config, error) {
 	}
 
 	namespace := parts[0]
-	accessKeyId := parts[2]
-	accessKeySecret := parts[3]
-	accessKeyToken := ""
-
-	// if creds empty, fetch from another ENV variable.
-	// https://docs.aws.amazon.com/lambda/latest/dg/configuration-envvars.html#configuration-envvars-runtime
-	if accessKeyId == "" || accessKeySecret == "" {
-		if accessKeyId != "" || accessKeySecret != "" {
-			return nil, errors.New(
-				"both accessKeyId and accessKeySecret must be empty or both must be set")
+
+	accessKeyId, accessKeySecret, accessKeyToken, err := awsCredentialsOrFromENV(parts[2], parts[3])
+	if err != nil {
+		return nil, err
+	}
+
+	switch namespace {
+	case "prod", "dev":
+	default:
+		return nil, fmt.Errorf("unknown environment: %s", namespace)
+	}
+
+	return &Config{
+		backend:         backendDynamoDb,
+		tenantId:        parts[1],
+		accessKeyId:     accessKeyId,
+		accessKeySecret: accessKeySecret,
+		accessKeyToken:  accessKeyToken,
+		regionId:        parts[4],
+		env:             environmentNamed(namespace),
+	}, nil
+}
+
+// formats:
+//
+//	dynamodb://[<accessKeyId>:<accessKeySecret>@]<regionId>?env=<env>[&tenant=<tenant>]
+//	    [&events_table=<table>][&snapshots_table=<table>][&endpoint=<url>]
+//	file://<path>[?tenant=<tenant>]
+func getConfigFromUrl(confString string) (*Config, error) {
+	confUrl, err := url.Parse(confString)
+	if err != nil {
+		return nil, err
+	}
+
+	query := confUrl.Query()
+
+	tenantId := query.Get("tenant")
+
+	switch confUrl.Scheme {
+	case "dynamodb":
+		accessKeyId, accessKeySecret := "", ""
+		if confUrl.User != nil {
+			accessKeyId = confUrl.User.Username()
+			accessKeySecret, _ = confUrl.User.Password()
 		}
 
-		accessKeyId, err = osutil.GetenvRequired("AWS_ACCESS_KEY_ID")
+		accessKeyId, accessKeySecret, accessKeyToken, err := awsCredentialsOrFromENV(accessKeyId, accessKeySecret)
 		if err != nil {
 			return nil, err
 		}
 
-		accessKeySecret, err = osutil.GetenvRequired("AWS_SECRET_ACCESS_KEY")
-		if err != nil {
-			return nil, err
+		if confUrl.Host == "" {
+			return nil, errors.New("dynamodb: regionId not specified")
 		}
 
-		accessKeyToken = os.Getenv("AWS_SESSION_TOKEN")
-	}
+		// custom table names take precedence over the ones derived from environment name
+		env := environmentNamed(query.Get("env"))
+		if eventsTableName := query.Get("events_table"); eventsTableName != "" {
+			env.eventsTableName = eventsTableName
+		}
+		if snapshotsTableName := query.Get("snapshots_table"); snapshotsTableName != "" {
+			env.snapshotsTableName = snapshotsTableName
+		}
 
-	environment, err := func() (*environment, error) {
-		switch namespace {
-		case "prod":
-			return &environment{"prod_eh_events", "prod_eh_snapshots"}, nil
-		case "dev":
-			return &environment{"dev_eh_events", "dev_eh_snapshots"}, nil
-		default:
-			return nil, fmt.Errorf("unknown environment: %s", namespace)
+		if query.Get("env") == "" && (query.Get("events_table") == "" || query.Get("snapshots_table") == "") {
+			return nil, errors.New("dynamodb: specify 'env' or both of 'events_table' and 'snapshots_table'")
 		}
-	}()
+
+		return &Config{
+			backend:         backendDynamoDb,
+			tenantId:        tenantId,
+			accessKeyId:     accessKeyId,
+			accessKeySecret: accessKeySecret,
+			accessKeyToken:  accessKeyToken,
+			regionId:        confUrl.Host,
+			endpoint:        query.Get("endpoint"),
+			env:             env,
+		}, nil
+	case "file":
+		// "file:///var/lib/eh.db" => host="", path="/var/lib/eh.db"
+		// "file://eh.db" => host="eh.db", path="" (relative paths)
+		filePath := confUrl.Host + confUrl.Path
+		if filePath == "" {
+			return nil, errors.New("file: path not specified")
+		}
+
+		return &Config{
+			backend:  backendFile,
+			tenantId: tenantId,
+			filePath: filePath,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported config scheme: %s", confUrl.Scheme)
+	}
+}
+
+// if creds empty, fetch from another ENV variable.
+// https://docs.aws.amazon.com/lambda/latest/dg/configuration-envvars.html#configuration-envvars-runtime
+func awsCredentialsOrFromENV(
+	accessKeyId string,
+	accessKeySecret string,
+) (string, string, string, error) {
+	if accessKeyId != "" && accessKeySecret != "" {
+		return accessKeyId, accessKeySecret, "", nil
+	}
+
+	if accessKeyId != "" || accessKeySecret != "" {
+		return "", "", "", errors.New(
+			"both accessKeyId and accessKeySecret must be empty or both must be set")
+	}
+
+	accessKeyId, err := osutil.GetenvRequired("AWS_ACCESS_KEY_ID")
 	if err != nil {
-		return nil, err
+		return "", "", "", err
 	}
 
-	return &Config{
-		tenantId:        parts[1],
-		accessKeyId:     accessKeyId,
-		accessKeySecret: accessKeySecret,
-		accessKeyToken:  accessKeyToken,
-		regionId:        parts[4],
-		env:             *environment,
-	}, nil
+	accessKeySecret, err = osutil.GetenvRequired("AWS_SECRET_ACCESS_KEY")
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return accessKeyId, accessKeySecret, os.Getenv("AWS_SESSION_TOKEN"), nil
 }
 
 type environment struct {
 	eventsTableName    string
 	snapshotsTableName string
 }
+
+// "prod" => "prod_eh_events", "prod_eh_snapshots"
+func environmentNamed(name string) environment {
+	return environment{name + "_eh_events", name + "_eh_snapshots"}
+}
@@ -4,15 +4,21 @@ package ehclienttest
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehevent"
 	"github.com/function61/gokit/crypto/envelopeenc"
+	"github.com/function61/gokit/sync/syncutil"
 )
 
-// Dummy in-memory based event log for testing
+// Dummy in-memory based event log for testing. Safe for concurrent use.
 type EventLog struct {
 	memoryStore  map[string]*[]eh.LogEntry
 	dekEnvelopes map[string]*envelopeenc.Envelope
+	closed       map[string]bool
+	mu           sync.Mutex
 }
 
 // interface assertion
@@ -22,23 +28,62 @@ func NewEventLog() *EventLog {
 	return &EventLog{
 		memoryStore:  map[string]*[]eh.LogEntry{},
 		dekEnvelopes: map[string]*envelopeenc.Envelope{},
+		closed:       map[string]bool{},
 	}
 }
 
 func (e *EventLog) Append(ctx context.Context, stream eh.StreamName, data eh.LogData) (*eh.AppendResult, error) {
+	defer syncutil.LockAndUnlock(&e.mu)()
+
 	entries := e.memoryStore[stream.String()]
 
 	if entries == nil {
-		return e.AppendAfter(ctx, stream.Beginning(), data)
+		return e.appendAfter(stream.Beginning(), data)
 	} else {
-		return e.AppendAfter(
-			ctx,
+		return e.appendAfter(
 			stream.At(int64(len(*entries)-1)),
 			data)
 	}
 }
 
 func (e *EventLog) AppendAfter(ctx context.Context, after eh.Cursor, data eh.LogData) (*eh.AppendResult, error) {
+	defer syncutil.LockAndUnlock(&e.mu)()
+
+	return e.appendAfter(after, data)
+}
+
+func (e *EventLog) AppendMany(ctx context.Context, appends []eh.AppendAfterItem) ([]eh.AppendResult, error) {
+	defer syncutil.LockAndUnlock(&e.mu)()
+
+	if err := eh.ValidateAppendMany(appends); err != nil {
+		return nil, err
+	}
+
+	// check all before appending any, so we don't end up with partial writes
+	for _, item := range appends {
+		if err := e.checkAppendAfter(item.After); err != nil {
+			return nil, err
+		}
+	}
+
+	results := []eh.AppendResult{}
+	for _, item := range appends {
+		result, err := e.appendAfter(item.After, item.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, *result)
+	}
+
+	return results, nil
+}
+
+func (e *EventLog) appendAfter(after eh.Cursor, data eh.LogData) (*eh.AppendResult, error) {
+	if err := e.checkAppendAfter(after); err != nil {
+		return nil, err
+	}
+
 	stream := after.Stream()
 
 	entries, found := e.memoryStore[stream.String()]
@@ -48,39 +93,118 @@ func (e *EventLog) AppendAfter(ctx context.Context, after eh.Cursor, data eh.Log
 		e.memoryStore[stream.String()] = entries
 	}
 
-	afterRequested := after.Next()
-	afterActual := after.Stream().At(int64(len(*entries)))
+	afterActual := stream.At(int64(len(*entries)))
+
+	*entries = append(*entries, hashChained(*entries, afterActual, data))
 
-	if !afterRequested.Equal(afterActual) {
-		return nil, eh.NewErrOptimisticLockingFailed(fmt.Errorf(
+	return &eh.AppendResult{
+		Cursor: afterActual,
+	}, nil
+}
+
+func (e *EventLog) checkAppendAfter(after eh.Cursor) error {
+	stream := after.Stream()
+
+	if e.closed[stream.String()] {
+		return eh.NewErrStreamClosed(stream)
+	}
+
+	headVersion := int64(-1)
+	if entries := e.memoryStore[stream.String()]; entries != nil {
+		headVersion = int64(len(*entries) - 1)
+	}
+
+	if after.Version() != headVersion {
+		afterRequested := after.Next()
+
+		return eh.NewErrOptimisticLockingFailed(fmt.Errorf(
 			"conflict: %s afterRequested=%d afterActual=%d",
 			stream.String(),
 			afterRequested.Version(),
-			afterActual.Version()))
+			headVersion+1))
 	}
 
-	*entries = append(*entries, eh.LogEntry{
-		Cursor: afterActual,
-		Data:   data,
-	})
-
-	return &eh.AppendResult{
-		Cursor: afterActual,
-	}, nil
+	return nil
 }
 
+// parent is not notified
 func (e *EventLog) CreateStream(
 	ctx context.Context,
 	stream eh.StreamName,
 	dekEnvelope envelopeenc.Envelope,
+	keyGroupId string,
 	data *eh.LogData,
 ) (*eh.AppendResult, error) {
+	defer syncutil.LockAndUnlock(&e.mu)()
+
+	if _, exists := e.memoryStore[stream.String()]; exists {
+		return nil, fmt.Errorf("CreateStream: already exists: %s", stream.String())
+	}
+
 	e.dekEnvelopes[stream.String()] = &dekEnvelope
 
-	return nil, nil
+	result, err := e.appendAfter(stream.Beginning(), *eh.LogDataMeta(eh.NewStreamStarted(
+		dekEnvelope,
+		keyGroupId,
+		ehevent.MetaSystemUser(time.Now()))))
+	if err != nil {
+		return nil, err
+	}
+
+	if data != nil {
+		return e.appendAfter(result.Cursor, *data)
+	}
+
+	return result, nil
+}
+
+func (e *EventLog) CloseStream(ctx context.Context, stream eh.StreamName, reason string) (*eh.AppendResult, error) {
+	defer syncutil.LockAndUnlock(&e.mu)()
+
+	entries := e.memoryStore[stream.String()]
+	if entries == nil {
+		return nil, fmt.Errorf("stream not created: %s", stream)
+	}
+
+	result, err := e.appendAfter(
+		stream.At(int64(len(*entries)-1)),
+		*eh.LogDataMeta(eh.NewStreamClosed(reason, ehevent.MetaSystemUser(time.Now()))))
+	if err != nil {
+		return nil, err
+	}
+
+	e.closed[stream.String()] = true
+
+	return result, nil
+}
+
+// only forgets the DEK envelope (parent is not notified)
+func (e *EventLog) ShredStream(ctx context.Context, stream eh.StreamName) (*eh.AppendResult, error) {
+	defer syncutil.LockAndUnlock(&e.mu)()
+
+	if !e.closed[stream.String()] {
+		return nil, fmt.Errorf("ShredStream: close stream first: %s", stream.String())
+	}
+
+	delete(e.dekEnvelopes, stream.String())
+
+	entries := e.memoryStore[stream.String()]
+
+	shreddedAt := stream.At(int64(len(*entries)))
+
+	*entries = append(*entries, hashChained(
+		*entries,
+		shreddedAt,
+		*eh.LogDataMeta(eh.NewStreamShredded(ehevent.MetaSystemUser(time.Now())))))
+
+	return &eh.AppendResult{
+		Cursor: shreddedAt,
+	}, nil
 }
 
 func (e *EventLog) Read(_ context.Context, lastKnown eh.Cursor) (*eh.ReadResult, error) {
+	defer syncutil.LockAndUnlock(&e.mu)()
+
 	streamAllEntries := e.memoryStore[lastKnown.Stream().String()]
 
 	if streamAllEntries == nil {
@@ -89,7 +213,8 @@ func (e *EventLog) Read(_ context.Context, lastKnown eh.Cursor) (*eh.ReadResult,
 
 	nextCur := lastKnown.Next()
 
-	entries := (*streamAllEntries)[nextCur.Version():]
+	// copy so concurrent appends don't touch what we return
+	entries := append([]eh.LogEntry{}, (*streamAllEntries)[nextCur.Version():]...)
 
 	lastEntryCur := func() eh.Cursor {
 		if len(entries) > 0 {
@@ -108,5 +233,21 @@ func (e *EventLog) Read(_ context.Context, lastKnown eh.Cursor) (*eh.ReadResult,
 
 // for testing
 func (e *EventLog) ResolveDEKEnvelope(stream eh.StreamName) *envelopeenc.Envelope {
+	defer syncutil.LockAndUnlock(&e.mu)()
+
 	return e.dekEnvelopes[stream.String()]
 }
+
+// makes an entry to be appended after "entries"
+func hashChained(entries []eh.LogEntry, cursor eh.Cursor, data eh.LogData) eh.LogEntry {
+	var prevHash []byte
+	if len(entries) > 0 {
+		prevHash = entries[len(entries)-1].Hash
+	}
+
+	return eh.LogEntry{
+		Cursor: cursor,
+		Data:   data,
+		Hash:   eh.EntryHash(prevHash, cursor, data),
+	}
+}
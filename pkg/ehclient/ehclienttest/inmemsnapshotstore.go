@@ -3,13 +3,18 @@ package ehclienttest
 import (
 	"context"
 	"os"
+	"sync"
 
 	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/gokit/sync/syncutil"
 )
 
+// Safe for concurrent use
 type SnapshotStore struct {
-	snapshots map[string]*eh.PersistedSnapshot
+	snapshots map[string][]*eh.PersistedSnapshot // versions newest first
+	retention eh.SnapshotRetention
 	stats     SnapshotStoreStats
+	mu        sync.Mutex
 }
 
 // interface assertion
@@ -18,28 +23,49 @@ var _ eh.SnapshotStore = (*SnapshotStore)(nil)
 // do not use in anything else than testing
 func NewSnapshotStore() *SnapshotStore {
 	return &SnapshotStore{
-		snapshots: map[string]*eh.PersistedSnapshot{},
+		snapshots: map[string][]*eh.PersistedSnapshot{},
+		retention: eh.DefaultSnapshotRetention,
 	}
 }
 
 func (i *SnapshotStore) ReadSnapshot(
 	_ context.Context,
-	stream eh.StreamName,
-	perspective eh.SnapshotPerspective,
-) (*eh.PersistedSnapshot, error) {
+	input eh.ReadSnapshotInput,
+) (*eh.ReadSnapshotOutput, error) {
+	defer syncutil.LockAndUnlock(&i.mu)()
+
 	i.stats.ReadOps++
 
-	if snap, found := i.snapshots[stream.String()]; found {
-		return snap, nil
-	} else {
-		return nil, os.ErrNotExist
+	for _, snap := range i.snapshots[snapshotKey(input.Stream, input.Perspective)] {
+		if input.Accepts(snap.Cursor.Version()) {
+			return &eh.ReadSnapshotOutput{
+				Snapshot: snap,
+			}, nil
+		}
 	}
+
+	return nil, os.ErrNotExist
 }
 
 func (i *SnapshotStore) WriteSnapshot(_ context.Context, snap eh.PersistedSnapshot) error {
+	defer syncutil.LockAndUnlock(&i.mu)()
+
 	i.stats.WriteOps++
 
-	i.snapshots[snap.Cursor.Stream().String()] = &snap
+	key := snapshotKey(snap.Cursor.Stream(), snap.Perspective)
+	versions := i.snapshots[key]
+
+	if len(versions) > 0 && !versions[0].Cursor.Before(snap.Cursor) {
+		return nil // not newer than what we have
+	}
+
+	versions = append([]*eh.PersistedSnapshot{&snap}, versions...)
+
+	if expired := len(i.retention.Expired(snapshotVersions(versions))); expired > 0 {
+		versions = versions[:len(versions)-expired]
+	}
+
+	i.snapshots[key] = versions
 
 	return nil
 }
@@ -47,16 +73,70 @@ func (i *SnapshotStore) WriteSnapshot(_ context.Context, snap eh.PersistedSnapsh
 func (i *SnapshotStore) DeleteSnapshot(
 	ctx context.Context,
 	stream eh.StreamName,
-	snapshotContext string,
+	perspective eh.SnapshotPerspective,
 ) error {
+	defer syncutil.LockAndUnlock(&i.mu)()
+
 	i.stats.DeleteOps++
 
-	delete(i.snapshots, stream.String())
+	key := snapshotKey(stream, perspective)
+
+	if _, found := i.snapshots[key]; !found {
+		return os.ErrNotExist
+	}
+
+	delete(i.snapshots, key)
 
 	return nil
 }
 
+func (i *SnapshotStore) ListSnapshots(
+	_ context.Context,
+	stream eh.StreamName,
+	perspective eh.SnapshotPerspective,
+) ([]eh.Cursor, error) {
+	defer syncutil.LockAndUnlock(&i.mu)()
+
+	cursors := []eh.Cursor{}
+	for _, snap := range i.snapshots[snapshotKey(stream, perspective)] {
+		cursors = append(cursors, snap.Cursor)
+	}
+
+	return cursors, nil
+}
+
+func (i *SnapshotStore) RollbackSnapshot(
+	_ context.Context,
+	to eh.Cursor,
+	perspective eh.SnapshotPerspective,
+) error {
+	defer syncutil.LockAndUnlock(&i.mu)()
+
+	i.stats.DeleteOps++
+
+	key := snapshotKey(to.Stream(), perspective)
+	versions := i.snapshots[key]
+
+	for idx, snap := range versions {
+		if snap.Cursor.Equal(to) {
+			i.snapshots[key] = versions[idx:]
+			return nil
+		}
+	}
+
+	return os.ErrNotExist
+}
+
+// defaults to eh.DefaultSnapshotRetention
+func (i *SnapshotStore) SetRetention(retention eh.SnapshotRetention) {
+	defer syncutil.LockAndUnlock(&i.mu)()
+
+	i.retention = retention
+}
+
 func (i *SnapshotStore) Stats() SnapshotStoreStats {
+	defer syncutil.LockAndUnlock(&i.mu)()
+
 	return i.stats
 }
 
@@ -73,3 +153,16 @@ func (s SnapshotStoreStats) Diff(to SnapshotStoreStats) SnapshotStoreStats {
 		DeleteOps: to.DeleteOps - s.DeleteOps,
 	}
 }
+
+func snapshotKey(stream eh.StreamName, perspective eh.SnapshotPerspective) string {
+	return stream.String() + ":" + perspective.String()
+}
+
+func snapshotVersions(snapshots []*eh.PersistedSnapshot) []int64 {
+	versions := []int64{}
+	for _, snap := range snapshots {
+		versions = append(versions, snap.Cursor.Version())
+	}
+
+	return versions
+}
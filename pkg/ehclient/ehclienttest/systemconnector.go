@@ -0,0 +1,190 @@
+package ehclienttest
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/eheventencryption"
+	"github.com/function61/gokit/crypto/envelopeenc"
+)
+
+// Dummy system connector (see ehclient.SystemConnector) for testing. Every DEK of every stream
+// is the same key, and DEK envelopes are sealed with a well-known key. Stream metadata is read
+// straight from the event log (without ehstreammeta, which would be an import cycle).
+type SystemConnector struct {
+	eventLog *EventLog
+	dek      []byte
+	kek      [32]byte
+	Encoding ehevent.Encoding // for new data. defaults to lines
+}
+
+func NewSystemConnector(eventLog *EventLog) *SystemConnector {
+	return &SystemConnector{
+		eventLog: eventLog,
+		dek:      testKey("dek"),
+		kek:      sha256.Sum256([]byte("kek")),
+		Encoding: ehevent.EncodingLines,
+	}
+}
+
+func (s *SystemConnector) DefaultKeyGroupID(_ context.Context, _ eh.StreamName) (string, error) {
+	return "default", nil
+}
+
+func (s *SystemConnector) KeyGroupID(ctx context.Context, stream eh.StreamName) (string, error) {
+	metaEvents, _, err := s.metaEvents(ctx, stream)
+	if err != nil {
+		return "", err
+	}
+
+	for _, event := range metaEvents {
+		if started, is := event.(*eh.StreamStarted); is {
+			return started.KeyGroup, nil
+		}
+	}
+
+	return "", nil
+}
+
+func (s *SystemConnector) DEKv0EnvelopeForNewStream(
+	_ context.Context,
+	stream eh.StreamName,
+	_ string,
+) (*envelopeenc.EnvelopeBundle, error) {
+	return s.dekEnvelope(stream, 0)
+}
+
+func (s *SystemConnector) DEKEnvelopeForRotation(
+	ctx context.Context,
+	stream eh.StreamName,
+) (*envelopeenc.EnvelopeBundle, uint64, *eh.Cursor, error) {
+	newestVersion, after, err := s.newestDEKVersion(ctx, stream)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	dekEnvelope, err := s.dekEnvelope(stream, newestVersion+1)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	return dekEnvelope, newestVersion + 1, after, nil
+}
+
+// streams that weren't created with CreateStream() (or were shredded) have no DEK
+func (s *SystemConnector) ResolveDEK(_ context.Context, stream eh.StreamName, _ uint64) ([]byte, error) {
+	if s.eventLog.ResolveDEKEnvelope(stream) == nil {
+		return nil, eh.NewErrDEKUnavailable(fmt.Errorf("no DEK envelope for %s", stream.String()))
+	}
+
+	return s.dek, nil
+}
+
+func (s *SystemConnector) NewestDEKVersion(ctx context.Context, stream eh.StreamName) (uint64, error) {
+	newestVersion, _, err := s.newestDEKVersion(ctx, stream)
+	return newestVersion, err
+}
+
+func (s *SystemConnector) EventEncoding(_ context.Context, _ eh.StreamName) (ehevent.Encoding, error) {
+	return s.Encoding, nil
+}
+
+func (s *SystemConnector) Compression(
+	ctx context.Context,
+	stream eh.StreamName,
+) (eheventencryption.CompressionMethod, uint32, error) {
+	metaEvents, _, err := s.metaEvents(ctx, stream)
+	if err != nil {
+		return eheventencryption.CompressionMethodNone, 0, err
+	}
+
+	method, dictionaryID := eheventencryption.DefaultCompression.Method, uint32(0)
+
+	for _, event := range metaEvents {
+		if compressionSet, is := event.(*eh.StreamCompressionSet); is {
+			method, dictionaryID = compressionSet.Method, compressionSet.DictionaryID
+		}
+	}
+
+	return method, dictionaryID, nil
+}
+
+func (s *SystemConnector) CompressionDictionaryEncrypted(
+	ctx context.Context,
+	stream eh.StreamName,
+	dictionaryID uint32,
+) ([]byte, error) {
+	metaEvents, _, err := s.metaEvents(ctx, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, event := range metaEvents {
+		if compressionSet, is := event.(*eh.StreamCompressionSet); is && compressionSet.DictionaryID == dictionaryID && compressionSet.Dictionary != nil {
+			return compressionSet.Dictionary, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no compression dictionary %d for %s: %w", dictionaryID, stream.String(), os.ErrNotExist)
+}
+
+func (s *SystemConnector) dekEnvelope(stream eh.StreamName, version uint64) (*envelopeenc.EnvelopeBundle, error) {
+	return envelopeenc.EncryptDEK(
+		stream.DEKResourceName(int(version)).String(),
+		s.dek,
+		envelopeenc.NaclSecretBoxEncrypter(s.kek, "test-kek"))
+}
+
+// 2nd return is the stream's version the answer is based on
+func (s *SystemConnector) newestDEKVersion(ctx context.Context, stream eh.StreamName) (uint64, *eh.Cursor, error) {
+	metaEvents, after, err := s.metaEvents(ctx, stream)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	newestVersion := uint64(0)
+
+	for _, event := range metaEvents {
+		if rotated, is := event.(*eh.StreamDEKRotated); is && rotated.Version > newestVersion {
+			newestVersion = rotated.Version
+		}
+	}
+
+	return newestVersion, after, nil
+}
+
+// 2nd return is the stream's version the events are read up to
+func (s *SystemConnector) metaEvents(ctx context.Context, stream eh.StreamName) ([]ehevent.Event, *eh.Cursor, error) {
+	res, err := s.eventLog.Read(ctx, stream.Beginning())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metaEvents := []ehevent.Event{}
+
+	for _, entry := range res.Entries {
+		if entry.Data.Kind != eh.LogDataKindMeta {
+			continue
+		}
+
+		for _, line := range ehevent.DeserializeLines(entry.Data.Raw) {
+			event, err := ehevent.Deserialize(line, eh.MetaTypes)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			metaEvents = append(metaEvents, event)
+		}
+	}
+
+	return metaEvents, &res.LastEntry, nil
+}
+
+func testKey(name string) []byte {
+	key := sha256.Sum256([]byte(name))
+	return key[:]
+}
@@ -0,0 +1,82 @@
+// Realtime (MQTT) notifications of new data in streams a subscriber is subscribed to.
+// Feed these to Reader.Synchronizer
+package ehrealtime
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehserver"
+	"github.com/function61/eventhorizon/pkg/system/ehsettings"
+	"github.com/function61/gokit/log/logex"
+)
+
+// subscribes to subscription's MQTT topic. cursors of streams that got new data are sent
+// to the returned channel until ctx is canceled.
+//
+// returns nil channel if realtime is not configured for the cluster, in which case
+// Synchronizer can only rely on polling.
+func SubscribeToActivity(
+	ctx context.Context,
+	subscription eh.SubscriberID,
+	client *ehclient.SystemClient,
+	logger *log.Logger,
+) (<-chan eh.Cursor, error) {
+	logl := logex.Levels(logger)
+
+	settings, err := ehsettings.LoadUntilRealtime(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	mqttConfig := settings.State.MqttConfig()
+	if mqttConfig == nil {
+		logl.Info.Println("realtime not configured; rely on polling")
+		return nil, nil
+	}
+
+	mqClient, err := ehserver.MqttClientFrom(mqttConfig, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// not closed, because MQTT client can still be delivering messages while disconnecting
+	activity := make(chan eh.Cursor, 100)
+
+	topic := ehserver.MqttTopicForSubscription(subscription, mqttConfig.Namespace)
+
+	if err := ehserver.WaitToken(mqClient.Subscribe(topic, ehserver.MqttQos0AtMostOnce, func(_ mqtt.Client, msg mqtt.Message) {
+		notification := eh.MqttActivityNotification{}
+		if err := json.Unmarshal(msg.Payload(), &notification); err != nil {
+			logl.Error.Printf("Unmarshal: %v", err)
+			return
+		}
+
+		for _, cursor := range notification.Activity {
+			select {
+			case activity <- cursor.Cursor:
+			default:
+				// safe to drop, since Synchronizer's loads read until realtime anyway,
+				// and polling catches up eventually
+				logl.Error.Printf("activity queue full, dropping %s", cursor.Serialize())
+			}
+		}
+	})); err != nil {
+		mqClient.Disconnect(250)
+		return nil, err
+	}
+
+	logl.Info.Printf("subscribed to %s", topic)
+
+	go func() {
+		<-ctx.Done()
+
+		mqClient.Disconnect(250) // doesn't offer error status :O
+	}()
+
+	return activity, nil
+}
@@ -0,0 +1,202 @@
+// Caches snapshots on local disk, for processes that start often (CLI tools, Lambdas)
+package ehsnapshotcache
+
+// The cache holds the newest PersistedSnapshot of each (stream, perspective) as it was stored
+// (= usually encrypted). Before a cached snapshot is used, the remote store is asked which
+// versions it has. That's cheap compared to fetching the snapshot, and it means rollbacks,
+// deletions (e.g. shredding) and newer snapshots written by other processes are noticed.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/gokit/os/atomicfilewrite"
+	"github.com/function61/gokit/sync/syncutil"
+)
+
+// Safe for concurrent use
+type Store struct {
+	remote eh.SnapshotStore
+	dir    string
+	mu     sync.Mutex // serializes file writes (atomicfilewrite uses the same temp filename)
+}
+
+// interface assertion
+var _ eh.SnapshotStore = (*Store)(nil)
+
+// wraps *remote* with cache in *dir* (created if it doesn't exist)
+func New(remote eh.SnapshotStore, dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &Store{
+		remote: remote,
+		dir:    dir,
+	}, nil
+}
+
+// "~/.cache/eventhorizon/snapshots" on Linux
+func DefaultDir() (string, error) {
+	userCacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(userCacheDir, "eventhorizon", "snapshots"), nil
+}
+
+func (s *Store) ReadSnapshot(ctx context.Context, input eh.ReadSnapshotInput) (*eh.ReadSnapshotOutput, error) {
+	newest, err := s.newestRemoteVersion(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	if newest == nil { // also cached one (if any) is gone
+		if err := s.remove(input.Stream, input.Perspective); err != nil {
+			return nil, err
+		}
+
+		return nil, os.ErrNotExist
+	}
+
+	cached, err := s.cached(input.Stream, input.Perspective)
+	if err != nil {
+		return nil, err
+	}
+
+	// no eager read, but Reader does an explicit read in that case
+	if cached != nil && cached.Cursor.Equal(*newest) {
+		return &eh.ReadSnapshotOutput{Snapshot: cached}, nil
+	}
+
+	output, err := s.remote.ReadSnapshot(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	// don't replace newer cached one with older one fetched by AtOrBefore
+	if cached == nil || cached.Cursor.Before(output.Snapshot.Cursor) {
+		if err := s.store(*output.Snapshot); err != nil {
+			return nil, err
+		}
+	}
+
+	return output, nil
+}
+
+func (s *Store) WriteSnapshot(ctx context.Context, snapshot eh.PersistedSnapshot) error {
+	if err := s.remote.WriteSnapshot(ctx, snapshot); err != nil {
+		return err
+	}
+
+	cached, err := s.cached(snapshot.Cursor.Stream(), snapshot.Perspective)
+	if err != nil {
+		return err
+	}
+
+	// remote ignores writes that aren't newer, and so do we
+	if cached != nil && !cached.Cursor.Before(snapshot.Cursor) {
+		return nil
+	}
+
+	return s.store(snapshot)
+}
+
+func (s *Store) DeleteSnapshot(ctx context.Context, stream eh.StreamName, perspective eh.SnapshotPerspective) error {
+	if err := s.remove(stream, perspective); err != nil {
+		return err
+	}
+
+	return s.remote.DeleteSnapshot(ctx, stream, perspective)
+}
+
+func (s *Store) ListSnapshots(
+	ctx context.Context,
+	stream eh.StreamName,
+	perspective eh.SnapshotPerspective,
+) ([]eh.Cursor, error) {
+	return s.remote.ListSnapshots(ctx, stream, perspective)
+}
+
+func (s *Store) RollbackSnapshot(ctx context.Context, to eh.Cursor, perspective eh.SnapshotPerspective) error {
+	if err := s.remove(to.Stream(), perspective); err != nil {
+		return err
+	}
+
+	return s.remote.RollbackSnapshot(ctx, to, perspective)
+}
+
+// the version remote's ReadSnapshot() would return. nil if none.
+func (s *Store) newestRemoteVersion(ctx context.Context, input eh.ReadSnapshotInput) (*eh.Cursor, error) {
+	versions, err := s.remote.ListSnapshots(ctx, input.Stream, input.Perspective)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, version := range versions { // newest first
+		if input.Accepts(version.Version()) {
+			return &version, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// nil if not cached (or cached file was corrupted)
+func (s *Store) cached(stream eh.StreamName, perspective eh.SnapshotPerspective) (*eh.PersistedSnapshot, error) {
+	snapshotJSON, err := ioutil.ReadFile(s.path(stream, perspective))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	snapshot := &eh.PersistedSnapshot{}
+	if err := json.Unmarshal(snapshotJSON, snapshot); err != nil {
+		// corrupted (e.g. disk full or crash with a non-atomic filesystem). it's only a cache,
+		// so drop it instead of failing every read from now on.
+		if err := s.remove(stream, perspective); err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	}
+
+	return snapshot, nil
+}
+
+func (s *Store) store(snapshot eh.PersistedSnapshot) error {
+	defer syncutil.LockAndUnlock(&s.mu)()
+
+	return atomicfilewrite.Write(s.path(snapshot.Cursor.Stream(), snapshot.Perspective), func(file io.Writer) error {
+		return json.NewEncoder(file).Encode(snapshot)
+	})
+}
+
+func (s *Store) remove(stream eh.StreamName, perspective eh.SnapshotPerspective) error {
+	defer syncutil.LockAndUnlock(&s.mu)()
+
+	if err := os.Remove(s.path(stream, perspective)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// stream names can be long and contain "/", so the filename is a hash
+func (s *Store) path(stream eh.StreamName, perspective eh.SnapshotPerspective) string {
+	key := sha256.Sum256([]byte(stream.String() + "\x00" + perspective.String()))
+
+	return filepath.Join(s.dir, hex.EncodeToString(key[:])+".json")
+}
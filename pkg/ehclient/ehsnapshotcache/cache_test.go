@@ -0,0 +1,154 @@
+package ehsnapshotcache
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient/ehclienttest"
+	"github.com/function61/gokit/testing/assert"
+)
+
+var (
+	chatRooms   = eh.RootName.Child("chatrooms")
+	perspective = eh.NewV1Perspective("chat")
+)
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "ehsnapshotcache")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	remote := ehclienttest.NewSnapshotStore()
+
+	cache, err := New(remote, dir)
+	assert.Ok(t, err)
+
+	read := func() string {
+		output, err := cache.ReadSnapshot(ctx, eh.ReadSnapshotInput{
+			Stream:      chatRooms,
+			Perspective: perspective,
+		})
+		if err != nil {
+			return err.Error()
+		}
+
+		return string(output.Snapshot.RawData[1:])
+	}
+
+	remoteReads := func() int {
+		return remote.Stats().ReadOps
+	}
+
+	assert.EqualString(t, read(), os.ErrNotExist.Error())
+
+	assert.Ok(t, remote.WriteSnapshot(ctx, snapshotAt(1)))
+
+	// cache miss
+	assert.EqualString(t, read(), "v1")
+	assert.EqualInt(t, remoteReads(), 1)
+
+	// cache hit (also from a new process)
+	cache, err = New(remote, dir)
+	assert.Ok(t, err)
+
+	assert.EqualString(t, read(), "v1")
+	assert.EqualInt(t, remoteReads(), 1)
+
+	// other process wrote newer version => cache is stale
+	assert.Ok(t, remote.WriteSnapshot(ctx, snapshotAt(2)))
+
+	assert.EqualString(t, read(), "v2")
+	assert.EqualInt(t, remoteReads(), 2)
+
+	// our writes go to the cache as well
+	assert.Ok(t, cache.WriteSnapshot(ctx, snapshotAt(3)))
+
+	assert.EqualString(t, read(), "v3")
+	assert.EqualInt(t, remoteReads(), 2)
+
+	// older version is fetched from remote, but doesn't replace the cached one
+	atOrBefore := chatRooms.At(2)
+	output, err := cache.ReadSnapshot(ctx, eh.ReadSnapshotInput{
+		Stream:      chatRooms,
+		Perspective: perspective,
+		AtOrBefore:  &atOrBefore,
+	})
+	assert.Ok(t, err)
+	assert.EqualString(t, output.Snapshot.Cursor.Serialize(), "/chatrooms@2")
+	assert.EqualInt(t, remoteReads(), 3)
+
+	assert.EqualString(t, read(), "v3")
+	assert.EqualInt(t, remoteReads(), 3)
+
+	// rolled back by someone else
+	assert.Ok(t, remote.RollbackSnapshot(ctx, chatRooms.At(2), perspective))
+
+	assert.EqualString(t, read(), "v2")
+	assert.EqualInt(t, remoteReads(), 4)
+
+	// deleted (e.g. stream shredded) by someone else => cached copy is removed too
+	assert.Ok(t, remote.DeleteSnapshot(ctx, chatRooms, perspective))
+
+	assert.EqualString(t, read(), os.ErrNotExist.Error())
+
+	files, err := ioutil.ReadDir(dir)
+	assert.Ok(t, err)
+	assert.EqualInt(t, len(files), 0)
+}
+
+func TestCacheCorruptFile(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "ehsnapshotcache")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	remote := ehclienttest.NewSnapshotStore()
+
+	cache, err := New(remote, dir)
+	assert.Ok(t, err)
+
+	read := func() string {
+		output, err := cache.ReadSnapshot(ctx, eh.ReadSnapshotInput{
+			Stream:      chatRooms,
+			Perspective: perspective,
+		})
+		assert.Ok(t, err)
+
+		return string(output.Snapshot.RawData[1:])
+	}
+
+	assert.Ok(t, remote.WriteSnapshot(ctx, snapshotAt(1)))
+
+	assert.EqualString(t, read(), "v1")
+	assert.EqualInt(t, remote.Stats().ReadOps, 1)
+
+	assert.Ok(t, ioutil.WriteFile(cache.path(chatRooms, perspective), []byte("garbage\x00{"), 0600))
+
+	// falls back to remote, and the cache is repaired
+	assert.EqualString(t, read(), "v1")
+	assert.EqualInt(t, remote.Stats().ReadOps, 2)
+
+	assert.EqualString(t, read(), "v1")
+	assert.EqualInt(t, remote.Stats().ReadOps, 2)
+
+	// also writes get past the corrupted file
+	assert.Ok(t, ioutil.WriteFile(cache.path(chatRooms, perspective), []byte("garbage"), 0600))
+
+	assert.Ok(t, cache.WriteSnapshot(ctx, snapshotAt(2)))
+
+	assert.EqualString(t, read(), "v2")
+	assert.EqualInt(t, remote.Stats().ReadOps, 2)
+}
+
+func snapshotAt(version int64) eh.PersistedSnapshot {
+	data := []byte(fmt.Sprintf("v%d", version))
+
+	return *eh.NewSnapshot(chatRooms.At(version), data, perspective).Unencrypted()
+}
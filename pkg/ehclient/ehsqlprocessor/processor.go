@@ -0,0 +1,215 @@
+// EventsProcessor adapter for read models stored in an SQL database (via database/sql)
+package ehsqlprocessor
+
+// The processor's cursor is stored in a table in the same database as the read model, so the
+// events' effects and the cursor are committed in one transaction. Committing also verifies
+// that the in-DB cursor is still what the processing was based on, so concurrent processors
+// (e.g. multiple instances of the same app) can't process the same events twice.
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+)
+
+const (
+	DefaultCursorTable = "eh_cursors"
+)
+
+// applies one event to the read model, inside the transaction that'll commit the cursor
+type HandleEventFn func(ctx context.Context, tx *sql.Tx, event ehevent.Event) error
+
+// SQL drivers don't agree on placeholder syntax. *n* starts from 1.
+type Placeholders func(n int) string
+
+var (
+	PlaceholdersQuestionMark Placeholders = func(_ int) string { return "?" }                   // SQLite, MySQL
+	PlaceholdersDollar       Placeholders = func(n int) string { return fmt.Sprintf("$%d", n) } // PostgreSQL
+)
+
+type Options struct {
+	CursorTable  string       // defaults to DefaultCursorTable. not escaped, so don't use untrusted input
+	Placeholders Placeholders // defaults to PlaceholdersQuestionMark
+}
+
+// implements ehclient.EventsProcessor. doesn't support snapshots, since the read model is durable anyway.
+type Processor struct {
+	db          *sql.DB
+	name        string
+	stream      eh.StreamName
+	types       []ehclient.LogDataKindDeserializer
+	handleEvent HandleEventFn
+	cursorTable string
+	placeholder Placeholders
+
+	ehclient.NoSnapshots
+}
+
+var _ ehclient.EventsProcessor = (*Processor)(nil)
+
+// *name* identifies the processor in the cursor table, so multiple processors can share the table
+func New(
+	db *sql.DB,
+	name string,
+	stream eh.StreamName,
+	types []ehclient.LogDataKindDeserializer,
+	handleEvent HandleEventFn,
+	opts Options,
+) *Processor {
+	if opts.CursorTable == "" {
+		opts.CursorTable = DefaultCursorTable
+	}
+
+	if opts.Placeholders == nil {
+		opts.Placeholders = PlaceholdersQuestionMark
+	}
+
+	return &Processor{
+		db:          db,
+		name:        name,
+		stream:      stream,
+		types:       types,
+		handleEvent: handleEvent,
+		cursorTable: opts.CursorTable,
+		placeholder: opts.Placeholders,
+	}
+}
+
+// the column types are understood by at least SQLite, MySQL and PostgreSQL
+func (p *Processor) CreateCursorTableIfNotExists(ctx context.Context) error {
+	_, err := p.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	processor VARCHAR(255) NOT NULL PRIMARY KEY,
+	stream VARCHAR(1024) NOT NULL,
+	version BIGINT NOT NULL
+)`, p.cursorTable))
+	return err
+}
+
+func (p *Processor) GetEventTypes() []ehclient.LogDataKindDeserializer {
+	return p.types
+}
+
+func (p *Processor) ProcessEvents(ctx context.Context, handle ehclient.EventProcessorHandler) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback() // no-op if committed
+	}()
+
+	cur, cursorStored, err := p.cursor(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	committed := false
+
+	if err := handle(
+		cur,
+		func(event ehevent.Event) error {
+			return p.handleEvent(ctx, tx, event)
+		},
+		func(version eh.Cursor) error {
+			if err := p.storeCursor(ctx, tx, cur, cursorStored, version); err != nil {
+				return err
+			}
+
+			committed = true
+
+			return tx.Commit()
+		},
+	); err != nil {
+		return err
+	}
+
+	// handler didn't commit (e.g. Reader only wanted to know our cursor)
+	if !committed {
+		return tx.Rollback()
+	}
+
+	return nil
+}
+
+// 2nd return is false if the processor doesn't have a stored cursor yet
+func (p *Processor) cursor(ctx context.Context, tx *sql.Tx) (eh.Cursor, bool, error) {
+	var stream string
+	var version int64
+
+	if err := tx.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT stream, version FROM %s WHERE processor = %s",
+		p.cursorTable,
+		p.placeholder(1),
+	), p.name).Scan(&stream, &version); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return p.stream.Beginning(), false, nil
+		}
+
+		return eh.Cursor{}, false, fmt.Errorf("cursor: %w", err)
+	}
+
+	if stream != p.stream.String() {
+		return eh.Cursor{}, false, fmt.Errorf(
+			"cursor: processor %s has stored cursor for %s, not %s",
+			p.name,
+			stream,
+			p.stream.String())
+	}
+
+	return p.stream.At(version), true, nil
+}
+
+// the update is conditional on the cursor we read, so that the DB verifies nobody else committed in between
+func (p *Processor) storeCursor(
+	ctx context.Context,
+	tx *sql.Tx,
+	expected eh.Cursor,
+	expectedStored bool,
+	version eh.Cursor,
+) error {
+	if !version.Stream().Equal(p.stream) {
+		return fmt.Errorf("storeCursor: cursor for %s, expecting %s", version.Stream().String(), p.stream.String())
+	}
+
+	var res sql.Result
+	var err error
+	if expectedStored {
+		res, err = tx.ExecContext(ctx, fmt.Sprintf(
+			"UPDATE %s SET version = %s WHERE processor = %s AND version = %s",
+			p.cursorTable,
+			p.placeholder(1),
+			p.placeholder(2),
+			p.placeholder(3),
+		), version.Version(), p.name, expected.Version())
+	} else { // a concurrent insert gets primary key violation
+		res, err = tx.ExecContext(ctx, fmt.Sprintf(
+			"INSERT INTO %s (processor, stream, version) VALUES (%s, %s, %s)",
+			p.cursorTable,
+			p.placeholder(1),
+			p.placeholder(2),
+			p.placeholder(3),
+		), p.name, p.stream.String(), version.Version())
+	}
+	if err != nil {
+		return fmt.Errorf("storeCursor: %w", err)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("storeCursor: %w", err)
+	}
+
+	if affected != 1 {
+		return eh.NewErrOptimisticLockingFailed(fmt.Errorf(
+			"storeCursor: in-DB cursor of %s no longer at %s",
+			p.name,
+			expected.Serialize()))
+	}
+
+	return nil
+}
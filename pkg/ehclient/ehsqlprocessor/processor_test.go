@@ -0,0 +1,206 @@
+package ehsqlprocessor
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehclient/ehclienttest"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/testing/assert"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var t0 = time.Date(2020, 2, 12, 13, 45, 0, 0, time.UTC)
+
+func TestProcessor(t *testing.T) {
+	ctx := context.Background()
+
+	db := openTestDb(t)
+	defer db.Close()
+
+	eventLog := ehclienttest.NewEventLog()
+	client := ehclient.NewSystemClient(
+		eventLog,
+		ehclienttest.NewSnapshotStore(),
+		ehclienttest.NewSystemConnector(eventLog),
+		nil)
+
+	stream := eh.RootName.Child("chatrooms").Child("offtopic")
+
+	_, err := client.CreateStream(ctx, stream, "default", nil)
+	assert.Ok(t, err)
+
+	assert.Ok(t, client.Append(ctx, stream, newMessage("Hello"), newMessage("World")))
+	assert.Ok(t, client.Append(ctx, stream, newMessage("boom")))
+
+	processor := newMessagesProcessor(db, stream)
+	assert.Ok(t, processor.CreateCursorTableIfNotExists(ctx))
+
+	reader := ehclient.NewReader(processor, client)
+
+	// failing entry rolls back its events and the cursor
+	assert.EqualString(t, reader.LoadUntilRealtime(ctx).Error(), "LoadUntilRealtime: handleEvent: boom")
+	assert.EqualString(t, messages(t, db), "Hello, World")
+	assert.EqualString(t, cursor(t, db), "/chatrooms/offtopic@1")
+
+	// other processors (re-using the same table) are not affected
+	other := New(db, "other", stream, processor.types, func(_ context.Context, _ *sql.Tx, _ ehevent.Event) error {
+		return nil
+	}, Options{})
+	assert.Ok(t, ehclient.NewReader(other, client).LoadUntilRealtime(ctx))
+
+	messagesProcessor := newMessagesProcessor(db, stream)
+	messagesProcessor.failOn = ""
+
+	assert.Ok(t, ehclient.NewReader(messagesProcessor, client).LoadUntilRealtime(ctx))
+	assert.EqualString(t, messages(t, db), "Hello, World, boom")
+	assert.EqualString(t, cursor(t, db), "/chatrooms/offtopic@2")
+}
+
+func TestProcessorVerifiesCursorInDb(t *testing.T) {
+	ctx := context.Background()
+
+	db := openTestDb(t)
+	defer db.Close()
+
+	stream := eh.RootName.Child("chatrooms").Child("offtopic")
+
+	processor := newMessagesProcessor(db, stream)
+	assert.Ok(t, processor.CreateCursorTableIfNotExists(ctx))
+
+	processAt := func(version int64, event ehevent.Event) error {
+		return processor.ProcessEvents(ctx, func(
+			cur eh.Cursor,
+			handleEvent func(ehevent.Event) error,
+			commit func(eh.Cursor) error,
+		) error {
+			if err := handleEvent(event); err != nil {
+				return err
+			}
+
+			return commit(stream.At(version))
+		})
+	}
+
+	assert.Ok(t, processAt(0, newMessage("Hello")))
+
+	// simulates another processor having committed after we read our cursor
+	processor.sideEffect = func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE eh_cursors SET version = 5")
+		return err
+	}
+
+	err := processAt(1, newMessage("World"))
+
+	var optimisticLockingFailed *eh.ErrOptimisticLockingFailed
+	assert.Assert(t, errors.As(err, &optimisticLockingFailed))
+	assert.EqualString(t, err.Error(), "storeCursor: in-DB cursor of messages no longer at /chatrooms/offtopic@0")
+	assert.EqualString(t, messages(t, db), "Hello")
+	assert.EqualString(t, cursor(t, db), "/chatrooms/offtopic@0")
+
+	// processor is configured to follow different stream than what it has cursor for
+	processor.stream = eh.RootName.Child("chatrooms").Child("ontopic")
+
+	assert.EqualString(
+		t,
+		processAt(1, newMessage("World")).Error(),
+		"cursor: processor messages has stored cursor for /chatrooms/offtopic, not /chatrooms/ontopic")
+}
+
+type messagesProcessor struct {
+	*Processor
+	failOn     string
+	sideEffect func(*sql.Tx) error
+}
+
+func newMessagesProcessor(db *sql.DB, stream eh.StreamName) *messagesProcessor {
+	m := &messagesProcessor{failOn: "boom"}
+
+	m.Processor = New(
+		db,
+		"messages",
+		stream,
+		ehclient.EncryptedDataDeserializer(testEventTypes),
+		func(ctx context.Context, tx *sql.Tx, event ehevent.Event) error {
+			msg := event.(*chatMessage).Message
+
+			if _, err := tx.ExecContext(ctx, "INSERT INTO messages (message) VALUES (?)", msg); err != nil {
+				return err
+			}
+
+			if m.sideEffect != nil {
+				if err := m.sideEffect(tx); err != nil {
+					return err
+				}
+			}
+
+			if msg == m.failOn {
+				return errors.New(msg)
+			}
+
+			return nil
+		},
+		Options{})
+
+	return m
+}
+
+func openTestDb(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.Ok(t, err)
+
+	// each connection would have its own in-memory database
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec("CREATE TABLE messages (id INTEGER PRIMARY KEY, message TEXT NOT NULL)")
+	assert.Ok(t, err)
+
+	return db
+}
+
+func messages(t *testing.T, db *sql.DB) string {
+	rows, err := db.Query("SELECT message FROM messages ORDER BY id")
+	assert.Ok(t, err)
+	defer rows.Close()
+
+	msgs := []string{}
+	for rows.Next() {
+		msg := ""
+		assert.Ok(t, rows.Scan(&msg))
+		msgs = append(msgs, msg)
+	}
+	assert.Ok(t, rows.Err())
+
+	return strings.Join(msgs, ", ")
+}
+
+func cursor(t *testing.T, db *sql.DB) string {
+	stream := ""
+	version := int64(0)
+	assert.Ok(t, db.QueryRow("SELECT stream, version FROM eh_cursors WHERE processor = 'messages'").Scan(&stream, &version))
+
+	return fmt.Sprintf("%s@%d", stream, version)
+}
+
+var testEventTypes = ehevent.Types{
+	"chat.Message": func() ehevent.Event { return &chatMessage{} },
+}
+
+type chatMessage struct {
+	meta    ehevent.EventMeta
+	Message string
+}
+
+func (e *chatMessage) MetaType() string         { return "chat.Message" }
+func (e *chatMessage) Meta() *ehevent.EventMeta { return &e.meta }
+
+func newMessage(message string) *chatMessage {
+	return &chatMessage{ehevent.MetaSystemUser(t0), message}
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/function61/eventhorizon/pkg/eh"
 	"github.com/function61/eventhorizon/pkg/ehevent"
 	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/sync/syncutil"
 )
 
 // embed this struct in your implementation if you want to opt-out of snapshotting
@@ -25,10 +26,12 @@ func (n *NoSnapshots) Perspective() eh.SnapshotPerspective {
 	return eh.SnapshotPerspective{} // signals to Reader that we opt out of snapshotting
 }
 
-// wraps your AppendAfter() result with state-refreshed retries for ErrOptimisticLockingFailed
-// FIXME: currently this cannot be used along with Synchronizer(), because the Reader
-//        is not safe for concurrent use
+// wraps your AppendAfter() result with state-refreshed retries for ErrOptimisticLockingFailed.
+// the processor doesn't receive new events while fn runs, so fn sees a stable state.
+// (this also means fn must not call LoadUntilRealtime() or WaitUntilProcessed() of this Reader)
 func (r *Reader) TransactWrite(ctx context.Context, fn func() error) error {
+	defer syncutil.LockAndUnlock(&r.loadMu)()
+
 	maxTries := 4
 	var err error
 
@@ -45,7 +48,7 @@ func (r *Reader) TransactWrite(ctx context.Context, fn func() error) error {
 		r.logl.Info.Printf("ErrOptimisticLockingFailed, try %d: %v", i+1, err)
 
 		// reach realtime again, so we can try again
-		if err := r.LoadUntilRealtime(ctx); err != nil {
+		if err := r.loadUntilRealtimeAlreadyLocked(ctx); err != nil {
 			return err
 		}
 	}
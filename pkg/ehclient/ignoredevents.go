@@ -0,0 +1,70 @@
+package ehclient
+
+// Tracking of events the processor didn't (fully) understand. By default these are ignored for
+// forward compatibility, but they're counted in metrics and strict mode can refuse to ignore them.
+
+import (
+	"fmt"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type IgnoredEventReason string
+
+const (
+	IgnoredEventUnknownType   IgnoredEventReason = "unknown_type"   // event not in processor's types
+	IgnoredEventUnknownFields IgnoredEventReason = "unknown_fields" // event was processed, but some of its fields were not
+)
+
+// describes an event (or a part of it) that the processor didn't understand
+type IgnoredEvent struct {
+	Entry  eh.Cursor // log entry the event was in
+	Type   string
+	Reason IgnoredEventReason
+	Err    error
+}
+
+func (i IgnoredEvent) String() string {
+	return fmt.Sprintf("%s in %s: %v", i.Reason, i.Entry.Serialize(), i.Err)
+}
+
+// strict mode handler. return error to fail processing (the log entry won't be committed).
+// return nil to ignore the event after all (e.g. if you just want to log about it).
+type IgnoredEventHandler func(IgnoredEvent) error
+
+// handler for strict mode that fails on any ignored event
+func FailOnIgnoredEvent(ignored IgnoredEvent) error {
+	return fmt.Errorf("strict mode: %s", ignored.String())
+}
+
+// placeholder that deserializers give to Reader. Reader doesn't pass these to the processor.
+type ignoredEvent struct {
+	reason    IgnoredEventReason
+	eventType string
+	err       error
+}
+
+func (e *ignoredEvent) MetaType() string         { return "$ignored" }
+func (e *ignoredEvent) Meta() *ehevent.EventMeta { return &ehevent.EventMeta{} }
+
+var (
+	ignoredEventsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "eventhorizon_reader_ignored_events_total",
+		Help: "Events the processor didn't (fully) understand",
+	}, []string{"processor", "reason"})
+)
+
+func ignoredMetricsFor(processor interface{}) map[IgnoredEventReason]prometheus.Counter {
+	processorName := fmt.Sprintf("%T", processor)
+
+	return map[IgnoredEventReason]prometheus.Counter{
+		IgnoredEventUnknownType:   ignoredEventsMetric.WithLabelValues(processorName, string(IgnoredEventUnknownType)),
+		IgnoredEventUnknownFields: ignoredEventsMetric.WithLabelValues(processorName, string(IgnoredEventUnknownFields)),
+	}
+}
+
+func init() {
+	prometheus.MustRegister(ignoredEventsMetric)
+}
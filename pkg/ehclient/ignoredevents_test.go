@@ -0,0 +1,172 @@
+package ehclient
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient/ehclienttest"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/testing/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var (
+	// chat.Message from the future: has a field we don't know about
+	chatMessageFromNewerVersion = `{"_":"chat.Message","t":"2020-02-12T13:45:00Z","u":"joonas"} {"Id":2,"Message":"Hi","Mood":"happy"}`
+	// event type from the future
+	chatReactionAdded = `{"_":"chat.ReactionAdded","t":"2020-02-12T13:45:00Z","u":"joonas"} {"MessageId":2}`
+)
+
+func TestDeserializeLinesReportsIgnored(t *testing.T) {
+	events, err := deserializeLines([]string{
+		ehevent.SerializeOne(NewChatMessage(1, "Hello", ehevent.Meta(t0, "joonas"))),
+		chatMessageFromNewerVersion,
+		chatReactionAdded,
+	}, testingEventTypes, nil)
+	assert.Ok(t, err)
+
+	assert.EqualInt(t, len(events), 4)
+	assert.EqualString(t, events[0].(*ChatMessage).Message, "Hello")
+	assert.Assert(t, events[1].(*ignoredEvent).reason == IgnoredEventUnknownFields)
+	assert.EqualString(t, events[2].(*ChatMessage).Message, "Hi") // known parts were deserialized
+	assert.Assert(t, events[3].(*ignoredEvent).reason == IgnoredEventUnknownType)
+	assert.EqualString(t, events[3].(*ignoredEvent).eventType, "chat.ReactionAdded")
+}
+
+func TestStrictMode(t *testing.T) {
+	stream := eh.RootName.Child("chatrooms").Child("offtopic")
+
+	newReader := func() *Reader {
+		return &Reader{
+			ignoredMetrics: map[IgnoredEventReason]prometheus.Counter{
+				IgnoredEventUnknownType:   prometheus.NewCounter(prometheus.CounterOpts{Name: "type"}),
+				IgnoredEventUnknownFields: prometheus.NewCounter(prometheus.CounterOpts{Name: "fields"}),
+			},
+		}
+	}
+
+	events, err := deserializeLines([]string{
+		ehevent.SerializeOne(NewChatMessage(1, "Hello", ehevent.Meta(t0, "joonas"))),
+		chatReactionAdded,
+	}, testingEventTypes, nil)
+	assert.Ok(t, err)
+
+	// lenient (default): unknown event is skipped, but counted
+	lenient := newReader()
+
+	understood, err := lenient.withoutIgnoredEvents(stream.At(2), events)
+	assert.Ok(t, err)
+	assert.EqualInt(t, len(understood), 1)
+	assert.EqualString(t, understood[0].(*ChatMessage).Message, "Hello")
+	assert.Assert(t, testutil.ToFloat64(lenient.ignoredMetrics[IgnoredEventUnknownType]) == 1)
+	assert.Assert(t, testutil.ToFloat64(lenient.ignoredMetrics[IgnoredEventUnknownFields]) == 0)
+
+	// strict: handler decides to fail
+	strict := newReader()
+
+	reported := []IgnoredEvent{}
+	strict.SetStrict(func(ignored IgnoredEvent) error {
+		reported = append(reported, ignored)
+		return FailOnIgnoredEvent(ignored)
+	})
+
+	_, err = strict.withoutIgnoredEvents(stream.At(2), events)
+	assert.EqualString(t, err.Error(), "strict mode: unknown_type in /chatrooms/offtopic@2: unsupported event: chat.ReactionAdded")
+
+	assert.EqualInt(t, len(reported), 1)
+	assert.EqualString(t, reported[0].Type, "chat.ReactionAdded")
+
+	var unsupp *ehevent.ErrUnsupportedEvent
+	assert.Assert(t, errors.As(reported[0].Err, &unsupp))
+}
+
+func TestStrictModeLoadUntilRealtime(t *testing.T) {
+	ctx := context.Background()
+
+	eventLog := ehclienttest.NewEventLog()
+	client := NewSystemClient(
+		eventLog,
+		ehclienttest.NewSnapshotStore(),
+		ehclienttest.NewSystemConnector(eventLog),
+		nil)
+
+	stream := eh.RootName.Child("chatrooms").Child("offtopic")
+
+	_, err := client.CreateStream(ctx, stream, "default", nil)
+	assert.Ok(t, err)
+
+	assert.Ok(t, client.Append(ctx, stream, NewChatMessage(1, "Hello", ehevent.Meta(t0, "joonas"))))
+	assert.Ok(t, client.Append(ctx, stream, &ChatReactionAdded{ehevent.Meta(t0, "joonas"), 1}))
+	assert.Ok(t, client.Append(ctx, stream, NewChatMessage(2, "Bye", ehevent.Meta(t0, "joonas"))))
+
+	// metrics are process-wide, so compare to what they were before
+	unknownTypes := ignoredEventsMetric.WithLabelValues("*ehclient.messagesProjection", string(IgnoredEventUnknownType))
+	unknownTypesBefore := testutil.ToFloat64(unknownTypes)
+
+	// lenient (default): unknown event is skipped, but counted
+	lenient := &messagesProjection{cur: stream.Beginning()}
+
+	assert.Ok(t, NewReader(lenient, client).LoadUntilRealtime(ctx))
+	assert.EqualString(t, strings.Join(lenient.messages, ", "), "Hello, Bye")
+	assert.EqualString(t, lenient.cur.Serialize(), "/chatrooms/offtopic@3")
+	assert.Assert(t, testutil.ToFloat64(unknownTypes) == unknownTypesBefore+1)
+
+	// strict: processing stops before the entry with the unknown event
+	strict := &messagesProjection{cur: stream.Beginning()}
+
+	strictReader := NewReader(strict, client)
+	strictReader.SetStrict(FailOnIgnoredEvent)
+
+	err = strictReader.LoadUntilRealtime(ctx)
+	assert.EqualString(t, err.Error(), "LoadUntilRealtime: strict mode: unknown_type in /chatrooms/offtopic@2: unsupported event: chat.ReactionAdded")
+	assert.Assert(t, testutil.ToFloat64(unknownTypes) == unknownTypesBefore+2)
+
+	// entry with the unknown event (nor anything after it) was not committed
+	assert.EqualString(t, strings.Join(strict.messages, ", "), "Hello")
+	assert.EqualString(t, strict.cur.Serialize(), "/chatrooms/offtopic@1")
+
+	// retrying doesn't get past it either
+	assert.Assert(t, strictReader.LoadUntilRealtime(ctx) != nil)
+	assert.EqualString(t, strict.cur.Serialize(), "/chatrooms/offtopic@1")
+}
+
+// event type that testingEventTypes doesn't know about
+type ChatReactionAdded struct {
+	meta      ehevent.EventMeta
+	MessageId int
+}
+
+func (e *ChatReactionAdded) MetaType() string         { return "chat.ReactionAdded" }
+func (e *ChatReactionAdded) Meta() *ehevent.EventMeta { return &e.meta }
+
+type messagesProjection struct {
+	cur      eh.Cursor
+	messages []string
+	commits  int
+}
+
+func (m *messagesProjection) GetEventTypes() []LogDataKindDeserializer {
+	return EncryptedDataDeserializer(testingEventTypes)
+}
+
+func (m *messagesProjection) ProcessEvents(_ context.Context, processAndCommit EventProcessorHandler) error {
+	return processAndCommit(
+		m.cur,
+		func(ev ehevent.Event) error {
+			m.messages = append(m.messages, ev.(*ChatMessage).Message)
+			return nil
+		},
+		func(version eh.Cursor) error {
+			m.cur = version
+			m.commits++
+			return nil
+		})
+}
+
+func (m *messagesProjection) InstallSnapshot(_ *eh.Snapshot) error { return nil }
+func (m *messagesProjection) Snapshot() (*eh.Snapshot, error)      { return nil, nil }
+func (m *messagesProjection) Perspective() eh.SnapshotPerspective  { return eh.SnapshotPerspective{} }
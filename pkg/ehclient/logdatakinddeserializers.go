@@ -8,7 +8,6 @@ import (
 
 	"github.com/function61/eventhorizon/pkg/eh"
 	"github.com/function61/eventhorizon/pkg/ehevent"
-	"github.com/function61/eventhorizon/pkg/eheventencryption"
 )
 
 type LogDataKindDeserializer struct {
@@ -22,42 +21,28 @@ type LogDataKindDeserializer struct {
 
 type LogDataDeserializerFn func(ctx context.Context, entry *eh.LogEntry, client *SystemClient) ([]ehevent.Event, error)
 
-// returns a slice for ergonomics
-func EncryptedDataDeserializer(types ehevent.Types) []LogDataKindDeserializer {
+// returns a slice for ergonomics. *upcasters* (optional) migrate older event versions to the
+// versions in *types* before deserialization.
+func EncryptedDataDeserializer(types ehevent.Types, upcasters ...ehevent.Upcaster) []LogDataKindDeserializer {
+	upcasterRegistry := ehevent.NewUpcasters(upcasters...)
+
 	return []LogDataKindDeserializer{
 		{
 			Kind:       eh.LogDataKindEncryptedData,
 			Encryption: true,
 			Deserializer: func(ctx context.Context, entry *eh.LogEntry, client *SystemClient) ([]ehevent.Event, error) {
-				dek, err := client.LoadDEKv0(ctx, entry.Cursor.Stream())
+				eventsSerialized, err := client.Decrypt(ctx, entry.Cursor.Stream(), entry.Data.Raw)
 				if err != nil {
 					return nil, err
 				}
 
-				eventsSerialized, err := eheventencryption.Decrypt(entry.Data.Raw, dek)
+				// line format or binary format (depending on the encoding the stream had at the time)
+				eventsSplit, err := ehevent.DeserializeBatch(eventsSerialized)
 				if err != nil {
 					return nil, err
 				}
 
-				events := []ehevent.Event{}
-
-				for _, eventSerialized := range ehevent.DeserializeLines(eventsSerialized) {
-					event, err := ehevent.Deserialize(eventSerialized, types)
-					if err != nil {
-						var unsupp *ehevent.ErrUnsupportedEvent
-						if errors.As(err, &unsupp) {
-							// means it was unrecognized type (not in the map). this is necessary for forward
-							// compatibility (if strict parsing is needed we can make new deserializer)
-							continue
-						} else {
-							return nil, err
-						}
-					}
-
-					events = append(events, event)
-				}
-
-				return events, nil
+				return deserializeLines(eventsSplit, types, upcasterRegistry)
 			},
 		},
 	}
@@ -68,31 +53,56 @@ func MetaDeserializer() []LogDataKindDeserializer {
 	return MetaDeserializer2(eh.MetaTypes)
 }
 
-func MetaDeserializer2(types ehevent.Types) []LogDataKindDeserializer {
+// *upcasters* work like in EncryptedDataDeserializer()
+func MetaDeserializer2(types ehevent.Types, upcasters ...ehevent.Upcaster) []LogDataKindDeserializer {
+	upcasterRegistry := ehevent.NewUpcasters(upcasters...)
+
 	return []LogDataKindDeserializer{
 		{
 			Kind: eh.LogDataKindMeta,
 			Deserializer: func(ctx context.Context, entry *eh.LogEntry, client *SystemClient) ([]ehevent.Event, error) {
-				events := []ehevent.Event{}
-
-				for _, eventSerialized := range ehevent.DeserializeLines(entry.Data.Raw) {
-					metaEvent, err := ehevent.Deserialize(eventSerialized, types)
-					if err != nil {
-						var unsupp *ehevent.ErrUnsupportedEvent
-						if errors.As(err, &unsupp) {
-							// means it was unrecognized type (not in the map). this is necessary for forward
-							// compatibility (if strict parsing is needed we can make new deserializer)
-							continue
-						} else {
-							return nil, err
-						}
-					}
-
-					events = append(events, metaEvent)
-				}
-
-				return events, nil
+				return deserializeLines(ehevent.DeserializeLines(entry.Data.Raw), types, upcasterRegistry)
 			},
 		},
 	}
 }
+
+// events we don't recognize (or only partially recognize) are reported to Reader as *ignoredEvent*,
+// so Reader can count them and apply strict mode. Reader doesn't pass them to the processor.
+func deserializeLines(
+	lines []string,
+	types ehevent.Types,
+	upcasters *ehevent.Upcasters,
+) ([]ehevent.Event, error) {
+	events := []ehevent.Event{}
+
+	for _, line := range lines {
+		event, err := ehevent.DeserializeStrict(line, types, upcasters)
+		if err != nil {
+			var unsupp *ehevent.ErrUnsupportedEvent
+			var unknownFields *ehevent.ErrUnknownFields
+
+			switch {
+			case errors.As(err, &unsupp):
+				// means it was unrecognized type (not in the map). this is necessary for forward
+				// compatibility (if strict parsing is needed, see Reader.SetStrict())
+				events = append(events, &ignoredEvent{IgnoredEventUnknownType, unsupp.Type(), err})
+				continue
+			case errors.As(err, &unknownFields):
+				// payload from newer version of the event. we understand the parts we know about.
+				event, err = ehevent.DeserializeUpcasting(line, types, upcasters)
+				if err != nil {
+					return nil, err
+				}
+
+				events = append(events, &ignoredEvent{IgnoredEventUnknownFields, unknownFields.Type(), unknownFields})
+			default:
+				return nil, err
+			}
+		}
+
+		events = append(events, event)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,436 @@
+package ehclient
+
+// Reader for processors that fold multiple streams (e.g. all of "/t-1/users/*") into one read model.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/sync/syncutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// same as EventProcessorHandler, but with a vector of cursors (one for each stream)
+type MultiStreamEventProcessorHandler func(
+	cursors eh.CursorVector,
+	handleEvent func(ehevent.Event) error,
+	commit func(eh.CursorVector) error,
+) error
+
+// EventsProcessor's contract, extended for following multiple streams. the processor stores a
+// cursor vector instead of a cursor, and must commit the whole vector atomically with the effects
+// of the handled events.
+type MultiStreamEventsProcessor interface {
+	ProcessEvents(ctx context.Context, handle MultiStreamEventProcessorHandler) error
+	GetEventTypes() []LogDataKindDeserializer
+
+	// Snapshot related APIs
+
+	InstallSnapshot(*MultiStreamSnapshot) error
+	Snapshot() (*MultiStreamSnapshot, error)
+	// return "" if you don't implement snapshots
+	Perspective() eh.SnapshotPerspective
+}
+
+// processor's state as of the state of multiple streams
+type MultiStreamSnapshot struct {
+	Cursors eh.CursorVector `json:"Cursors"`
+	Data    []byte          `json:"Data"` // opaque byte blob, usually but not necessarily JSON
+}
+
+// Serves reads for one multi-stream processor. entries of different streams are interleaved by
+// their events' time of recording. safe for concurrent use (loads are serialized).
+//
+// Snapshots are stored as snapshots of the *home* stream (usually the common parent of the
+// streams) and encrypted with its DEK. so that the snapshot doesn't leak data to those who only
+// have access to the home stream's DEK, encrypted snapshots are uploaded only if all the streams
+// are in the home stream's key group.
+type MultiStreamReader struct {
+	client           *SystemClient
+	deserializers    map[eh.LogDataKind]LogDataDeserializerFn
+	processor        MultiStreamEventsProcessor
+	home             eh.StreamName
+	streams          []eh.StreamName
+	processorCursors *eh.CursorVector // last known used as optimization, if gets out-of-sync it will be detected
+	snapshotCapable  bool
+	snapshotEncrypt  bool // true if processor handles any LogDataKind that are encrypted
+	snapshotCursors  *eh.CursorVector
+	keyGroupsChecked bool // all streams are in the home stream's key group
+	logl             *logex.Leveled
+	loadMu           sync.Mutex
+	onIgnoredEvent   IgnoredEventHandler // nil = not strict (= ignore unknown events)
+	ignoredMetrics   map[IgnoredEventReason]prometheus.Counter
+}
+
+// *streams* that the processor's cursor vector doesn't yet have are followed from their beginning.
+// streams can be added later by re-creating the reader with more streams.
+func NewMultiStreamReader(
+	processor MultiStreamEventsProcessor,
+	home eh.StreamName,
+	streams []eh.StreamName,
+	client *SystemClient,
+) *MultiStreamReader {
+	snapshotEncrypt := false
+
+	deserializers := map[eh.LogDataKind]LogDataDeserializerFn{}
+	for _, deserializer := range processor.GetEventTypes() {
+		deserializers[deserializer.Kind] = deserializer.Deserializer
+
+		if deserializer.Encryption {
+			snapshotEncrypt = true
+		}
+	}
+
+	return &MultiStreamReader{
+		client:           client,
+		deserializers:    deserializers,
+		processor:        processor,
+		home:             home,
+		streams:          append([]eh.StreamName{}, streams...),
+		processorCursors: nil, // unknown at start
+		snapshotCapable:  !processor.Perspective().IsEmpty(),
+		snapshotEncrypt:  snapshotEncrypt,
+		snapshotCursors:  nil, // unknown at start
+		logl:             logex.Levels(logex.Prefix(fmt.Sprintf("MultiStreamReader[%s]", home.String()), client.logger)),
+		ignoredMetrics:   ignoredMetricsFor(processor),
+	}
+}
+
+// see Reader.SetStrict()
+func (r *MultiStreamReader) SetStrict(handler IgnoredEventHandler) {
+	r.onIgnoredEvent = handler
+}
+
+// feeds the processor entries from all the streams until none of them has newer entries
+func (r *MultiStreamReader) LoadUntilRealtime(ctx context.Context) error {
+	defer syncutil.LockAndUnlock(&r.loadMu)()
+
+	if err := r.loadUntilRealtime(ctx); err != nil {
+		return fmt.Errorf("LoadUntilRealtime: %w", err)
+	}
+
+	return nil
+}
+
+// entry that was read ahead but not yet given to the processor
+type pendingEntry struct {
+	cursor          eh.Cursor
+	events          []ehevent.Event
+	timeOfRecording time.Time // zero if entry has no events for the processor
+}
+
+// read-ahead state of one stream
+type streamReadAhead struct {
+	pending  []pendingEntry
+	readFrom eh.Cursor // where to continue reading after pending
+	realtime bool      // no entries after pending (at the time of reading)
+}
+
+func (r *MultiStreamReader) loadUntilRealtime(ctx context.Context) error {
+	if err := r.discoverProcessorCursors(ctx); err != nil {
+		return err
+	}
+
+	if r.snapshotCapable && r.atBeginning() {
+		if err := r.fetchAndInstallSnapshot(ctx); err != nil {
+			r.logl.Error.Printf("fetchAndInstallSnapshot: %v", err)
+		}
+	}
+
+	readAheads := []*streamReadAhead{}
+	for _, cur := range r.processorCursors.Cursors() {
+		readAheads = append(readAheads, &streamReadAhead{readFrom: cur})
+	}
+
+	for {
+		for _, readAhead := range readAheads {
+			if len(readAhead.pending) == 0 && !readAhead.realtime {
+				if err := r.readAhead(ctx, readAhead); err != nil {
+					return err
+				}
+			}
+		}
+
+		next := oldestPending(readAheads)
+		if next == nil { // all streams are in realtime
+			break
+		}
+
+		entry := next.pending[0]
+
+		if err := r.processAndCommit(ctx, entry); err != nil {
+			return err
+		}
+
+		next.pending = next.pending[1:]
+	}
+
+	r.logl.Debug.Printf("reached realtime: %s", r.processorCursors.Serialize())
+
+	if r.snapshotCapable && (r.snapshotCursors == nil || !r.snapshotCursors.Equal(*r.processorCursors)) {
+		if err := r.uploadNewerSnapshot(ctx); err != nil {
+			r.logl.Error.Printf("uploadNewerSnapshot: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (r *MultiStreamReader) readAhead(ctx context.Context, readAhead *streamReadAhead) error {
+	readResult, err := r.client.EventLog.Read(ctx, readAhead.readFrom)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range readResult.Entries {
+		events, err := deserializeEntry(ctx, &record, r.deserializers, r.client)
+		if err != nil {
+			return err
+		}
+
+		events, err = withoutIgnoredEvents(record.Cursor, events, r.ignoredMetrics, r.onIgnoredEvent)
+		if err != nil {
+			return err
+		}
+
+		entry := pendingEntry{cursor: record.Cursor, events: events}
+		if len(events) > 0 { // all events of an entry were appended at the same time
+			entry.timeOfRecording = events[0].Meta().TimeOfRecording()
+		}
+
+		readAhead.pending = append(readAhead.pending, entry)
+	}
+
+	readAhead.readFrom = readResult.LastEntry
+	readAhead.realtime = !readResult.More || len(readResult.Entries) == 0
+
+	return nil
+}
+
+// returns nil if no stream has pending entries. entries without events have nothing to
+// interleave, so they're processed as soon as they're seen.
+func oldestPending(readAheads []*streamReadAhead) *streamReadAhead {
+	var oldest *streamReadAhead
+
+	for _, readAhead := range readAheads { // sorted by stream name, so ties go to the first stream
+		if len(readAhead.pending) == 0 {
+			continue
+		}
+
+		if oldest == nil || readAhead.pending[0].timeOfRecording.Before(oldest.pending[0].timeOfRecording) {
+			oldest = readAhead
+		}
+	}
+
+	return oldest
+}
+
+func (r *MultiStreamReader) processAndCommit(ctx context.Context, entry pendingEntry) error {
+	cursorsToCommit := r.processorCursors.With(entry.cursor)
+
+	if err := r.processor.ProcessEvents(ctx, func(
+		cursorsInDb eh.CursorVector,
+		handleEvent func(ehevent.Event) error,
+		commit func(eh.CursorVector) error,
+	) error {
+		// sanity check that DB is at version we need it to be at. streams that were added
+		// (i.e. not yet committed) are at their beginning.
+		if !r.processorCursors.Equal(*r.withAllStreams(cursorsInDb)) {
+			return fmt.Errorf(
+				"in-DB cursors (%s) out-of-sync with our perspective processorCursors (%s)",
+				cursorsInDb.Serialize(),
+				r.processorCursors.Serialize())
+		}
+
+		for _, event := range entry.events {
+			if errHandle := handleEvent(event); errHandle != nil {
+				return fmt.Errorf("handleEvent: %v", errHandle)
+			}
+		}
+
+		return commit(cursorsToCommit)
+	}); err != nil {
+		return err
+	}
+
+	// commit succeeded -> we know processor is at these cursors
+	r.processorCursors = &cursorsToCommit
+
+	return nil
+}
+
+func (r *MultiStreamReader) discoverProcessorCursors(ctx context.Context) error {
+	// only discover them once
+	if r.processorCursors != nil {
+		return nil
+	}
+
+	var processorCursors eh.CursorVector
+
+	// start an empty transaction without committing any events, so we can
+	// query the initial cursors of the processor
+	if err := r.processor.ProcessEvents(ctx, func(
+		cursorsInDb eh.CursorVector,
+		handleEvent func(ehevent.Event) error,
+		commit func(eh.CursorVector) error,
+	) error {
+		processorCursors = cursorsInDb
+
+		// purposefully missing here: handleEvent(); commit()
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("load cursors: %v", err)
+	}
+
+	r.processorCursors = r.withAllStreams(processorCursors)
+
+	return nil
+}
+
+// adds streams the processor doesn't know about yet (at their beginning)
+func (r *MultiStreamReader) withAllStreams(cursors eh.CursorVector) *eh.CursorVector {
+	for _, stream := range r.streams {
+		if _, has := cursors.Cursor(stream); !has {
+			cursors = cursors.With(stream.Beginning())
+		}
+	}
+
+	return &cursors
+}
+
+func (r *MultiStreamReader) atBeginning() bool {
+	for _, cur := range r.processorCursors.Cursors() {
+		if !cur.AtBeginning() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *MultiStreamReader) fetchAndInstallSnapshot(ctx context.Context) error {
+	output, err := r.client.SnapshotStore.ReadSnapshot(ctx, eh.ReadSnapshotInput{
+		Stream:      r.home,
+		Perspective: r.processor.Perspective(),
+	})
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			r.logl.Info.Printf("no initial snapshot for %s", r.home.String())
+
+			// not an error - we just need to continue fetching data from beginning
+			return nil
+		}
+
+		return err
+	}
+
+	snap, err := output.Snapshot.DecryptIfRequired(func(dekVersion uint64) ([]byte, error) {
+		return r.client.LoadDEK(ctx, r.home, dekVersion)
+	})
+	if err != nil {
+		return err
+	}
+
+	multiSnap := &MultiStreamSnapshot{}
+	if err := json.Unmarshal(snap.Data, multiSnap); err != nil {
+		return err
+	}
+
+	if err := r.processor.InstallSnapshot(multiSnap); err != nil {
+		return fmt.Errorf("InstallSnapshot: %w", err)
+	}
+
+	r.processorCursors = r.withAllStreams(multiSnap.Cursors)
+	r.snapshotCursors = &multiSnap.Cursors
+
+	return nil
+}
+
+func (r *MultiStreamReader) uploadNewerSnapshot(ctx context.Context) error {
+	multiSnap, err := r.processor.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(multiSnap)
+	if err != nil {
+		return err
+	}
+
+	// snapshot stores only know single-stream cursors. the vector's total entry count grows
+	// monotonically, so stores that refuse to go back in versions work correctly.
+	snap := eh.NewSnapshot(r.home.At(multiSnap.Cursors.TotalEntries()-1), data, r.processor.Perspective())
+
+	persisted, err := func() (*eh.PersistedSnapshot, error) {
+		if r.snapshotEncrypt {
+			if err := r.checkKeyGroups(ctx); err != nil {
+				return nil, err
+			}
+
+			dek, dekVersion, err := r.client.LoadNewestDEK(ctx, r.home)
+			if err != nil {
+				return nil, err
+			}
+
+			return snap.Encrypted(dek, dekVersion)
+		} else {
+			return snap.Compressed()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	if err := r.client.SnapshotStore.WriteSnapshot(ctx, *persisted); err != nil {
+		return err
+	}
+
+	r.snapshotCursors = &multiSnap.Cursors
+
+	return nil
+}
+
+// key group of a stream is decided when it's created, so a successful check needn't be repeated
+func (r *MultiStreamReader) checkKeyGroups(ctx context.Context) error {
+	if r.keyGroupsChecked {
+		return nil
+	}
+
+	homeKeyGroup, err := r.client.sysConn.KeyGroupID(ctx, r.home)
+	if err != nil {
+		return err
+	}
+
+	if homeKeyGroup == "" {
+		return fmt.Errorf("refusing to snapshot: key group of %s not recorded", r.home.String())
+	}
+
+	for _, stream := range r.streams {
+		keyGroup, err := r.client.sysConn.KeyGroupID(ctx, stream)
+		if err != nil {
+			return err
+		}
+
+		if keyGroup != homeKeyGroup {
+			return fmt.Errorf(
+				"refusing to snapshot: %s is in key group '%s' but %s is in '%s'",
+				stream.String(),
+				keyGroup,
+				r.home.String(),
+				homeKeyGroup)
+		}
+	}
+
+	r.keyGroupsChecked = true
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package ehclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient/ehclienttest"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestMultiStreamReader(t *testing.T) {
+	ctx := context.Background()
+
+	eventLog := ehclienttest.NewEventLog()
+	snapshotStore := ehclienttest.NewSnapshotStore()
+	client := NewSystemClient(eventLog, snapshotStore, ehclienttest.NewSystemConnector(eventLog), nil)
+
+	users := eh.RootName.Child("t-1").Child("users")
+	alice, bob := users.Child("alice"), users.Child("bob")
+
+	for _, stream := range []eh.StreamName{users, alice, bob} {
+		_, err := client.CreateStream(ctx, stream, "default", nil)
+		assert.Ok(t, err)
+	}
+
+	at := func(minutes int) ehevent.EventMeta {
+		return ehevent.MetaSystemUser(t0.Add(time.Duration(minutes) * time.Minute))
+	}
+
+	assert.Ok(t, client.Append(ctx, alice, NewChatMessage(1, "alice 1", at(0))))
+	assert.Ok(t, client.Append(ctx, bob, NewChatMessage(1, "bob 1", at(1))))
+	assert.Ok(t, client.Append(ctx, alice, NewChatMessage(2, "alice 2", at(2))))
+	assert.Ok(t, client.Append(ctx, bob, NewChatMessage(2, "bob 2", at(3))))
+	// alice's event was backdated, but it was recorded after bob's
+	assert.Ok(t, client.Append(ctx, alice, NewChatMessage(3, "alice 3", ehevent.MetaSystemUserBackdate(t0, t0.Add(5*time.Minute)))))
+	assert.Ok(t, client.Append(ctx, bob, NewChatMessage(3, "bob 3", at(4))))
+
+	streams := []eh.StreamName{alice, bob}
+
+	projection := newMultiChatProjection()
+	assert.Ok(t, NewMultiStreamReader(projection, users, streams, client).LoadUntilRealtime(ctx))
+
+	assert.EqualString(t, projection.Messages(), "alice 1, bob 1, alice 2, bob 2, bob 3, alice 3")
+	assert.EqualString(t, projection.cursors.Serialize(), "/t-1/users/alice@3,/t-1/users/bob@3")
+	assert.EqualInt(t, snapshotStore.Stats().WriteOps, 1)
+
+	// new processor starts from the snapshot, so the streams' old entries are not processed again
+	fromSnapshot := newMultiChatProjection()
+	reader := NewMultiStreamReader(fromSnapshot, users, streams, client)
+	assert.Ok(t, reader.LoadUntilRealtime(ctx))
+
+	assert.EqualString(t, fromSnapshot.Messages(), projection.Messages())
+	assert.EqualInt(t, fromSnapshot.handled, 0)
+	assert.EqualString(t, fromSnapshot.cursors.Serialize(), "/t-1/users/alice@3,/t-1/users/bob@3")
+
+	// failed entry isn't committed, and the failure stops processing
+	assert.Ok(t, client.Append(ctx, bob, NewChatMessage(4, "boom", at(6))))
+	assert.Ok(t, client.Append(ctx, alice, NewChatMessage(4, "alice 4", at(7))))
+
+	assert.EqualString(
+		t,
+		reader.LoadUntilRealtime(ctx).Error(),
+		"LoadUntilRealtime: handleEvent: boom")
+	assert.EqualString(t, fromSnapshot.cursors.Serialize(), "/t-1/users/alice@3,/t-1/users/bob@3")
+
+	// streams can be added later
+	carol := users.Child("carol")
+	_, err := client.CreateStream(ctx, carol, "default", nil)
+	assert.Ok(t, err)
+	assert.Ok(t, client.Append(ctx, carol, NewChatMessage(1, "carol 1", at(5))))
+
+	projection.failOn = ""
+	assert.Ok(t, NewMultiStreamReader(projection, users, append(streams, carol), client).LoadUntilRealtime(ctx))
+	assert.EqualString(t, projection.Messages(), "alice 1, bob 1, alice 2, bob 2, bob 3, alice 3, carol 1, boom, alice 4")
+	assert.EqualString(t, projection.cursors.Serialize(), "/t-1/users/alice@4,/t-1/users/bob@4,/t-1/users/carol@1")
+}
+
+func TestMultiStreamReaderRefusesSnapshotAcrossKeyGroups(t *testing.T) {
+	ctx := context.Background()
+
+	logBuf := &bytes.Buffer{}
+
+	eventLog := ehclienttest.NewEventLog()
+	snapshotStore := ehclienttest.NewSnapshotStore()
+	client := NewSystemClient(eventLog, snapshotStore, ehclienttest.NewSystemConnector(eventLog), log.New(logBuf, "", 0))
+
+	users := eh.RootName.Child("t-1").Child("users")
+	alice, admin := users.Child("alice"), users.Child("admin")
+
+	for _, stream := range []eh.StreamName{users, alice} {
+		_, err := client.CreateStream(ctx, stream, "default", nil)
+		assert.Ok(t, err)
+	}
+
+	_, err := client.CreateStream(ctx, admin, "admins", nil)
+	assert.Ok(t, err)
+
+	assert.Ok(t, client.Append(ctx, alice, NewChatMessage(1, "alice 1", ehevent.Meta(t0, "alice"))))
+	assert.Ok(t, client.Append(ctx, admin, NewChatMessage(1, "admin 1", ehevent.Meta(t0.Add(time.Minute), "admin"))))
+
+	projection := newMultiChatProjection()
+	assert.Ok(t, NewMultiStreamReader(projection, users, []eh.StreamName{alice, admin}, client).LoadUntilRealtime(ctx))
+
+	// processing works, but the admin's data isn't encrypted with a DEK of the default key group
+	assert.EqualString(t, projection.Messages(), "alice 1, admin 1")
+	assert.EqualInt(t, snapshotStore.Stats().WriteOps, 0)
+	assert.Assert(t, strings.Contains(logBuf.String(), "[ERROR] uploadNewerSnapshot: refusing to snapshot: /t-1/users/admin is in key group 'admins' but /t-1/users is in 'default'"))
+}
+
+type multiChatProjection struct {
+	cursors  eh.CursorVector
+	messages []string
+	handled  int
+	failOn   string
+	mu       sync.Mutex
+}
+
+func newMultiChatProjection() *multiChatProjection {
+	return &multiChatProjection{
+		cursors:  eh.NewCursorVector(),
+		messages: []string{},
+		failOn:   "boom",
+	}
+}
+
+func (m *multiChatProjection) Messages() string {
+	return strings.Join(m.messages, ", ")
+}
+
+func (m *multiChatProjection) GetEventTypes() []LogDataKindDeserializer {
+	return EncryptedDataDeserializer(testingEventTypes)
+}
+
+func (m *multiChatProjection) InstallSnapshot(snap *MultiStreamSnapshot) error {
+	m.cursors = snap.Cursors
+	return json.Unmarshal(snap.Data, &m.messages)
+}
+
+func (m *multiChatProjection) Snapshot() (*MultiStreamSnapshot, error) {
+	data, err := json.Marshal(m.messages)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MultiStreamSnapshot{Cursors: m.cursors, Data: data}, nil
+}
+
+func (m *multiChatProjection) Perspective() eh.SnapshotPerspective {
+	return eh.NewV1Perspective("test.multichat")
+}
+
+func (m *multiChatProjection) ProcessEvents(_ context.Context, handle MultiStreamEventProcessorHandler) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	uncommitted := []string{}
+
+	return handle(
+		m.cursors,
+		func(ev ehevent.Event) error {
+			msg := ev.(*ChatMessage).Message
+			if msg == m.failOn {
+				return errors.New(msg)
+			}
+
+			uncommitted = append(uncommitted, msg)
+			return nil
+		},
+		func(cursors eh.CursorVector) error {
+			m.cursors = cursors
+			m.messages = append(m.messages, uncommitted...)
+			m.handled += len(uncommitted)
+			return nil
+		})
+}
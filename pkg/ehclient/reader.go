@@ -12,6 +12,7 @@ import (
 	"github.com/function61/eventhorizon/pkg/ehevent"
 	"github.com/function61/gokit/log/logex"
 	"github.com/function61/gokit/sync/syncutil"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 /* encapsulates:
@@ -48,19 +49,51 @@ type EventsProcessor interface {
 	Perspective() eh.SnapshotPerspective
 }
 
-// Serves reads for one processor. not safe for concurrent use
+// Serves reads for one processor. safe for concurrent use: loads, TransactWrite()s and
+// snapshot uploads are serialized, so the same Reader can be used from request handlers
+// while Synchronizer() runs in the background.
 type Reader struct {
 	client           *SystemClient
 	deserializers    map[eh.LogDataKind]LogDataDeserializerFn
 	processor        EventsProcessor
 	processorVersion *eh.Cursor // last known used as optimization, if gets out-of-sync it will be detected
 	snapshotCapable  bool
-	snapshotEncrypt  bool // true if processor handles any LogDataKind that are encrypted
-	snapshotVersion  *eh.Cursor
+	snapshotEncrypt  bool       // true if processor handles any LogDataKind that are encrypted
+	snapshotVersion  *eh.Cursor // newest stored snapshot (protected by snapshotMu, as background uploads update it)
 	logl             *logex.Leveled
 	logPrefix        string // in rare cases (like eh.streammeta, i.e. 2nd reader for same stream) it would make sense to disambiguate
 	lastLoad         time.Time
-	lastLoadMu       sync.Mutex
+	loadMu           sync.Mutex    // serializes access to processor & our view of its state (see above)
+	processed        *eh.Cursor    // processorVersion as published for other goroutines (see WaitUntilProcessed())
+	processedChanged chan struct{} // closed (and replaced) each time processed changes
+	processedMu      sync.Mutex
+	nudge            chan struct{}       // asks Synchronizer to load now
+	onIgnoredEvent   IgnoredEventHandler // nil = not strict (= ignore unknown events)
+	ignoredMetrics   map[IgnoredEventReason]prometheus.Counter
+	batching         Batching
+	snapshotPolicy   SnapshotPolicy
+	snapshotMu       sync.Mutex
+	snapshotInFlight bool           // protected by snapshotMu
+	snapshotUploads  sync.WaitGroup // background uploads
+	snapshotTaken    time.Time      // when the newest uploaded snapshot was taken (protected by snapshotMu)
+	snapshotEvents   int            // processed since the newest uploaded snapshot (protected by snapshotMu)
+}
+
+// limits for how many log entries one ProcessEvents() handles. zero = no limit, so zero value
+// means the whole read page. the limits are checked between entries, so each batch has at least
+// one entry.
+type Batching struct {
+	MaxEntries  int
+	MaxDuration time.Duration // measured from the start of the batch
+}
+
+var (
+	BatchingPerEntry = Batching{MaxEntries: 1} // default
+	BatchingPerPage  = Batching{}
+)
+
+func (b Batching) full(entries int, elapsed time.Duration) bool {
+	return (b.MaxEntries > 0 && entries >= b.MaxEntries) || (b.MaxDuration > 0 && elapsed >= b.MaxDuration)
 }
 
 // "keep processor happy by feeding it from client"
@@ -87,14 +120,45 @@ func NewReader(processor EventsProcessor, client *SystemClient) *Reader {
 		snapshotEncrypt:  snapshotEncrypt,
 		snapshotVersion:  nil,                                                          // unknown at start
 		logl:             logex.Levels(logex.Prefix("Reader[unknown]", client.logger)), // unknown stream name at start. will be augmented by discoverProcessorVersion()
+		processedChanged: make(chan struct{}),
+		nudge:            make(chan struct{}, 1),
+		ignoredMetrics:   ignoredMetricsFor(processor),
+		batching:         BatchingPerEntry,
 	}
 }
 
+// during catch-up of large streams, processing (and committing) each log entry in its own
+// ProcessEvents() means lots of small transactions. with batching one ProcessEvents() handles
+// many entries (of the same read page) and commits only the last entry's cursor.
+// call this before loading.
+func (r *Reader) SetBatching(batching Batching) {
+	r.batching = batching
+}
+
+// opt-in for audit-critical processors: instead of silently ignoring events of unknown types and
+// unknown payload fields, *handler* gets to decide. use FailOnIgnoredEvent to stop processing.
+// call this before loading.
+func (r *Reader) SetStrict(handler IgnoredEventHandler) {
+	r.onIgnoredEvent = handler
+}
+
 // feeds events to processor from the beginning of stream's event log (or as optimization
 // starts from snapshot if there is one) and reads until we have reached realtime
 // (= no more newer events) state
 func (r *Reader) LoadUntilRealtime(ctx context.Context) error {
-	if err := r.loadUntilRealtime(ctx); err != nil {
+	defer syncutil.LockAndUnlock(&r.loadMu)()
+
+	return r.loadUntilRealtimeAlreadyLocked(ctx)
+}
+
+// caller must hold loadMu
+func (r *Reader) loadUntilRealtimeAlreadyLocked(ctx context.Context) error {
+	err := r.loadUntilRealtime(ctx)
+
+	// even failed load could have made progress
+	r.publishProcessed()
+
+	if err != nil {
 		return fmt.Errorf("LoadUntilRealtime: %w", err)
 	}
 
@@ -142,70 +206,152 @@ func (r *Reader) loadUntilRealtime(ctx context.Context) error {
 			return err
 		}
 
-		// each record is an event batch (could be transaction)
-		// TODO: make it opt-in to increase transaction batch size to all readResult.Entries
-		for _, record := range readResult.Entries {
-			events, err := func() ([]ehevent.Event, error) {
-				deserializer, found := r.deserializers[record.Data.Kind]
-				if !found {
-					// not an error, but we've to proceed so we can commit going past this ignored entry
-					return []ehevent.Event{}, nil
-				}
-
-				return deserializer(ctx, &record, r.client)
-			}()
+		// each record is an event batch (could be transaction). by default each record is
+		// processed in its own ProcessEvents(), but see SetBatching()
+		for remaining := readResult.Entries; len(remaining) > 0; {
+			processedCount, err := r.processBatch(ctx, remaining)
 			if err != nil {
 				return err
 			}
 
-			versionToCommit := record.Cursor
-
-			if err := r.processor.ProcessEvents(ctx, func(
-				versionInDb eh.Cursor,
-				handleEvent func(ehevent.Event) error,
-				commit func(eh.Cursor) error,
-			) error {
-				// sanity check that DB is at version we need it to be at
-				if !r.processorVersion.Equal(versionInDb) {
-					return fmt.Errorf(
-						"in-DB version (%s) out-of-sync with our perspective processorVersion (%s)",
-						versionInDb.Serialize(),
-						r.processorVersion.Serialize())
-				}
+			remaining = remaining[processedCount:]
+		}
 
-				for _, event := range events {
-					if errHandle := handleEvent(event); errHandle != nil {
-						return fmt.Errorf("handleEvent: %v", errHandle)
-					}
-				}
+		if !readResult.More {
+			r.logl.Debug.Printf("reached realtime: %s", r.processorVersion.Serialize())
 
-				return commit(versionToCommit)
-			}); err != nil {
-				return err
-			}
+			r.snapshotIfDue(ctx, true)
 
-			// commit succeeded -> we know processor is at this version
-			r.processorVersion = &versionToCommit
+			return nil
 		}
 
-		if !readResult.More {
-			r.logl.Debug.Printf("reached realtime: %s", r.processorVersion.Serialize())
+		r.snapshotIfDue(ctx, false)
+	}
+}
+
+// processes (with one ProcessEvents() call) as many of *entries* as batching allows.
+// returns count of entries processed (and committed).
+func (r *Reader) processBatch(ctx context.Context, entries []eh.LogEntry) (int, error) {
+	var versionToCommit *eh.Cursor
+	processedCount := 0
+	var errEntry error // stops the batch (entries before it are still committed)
+	eventCount := 0
+
+	if err := r.processor.ProcessEvents(ctx, func(
+		versionInDb eh.Cursor,
+		handleEvent func(ehevent.Event) error,
+		commit func(eh.Cursor) error,
+	) error {
+		// sanity check that DB is at version we need it to be at
+		if !r.processorVersion.Equal(versionInDb) {
+			return fmt.Errorf(
+				"in-DB version (%s) out-of-sync with our perspective processorVersion (%s)",
+				versionInDb.Serialize(),
+				r.processorVersion.Serialize())
+		}
+
+		started := time.Now()
+
+		for idx := range entries {
+			if processedCount > 0 && r.batching.full(processedCount, time.Since(started)) {
+				break
+			}
+
+			events, err := r.entryEvents(ctx, &entries[idx])
+			if err != nil {
+				errEntry = err
+				break
+			}
 
-			// store newer snapshot if we:
-			// - didn't have a stored snapshot
-			// - know the latest snapshot is older than what EventsProcessor now knows
-			if r.snapshotCapable && (r.snapshotVersion == nil || r.snapshotVersion.Before(*r.processorVersion)) {
-				snapshotVersion, err := r.uploadNewerSnapshot(ctx)
-				if err != nil {
-					r.logl.Error.Printf("uploadNewerSnapshot: %v", err)
-				} else {
-					r.snapshotVersion = snapshotVersion
+			for _, event := range events {
+				if errHandle := handleEvent(event); errHandle != nil {
+					return fmt.Errorf("handleEvent: %v", errHandle)
 				}
 			}
 
+			versionToCommit = &entries[idx].Cursor
+			processedCount++
+			eventCount += len(events)
+		}
+
+		if versionToCommit == nil { // first entry failed => nothing to commit
 			return nil
 		}
+
+		return commit(*versionToCommit)
+	}); err != nil {
+		return 0, err
+	}
+
+	if versionToCommit != nil {
+		// commit succeeded -> we know processor is at this version
+		r.processorVersion = versionToCommit
+		r.countSnapshotEvents(eventCount)
+	}
+
+	return processedCount, errEntry
+}
+
+func (r *Reader) entryEvents(ctx context.Context, entry *eh.LogEntry) ([]ehevent.Event, error) {
+	events, err := deserializeEntry(ctx, entry, r.deserializers, r.client)
+	if err != nil {
+		return nil, err
 	}
+
+	return r.withoutIgnoredEvents(entry.Cursor, events)
+}
+
+// counts (and in strict mode, reports) events that deserializers flagged as ignored
+func (r *Reader) withoutIgnoredEvents(entry eh.Cursor, events []ehevent.Event) ([]ehevent.Event, error) {
+	return withoutIgnoredEvents(entry, events, r.ignoredMetrics, r.onIgnoredEvent)
+}
+
+// entries of kinds that the processor has no deserializer for have no events for it. they still
+// have to be committed, so we can go past them.
+func deserializeEntry(
+	ctx context.Context,
+	entry *eh.LogEntry,
+	deserializers map[eh.LogDataKind]LogDataDeserializerFn,
+	client *SystemClient,
+) ([]ehevent.Event, error) {
+	deserializer, found := deserializers[entry.Data.Kind]
+	if !found {
+		return []ehevent.Event{}, nil
+	}
+
+	return deserializer(ctx, entry, client)
+}
+
+func withoutIgnoredEvents(
+	entry eh.Cursor,
+	events []ehevent.Event,
+	metrics map[IgnoredEventReason]prometheus.Counter,
+	onIgnoredEvent IgnoredEventHandler,
+) ([]ehevent.Event, error) {
+	understood := make([]ehevent.Event, 0, len(events))
+
+	for _, event := range events {
+		ignored, is := event.(*ignoredEvent)
+		if !is {
+			understood = append(understood, event)
+			continue
+		}
+
+		metrics[ignored.reason].Inc()
+
+		if onIgnoredEvent != nil {
+			if err := onIgnoredEvent(IgnoredEvent{
+				Entry:  entry,
+				Type:   ignored.eventType,
+				Reason: ignored.reason,
+				Err:    ignored.err,
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return understood, nil
 }
 
 func (r *Reader) discoverProcessorVersion(ctx context.Context) error {
@@ -265,8 +411,8 @@ func (r *Reader) fetchAndInstallSnapshot(ctx context.Context) (*eh.ReadResult, e
 	}
 
 	// convert to app-level snapshot by decrypting
-	snap, err := output.Snapshot.DecryptIfRequired(func() ([]byte, error) {
-		return r.client.LoadDEKv0(ctx, stream)
+	snap, err := output.Snapshot.DecryptIfRequired(func(dekVersion uint64) ([]byte, error) {
+		return r.client.LoadDEK(ctx, stream, dekVersion)
 	})
 	if err != nil {
 		return nil, err
@@ -277,52 +423,43 @@ func (r *Reader) fetchAndInstallSnapshot(ctx context.Context) (*eh.ReadResult, e
 	}
 
 	r.processorVersion = &snap.Cursor
+
+	r.snapshotMu.Lock()
 	r.snapshotVersion = &snap.Cursor
+	r.snapshotMu.Unlock()
 
 	return output.EagerRead, nil
 }
 
-func (r *Reader) uploadNewerSnapshot(ctx context.Context) (*eh.Cursor, error) {
-	snap, err := r.processor.Snapshot()
-	if err != nil {
-		return nil, err
-	}
-
+func (r *Reader) uploadSnapshot(ctx context.Context, snap *eh.Snapshot) error {
 	persisted, err := func() (*eh.PersistedSnapshot, error) {
 		if r.snapshotEncrypt {
-			dek, err := r.client.LoadDEKv0(ctx, snap.Cursor.Stream())
+			dek, dekVersion, err := r.client.LoadNewestDEK(ctx, snap.Cursor.Stream())
 			if err != nil {
 				return nil, err
 			}
 
-			return snap.Encrypted(dek)
+			return snap.Encrypted(dek, dekVersion)
 		} else {
-			return snap.Unencrypted(), nil
+			return snap.Compressed()
 		}
 	}()
 	if err != nil {
-		return nil, err
-	}
-
-	// TODO: store this async?
-	if err := r.client.SnapshotStore.WriteSnapshot(ctx, *persisted); err != nil {
-		return nil, err
+		return err
 	}
 
-	return &snap.Cursor, nil
+	return r.client.SnapshotStore.WriteSnapshot(ctx, *persisted)
 }
 
 // same as LoadUntilRealtime(), but only loads if not done so recently.
-// safe for concurrent access.
 func (r *Reader) LoadUntilRealtimeIfStale(
 	ctx context.Context,
 	staleDuration time.Duration,
 ) error {
-	// don't start concurrent ops
-	defer syncutil.LockAndUnlock(&r.lastLoadMu)()
+	defer syncutil.LockAndUnlock(&r.loadMu)()
 
 	if time.Since(r.lastLoad) > staleDuration {
-		if err := r.LoadUntilRealtime(ctx); err != nil {
+		if err := r.loadUntilRealtimeAlreadyLocked(ctx); err != nil {
 			return fmt.Errorf("LoadUntilRealtimeIfStale: %w", err)
 		}
 	}
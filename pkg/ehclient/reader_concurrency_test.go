@@ -0,0 +1,118 @@
+package ehclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/testing/assert"
+)
+
+// most value is gotten from running this with "$ go test -race"
+func TestReaderSynchronizerAndTransactWritesConcurrently(t *testing.T) {
+	client, ctx := newTestingClient(nil)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream := client.CreateStreamT(t, "/chatrooms/offtopic")
+
+	client.AppendT(t, stream, NewChatMessage(0, "Welcome", ehevent.Meta(t0, "joonas")))
+
+	chatRoom := newChatRoomProjection(stream)
+
+	reader := NewReader(chatRoom, client.SystemClient)
+
+	synchronizerDone := make(chan error, 1)
+	go func() {
+		// aggressive polling so loads overlap with writes as much as possible
+		synchronizerDone <- reader.Synchronizer(ctx, nil, time.Millisecond)
+	}()
+
+	const (
+		writers           = 4
+		messagesPerWriter = 10
+	)
+
+	errs := make(chan error, writers*messagesPerWriter*2)
+
+	wg := sync.WaitGroup{}
+
+	for writer := 0; writer < writers; writer++ {
+		wg.Add(1)
+
+		go func(writer int) {
+			defer wg.Done()
+
+			for i := 0; i < messagesPerWriter; i++ {
+				// like a command handler would do
+				errs <- reader.TransactWrite(ctx, func() error {
+					msg := NewChatMessage(
+						len(chatRoom.chatLog),
+						fmt.Sprintf("writer %d msg %d", writer, i),
+						ehevent.Meta(t0, "joonas"))
+
+					return client.AppendAfter(ctx, chatRoom.cur, msg)
+				})
+
+				// like a query handler would do
+				errs <- reader.LoadUntilRealtimeIfStale(ctx, time.Millisecond)
+			}
+		}(writer)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.Ok(t, err)
+	}
+
+	// welcome message is @0
+	assert.Ok(t, reader.WaitUntilProcessed(ctx, stream.At(writers*messagesPerWriter)))
+
+	assert.Ok(t, reader.TransactWrite(ctx, func() error {
+		assert.EqualInt(t, len(chatRoom.chatLog), 1+writers*messagesPerWriter)
+		return nil
+	}))
+
+	cancel()
+
+	assert.Ok(t, <-synchronizerDone)
+}
+
+func TestReaderConcurrentWaitUntilProcessed(t *testing.T) {
+	client, ctx := newTestingClient(nil)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream := client.CreateStreamT(t, "/chatrooms/offtopic")
+
+	reader := NewReader(newChatRoomProjection(stream), client.SystemClient)
+
+	go func() {
+		_ = reader.Synchronizer(ctx, nil, time.Hour)
+	}()
+
+	const waiters = 8
+
+	errs := make(chan error, waiters)
+
+	for i := 0; i < waiters; i++ {
+		go func() {
+			errs <- reader.WaitUntilProcessed(ctx, stream.At(2))
+		}()
+	}
+
+	for i := 0; i < 3; i++ {
+		client.AppendT(t, stream, NewChatMessage(i, "Hello", ehevent.Meta(t0, "joonas")))
+	}
+
+	for i := 0; i < waiters; i++ {
+		assert.Ok(t, <-errs)
+	}
+}
@@ -10,28 +10,23 @@ import (
 	"testing"
 	"time"
 
-	"github.com/function61/eventhorizon/pkg/cryptosvc"
 	"github.com/function61/eventhorizon/pkg/eh"
 	"github.com/function61/eventhorizon/pkg/ehclient/ehclienttest"
 	"github.com/function61/eventhorizon/pkg/ehevent"
-	"github.com/function61/gokit/crypto/envelopeenc"
-	"github.com/function61/gokit/sync/syncutil"
 	"github.com/function61/gokit/testing/assert"
 )
 
 func TestReaderReadIntoProjection(t *testing.T) {
-	client, ctx := newTestingClient()
+	client, ctx := newTestingClient(nil)
 
 	stream := client.CreateStreamT(t, "/chatrooms/offtopic")
 
 	chatRoom := newChatRoomProjection(stream)
 
-	t0 := time.Date(2020, 2, 12, 13, 45, 0, 0, time.UTC)
-
 	client.AppendT(t, stream, NewChatMessage(1, "Testing first message", ehevent.Meta(t0, "joonas")))
 	client.AppendT(t, stream, NewChatMessage(2, "Is anybody listening?", ehevent.Meta(t0.Add(2*time.Minute), "joonas")))
 
-	reader := NewReader(chatRoom, client.SystemClient, nil)
+	reader := NewReader(chatRoom, client.SystemClient)
 
 	// transactionally pumps events from event log into the projection
 	assert.Ok(t, reader.LoadUntilRealtime(ctx))
@@ -51,13 +46,13 @@ func TestReaderReadIntoProjection(t *testing.T) {
 }
 
 func TestTransactWriteFailsEachTry(t *testing.T) {
-	client, _ := newTestingClient()
+	client, _ := newTestingClient(nil)
 
 	stream := client.CreateStreamT(t, "/chatrooms/offtopic")
 
 	client.AppendT(t, stream, NewChatMessage(1, "Testing first message", ehevent.Meta(t0, "joonas")))
 
-	reader := NewReader(newChatRoomProjection(stream), client.SystemClient, nil)
+	reader := NewReader(newChatRoomProjection(stream), client.SystemClient)
 
 	tryNumber := 0
 
@@ -71,7 +66,9 @@ func TestTransactWriteFailsEachTry(t *testing.T) {
 }
 
 func TestTransactWriteSucceedsOnThirdTry(t *testing.T) {
-	client, ctx := newTestingClient()
+	logBuf := &bytes.Buffer{}
+
+	client, ctx := newTestingClient(log.New(logBuf, "", 0))
 
 	stream := client.CreateStreamT(t, "/chatrooms/offtopic")
 
@@ -80,9 +77,7 @@ func TestTransactWriteSucceedsOnThirdTry(t *testing.T) {
 	chatRoom := newChatRoomProjection(stream)
 	chatRoom.includeSequenceNumbers = true
 
-	logBuf := &bytes.Buffer{}
-
-	reader := NewReader(chatRoom, client.SystemClient, log.New(logBuf, "", 0))
+	reader := NewReader(chatRoom, client.SystemClient)
 
 	assert.Ok(t, reader.LoadUntilRealtime(ctx))
 
@@ -103,12 +98,12 @@ func TestTransactWriteSucceedsOnThirdTry(t *testing.T) {
 	}))
 
 	assert.EqualString(t, "\n"+logBuf.String(), `
-[INFO] no initial snapshot for /chatrooms/offtopic
-[DEBUG] reached realtime: /chatrooms/offtopic@0
-[INFO] ErrOptimisticLockingFailed, try 1: conflict: /chatrooms/offtopic afterRequested=1 afterActual=2
-[DEBUG] reached realtime: /chatrooms/offtopic@1
-[INFO] ErrOptimisticLockingFailed, try 2: conflict: /chatrooms/offtopic afterRequested=2 afterActual=3
-[DEBUG] reached realtime: /chatrooms/offtopic@2
+Reader[/chatrooms/offtopic] [INFO] no initial snapshot for /chatrooms/offtopic
+Reader[/chatrooms/offtopic] [DEBUG] reached realtime: /chatrooms/offtopic@1
+Reader[/chatrooms/offtopic] [INFO] ErrOptimisticLockingFailed, try 1: conflict: /chatrooms/offtopic afterRequested=2 afterActual=3
+Reader[/chatrooms/offtopic] [DEBUG] reached realtime: /chatrooms/offtopic@2
+Reader[/chatrooms/offtopic] [INFO] ErrOptimisticLockingFailed, try 2: conflict: /chatrooms/offtopic afterRequested=3 afterActual=4
+Reader[/chatrooms/offtopic] [DEBUG] reached realtime: /chatrooms/offtopic@3
 `)
 
 	assert.Ok(t, reader.LoadUntilRealtime(ctx))
@@ -152,11 +147,11 @@ func (d *chatRoomProjection) Snapshot() (*eh.Snapshot, error) {
 		return nil, err
 	}
 
-	return eh.NewSnapshot(d.cur, data, d.SnapshotContextAndVersion()), nil
+	return eh.NewSnapshot(d.cur, data, d.Perspective()), nil
 }
 
-func (d *chatRoomProjection) SnapshotContextAndVersion() string {
-	return "chat:v1"
+func (d *chatRoomProjection) Perspective() eh.SnapshotPerspective {
+	return eh.NewV1Perspective("chat")
 }
 
 func (d *chatRoomProjection) ProcessEvents(ctx context.Context, handle EventProcessorHandler) error {
@@ -232,41 +227,22 @@ func (s *SystemClientTesting) CreateStreamT(t *testing.T, streamName string) eh.
 	stream, err := eh.DeserializeStreamName(streamName)
 	assert.Ok(t, err)
 
-	_, err = s.CreateStream(context.Background(), stream, nil)
+	_, err = s.CreateStream(context.Background(), stream, "default", nil)
 	assert.Ok(t, err)
 
 	return stream
 }
 
-func (s *SystemClientTesting) DEKForT(t *testing.T, stream eh.StreamName) []byte {
-	dekEnvelope, err := s.resolveDEKEnvelope(context.Background(), stream)
-	assert.Ok(t, err)
-	dek, err := s.cryptoSvc.DecryptEnvelope(context.Background(), *dekEnvelope)
-	assert.Ok(t, err)
-	return dek
-}
-
-func newTestingClient() (*SystemClientTesting, context.Context) {
+func newTestingClient(logger *log.Logger) (*SystemClientTesting, context.Context) {
 	eventLog := ehclienttest.NewEventLog()
 	snapshotStore := ehclienttest.NewSnapshotStore()
 
 	return &SystemClientTesting{
-		SystemClient: &SystemClient{
-			EventLog:      eventLog,
-			SnapshotStore: snapshotStore,
-			resolveDEKEnvelope: func(_ context.Context, stream eh.StreamName) (*envelopeenc.EnvelopeBundle, error) {
-				dekEnvelope := eventLog.ResolveDEKEnvelope(stream)
-				if dekEnvelope == nil {
-					return nil, fmt.Errorf("Failed to resolve DEK envelope for %s", stream.String())
-				}
-
-				return dekEnvelope, nil
-			},
-			cryptoSvc: cryptosvc.New(nil),
-
-			deksCache:         map[string][]byte{},
-			deksCacheStreamMu: syncutil.NewMutexMap(),
-		},
+		SystemClient: NewSystemClient(
+			eventLog,
+			snapshotStore,
+			ehclienttest.NewSystemConnector(eventLog),
+			logger),
 		TestSnapshotStore: snapshotStore,
 	}, context.Background()
 }
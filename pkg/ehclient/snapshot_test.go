@@ -15,7 +15,7 @@ var (
 )
 
 func TestSnapshot(t *testing.T) {
-	client, ctx := newTestingClient()
+	client, ctx := newTestingClient(nil)
 
 	snapshotStats := func() ehclienttest.SnapshotStoreStats {
 		return client.TestSnapshotStore.Stats()
@@ -25,12 +25,13 @@ func TestSnapshot(t *testing.T) {
 
 	chatRoom := newChatRoomProjection(stream)
 
-	dek := client.DEKForT(t, stream)
+	dek, err := client.LoadDEK(ctx, stream, 0)
+	assert.Ok(t, err)
 
-	initialSnap, err := eh.NewSnapshot(stream.At(1), []byte(`[
+	initialSnap, err := eh.NewSnapshot(stream.At(2), []byte(`[
 		"12:00:01 joonas: First msg from snapshot",
 		"12:00:02 joonas: Second msg from snapshot"
-	]`), chatRoom.SnapshotContextAndVersion()).Encrypted(dek)
+	]`), chatRoom.Perspective()).Encrypted(dek, 0)
 	assert.Ok(t, err)
 
 	beforeInitialSnapWrite := snapshotStats()
@@ -43,14 +44,14 @@ func TestSnapshot(t *testing.T) {
 
 	// as a hack we'll put different content on the event log than the snapshot version of
 	// the events, so it's easy for us to distinguish that our logic started looking at log
-	// from 3rd event onwards
+	// from 3rd message onwards (@0 is $stream.Started)
 	client.AppendT(t, stream, NewChatMessage(1, "This message not actually processed 1", ehevent.Meta(t0, "joonas")))
 	client.AppendT(t, stream, NewChatMessage(2, "This message not actually processed 2", ehevent.Meta(t0.Add(2*time.Minute), "joonas")))
 
 	// this message is not contained in the snapshot
 	client.AppendT(t, stream, NewChatMessage(3, "Third msg from log", ehevent.Meta(t0.Add(3*time.Minute), "joonas")))
 
-	reader := NewReader(chatRoom, client.SystemClient, nil)
+	reader := NewReader(chatRoom, client.SystemClient)
 
 	before3rdMsgLoad := snapshotStats()
 
@@ -63,11 +64,14 @@ func TestSnapshot(t *testing.T) {
 12:00:02 joonas: Second msg from snapshot
 13:48:00 joonas: Third msg from log`)
 
-	snapPersisted, err := client.SnapshotStore.ReadSnapshot(ctx, stream, chatRoom.SnapshotContextAndVersion())
+	snapPersisted, err := client.SnapshotStore.ReadSnapshot(ctx, eh.ReadSnapshotInput{
+		Stream:      stream,
+		Perspective: chatRoom.Perspective(),
+	})
 	assert.Ok(t, err)
 
-	snap, err := snapPersisted.DecryptIfRequired(func() ([]byte, error) {
-		return client.DEKForT(t, stream), nil
+	snap, err := snapPersisted.Snapshot.DecryptIfRequired(func(_ uint64) ([]byte, error) {
+		return dek, nil
 	})
 	assert.Ok(t, err)
 
@@ -2,14 +2,18 @@ package ehclient
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/function61/eventhorizon/pkg/eh"
 	"github.com/function61/eventhorizon/pkg/ehserver/ehdynamodb"
 	"github.com/function61/gokit/app/aws/dynamoutils"
@@ -25,19 +29,50 @@ type SnapshotVersion struct {
 	Version  int64
 }
 
+const (
+	// DynamoDB's item size limit is 400 KB, which includes attribute names and the key
+	dynamoSnapshotChunkSize = 350 * 1024
+)
+
+// each version of a snapshot is a separate item. the version is in the sort key so that querying
+// the perspective's items returns them in version order.
 type DynamoSnapshotItem struct {
-	Stream      string `json:"s"` // stream + perspective form the composite key
+	Stream      string `json:"s"` // stream + perspective#version form the composite key
 	Perspective string `json:"c"` // different software can have different perspective for the same stream
-	Version     int64  `json:"v"` // we conditionally put updates into DynamoDB as not to overwrite advanced state
-	RawData     []byte `json:"d"` // actual snapshot data, probably encrypted
+	Version     int64  `json:"v"`
+	RawData     []byte `json:"d"`           // actual snapshot data, probably encrypted. 1st chunk if split
+	Chunks      int    `json:"n,omitempty"` // RawData split into this many chunks (this item included)
+	Digest      string `json:"h,omitempty"` // eh.SnapshotDigest() of the whole RawData. empty in items from before chunking
+}
+
+// 2nd, 3rd, ... chunk of a DynamoSnapshotItem's RawData
+type DynamoSnapshotChunkItem struct {
+	Stream string `json:"s"`
+	Key    string `json:"c"` // see dynamoSnapshotVersion.chunkKey()
+	Data   []byte `json:"d"`
+}
+
+// tables from before snapshot history have items keyed by only the perspective. these are read
+// as any other version, and get deleted by retention.
+func dynamoSnapshotSortKey(perspective eh.SnapshotPerspective, version int64) string {
+	return fmt.Sprintf("%s#%020d", perspective.String(), version)
+}
+
+// parses perspective from both dynamoSnapshotSortKey() and legacy format
+func perspectiveFromDynamoSortKey(sortKey string) eh.SnapshotPerspective {
+	return eh.ParseSnapshotPerspective(strings.Split(sortKey, "#")[0])
 }
 
 type dynamoSnapshotStorage struct {
-	dynamo             *dynamodb.DynamoDB
+	dynamo             dynamodbiface.DynamoDBAPI // interface for testability
 	snapshotsTableName *string
+	retention          eh.SnapshotRetention
 }
 
-func NewDynamoDbSnapshotStore(opts ehdynamodb.DynamoDbOptions) (eh.SnapshotStore, error) {
+func NewDynamoDbSnapshotStore(
+	opts ehdynamodb.DynamoDbOptions,
+	retention eh.SnapshotRetention,
+) (eh.SnapshotStore, error) {
 	sess, err := session.NewSession()
 	if err != nil {
 		return nil, err
@@ -48,13 +83,12 @@ func NewDynamoDbSnapshotStore(opts ehdynamodb.DynamoDbOptions) (eh.SnapshotStore
 		opts.AccessKeySecret,
 		opts.AccessKeyToken)
 
-	dynamo := dynamodb.New(
-		sess,
-		aws.NewConfig().WithCredentials(staticCreds).WithRegion(opts.RegionId))
+	dynamo := dynamodb.New(sess, opts.AwsConfig(staticCreds))
 
 	return &dynamoSnapshotStorage{
 		dynamo:             dynamo,
 		snapshotsTableName: &opts.TableName,
+		retention:          retention,
 	}, nil
 }
 
@@ -62,11 +96,25 @@ func (d *dynamoSnapshotStorage) ReadSnapshot(
 	ctx context.Context,
 	input eh.ReadSnapshotInput,
 ) (*eh.ReadSnapshotOutput, error) {
+	versions, err := d.versions(ctx, input.Stream, input.Perspective)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *dynamoSnapshotVersion
+	for idx := range versions {
+		if input.Accepts(versions[idx].version) {
+			found = &versions[idx]
+			break
+		}
+	}
+
+	if found == nil {
+		return nil, os.ErrNotExist
+	}
+
 	getResponse, err := d.dynamo.GetItemWithContext(ctx, &dynamodb.GetItemInput{
-		Key: dynamoutils.Record{
-			"s": dynamoutils.String(input.Stream.String()),
-			"c": dynamoutils.String(input.Perspective.String()),
-		},
+		Key:       d.key(input.Stream, found.sortKey),
 		TableName: d.snapshotsTableName,
 	})
 	if err != nil {
@@ -74,7 +122,7 @@ func (d *dynamoSnapshotStorage) ReadSnapshot(
 	}
 
 	// genius, for items that don't exist the only way to know is to check that there are
-	// no attributes.........
+	// no attributes......... (the version could've been deleted after we listed it)
 	if len(getResponse.Item) == 0 {
 		return nil, os.ErrNotExist
 	}
@@ -89,43 +137,93 @@ func (d *dynamoSnapshotStorage) ReadSnapshot(
 		return nil, err
 	}
 
+	rawData, err := d.reassemble(ctx, streamName, found.sortKey, dynamoSnapshot)
+	if err != nil {
+		return nil, err
+	}
+
 	return &eh.ReadSnapshotOutput{
 		Snapshot: &eh.PersistedSnapshot{
 			Cursor:      streamName.At(dynamoSnapshot.Version),
-			RawData:     dynamoSnapshot.RawData,
-			Perspective: eh.ParseSnapshotPerspective(dynamoSnapshot.Perspective),
+			RawData:     rawData,
+			Perspective: perspectiveFromDynamoSortKey(dynamoSnapshot.Perspective),
 		},
 	}, nil
 }
 
 func (d *dynamoSnapshotStorage) WriteSnapshot(ctx context.Context, snap eh.PersistedSnapshot) error {
+	versions, err := d.versions(ctx, snap.Cursor.Stream(), snap.Perspective)
+	if err != nil {
+		return err
+	}
+
+	if len(versions) > 0 && versions[0].version >= snap.Cursor.Version() {
+		return nil // not an error per se, since there was a newer version in DynamoDB
+	}
+
+	chunks := eh.SnapshotChunks(snap.RawData, dynamoSnapshotChunkSize)
+
+	written := dynamoSnapshotVersion{
+		sortKey: dynamoSnapshotSortKey(snap.Perspective, snap.Cursor.Version()),
+		version: snap.Cursor.Version(),
+		chunks:  len(chunks),
+		digest:  eh.SnapshotDigest(snap.RawData),
+	}
+
+	// chunks first, so that once the head item is visible the whole snapshot is readable
+	for idx, chunk := range chunks[1:] {
+		chunkItem, err := dynamoutils.Marshal(DynamoSnapshotChunkItem{
+			Stream: snap.Cursor.Stream().String(),
+			Key:    written.chunkKey(idx + 1),
+			Data:   chunk,
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, err := d.dynamo.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName: d.snapshotsTableName,
+			Item:      chunkItem,
+		}); err != nil {
+			return err
+		}
+	}
+
 	dynamoSnapshot, err := dynamoutils.Marshal(DynamoSnapshotItem{
 		Stream:      snap.Cursor.Stream().String(),
-		Perspective: snap.Perspective.String(),
+		Perspective: written.sortKey,
 		Version:     snap.Cursor.Version(),
-		RawData:     snap.RawData,
+		RawData:     chunks[0],
+		Chunks:      len(chunks),
+		Digest:      written.digest,
 	})
 	if err != nil {
 		return err
 	}
 
-	_, err = d.dynamo.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+	if _, err := d.dynamo.PutItemWithContext(ctx, &dynamodb.PutItemInput{
 		TableName:           d.snapshotsTableName,
 		Item:                dynamoSnapshot,
-		ConditionExpression: aws.String("attribute_not_exists(v) OR v < :versionToPut"),
-		ExpressionAttributeValues: dynamoutils.Record{
-			":versionToPut": dynamoutils.Number(int(snap.Cursor.Version())),
-		},
-	})
-	if err != nil {
+		ConditionExpression: aws.String("attribute_not_exists(s)"), // concurrent writer of same version
+	}); err != nil {
 		if err, ok := err.(awserr.Error); ok && err.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
-			return nil // not an error per se, since there was a newer version in DynamoDB
+			// the other writer's head item refers to its own chunks (they're keyed by digest)
+			return d.deleteKeys(ctx, snap.Cursor.Stream(), written.chunkKeys())
 		} else {
 			return err
 		}
 	}
 
-	return nil
+	// the version we just wrote counts towards retention
+	versionNumbers := []int64{snap.Cursor.Version()}
+	for _, version := range versions {
+		versionNumbers = append(versionNumbers, version.version)
+	}
+
+	// expired ones are the oldest, so they're all in versions[]
+	expired := versions[len(versions)-len(d.retention.Expired(versionNumbers)):]
+
+	return d.deleteVersions(ctx, snap.Cursor.Stream(), expired)
 }
 
 func (d *dynamoSnapshotStorage) DeleteSnapshot(
@@ -133,18 +231,183 @@ func (d *dynamoSnapshotStorage) DeleteSnapshot(
 	stream eh.StreamName,
 	perspective eh.SnapshotPerspective,
 ) error {
-	_, err := d.dynamo.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
-		TableName:           d.snapshotsTableName,
-		ConditionExpression: aws.String("attribute_exists(s)"), // without this we don't get error if item does not exist
-		Key: dynamoutils.Record{
-			"s": dynamoutils.String(stream.String()),
-			"c": dynamoutils.String(perspective.String()),
-		},
-	})
+	versions, err := d.versions(ctx, stream, perspective)
 	if err != nil {
-		if err, ok := err.(awserr.Error); ok && err.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
-			return os.ErrNotExist
-		} else {
+		return err
+	}
+
+	if len(versions) == 0 {
+		return os.ErrNotExist
+	}
+
+	return d.deleteVersions(ctx, stream, versions)
+}
+
+func (d *dynamoSnapshotStorage) ListSnapshots(
+	ctx context.Context,
+	stream eh.StreamName,
+	perspective eh.SnapshotPerspective,
+) ([]eh.Cursor, error) {
+	versions, err := d.versions(ctx, stream, perspective)
+	if err != nil {
+		return nil, err
+	}
+
+	cursors := []eh.Cursor{}
+	for _, version := range versions {
+		cursors = append(cursors, stream.At(version.version))
+	}
+
+	return cursors, nil
+}
+
+func (d *dynamoSnapshotStorage) RollbackSnapshot(
+	ctx context.Context,
+	to eh.Cursor,
+	perspective eh.SnapshotPerspective,
+) error {
+	versions, err := d.versions(ctx, to.Stream(), perspective)
+	if err != nil {
+		return err
+	}
+
+	for idx, version := range versions {
+		if version.version == to.Version() {
+			return d.deleteVersions(ctx, to.Stream(), versions[:idx])
+		}
+	}
+
+	return os.ErrNotExist
+}
+
+type dynamoSnapshotVersion struct {
+	sortKey string
+	version int64
+	chunks  int
+	digest  string
+}
+
+// keyed by digest so that concurrent writers of the same version don't mix their chunks
+func (d dynamoSnapshotVersion) chunkKey(idx int) string {
+	return fmt.Sprintf("%s#%s#%04d", d.sortKey, d.digest[:16], idx)
+}
+
+// excludes the 1st chunk, which is in the version's item
+func (d dynamoSnapshotVersion) chunkKeys() []string {
+	keys := []string{}
+	for idx := 1; idx < d.chunks; idx++ {
+		keys = append(keys, d.chunkKey(idx))
+	}
+
+	return keys
+}
+
+// the 2nd, 3rd, ... chunks of the item's RawData are in separate items
+func (d *dynamoSnapshotStorage) reassemble(
+	ctx context.Context,
+	stream eh.StreamName,
+	sortKey string,
+	item DynamoSnapshotItem,
+) ([]byte, error) {
+	if item.Digest == "" { // from before chunking
+		return item.RawData, nil
+	}
+
+	version := dynamoSnapshotVersion{sortKey, item.Version, item.Chunks, item.Digest}
+
+	chunks := [][]byte{item.RawData}
+
+	for _, key := range version.chunkKeys() {
+		getResponse, err := d.dynamo.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			Key:       d.key(stream, key),
+			TableName: d.snapshotsTableName,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		chunk := DynamoSnapshotChunkItem{}
+		if err := dynamoutils.Unmarshal(getResponse.Item, &chunk); err != nil {
+			return nil, err
+		}
+
+		chunks = append(chunks, chunk.Data)
+	}
+
+	return eh.ReassembleSnapshotChunks(chunks, item.Digest)
+}
+
+// newest first
+func (d *dynamoSnapshotStorage) versions(
+	ctx context.Context,
+	stream eh.StreamName,
+	perspective eh.SnapshotPerspective,
+) ([]dynamoSnapshotVersion, error) {
+	versions := []dynamoSnapshotVersion{}
+	var errParse error
+
+	// the prefix matches also other perspectives, e.g. "myapp:v1" matches "myapp:v10"
+	if err := d.dynamo.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              d.snapshotsTableName,
+		KeyConditionExpression: aws.String("s = :s AND begins_with(c, :c)"),
+		ExpressionAttributeValues: dynamoutils.Record{
+			":s": dynamoutils.String(stream.String()),
+			":c": dynamoutils.String(perspective.String()),
+		},
+		ProjectionExpression: aws.String("c,v,n,h"), // don't bother fetching data
+	}, func(page *dynamodb.QueryOutput, _ bool) bool {
+		for _, item := range page.Items {
+			sortKey := *item["c"].S
+			if sortKey != perspective.String() && !strings.HasPrefix(sortKey, perspective.String()+"#") {
+				continue
+			}
+
+			if item["v"] == nil { // chunk item
+				continue
+			}
+
+			head := DynamoSnapshotItem{}
+			if err := dynamoutils.Unmarshal(item, &head); err != nil {
+				errParse = err
+				return false
+			}
+
+			versions = append(versions, dynamoSnapshotVersion{sortKey, head.Version, head.Chunks, head.Digest})
+		}
+
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	if errParse != nil {
+		return nil, errParse
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].version > versions[j].version })
+
+	return versions, nil
+}
+
+func (d *dynamoSnapshotStorage) deleteVersions(
+	ctx context.Context,
+	stream eh.StreamName,
+	versions []dynamoSnapshotVersion,
+) error {
+	keys := []string{}
+	for _, version := range versions {
+		// version's item before its chunks, so readers never see a version with missing chunks
+		keys = append(append(keys, version.sortKey), version.chunkKeys()...)
+	}
+
+	return d.deleteKeys(ctx, stream, keys)
+}
+
+func (d *dynamoSnapshotStorage) deleteKeys(ctx context.Context, stream eh.StreamName, sortKeys []string) error {
+	for _, sortKey := range sortKeys {
+		if _, err := d.dynamo.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			TableName: d.snapshotsTableName,
+			Key:       d.key(stream, sortKey),
+		}); err != nil {
 			return err
 		}
 	}
@@ -152,6 +415,13 @@ func (d *dynamoSnapshotStorage) DeleteSnapshot(
 	return nil
 }
 
+func (d *dynamoSnapshotStorage) key(stream eh.StreamName, sortKey string) dynamoutils.Record {
+	return dynamoutils.Record{
+		"s": dynamoutils.String(stream.String()),
+		"c": dynamoutils.String(sortKey),
+	}
+}
+
 // mainly useful for debugging
 func (d *dynamoSnapshotStorage) ListSnapshotsForStream(ctx context.Context, stream eh.StreamName) ([]SnapshotVersion, error) {
 	contextNames, err := d.dynamo.QueryWithContext(ctx, &dynamodb.QueryInput{
@@ -169,6 +439,10 @@ func (d *dynamoSnapshotStorage) ListSnapshotsForStream(ctx context.Context, stre
 	names := []SnapshotVersion{}
 
 	for _, item := range contextNames.Items {
+		if item["v"] == nil { // chunk item
+			continue
+		}
+
 		ver, err := strconv.ParseInt(*item["v"].N, 10, 64) // DynamoDB network APIs send numbers as string
 		if err != nil {
 			return nil, err
@@ -177,7 +451,7 @@ func (d *dynamoSnapshotStorage) ListSnapshotsForStream(ctx context.Context, stre
 		names = append(names, SnapshotVersion{
 			Snapshot: SnapshotReference{
 				Stream:      stream,
-				Perspective: eh.ParseSnapshotPerspective(*item["c"].S),
+				Perspective: perspectiveFromDynamoSortKey(*item["c"].S),
 			},
 			Version: ver,
 		})
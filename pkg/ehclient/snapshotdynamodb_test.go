@@ -0,0 +1,228 @@
+package ehclient
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestDynamoSnapshotChunks(t *testing.T) {
+	ctx := context.Background()
+
+	chatRooms := eh.RootName.Child("chatrooms")
+	perspective := eh.NewV1Perspective("chat")
+
+	table := newFakeDynamoTable()
+
+	store := &dynamoSnapshotStorage{
+		dynamo:             table,
+		snapshotsTableName: aws.String("snapshots"),
+		retention:          eh.SnapshotRetention{KeepVersions: 1},
+	}
+
+	// 3 chunks, and every chunk differs from the others
+	snapshotAt := func(version int64) eh.PersistedSnapshot {
+		rawData := make([]byte, 2*dynamoSnapshotChunkSize+100)
+		for i := range rawData {
+			rawData[i] = byte((int64(i) + version) % 251)
+		}
+
+		return eh.PersistedSnapshot{
+			Cursor:      chatRooms.At(version),
+			RawData:     rawData,
+			Perspective: perspective,
+		}
+	}
+
+	read := func() (*eh.PersistedSnapshot, error) {
+		output, err := store.ReadSnapshot(ctx, eh.ReadSnapshotInput{
+			Stream:      chatRooms,
+			Perspective: perspective,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return output.Snapshot, nil
+	}
+
+	assert.Ok(t, store.WriteSnapshot(ctx, snapshotAt(1)))
+
+	// head item + 2 chunk items
+	assert.EqualString(t, table.sortKeys(), "chat:v1#00000000000000000001, chat:v1#00000000000000000001#9b29b94b41522031#0001, chat:v1#00000000000000000001#9b29b94b41522031#0002")
+
+	snap, err := read()
+	assert.Ok(t, err)
+	assert.EqualString(t, snap.Cursor.Serialize(), "/chatrooms@1")
+	assert.Assert(t, bytes.Equal(snap.RawData, snapshotAt(1).RawData))
+
+	versions, err := store.ListSnapshots(ctx, chatRooms, perspective)
+	assert.Ok(t, err)
+	assert.EqualInt(t, len(versions), 1) // chunk items are not versions
+
+	// retention deletes also the chunks of the expired version
+	assert.Ok(t, store.WriteSnapshot(ctx, snapshotAt(2)))
+
+	assert.EqualString(t, table.sortKeys(), "chat:v1#00000000000000000002, chat:v1#00000000000000000002#4acbd444b4deb99b#0001, chat:v1#00000000000000000002#4acbd444b4deb99b#0002")
+
+	snap, err = read()
+	assert.Ok(t, err)
+	assert.EqualString(t, snap.Cursor.Serialize(), "/chatrooms@2")
+	assert.Assert(t, bytes.Equal(snap.RawData, snapshotAt(2).RawData))
+
+	// missing chunk is detected
+	table.delete(chatRooms.String(), "chat:v1#00000000000000000002#4acbd444b4deb99b#0001")
+
+	_, err = read()
+	assert.Assert(t, strings.HasPrefix(err.Error(), "ReassembleSnapshotChunks: digest mismatch (3 chunks)"))
+
+	assert.Ok(t, store.DeleteSnapshot(ctx, chatRooms, perspective))
+
+	assert.EqualString(t, table.sortKeys(), "")
+}
+
+// in-memory DynamoDB table for the operations (and expressions) that dynamoSnapshotStorage uses.
+// items are keyed by "s" (partition key) and "c" (sort key).
+type fakeDynamoTable struct {
+	dynamodbiface.DynamoDBAPI // not implemented methods panic
+	items                     map[string]map[string]*dynamodb.AttributeValue
+	itemsMu                   sync.Mutex
+}
+
+func newFakeDynamoTable() *fakeDynamoTable {
+	return &fakeDynamoTable{
+		items: map[string]map[string]*dynamodb.AttributeValue{},
+	}
+}
+
+func (f *fakeDynamoTable) GetItemWithContext(
+	_ aws.Context,
+	input *dynamodb.GetItemInput,
+	_ ...request.Option,
+) (*dynamodb.GetItemOutput, error) {
+	f.itemsMu.Lock()
+	defer f.itemsMu.Unlock()
+
+	return &dynamodb.GetItemOutput{Item: f.items[fakeDynamoKey(input.Key)]}, nil
+}
+
+func (f *fakeDynamoTable) PutItemWithContext(
+	_ aws.Context,
+	input *dynamodb.PutItemInput,
+	_ ...request.Option,
+) (*dynamodb.PutItemOutput, error) {
+	f.itemsMu.Lock()
+	defer f.itemsMu.Unlock()
+
+	key := fakeDynamoKey(input.Item)
+
+	if input.ConditionExpression != nil {
+		if *input.ConditionExpression != "attribute_not_exists(s)" {
+			panic("unsupported condition: " + *input.ConditionExpression)
+		}
+
+		if _, exists := f.items[key]; exists {
+			return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "item exists", nil)
+		}
+	}
+
+	f.items[key] = input.Item
+
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoTable) DeleteItemWithContext(
+	_ aws.Context,
+	input *dynamodb.DeleteItemInput,
+	_ ...request.Option,
+) (*dynamodb.DeleteItemOutput, error) {
+	f.itemsMu.Lock()
+	defer f.itemsMu.Unlock()
+
+	delete(f.items, fakeDynamoKey(input.Key))
+
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// one page
+func (f *fakeDynamoTable) QueryPagesWithContext(
+	ctx aws.Context,
+	input *dynamodb.QueryInput,
+	fn func(*dynamodb.QueryOutput, bool) bool,
+	opts ...request.Option,
+) error {
+	output, err := f.QueryWithContext(ctx, input, opts...)
+	if err != nil {
+		return err
+	}
+
+	fn(output, true)
+
+	return nil
+}
+
+func (f *fakeDynamoTable) QueryWithContext(
+	_ aws.Context,
+	input *dynamodb.QueryInput,
+	_ ...request.Option,
+) (*dynamodb.QueryOutput, error) {
+	f.itemsMu.Lock()
+	defer f.itemsMu.Unlock()
+
+	sortKeyPrefix := ""
+	switch *input.KeyConditionExpression {
+	case "s = :s":
+	case "s = :s AND begins_with(c, :c)":
+		sortKeyPrefix = *input.ExpressionAttributeValues[":c"].S
+	default:
+		panic("unsupported key condition: " + *input.KeyConditionExpression)
+	}
+
+	items := []map[string]*dynamodb.AttributeValue{}
+	for _, item := range f.items {
+		if *item["s"].S == *input.ExpressionAttributeValues[":s"].S && strings.HasPrefix(*item["c"].S, sortKeyPrefix) {
+			items = append(items, item)
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool { return *items[i]["c"].S < *items[j]["c"].S })
+
+	return &dynamodb.QueryOutput{Items: items}, nil
+}
+
+func (f *fakeDynamoTable) delete(partitionKey string, sortKey string) {
+	f.itemsMu.Lock()
+	defer f.itemsMu.Unlock()
+
+	delete(f.items, partitionKey+"\x00"+sortKey)
+}
+
+// sort keys of all items, sorted
+func (f *fakeDynamoTable) sortKeys() string {
+	f.itemsMu.Lock()
+	defer f.itemsMu.Unlock()
+
+	sortKeys := []string{}
+	for _, item := range f.items {
+		sortKeys = append(sortKeys, *item["c"].S)
+	}
+
+	sort.Strings(sortKeys)
+
+	return strings.Join(sortKeys, ", ")
+}
+
+func fakeDynamoKey(item map[string]*dynamodb.AttributeValue) string {
+	return *item["s"].S + "\x00" + *item["c"].S
+}
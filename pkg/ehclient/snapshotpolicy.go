@@ -0,0 +1,187 @@
+package ehclient
+
+// When Reader uploads snapshots of its processor's state, and whether the uploads block loading.
+
+import (
+	"context"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/gokit/sync/syncutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	backgroundSnapshotUploadTimeout = 1 * time.Minute
+)
+
+// Reader checks the policy after each read page of the stream (and when it reaches realtime). a
+// snapshot is uploaded only if the processor has advanced past the newest snapshot.
+// zero value: upload when reaching realtime, synchronously (= the load returns after it's stored).
+type SnapshotPolicy struct {
+	EveryEvents int           // upload after this many events since the last snapshot. 0 = disabled
+	Every       time.Duration // upload if the last snapshot is older than this. 0 = disabled
+	MaxSize     int           // bytes (before encryption). bigger snapshots are not uploaded. 0 = no limit
+	Background  bool          // don't block loading. for long-running processes, see WaitSnapshotUploads()
+}
+
+func (p SnapshotPolicy) due(snapshotEvents int, snapshotAge time.Duration, realtime bool) bool {
+	if p.EveryEvents == 0 && p.Every == 0 {
+		return realtime
+	}
+
+	return (p.EveryEvents > 0 && snapshotEvents >= p.EveryEvents) || (p.Every > 0 && snapshotAge >= p.Every)
+}
+
+// call this before loading
+func (r *Reader) SetSnapshotPolicy(policy SnapshotPolicy) {
+	r.snapshotPolicy = policy
+}
+
+// blocks until background snapshot uploads (if any) are done. call this before your process exits.
+func (r *Reader) WaitSnapshotUploads() {
+	r.snapshotUploads.Wait()
+}
+
+// caller must hold loadMu
+func (r *Reader) snapshotIfDue(ctx context.Context, realtime bool) {
+	if !r.snapshotCapable {
+		return
+	}
+
+	checkpoint := r.startSnapshotUpload(realtime)
+	if checkpoint == nil {
+		return
+	}
+
+	// taking the snapshot can't be done in the background, because the processor's state must not
+	// change while it's being serialized
+	snap, err := r.processor.Snapshot()
+	if err != nil {
+		r.logl.Error.Printf("Snapshot: %v", err)
+		r.snapshotUploadDone(nil, nil)
+		return
+	}
+
+	if r.snapshotPolicy.MaxSize > 0 && len(snap.Data) > r.snapshotPolicy.MaxSize {
+		r.logl.Error.Printf(
+			"not uploading snapshot %s: size %d exceeds %d",
+			snap.Cursor.Serialize(),
+			len(snap.Data),
+			r.snapshotPolicy.MaxSize)
+		// retrying on the next check wouldn't make it any smaller
+		r.snapshotUploadDone(nil, checkpoint)
+		return
+	}
+
+	upload := func(ctx context.Context) {
+		if err := r.uploadSnapshot(ctx, snap); err != nil {
+			r.logl.Error.Printf("uploadSnapshot: %v", err)
+			r.snapshotUploadDone(nil, nil) // counters not reset => retried on the next check
+			return
+		}
+
+		r.snapshotUploadDone(snap, checkpoint)
+	}
+
+	if !r.snapshotPolicy.Background {
+		upload(ctx)
+		return
+	}
+
+	r.snapshotUploads.Add(1)
+
+	go func() {
+		defer r.snapshotUploads.Done()
+
+		// not using the load's ctx, as it's usually canceled when the load returns
+		ctx, cancel := context.WithTimeout(context.Background(), backgroundSnapshotUploadTimeout)
+		defer cancel()
+
+		upload(ctx)
+	}()
+}
+
+// policy's counters at the time a snapshot was taken
+type snapshotCheckpoint struct {
+	events int // processed since the previous snapshot
+	taken  time.Time
+}
+
+// background upload resets the count, so it's not protected by loadMu
+func (r *Reader) countSnapshotEvents(events int) {
+	defer syncutil.LockAndUnlock(&r.snapshotMu)()
+
+	r.snapshotEvents += events
+}
+
+// returns nil if upload is not due, the newest snapshot is already current or an upload is in
+// progress (in which case a later check will retry). caller must hold loadMu.
+func (r *Reader) startSnapshotUpload(realtime bool) *snapshotCheckpoint {
+	defer syncutil.LockAndUnlock(&r.snapshotMu)()
+
+	if !r.snapshotPolicy.due(r.snapshotEvents, time.Since(r.snapshotTaken), realtime) {
+		return nil
+	}
+
+	if r.snapshotInFlight || !(r.snapshotVersion == nil || r.snapshotVersion.Before(*r.processorVersion)) {
+		return nil
+	}
+
+	r.snapshotInFlight = true
+
+	return &snapshotCheckpoint{
+		events: r.snapshotEvents,
+		taken:  time.Now(),
+	}
+}
+
+// *uploaded* is nil if upload failed or was skipped. non-nil *checkpoint* resets the policy's
+// counters (events processed while a background upload was in progress stay counted).
+func (r *Reader) snapshotUploadDone(uploaded *eh.Snapshot, checkpoint *snapshotCheckpoint) {
+	defer syncutil.LockAndUnlock(&r.snapshotMu)()
+
+	r.snapshotInFlight = false
+
+	if checkpoint != nil {
+		r.snapshotEvents -= checkpoint.events
+		r.snapshotTaken = checkpoint.taken
+	}
+
+	if uploaded != nil {
+		r.snapshotVersion = &uploaded.Cursor
+
+		metrics := snapshotMetricsFor(uploaded.Cursor.Stream(), uploaded.Perspective)
+		metrics.timestamp.SetToCurrentTime()
+		metrics.size.Set(float64(len(uploaded.Data)))
+	}
+}
+
+type snapshotMetrics struct {
+	timestamp prometheus.Gauge
+	size      prometheus.Gauge
+}
+
+var (
+	snapshotTimestampMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eventhorizon_reader_snapshot_timestamp_seconds",
+		Help: "When the newest snapshot was uploaded (age = time() - this)",
+	}, []string{"stream", "perspective"})
+	snapshotSizeMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eventhorizon_reader_snapshot_size_bytes",
+		Help: "Size of the newest uploaded snapshot (before encryption)",
+	}, []string{"stream", "perspective"})
+)
+
+// stream + perspective identify the processor (two Readers of the same processor type can't
+// be told apart by the type)
+func snapshotMetricsFor(stream eh.StreamName, perspective eh.SnapshotPerspective) snapshotMetrics {
+	return snapshotMetrics{
+		timestamp: snapshotTimestampMetric.WithLabelValues(stream.String(), perspective.String()),
+		size:      snapshotSizeMetric.WithLabelValues(stream.String(), perspective.String()),
+	}
+}
+
+func init() {
+	prometheus.MustRegister(snapshotTimestampMetric, snapshotSizeMetric)
+}
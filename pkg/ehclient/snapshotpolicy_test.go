@@ -0,0 +1,174 @@
+package ehclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient/ehclienttest"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/testing/assert"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSnapshotPolicyDue(t *testing.T) {
+	always := SnapshotPolicy{}
+	assert.Assert(t, !always.due(100, time.Hour, false))
+	assert.Assert(t, always.due(0, 0, true))
+
+	everyTwo := SnapshotPolicy{EveryEvents: 2}
+	assert.Assert(t, !everyTwo.due(1, time.Hour, true))
+	assert.Assert(t, everyTwo.due(2, 0, false))
+
+	hourly := SnapshotPolicy{Every: time.Hour}
+	assert.Assert(t, !hourly.due(100, time.Minute, true))
+	assert.Assert(t, hourly.due(0, time.Hour, false))
+}
+
+func TestSnapshotPolicyEveryEvents(t *testing.T) {
+	ctx := context.Background()
+
+	snapshotStore := ehclienttest.NewSnapshotStore()
+	client, stream := newSnapshotPolicyTestClient(t, snapshotStore)
+
+	projection := &snapshottingProjection{messagesProjection{cur: stream.Beginning()}}
+
+	reader := NewReader(projection, client)
+	reader.SetSnapshotPolicy(SnapshotPolicy{EveryEvents: 2})
+
+	assert.Ok(t, client.Append(ctx, stream, NewChatMessage(1, "Hello", ehevent.Meta(t0, "joonas"))))
+	assert.Ok(t, reader.LoadUntilRealtime(ctx))
+	assert.EqualInt(t, snapshotStore.Stats().WriteOps, 0)
+
+	assert.Ok(t, client.Append(ctx, stream, NewChatMessage(2, "World", ehevent.Meta(t0, "joonas"))))
+	assert.Ok(t, reader.LoadUntilRealtime(ctx))
+	assert.EqualInt(t, snapshotStore.Stats().WriteOps, 1)
+
+	metrics := snapshotMetricsFor(stream, projection.Perspective())
+	assert.Assert(t, testutil.ToFloat64(metrics.size) == float64(len(`["Hello","World"]`)))
+	assert.Assert(t, testutil.ToFloat64(metrics.timestamp) > 0)
+
+	// too big to upload
+	reader.SetSnapshotPolicy(SnapshotPolicy{EveryEvents: 1, MaxSize: 10})
+
+	assert.Ok(t, client.Append(ctx, stream, NewChatMessage(3, "Bye", ehevent.Meta(t0, "joonas"))))
+	assert.Ok(t, reader.LoadUntilRealtime(ctx))
+	assert.EqualInt(t, snapshotStore.Stats().WriteOps, 1)
+}
+
+func TestSnapshotPolicyBackground(t *testing.T) {
+	ctx := context.Background()
+
+	snapshotStore := &blockingSnapshotStore{ehclienttest.NewSnapshotStore(), make(chan struct{})}
+	client, stream := newSnapshotPolicyTestClient(t, snapshotStore)
+
+	projection := &snapshottingProjection{messagesProjection{cur: stream.Beginning()}}
+
+	reader := NewReader(projection, client)
+	reader.SetSnapshotPolicy(SnapshotPolicy{Background: true})
+
+	assert.Ok(t, client.Append(ctx, stream, NewChatMessage(1, "Hello", ehevent.Meta(t0, "joonas"))))
+
+	// returns even though upload is blocked
+	assert.Ok(t, reader.LoadUntilRealtime(ctx))
+
+	// upload in progress => new one is not started
+	assert.Ok(t, client.Append(ctx, stream, NewChatMessage(2, "World", ehevent.Meta(t0, "joonas"))))
+	assert.Ok(t, reader.LoadUntilRealtime(ctx))
+
+	close(snapshotStore.unblock)
+	reader.WaitSnapshotUploads()
+
+	assert.EqualInt(t, snapshotStore.Stats().WriteOps, 1)
+
+	snap, err := snapshotStore.ReadSnapshot(ctx, eh.ReadSnapshotInput{
+		Stream:      stream,
+		Perspective: projection.Perspective(),
+	})
+	assert.Ok(t, err)
+	assert.EqualString(t, snap.Snapshot.Cursor.Serialize(), "/chatrooms/offtopic@1")
+}
+
+func TestSnapshotPolicyRetriesFailedUpload(t *testing.T) {
+	ctx := context.Background()
+
+	snapshotStore := &failingSnapshotStore{ehclienttest.NewSnapshotStore(), 1}
+	client, stream := newSnapshotPolicyTestClient(t, snapshotStore)
+
+	projection := &snapshottingProjection{messagesProjection{cur: stream.Beginning()}}
+
+	reader := NewReader(projection, client)
+	reader.SetSnapshotPolicy(SnapshotPolicy{EveryEvents: 2})
+
+	assert.Ok(t, client.Append(ctx, stream, NewChatMessage(1, "Hello", ehevent.Meta(t0, "joonas"))))
+	assert.Ok(t, client.Append(ctx, stream, NewChatMessage(2, "World", ehevent.Meta(t0, "joonas"))))
+	assert.Ok(t, reader.LoadUntilRealtime(ctx))
+	assert.EqualInt(t, snapshotStore.Stats().WriteOps, 0)
+
+	// events before the failed upload still count towards the next one
+	assert.Ok(t, client.Append(ctx, stream, NewChatMessage(3, "Bye", ehevent.Meta(t0, "joonas"))))
+	assert.Ok(t, reader.LoadUntilRealtime(ctx))
+	assert.EqualInt(t, snapshotStore.Stats().WriteOps, 1)
+
+	// counters were reset by the successful upload
+	assert.Ok(t, client.Append(ctx, stream, NewChatMessage(4, "Again", ehevent.Meta(t0, "joonas"))))
+	assert.Ok(t, reader.LoadUntilRealtime(ctx))
+	assert.EqualInt(t, snapshotStore.Stats().WriteOps, 1)
+}
+
+func newSnapshotPolicyTestClient(t *testing.T, snapshotStore eh.SnapshotStore) (*SystemClient, eh.StreamName) {
+	eventLog := ehclienttest.NewEventLog()
+	client := NewSystemClient(eventLog, snapshotStore, ehclienttest.NewSystemConnector(eventLog), nil)
+
+	stream := eh.RootName.Child("chatrooms").Child("offtopic")
+
+	_, err := client.CreateStream(context.Background(), stream, "default", nil)
+	assert.Ok(t, err)
+
+	return client, stream
+}
+
+type snapshottingProjection struct {
+	messagesProjection
+}
+
+func (s *snapshottingProjection) Snapshot() (*eh.Snapshot, error) {
+	data, err := json.Marshal(s.messages)
+	if err != nil {
+		return nil, err
+	}
+
+	return eh.NewSnapshot(s.cur, data, s.Perspective()), nil
+}
+
+func (s *snapshottingProjection) Perspective() eh.SnapshotPerspective {
+	return eh.NewV1Perspective("test.messages")
+}
+
+type blockingSnapshotStore struct {
+	*ehclienttest.SnapshotStore
+	unblock chan struct{}
+}
+
+func (b *blockingSnapshotStore) WriteSnapshot(ctx context.Context, snap eh.PersistedSnapshot) error {
+	<-b.unblock
+
+	return b.SnapshotStore.WriteSnapshot(ctx, snap)
+}
+
+type failingSnapshotStore struct {
+	*ehclienttest.SnapshotStore
+	failures int // for this many writes
+}
+
+func (f *failingSnapshotStore) WriteSnapshot(ctx context.Context, snap eh.PersistedSnapshot) error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("store unavailable")
+	}
+
+	return f.SnapshotStore.WriteSnapshot(ctx, snap)
+}
@@ -0,0 +1,117 @@
+package ehclient
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/gokit/sync/syncutil"
+)
+
+// keeps the processor in sync with its stream until ctx is canceled. loads new data when:
+//   - "activity" tells that the stream has new data (nil if you don't have realtime notifications,
+//     see ehrealtime package). it's fine to send activity of other streams - they're ignored.
+//   - "pollInterval" has passed since last check (fallback for missed or non-existing notifications)
+//   - someone is waiting in WaitUntilProcessed()
+//
+// before returning, waits for background snapshot uploads (see SnapshotPolicy) to finish.
+func (r *Reader) Synchronizer(
+	ctx context.Context,
+	activity <-chan eh.Cursor,
+	pollInterval time.Duration,
+) error {
+	load := func() {
+		defer syncutil.LockAndUnlock(&r.loadMu)()
+
+		// logging inside the lock, because the first load re-binds logl
+		if err := r.loadUntilRealtimeAlreadyLocked(ctx); err != nil && ctx.Err() == nil {
+			r.logl.Error.Printf("Synchronizer: %v", err)
+		}
+	}
+
+	load() // initial load also discovers which stream we're following
+
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.WaitSnapshotUploads()
+			return nil
+		case cursor := <-activity:
+			if r.needsLoadFor(cursor) {
+				load()
+			}
+		case <-poll.C:
+			load()
+		case <-r.nudge:
+			load()
+		}
+	}
+}
+
+// blocks until the processor has processed "cursor" (or something newer), so request
+// handlers can read their own writes. Synchronizer needs to be running.
+// don't call this from inside TransactWrite() (it would deadlock).
+func (r *Reader) WaitUntilProcessed(ctx context.Context, cursor eh.Cursor) error {
+	for {
+		processed, processedChanged := r.processedState()
+
+		if processed != nil {
+			if !processed.Stream().Equal(cursor.Stream()) {
+				return fmt.Errorf(
+					"WaitUntilProcessed: reader is for %s, not %s",
+					processed.Stream().String(),
+					cursor.Stream().String())
+			}
+
+			if !processed.Before(cursor) {
+				return nil
+			}
+		}
+
+		// don't wait for next poll
+		select {
+		case r.nudge <- struct{}{}:
+		default: // synchronizer already has a pending nudge
+		}
+
+		select {
+		case <-processedChanged:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// activity for a stream we're not following, or which we already have processed, is ignored
+func (r *Reader) needsLoadFor(cursor eh.Cursor) bool {
+	processed, _ := r.processedState()
+
+	return processed == nil || (processed.Stream().Equal(cursor.Stream()) && processed.Before(cursor))
+}
+
+func (r *Reader) processedState() (*eh.Cursor, <-chan struct{}) {
+	defer syncutil.LockAndUnlock(&r.processedMu)()
+
+	return r.processed, r.processedChanged
+}
+
+// makes processorVersion visible to other goroutines and wakes up WaitUntilProcessed() callers.
+// caller must hold loadMu
+func (r *Reader) publishProcessed() {
+	if r.processorVersion == nil {
+		return
+	}
+
+	processed := *r.processorVersion
+
+	defer syncutil.LockAndUnlock(&r.processedMu)()
+
+	r.processed = &processed
+
+	close(r.processedChanged)
+	r.processedChanged = make(chan struct{})
+}
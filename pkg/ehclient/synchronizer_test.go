@@ -0,0 +1,61 @@
+package ehclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestSynchronizer(t *testing.T) {
+	client, ctx := newTestingClient(nil)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream := client.CreateStreamT(t, "/chatrooms/offtopic")
+
+	chatRoom := newChatRoomProjection(stream)
+
+	reader := NewReader(chatRoom, client.SystemClient)
+
+	activity := make(chan eh.Cursor, 1)
+
+	synchronizerDone := make(chan error, 1)
+	go func() {
+		// poll interval so long that it's not the mechanism we're testing here
+		synchronizerDone <- reader.Synchronizer(ctx, activity, time.Hour)
+	}()
+
+	// @0 is $stream.Started
+	client.AppendT(t, stream, NewChatMessage(1, "Testing first message", ehevent.Meta(t0, "joonas")))
+
+	// no activity notification, but waiting nudges the synchronizer
+	assert.Ok(t, reader.WaitUntilProcessed(ctx, stream.At(1)))
+
+	assert.EqualString(t, chatRoom.PrintChatLog(), `
+13:45:00 joonas: Testing first message`)
+
+	client.AppendT(t, stream, NewChatMessage(2, "Is anybody listening?", ehevent.Meta(t0, "joonas")))
+
+	activity <- eh.RootName.Child("unrelated").At(3) // should be ignored
+	activity <- stream.At(2)
+
+	assert.Ok(t, reader.WaitUntilProcessed(ctx, stream.At(2)))
+
+	assert.EqualString(t, chatRoom.PrintChatLog(), `
+13:45:00 joonas: Testing first message
+13:45:00 joonas: Is anybody listening?`)
+
+	assert.EqualString(
+		t,
+		reader.WaitUntilProcessed(ctx, eh.RootName.Child("unrelated").At(3)).Error(),
+		"WaitUntilProcessed: reader is for /chatrooms/offtopic, not /unrelated")
+
+	cancel()
+
+	assert.Ok(t, <-synchronizerDone)
+}
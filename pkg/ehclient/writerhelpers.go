@@ -4,8 +4,11 @@ package ehclient
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"time"
 
 	"github.com/function61/eventhorizon/pkg/eh"
 	"github.com/function61/eventhorizon/pkg/ehevent"
@@ -15,16 +18,32 @@ import (
 )
 
 func (e *SystemClient) Append(ctx context.Context, stream eh.StreamName, events ...ehevent.Event) error {
-	return e.AppendStrings(ctx, stream, ehevent.Serialize(events...))
+	data, err := e.encryptEvents(ctx, stream, events)
+	if err != nil {
+		return err
+	}
+
+	_, err = e.EventLog.Append(ctx, stream, *data)
+	return err
 }
 
+// events in line format, regardless of stream's encoding
 func (e *SystemClient) AppendStrings(ctx context.Context, stream eh.StreamName, eventsSerialized []string) error {
-	dek, err := e.LoadDEKv0(ctx, stream)
+	dek, dekVersion, err := e.LoadNewestDEK(ctx, stream)
 	if err != nil {
 		return err
 	}
 
-	eventsEncrypted, err := eheventencryption.Encrypt(ehevent.SerializeLines(eventsSerialized), dek)
+	compression, err := e.LoadCompression(ctx, stream)
+	if err != nil {
+		return err
+	}
+
+	eventsEncrypted, err := eheventencryption.EncryptWithCompression(
+		ehevent.SerializeLines(eventsSerialized),
+		dek,
+		dekVersion,
+		*compression)
 	if err != nil {
 		return err
 	}
@@ -37,49 +56,206 @@ func (e *SystemClient) AppendStrings(ctx context.Context, stream eh.StreamName,
 }
 
 func (e *SystemClient) AppendAfter(ctx context.Context, after eh.Cursor, events ...ehevent.Event) error {
-	dek, err := e.LoadDEKv0(ctx, after.Stream())
+	data, err := e.encryptEvents(ctx, after.Stream(), events)
 	if err != nil {
 		return err
 	}
 
-	eventsSerialized := ehevent.Serialize(events...)
-	eventsEncrypted, err := eheventencryption.Encrypt(ehevent.SerializeLines(eventsSerialized), dek)
+	_, err = e.EventLog.AppendAfter(ctx, after, *data)
+	return err
+}
+
+// one stream's events for AppendMany()
+type AppendAfterEvents struct {
+	After  eh.Cursor
+	Events []ehevent.Event
+}
+
+// appends to multiple streams atomically (e.g. an aggregate and its index stream), so that
+// either all streams get their events or none do
+func (e *SystemClient) AppendMany(ctx context.Context, appends ...AppendAfterEvents) error {
+	items := []eh.AppendAfterItem{}
+
+	for _, streamEvents := range appends {
+		data, err := e.encryptEvents(ctx, streamEvents.After.Stream(), streamEvents.Events)
+		if err != nil {
+			return err
+		}
+
+		items = append(items, eh.AppendAfterItem{
+			After: streamEvents.After,
+			Data:  *data,
+		})
+	}
+
+	_, err := e.EventLog.AppendMany(ctx, items)
+	return err
+}
+
+func (e *SystemClient) encryptEvents(ctx context.Context, stream eh.StreamName, events []ehevent.Event) (*eh.LogData, error) {
+	dek, dekVersion, err := e.LoadNewestDEK(ctx, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	encoding, err := e.sysConn.EventEncoding(ctx, stream)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = e.EventLog.AppendAfter(ctx, after, eh.LogData{
+	eventsSerialized, err := ehevent.SerializeBatch(encoding, events...)
+	if err != nil {
+		return nil, err
+	}
+
+	compression, err := e.LoadCompression(ctx, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	eventsEncrypted, err := eheventencryption.EncryptWithCompression(eventsSerialized, dek, dekVersion, *compression)
+	if err != nil {
+		return nil, err
+	}
+
+	return &eh.LogData{
 		Kind: eh.LogDataKindEncryptedData,
 		Raw:  eventsEncrypted,
-	})
-	return err
+	}, nil
 }
 
+// keyGroupId decides which KEKs control access to the stream. "" means cluster's default for the stream.
+//
 // TODO: maybe make *eh.LogData be returned from a cb, because for encrypted LogData it
 //       depends on the generated DEK
 func (e *SystemClient) CreateStream(
 	ctx context.Context,
 	stream eh.StreamName,
+	keyGroupId string,
 	data *eh.LogData,
 ) (*eh.AppendResult, error) {
+	if keyGroupId == "" {
+		var err error
+		keyGroupId, err = e.sysConn.DefaultKeyGroupID(ctx, stream)
+		if err != nil {
+			return nil, fmt.Errorf("DefaultKeyGroupID: %w", err)
+		}
+	}
+
 	// each stream needs a DEK (whether it will be used or not). we can't let the DB server
 	// generate it b/c then the server could theoretically have access to the data. and we
 	// prefer the crypto service generate the whole envelope, so not even application
 	// servers have theoretically default un-audited access to the data.
-	dekEnvelope, err := e.sysConn.DEKv0EnvelopeForNewStream(ctx, stream)
+	dekEnvelope, err := e.sysConn.DEKv0EnvelopeForNewStream(ctx, stream, keyGroupId)
 	if err != nil {
 		return nil, fmt.Errorf("DEKv0EnvelopeForNewStream: %w", err)
 	}
 
-	return e.EventLog.CreateStream(ctx, stream, *dekEnvelope, data)
+	return e.EventLog.CreateStream(ctx, stream, *dekEnvelope, keyGroupId, data)
+}
+
+// closes the stream (unless already closed) and destroys its DEKs, so the stream's encrypted
+// data becomes unreadable. also deletes ehstreammeta's snapshot which contains the DEK envelopes.
+// snapshots of other perspectives are left alone, but if they were encrypted they're unreadable.
+func (e *SystemClient) ShredStream(ctx context.Context, stream eh.StreamName, reason string) (*eh.AppendResult, error) {
+	if _, err := e.EventLog.CloseStream(ctx, stream, reason); err != nil {
+		if _, alreadyClosed := err.(*eh.ErrStreamClosed); !alreadyClosed {
+			return nil, fmt.Errorf("ShredStream: %w", err)
+		}
+	}
+
+	// before shredding, because after it the stream has no DEKs
+	newestDEKVersion, err := e.sysConn.NewestDEKVersion(ctx, stream)
+	if err != nil {
+		return nil, fmt.Errorf("ShredStream: %w", err)
+	}
+
+	result, err := e.EventLog.ShredStream(ctx, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.SnapshotStore.DeleteSnapshot(ctx, stream, eh.StreamMetaPerspective); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("ShredStream: DeleteSnapshot: %w", err)
+	}
+
+	e.forgetDEKs(stream, newestDEKVersion)
+	e.forgetCompressionDictionaries(stream)
+
+	return result, nil
+}
+
+// generates a new DEK for the stream. new data will be encrypted with it, while older data
+// stays decryptable with the previous DEKs. returns the new DEK version.
+//
+// NOTE: writers who have the stream's metadata cached keep using the previous DEK for a few seconds.
+func (e *SystemClient) RotateDEK(ctx context.Context, stream eh.StreamName) (uint64, error) {
+	// the rotation is appended with optimistic locking, so concurrent appends (including another
+	// rotation to the same version) make us retry on top of them
+	for i := 0; i < 3; i++ {
+		version, err := e.rotateDEK(ctx, stream)
+		if err != nil {
+			if _, isAboutConcurrency := err.(*eh.ErrOptimisticLockingFailed); isAboutConcurrency {
+				continue
+			} else {
+				return 0, fmt.Errorf("RotateDEK: %w", err)
+			}
+		}
+
+		return version, nil
+	}
+
+	return 0, fmt.Errorf("RotateDEK: retry times exceeded, stream=%s", stream)
+}
+
+func (e *SystemClient) rotateDEK(ctx context.Context, stream eh.StreamName) (uint64, error) {
+	// same reasoning as in CreateStream() for why we don't let the server do this
+	dekEnvelope, version, after, err := e.sysConn.DEKEnvelopeForRotation(ctx, stream)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := e.EventLog.AppendAfter(ctx, *after, *eh.LogDataMeta(eh.NewStreamDEKRotated(
+		version,
+		*dekEnvelope,
+		ehevent.MetaSystemUser(time.Now()),
+	))); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// removes stream's DEKs from our cache
+func (e *SystemClient) forgetDEKs(stream eh.StreamName, newestDEKVersion uint64) {
+	defer syncutil.LockAndUnlock(&e.deksCacheMu)()
+
+	for version := uint64(0); version <= newestDEKVersion; version++ {
+		delete(e.deksCache, stream.DEKResourceName(int(version)).String())
+	}
+}
+
+// loads the DEK new data should be encrypted with. 2nd return is its version.
+func (e *SystemClient) LoadNewestDEK(ctx context.Context, stream eh.StreamName) ([]byte, uint64, error) {
+	dekVersion, err := e.sysConn.NewestDEKVersion(ctx, stream)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	dek, err := e.LoadDEK(ctx, stream, dekVersion)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return dek, dekVersion, nil
 }
 
-// loads DEK (Data Encryption Key) for a given stream (by loading DEK envelope and decrypting it)
-// v0 in name to emphasize the fact that key rotation is not yet implemented.
-func (e *SystemClient) LoadDEKv0(ctx context.Context, stream eh.StreamName) ([]byte, error) {
-	// now that we're holding stream-specific mutex, we can without races read from DEK cache
+// loads DEK (Data Encryption Key) for a given stream (by loading DEK envelope and decrypting it).
+// when decrypting, the version is found from the ciphertext (see eheventencryption.DEKVersion())
+func (e *SystemClient) LoadDEK(ctx context.Context, stream eh.StreamName, dekVersion uint64) ([]byte, error) {
+	// now that we're holding DEK-specific mutex, we can without races read from DEK cache
 	// to determine if we have it cached or not, and fetch it to cache if needed (all inside a lock)
-	key := stream.String()
+	key := stream.DEKResourceName(int(dekVersion)).String()
 	defer e.deksCacheStreamMu.Lock(key)()
 
 	dek := func() []byte {
@@ -92,7 +268,7 @@ func (e *SystemClient) LoadDEKv0(ctx context.Context, stream eh.StreamName) ([]b
 
 	if dek == nil {
 		var err error
-		dek, err = e.loadAndDecryptDEKEnvelope(ctx, stream)
+		dek, err = e.loadAndDecryptDEKEnvelope(ctx, stream, dekVersion)
 		if err != nil {
 			return nil, err
 		}
@@ -109,9 +285,9 @@ func (s *SystemClient) Logger(prefix string) *log.Logger {
 	return logex.Prefix(prefix, s.logger)
 }
 
-// result of this will be cached, and this won't be called for same stream concurrently
-func (e *SystemClient) loadAndDecryptDEKEnvelope(ctx context.Context, stream eh.StreamName) ([]byte, error) {
+// result of this will be cached, and this won't be called for same DEK concurrently
+func (e *SystemClient) loadAndDecryptDEKEnvelope(ctx context.Context, stream eh.StreamName, dekVersion uint64) ([]byte, error) {
 	// e.logl.Debug.Printf("resolving DEK for %s", stream.String())
 
-	return e.sysConn.ResolveDEK(ctx, stream)
+	return e.sysConn.ResolveDEK(ctx, stream, dekVersion)
 }
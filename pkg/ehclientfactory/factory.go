@@ -8,15 +8,17 @@ import (
 	"fmt"
 	"log"
 	"net/url"
+	"os"
 	"sync"
 
 	"github.com/function61/eventhorizon/pkg/eh"
 	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/eheventencryption"
 	"github.com/function61/eventhorizon/pkg/keyserver"
 	"github.com/function61/eventhorizon/pkg/system/ehsettings"
 	"github.com/function61/eventhorizon/pkg/system/ehsettingsdomain"
 	"github.com/function61/eventhorizon/pkg/system/ehstreammeta"
-	"github.com/function61/gokit/crypto/cryptoutil"
 	"github.com/function61/gokit/crypto/envelopeenc"
 	"github.com/function61/gokit/log/logex"
 	"github.com/function61/gokit/os/osutil"
@@ -53,8 +55,12 @@ type sysConnection struct {
 	logger       *log.Logger
 }
 
-func (d *sysConnection) ResolveDEK(ctx context.Context, stream eh.StreamName) ([]byte, error) {
-	dekEnvelope, err := d.resolveDEKEnvelope(ctx, stream)
+func (d *sysConnection) ResolveDEK(
+	ctx context.Context,
+	stream eh.StreamName,
+	dekVersion uint64,
+) ([]byte, error) {
+	dekEnvelope, err := d.resolveDEKEnvelope(ctx, stream, dekVersion)
 	if err != nil {
 		return nil, err
 	}
@@ -67,83 +73,229 @@ func (d *sysConnection) ResolveDEK(ctx context.Context, stream eh.StreamName) ([
 	return keyServer.UnsealEnvelope(ctx, *dekEnvelope)
 }
 
+func (d *sysConnection) NewestDEKVersion(ctx context.Context, stream eh.StreamName) (uint64, error) {
+	streamMeta, err := d.loadStreamMeta(ctx, stream)
+	if err != nil {
+		return 0, err
+	}
+
+	return streamMeta.State.NewestDEKVersion(), nil
+}
+
+func (d *sysConnection) DefaultKeyGroupID(ctx context.Context, stream eh.StreamName) (string, error) {
+	settings, err := d.getSettings(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return settings.KeyGroupIDForStream(stream), nil
+}
+
+func (d *sysConnection) KeyGroupID(ctx context.Context, stream eh.StreamName) (string, error) {
+	streamMeta, err := d.loadStreamMeta(ctx, stream)
+	if err != nil {
+		return "", err
+	}
+
+	return streamMeta.State.KeyGroupID(), nil
+}
+
+func (d *sysConnection) EventEncoding(ctx context.Context, stream eh.StreamName) (ehevent.Encoding, error) {
+	settings, err := d.getSettings(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return settings.EventEncodingForStream(stream), nil
+}
+
+func (d *sysConnection) Compression(
+	ctx context.Context,
+	stream eh.StreamName,
+) (eheventencryption.CompressionMethod, uint32, error) {
+	streamMeta, err := d.loadStreamMeta(ctx, stream)
+	if err != nil {
+		return eheventencryption.CompressionMethodNone, 0, err
+	}
+
+	method, dictionaryID := streamMeta.State.Compression()
+
+	return method, dictionaryID, nil
+}
+
+func (d *sysConnection) CompressionDictionaryEncrypted(
+	ctx context.Context,
+	stream eh.StreamName,
+	dictionaryID uint32,
+) ([]byte, error) {
+	streamMeta, err := d.loadStreamMeta(ctx, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	dictionary := streamMeta.State.CompressionDictionary(dictionaryID)
+	if dictionary == nil {
+		return nil, fmt.Errorf("no compression dictionary %d for %s: %w", dictionaryID, stream.String(), os.ErrNotExist)
+	}
+
+	return dictionary, nil
+}
+
 // we're creating a new stream and it needs an encryption key (DEK).
 // generate DEK and put it in an envelope.
-// we'll need to use a KeyGroup to known which KEKs should be the envelope recipients
+// KeyGroup tells which KEKs should be the envelope recipients
 // (KEKs control access to the stream's data via controlling access to the DEK).
 func (d *sysConnection) DEKv0EnvelopeForNewStream(
 	ctx context.Context,
 	stream eh.StreamName,
-) (*envelopeenc.Envelope, error) {
-	parent := stream.Parent()
-	if parent == nil {
+	keyGroupId string,
+) (*envelopeenc.EnvelopeBundle, error) {
+	if stream.Parent() == nil {
 		return nil, errors.New("DekEnvelopeForStream: not supported for root stream")
 	}
 
-	parentEnvelope, err := d.resolveDekEnvelope(ctx, *parent)
+	slotEncrypters, err := d.slotEncryptersForKeyGroup(ctx, keyGroupId)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("DekEnvelopeForStream: %w", err)
 	}
 
-	settings, err := d.getSettings(ctx)
+	dek, err := keyserver.NewDEK()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("DekEnvelopeForStream: %w", err)
 	}
 
-	slotEncrypters := []envelopeenc.SlotEncrypter{}
+	// internally asserts for len(slotEncrypters) > 0
+	return envelopeenc.EncryptDEK(stream.DEKResourceName(0).String(), dek, slotEncrypters...)
+}
 
-	for _, slot := range parentEnvelope.KeySlots {
-		if slot.Kind != envelopeenc.SlotKindRsaOaepSha256 {
-			return nil, fmt.Errorf("DekEnvelopeForStream: parent has unsupported slot kind: %s", slot.Kind)
-		}
+// we're rotating the stream's DEK. new DEK's recipients are the KEKs of the stream's key group.
+// (streams created before key groups were recorded use the same recipients as the newest DEK.)
+func (d *sysConnection) DEKEnvelopeForRotation(
+	ctx context.Context,
+	stream eh.StreamName,
+) (*envelopeenc.EnvelopeBundle, uint64, *eh.Cursor, error) {
+	streamMeta, err := d.loadStreamMeta(ctx, stream)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	// the rotation will be appended with optimistic locking, so don't give a stale version
+	if err := streamMeta.Reader.LoadUntilRealtime(ctx); err != nil {
+		return nil, 0, nil, err
+	}
 
-		kek := settings.Kek(slot.KekId)
-		if kek == nil {
-			return nil, fmt.Errorf("DekEnvelopeForStream: KEK '%s' not found", slot.KekId)
+	newestVersion := streamMeta.State.NewestDEKVersion()
+	after := streamMeta.State.Version()
+
+	slotEncrypters, err := func() ([]envelopeenc.SlotEncrypter, error) {
+		if keyGroupId := streamMeta.State.KeyGroupID(); keyGroupId != "" {
+			return d.slotEncryptersForKeyGroup(ctx, keyGroupId)
 		}
 
-		pubKey, err := cryptoutil.ParsePemPkcs1EncodedRsaPublicKey([]byte(kek.PublicKey))
+		newestEnvelope, err := d.resolveDEKEnvelope(ctx, stream, newestVersion)
 		if err != nil {
-			return nil, fmt.Errorf("DekEnvelopeForStream: public key parsing: %w", err)
+			return nil, err
 		}
 
-		slotEncrypters = append(slotEncrypters, envelopeenc.RsaOaepSha256Encrypter(pubKey))
+		return d.slotEncryptersForSameRecipientsAs(ctx, *newestEnvelope)
+	}()
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("DEKEnvelopeForRotation: %w", err)
 	}
 
 	dek, err := keyserver.NewDEK()
 	if err != nil {
-		return nil, fmt.Errorf("DekEnvelopeForStream: %w", err)
+		return nil, 0, nil, fmt.Errorf("DEKEnvelopeForRotation: %w", err)
 	}
 
-	// internally asserts for len(recipients) > 0
-	return envelopeenc.EncryptDEK(stream.DEKResourceName(0).String(), dek, recipients...)
+	dekVersion := newestVersion + 1
+
+	dekEnvelope, err := envelopeenc.EncryptDEK(stream.DEKResourceName(int(dekVersion)).String(), dek, slotEncrypters...)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("DEKEnvelopeForRotation: %w", err)
+	}
+
+	return dekEnvelope, dekVersion, &after, nil
+}
+
+func (d *sysConnection) slotEncryptersForKeyGroup(
+	ctx context.Context,
+	keyGroupId string,
+) ([]envelopeenc.SlotEncrypter, error) {
+	settings, err := d.getSettings(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keyGroup := settings.KeyGroup(keyGroupId)
+	if keyGroup == nil {
+		return nil, fmt.Errorf("key group '%s' not found", keyGroupId)
+	}
+
+	return settings.SlotEncrypters(keyGroup.KEKs)
+}
+
+// encrypters for KEKs that are recipients of "envelope". retired KEKs don't get access to new DEKs.
+func (d *sysConnection) slotEncryptersForSameRecipientsAs(
+	ctx context.Context,
+	envelope envelopeenc.EnvelopeBundle,
+) ([]envelopeenc.SlotEncrypter, error) {
+	settings, err := d.getSettings(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	kekIds := []string{}
+
+	for _, slot := range envelope.KeySlots {
+		if slot.Kind != envelopeenc.SlotKindRsaOaepSha256 {
+			return nil, fmt.Errorf("unsupported slot kind: %d", slot.Kind)
+		}
+
+		if kek := settings.KEK(slot.KekId); kek != nil && kek.Retired != nil {
+			continue
+		}
+
+		kekIds = append(kekIds, slot.KekId)
+	}
+
+	return settings.SlotEncrypters(kekIds)
 }
 
 func (d *sysConnection) resolveDEKEnvelope(
 	ctx context.Context,
 	stream eh.StreamName,
-) (*envelopeenc.Envelope, error) {
-	// this is cached per-stream
-	streamMeta, err := ehstreammeta.LoadUntilRealtime(
-		ctx,
-		stream,
-		d.sysClient, // shouldn't recurse b/c ehstreammeta only reads unencrypted data
-		ehstreammeta.GlobalCache)
+	dekVersion uint64,
+) (*envelopeenc.EnvelopeBundle, error) {
+	streamMeta, err := d.loadStreamMeta(ctx, stream)
 	if err != nil {
 		return nil, err
 	}
 
-	dekEnvelope := streamMeta.State.Data().DEKv0
+	if streamMeta.State.Shredded() {
+		return nil, eh.NewErrDEKUnavailable(fmt.Errorf("stream shredded: %s", stream.String()))
+	}
+
+	dekEnvelope := streamMeta.State.DEK(dekVersion)
 	if dekEnvelope == nil {
-		return nil, fmt.Errorf("no DEK envelope for %s", stream.String())
+		return nil, eh.NewErrDEKUnavailable(fmt.Errorf("no DEK v%d envelope for %s", dekVersion, stream.String()))
 	}
 
 	return dekEnvelope, nil
 }
 
+func (d *sysConnection) loadStreamMeta(ctx context.Context, stream eh.StreamName) (*ehstreammeta.App, error) {
+	// this is cached per-stream
+	return ehstreammeta.LoadUntilRealtime(
+		ctx,
+		stream,
+		d.sysClient, // shouldn't recurse b/c ehstreammeta only reads unencrypted data
+		ehstreammeta.GlobalCache)
+}
+
 func (d *sysConnection) resolveKeyServer(
 	ctx context.Context,
-	dekEnvelope envelopeenc.Envelope,
+	dekEnvelope envelopeenc.EnvelopeBundle,
 	stream eh.StreamName,
 ) (keyserver.Unsealer, error) {
 	// has special key for bootstrap purposes which we can decrypt without actual key server
@@ -163,13 +315,13 @@ func (d *sysConnection) resolveKeyServer(
 
 	keyServer, err := func() (*ehsettings.KeyServer, error) {
 		for _, slot := range dekEnvelope.KeySlots {
-			keyServer := settings.KeyServerWithKekAttached(slot.KekId)
+			keyServer := settings.KeyServerWithKEKAttached(slot.KekId)
 			if keyServer != nil {
 				return keyServer, nil
 			}
 		}
 
-		return nil, fmt.Errorf("no KeyServer found for %s", stream.String())
+		return nil, eh.NewErrDEKUnavailable(fmt.Errorf("no KeyServer found for %s", stream.String()))
 	}()
 	if err != nil {
 		return nil, err
@@ -4,9 +4,12 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 
 	"github.com/function61/eventhorizon/pkg/eh"
 	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehevent"
 )
 
 func Debug(
@@ -33,8 +36,16 @@ func Debug(
 	for _, entry := range debugStore.entries {
 		printfln("<entry v=%d>", entry.cursor.Version())
 
-		for _, line := range entry.lines {
-			printfln("  %s", line)
+		for _, event := range entry.events {
+			if event.annotation != "" {
+				printfln("  # %s", event.annotation)
+			}
+
+			printfln("  %s", event.raw)
+
+			if tracing := tracingInfo(event.raw); tracing != "" {
+				printfln("  # %s", tracing)
+			}
 		}
 
 		printfln("</entry>")
@@ -42,3 +53,34 @@ func Debug(
 
 	return err
 }
+
+// correlation, causation and headers (if any) of a serialized event, in a more readable form than
+// the serialized metadata (which for binary formats isn't readable at all)
+func tracingInfo(eventSerialized string) string {
+	_, meta, err := ehevent.DeserializeTypeAndMeta(eventSerialized)
+	if err != nil {
+		return ""
+	}
+
+	attrs := []string{}
+
+	if correlationId := meta.CorrelationId(); correlationId != "" {
+		attrs = append(attrs, "correlation="+correlationId)
+	}
+
+	if causationId := meta.CausationId(); causationId != "" {
+		attrs = append(attrs, "causation="+causationId)
+	}
+
+	headerKeys := []string{}
+	for key := range meta.Headers() {
+		headerKeys = append(headerKeys, key)
+	}
+	sort.Strings(headerKeys) // for deterministic output
+
+	for _, key := range headerKeys {
+		attrs = append(attrs, fmt.Sprintf("h.%s=%s", key, meta.Header(key)))
+	}
+
+	return strings.Join(attrs, " ")
+}
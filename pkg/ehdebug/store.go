@@ -6,16 +6,16 @@ package ehdebug
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/function61/eventhorizon/pkg/eh"
 	"github.com/function61/eventhorizon/pkg/ehclient"
 	"github.com/function61/eventhorizon/pkg/ehevent"
-	"github.com/function61/eventhorizon/pkg/eheventencryption"
 )
 
 type entry struct {
 	cursor eh.Cursor
-	lines  []string
+	events []*rawEvent
 }
 
 type store struct {
@@ -30,19 +30,19 @@ func (s *store) GetEventTypes() []ehclient.LogDataKindDeserializer {
 }
 
 func (s *store) ProcessEvents(_ context.Context, processAndCommit ehclient.EventProcessorHandler) error {
-	uncommittedLines := []string{}
+	uncommittedEvents := []*rawEvent{}
 
 	return processAndCommit(
 		s.version,
 		func(ev ehevent.Event) error {
-			uncommittedLines = append(uncommittedLines, ev.(*rawEvent).raw)
+			uncommittedEvents = append(uncommittedEvents, ev.(*rawEvent))
 			return nil
 		},
 		func(version eh.Cursor) error {
 			s.version = version
 			s.entries = append(s.entries, entry{
 				cursor: version,
-				lines:  uncommittedLines,
+				events: uncommittedEvents,
 			})
 			return nil
 		})
@@ -69,12 +69,13 @@ func loadUntilRealtime(
 
 // encapsulates raw serialized payload by faking deserialization as succeeded, but all
 // events map to this raw event whose raw content we can now access
-func newRawEvent(raw string) ehevent.Event {
-	return &rawEvent{raw}
+func newRawEvent(raw string, annotation string) ehevent.Event {
+	return &rawEvent{raw, annotation}
 }
 
 type rawEvent struct {
-	raw string
+	raw        string
+	annotation string // optional
 }
 
 func (e *rawEvent) MetaType() string {
@@ -110,19 +111,19 @@ var mapEventsToRawEvent = []ehclient.LogDataKindDeserializer{
 		Kind:       eh.LogDataKindEncryptedData,
 		Encryption: true,
 		Deserializer: func(ctx context.Context, entry *eh.LogEntry, client *ehclient.SystemClient) ([]ehevent.Event, error) {
-			dek, err := client.LoadDEKv0(ctx, entry.Cursor.Stream())
+			eventsSerialized, err := client.Decrypt(ctx, entry.Cursor.Stream(), entry.Data.Raw)
 			if err != nil {
 				return nil, err
 			}
 
-			eventsSerialized, err := eheventencryption.Decrypt(entry.Data.Raw, dek)
+			eventsSplit, err := ehevent.DeserializeBatch(eventsSerialized)
 			if err != nil {
 				return nil, err
 			}
 
 			rawEvents := []ehevent.Event{}
 
-			for idx, eventSerialized := range ehevent.DeserializeLines(eventsSerialized) {
+			for idx, eventSerialized := range eventsSplit {
 				e := newRawEvent(eventSerialized, func() string {
 					if idx == 0 {
 						return fmt.Sprintf("kind=%d", entry.Data.Kind)
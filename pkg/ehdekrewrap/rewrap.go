@@ -0,0 +1,260 @@
+// Re-wraps streams' DEK envelopes for the current KEKs of their key group, and rotates DEKs
+// that a KEK outside of the key group (e.g. a retired one) has access to.
+//
+// Re-wrapping gives new KEKs access to existing data, but it can't take access away: the log is
+// append-only, so the old envelopes (in $stream.Started or $stream.DEKRotated) stay there and a
+// retired KEK can still unseal the DEKs that were sealed for it. That's why data written before
+// the rotation stays readable with the retired KEK, and only data written after it is safe.
+package ehdekrewrap
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/system/ehsettings"
+	"github.com/function61/eventhorizon/pkg/system/ehstreammeta"
+	"github.com/function61/gokit/crypto/envelopeenc"
+	"github.com/function61/gokit/log/logex"
+)
+
+type Stats struct {
+	Streams   int // streams walked
+	Rewrapped int // DEK envelopes re-wrapped
+	Rotated   int // DEKs rotated because KEKs outside of the key group had access to the newest DEK
+	Skipped   int // DEK envelopes that we can't re-wrap (see logs)
+}
+
+// walks all streams starting from "root" and re-seals DEKs whose envelope recipients differ
+// from the stream's key group's KEKs. DEKs are unsealed via keyservers, so some keyserver
+// still needs to hold a KEK that the envelope is currently sealed for.
+//
+// if the newest DEK was sealed for a KEK that is not in the key group, the DEK is also rotated
+// so that new data is encrypted with a DEK that the KEK never had access to.
+//
+// with dryRun we only report what would be re-wrapped.
+//
+// NOTE: streams are discovered via ehstreammeta, which tracks limited amount of children.
+func Rewrap(
+	ctx context.Context,
+	root eh.StreamName,
+	dryRun bool,
+	client *ehclient.SystemClient,
+	logger *log.Logger,
+) (*Stats, error) {
+	settings, err := ehsettings.LoadUntilRealtime(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &rewrapper{
+		settings: settings.State,
+		dryRun:   dryRun,
+		client:   client,
+		logl:     logex.Levels(logger),
+	}
+
+	return &r.stats, r.walk(ctx, root)
+}
+
+type rewrapper struct {
+	settings *ehsettings.Store
+	dryRun   bool
+	client   *ehclient.SystemClient
+	stats    Stats
+	logl     *logex.Leveled
+}
+
+func (r *rewrapper) walk(ctx context.Context, stream eh.StreamName) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	streamMeta, err := ehstreammeta.LoadUntilRealtime(ctx, stream, r.client, ehstreammeta.GlobalCache)
+	if err != nil {
+		return fmt.Errorf("%s: %w", stream.String(), err)
+	}
+
+	r.stats.Streams++
+
+	if err := r.rewrapStream(ctx, stream, streamMeta.State); err != nil {
+		return fmt.Errorf("%s: %w", stream.String(), err)
+	}
+
+	childStreams, truncated := streamMeta.State.ChildStreams()
+	if truncated {
+		r.logl.Error.Printf("%s: child stream list truncated; not all streams get re-wrapped", stream.String())
+	}
+
+	for _, childStream := range childStreams {
+		if err := r.walk(ctx, childStream); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *rewrapper) rewrapStream(ctx context.Context, stream eh.StreamName, streamMeta *ehstreammeta.Store) error {
+	keyGroupID := streamMeta.KeyGroupID()
+	if keyGroupID == "" { // stream created before key groups were recorded
+		keyGroupID = r.settings.KeyGroupIDForStream(stream)
+	}
+
+	keyGroup := r.settings.KeyGroup(keyGroupID)
+	if keyGroup == nil {
+		return fmt.Errorf("key group '%s' not found", keyGroupID)
+	}
+
+	newestVersion := streamMeta.NewestDEKVersion()
+	rotate := false
+
+	type rewrap struct {
+		version    uint64
+		recipients []string
+	}
+
+	rewraps := []rewrap{}
+
+	for version := uint64(0); version <= newestVersion; version++ {
+		envelope := streamMeta.DEK(version)
+		if envelope == nil { // stream has no DEK
+			continue
+		}
+
+		recipients, sealedOnlyForKEKs := kekIdsOf(*envelope)
+		if !sealedOnlyForKEKs {
+			// e.g. sealed also for cluster-wide key, which we don't have here
+			r.logl.Info.Printf("%s DEK v%d: has non-KEK recipients; skipping", stream.String(), version)
+			r.stats.Skipped++
+			continue
+		}
+
+		if sameKEKs(recipients, keyGroup.KEKs) {
+			continue
+		}
+
+		// re-wrapping doesn't take access away from KEKs that are no longer in the key group
+		if version == newestVersion && !allIn(recipients, keyGroup.KEKs) {
+			rotate = true
+		}
+
+		rewraps = append(rewraps, rewrap{version, recipients})
+	}
+
+	// rotation goes first: once the newest DEK is re-wrapped, its envelope no longer tells that
+	// it needs rotation. if we fail after the rotation, a re-run only has re-wrapping left to do.
+	if rotate {
+		r.logl.Info.Printf("%s DEK v%d: rotating", stream.String(), newestVersion+1)
+
+		if !r.dryRun {
+			// new DEK's recipients are the key group's KEKs
+			if _, err := r.client.RotateDEK(ctx, stream); err != nil {
+				return err
+			}
+		}
+
+		r.stats.Rotated++
+	}
+
+	for _, rewrap := range rewraps {
+		r.logl.Info.Printf(
+			"%s DEK v%d: [%s] -> [%s]",
+			stream.String(),
+			rewrap.version,
+			strings.Join(rewrap.recipients, ", "),
+			strings.Join(keyGroup.KEKs, ", "))
+
+		if !r.dryRun {
+			if err := r.rewrapDEK(ctx, stream, rewrap.version, keyGroup.KEKs); err != nil {
+				return err
+			}
+		}
+
+		r.stats.Rewrapped++
+	}
+
+	return nil
+}
+
+func (r *rewrapper) rewrapDEK(ctx context.Context, stream eh.StreamName, version uint64, kekIds []string) error {
+	dek, err := r.client.LoadDEK(ctx, stream, version)
+	if err != nil {
+		return err
+	}
+
+	slotEncrypters, err := r.settings.SlotEncrypters(kekIds)
+	if err != nil {
+		return err
+	}
+
+	rewrapped, err := envelopeenc.EncryptDEK(stream.DEKResourceName(int(version)).String(), dek, slotEncrypters...)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.EventLog.Append(ctx, stream, *eh.LogDataMeta(eh.NewStreamDEKRewrapped(
+		version,
+		*rewrapped,
+		ehevent.MetaSystemUser(time.Now()),
+	)))
+	return err
+}
+
+// 2nd return is false if some recipient is not a KEK
+func kekIdsOf(envelope envelopeenc.EnvelopeBundle) ([]string, bool) {
+	kekIds := []string{}
+	for _, slot := range envelope.KeySlots {
+		if slot.Kind != envelopeenc.SlotKindRsaOaepSha256 {
+			return nil, false
+		}
+
+		kekIds = append(kekIds, slot.KekId)
+	}
+
+	return kekIds, true
+}
+
+func sameKEKs(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	aSorted := append([]string{}, a...)
+	bSorted := append([]string{}, b...)
+	sort.Strings(aSorted)
+	sort.Strings(bSorted)
+
+	for i := range aSorted {
+		if aSorted[i] != bSorted[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// whether all items of "a" are in "b"
+func allIn(a []string, b []string) bool {
+	for _, item := range a {
+		found := false
+		for _, candidate := range b {
+			if candidate == item {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,191 @@
+package ehdekrewrap
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehclient/ehclienttest"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/system/ehsettingsdomain"
+	"github.com/function61/eventhorizon/pkg/system/ehstreammeta"
+	"github.com/function61/gokit/crypto/cryptoutil"
+	"github.com/function61/gokit/crypto/envelopeenc"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestRewrap(t *testing.T) {
+	ctx := context.Background()
+
+	eventLog := ehclienttest.NewEventLog()
+	sysConn := &failingRotations{ehclienttest.NewSystemConnector(eventLog), 0}
+	client := ehclient.NewSystemClient(
+		eventLog,
+		ehclienttest.NewSnapshotStore(),
+		sysConn,
+		nil)
+
+	keks := []*rsa.PublicKey{newKek(t), newKek(t), newKek(t)}
+	kekA, kekB, kekC := kekId(keks[0]), kekId(keks[1]), kekId(keks[2])
+
+	settingsEvents := []ehevent.Event{}
+	for _, kek := range keks {
+		settingsEvents = append(settingsEvents, ehsettingsdomain.NewKekRegistered(
+			kekId(kek),
+			"rsa",
+			"Test key",
+			string(cryptoutil.MarshalPemPkcs1EncodedRsaPublicKey(kek)),
+			meta()))
+	}
+
+	_, err := client.CreateStream(ctx, eh.SysSettings, "default", nil)
+	assert.Ok(t, err)
+	assert.Ok(t, client.Append(ctx, eh.SysSettings, append(
+		settingsEvents,
+		ehsettingsdomain.NewKeygroupCreated("default", "Default", []string{kekA, kekB}, meta()),
+		// B is compromised, so it's replaced with C
+		ehsettingsdomain.NewKekRetired(kekB, "compromised", meta()),
+		ehsettingsdomain.NewKeygroupKekAdded("default", kekC, meta()),
+	)...))
+
+	// sealed for the retired KEK, so needs re-wrapping and rotation
+	withRetired := createStreamSealedFor(t, eventLog, "withretired", keks[0], keks[1])
+	// sealed only for KEKs still in the group, so re-wrapping is enough to give C access
+	withoutRetired := createStreamSealedFor(t, eventLog, "withoutretired", keks[0])
+
+	stats, err := Rewrap(ctx, withRetired, true, client, nil)
+	assert.Ok(t, err)
+	assert.Assert(t, *stats == Stats{Streams: 1, Rewrapped: 1, Rotated: 1})
+
+	assert.EqualString(t, recipientsOfDEK(t, client, withRetired, 0), joinSorted(kekA, kekB)) // dry run
+
+	stats, err = Rewrap(ctx, withRetired, false, client, nil)
+	assert.Ok(t, err)
+	assert.Assert(t, *stats == Stats{Streams: 1, Rewrapped: 1, Rotated: 1})
+
+	assert.EqualString(t, recipientsOfDEK(t, client, withRetired, 0), joinSorted(kekA, kekC))
+
+	streamMeta := loadStreamMeta(t, client, withRetired)
+	assert.Assert(t, streamMeta.NewestDEKVersion() == 1)
+
+	stats, err = Rewrap(ctx, withoutRetired, false, client, nil)
+	assert.Ok(t, err)
+	assert.Assert(t, *stats == Stats{Streams: 1, Rewrapped: 1})
+
+	assert.EqualString(t, recipientsOfDEK(t, client, withoutRetired, 0), joinSorted(kekA, kekC))
+	assert.Assert(t, loadStreamMeta(t, client, withoutRetired).NewestDEKVersion() == 0)
+
+	// run that fails at rotation
+	rotationFails := createStreamSealedFor(t, eventLog, "rotationfails", keks[0], keks[1])
+
+	sysConn.failures = 1
+
+	_, err = Rewrap(ctx, rotationFails, false, client, nil)
+	assert.EqualString(t, err.Error(), "/t-1/rotationfails: RotateDEK: rotation failed")
+
+	// if the newest DEK was re-wrapped already, the re-run wouldn't know that it needs rotation
+	assert.EqualString(t, recipientsOfDEK(t, client, rotationFails, 0), joinSorted(kekA, kekB))
+
+	stats, err = Rewrap(ctx, rotationFails, false, client, nil)
+	assert.Ok(t, err)
+	assert.Assert(t, *stats == Stats{Streams: 1, Rewrapped: 1, Rotated: 1})
+
+	assert.EqualString(t, recipientsOfDEK(t, client, rotationFails, 0), joinSorted(kekA, kekC))
+	assert.Assert(t, loadStreamMeta(t, client, rotationFails).NewestDEKVersion() == 1)
+}
+
+func TestAllIn(t *testing.T) {
+	assert.Assert(t, allIn([]string{"a", "b"}, []string{"b", "c", "a"}))
+	assert.Assert(t, allIn([]string{}, []string{"a"}))
+	assert.Assert(t, !allIn([]string{"a", "d"}, []string{"a", "b"}))
+}
+
+func TestSameKEKs(t *testing.T) {
+	assert.Assert(t, sameKEKs([]string{"a", "b"}, []string{"b", "a"}))
+	assert.Assert(t, !sameKEKs([]string{"a", "b"}, []string{"a"}))
+	assert.Assert(t, !sameKEKs([]string{"a", "b"}, []string{"a", "c"}))
+}
+
+// fails given number of DEK rotations
+type failingRotations struct {
+	*ehclienttest.SystemConnector
+	failures int
+}
+
+func (f *failingRotations) DEKEnvelopeForRotation(
+	ctx context.Context,
+	stream eh.StreamName,
+) (*envelopeenc.EnvelopeBundle, uint64, *eh.Cursor, error) {
+	if f.failures > 0 {
+		f.failures--
+		return nil, 0, nil, errors.New("rotation failed")
+	}
+
+	return f.SystemConnector.DEKEnvelopeForRotation(ctx, stream)
+}
+
+func createStreamSealedFor(
+	t *testing.T,
+	eventLog *ehclienttest.EventLog,
+	name string,
+	keks ...*rsa.PublicKey,
+) eh.StreamName {
+	stream := eh.RootName.Child("t-1").Child(name)
+
+	slotEncrypters := []envelopeenc.SlotEncrypter{}
+	for _, kek := range keks {
+		slotEncrypters = append(slotEncrypters, envelopeenc.RsaOaepSha256Encrypter(kek))
+	}
+
+	dekEnvelope, err := envelopeenc.EncryptDEK(stream.DEKResourceName(0).String(), []byte("dek"), slotEncrypters...)
+	assert.Ok(t, err)
+
+	_, err = eventLog.CreateStream(context.Background(), stream, *dekEnvelope, "default", nil)
+	assert.Ok(t, err)
+
+	return stream
+}
+
+func recipientsOfDEK(t *testing.T, client *ehclient.SystemClient, stream eh.StreamName, version uint64) string {
+	envelope := loadStreamMeta(t, client, stream).DEK(version)
+
+	kekIds, _ := kekIdsOf(*envelope)
+
+	return joinSorted(kekIds...)
+}
+
+func loadStreamMeta(t *testing.T, client *ehclient.SystemClient, stream eh.StreamName) *ehstreammeta.Store {
+	// new cache so we see the writes we just did
+	streamMeta, err := ehstreammeta.LoadUntilRealtime(context.Background(), stream, client, ehstreammeta.NewCache())
+	assert.Ok(t, err)
+
+	return streamMeta.State
+}
+
+func newKek(t *testing.T) *rsa.PublicKey {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Ok(t, err)
+
+	return &privateKey.PublicKey
+}
+
+func kekId(kek *rsa.PublicKey) string {
+	return envelopeenc.RsaOaepSha256Encrypter(kek).KekId()
+}
+
+func joinSorted(items ...string) string {
+	sorted := append([]string{}, items...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ", ")
+}
+
+func meta() ehevent.EventMeta {
+	return ehevent.MetaSystemUser(time.Date(2020, 9, 1, 10, 0, 0, 0, time.UTC))
+}
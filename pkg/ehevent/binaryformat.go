@@ -0,0 +1,230 @@
+package ehevent
+
+// Compact binary alternative to the line format, for high-volume streams (sensor data etc.).
+//
+// Batch (= what goes inside one encrypted log entry) is:
+//   0x00 <format byte> <event> <event> ...
+// (line format batches never start with 0x00, because JSON can't)
+//
+// In CBOR format each event is a CBOR array: [type, meta, payload]. Payload is the event
+// struct encoded with its JSON field names, so the same structs work for both formats.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// how events of a batch are serialized
+type Encoding string
+
+const (
+	EncodingLines Encoding = "lines" // "<meta JSON> <payload JSON>\n..." (default)
+	EncodingCBOR  Encoding = "cbor"
+)
+
+const (
+	binaryBatchMarker = 0x00
+	formatCBOR        = 0x01
+
+	cborArrayOf3 = 0x83 // first byte of each CBOR-encoded event
+)
+
+var (
+	cborEnc = func() cbor.EncMode {
+		encMode, err := cbor.EncOptions{
+			Time: cbor.TimeRFC3339Nano, // preserves timezone. our timestamps are UTC anyway
+		}.EncMode()
+		if err != nil {
+			panic(err)
+		}
+		return encMode
+	}()
+	cborDec = func() cbor.DecMode {
+		decMode, err := cbor.DecOptions{}.DecMode()
+		if err != nil {
+			panic(err)
+		}
+		return decMode
+	}()
+)
+
+func ParseEncoding(serialized string) (Encoding, error) {
+	switch encoding := Encoding(serialized); encoding {
+	case EncodingLines, EncodingCBOR:
+		return encoding, nil
+	default:
+		return "", fmt.Errorf("unsupported encoding: %s", serialized)
+	}
+}
+
+// serializes events into a batch that DeserializeBatch() understands
+func SerializeBatch(encoding Encoding, events ...Event) ([]byte, error) {
+	switch encoding {
+	case EncodingLines, "":
+		return SerializeLines(Serialize(events...)), nil
+	case EncodingCBOR:
+		batch := []byte{binaryBatchMarker, formatCBOR}
+
+		for _, event := range events {
+			eventSerialized, err := serializeCBOR(event)
+			if err != nil {
+				return nil, err
+			}
+
+			batch = append(batch, eventSerialized...)
+		}
+
+		return batch, nil
+	default:
+		return nil, fmt.Errorf("SerializeBatch: unsupported encoding: %s", encoding)
+	}
+}
+
+// splits a batch (in any encoding) to individual serialized events, each of which you
+// can give to Deserialize()
+func DeserializeBatch(batch []byte) ([]string, error) {
+	if len(batch) == 0 || batch[0] != binaryBatchMarker {
+		return DeserializeLines(batch), nil
+	}
+
+	if len(batch) < 2 || batch[1] != formatCBOR {
+		return nil, errors.New("DeserializeBatch: unsupported binary format")
+	}
+
+	events := []string{}
+
+	dec := cborDec.NewDecoder(bytes.NewReader(batch[2:]))
+	for {
+		eventSerialized := cbor.RawMessage{}
+		if err := dec.Decode(&eventSerialized); err != nil {
+			if err == io.EOF {
+				return events, nil
+			}
+
+			return nil, fmt.Errorf("DeserializeBatch: %w", err)
+		}
+
+		events = append(events, string(eventSerialized))
+	}
+}
+
+// on-the-wire format for one event
+type cborEvent struct {
+	_       struct{} `cbor:",toarray"`
+	Type    string
+	Meta    EventMeta
+	Payload cbor.RawMessage
+}
+
+func serializeCBOR(event Event) ([]byte, error) {
+	payload, err := cborEnc.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("serializeCBOR: %s: %w", event.MetaType(), err)
+	}
+
+	return cborEnc.Marshal(cborEvent{
+		Type:    event.MetaType(),
+		Meta:    *event.Meta(),
+		Payload: payload,
+	})
+}
+
+func isCBOR(input string) bool {
+	return len(input) > 0 && input[0] == cborArrayOf3
+}
+
+func deserializeCBOR(input string, allocators Types, upcasters *Upcasters, strict bool) (Event, error) {
+	wire := cborEvent{}
+	if err := cborDec.Unmarshal([]byte(input), &wire); err != nil {
+		return nil, fmt.Errorf("deserialize: meta: %v", err)
+	}
+
+	var event Event
+
+	// upcasters transform JSON, and our CBOR library version can't detect unknown fields.
+	// both are rare enough that the (slower) detour via JSON is fine.
+	if upcasters.find(wire.Type) != nil || strict {
+		payload, err := cborToJSON(wire.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("deserialize: event: %v", err)
+		}
+
+		event, err = deserializePayloadJSON(wire.Type, payload, allocators, upcasters, strict)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		eventAllocator, found := allocators[wire.Type]
+		if !found {
+			return nil, &ErrUnsupportedEvent{kind: wire.Type}
+		}
+
+		event = eventAllocator()
+
+		if err := cborDec.Unmarshal(wire.Payload, event); err != nil {
+			return nil, fmt.Errorf("deserialize: event: %v", err)
+		}
+	}
+
+	*event.Meta() = wire.Meta
+
+	return event, nil
+}
+
+// payloads are encoded with JSON field names (and timestamps as RFC 3339 strings), so the
+// JSON equivalent decodes into the same struct
+func cborToJSON(payload cbor.RawMessage) (json.RawMessage, error) {
+	var generic interface{}
+	if err := cborDec.Unmarshal(payload, &generic); err != nil {
+		return nil, err
+	}
+
+	jsonCompatible, err := jsonCompatibleValue(generic)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(jsonCompatible)
+}
+
+// CBOR maps decode as map[interface{}]interface{}, which encoding/json doesn't support
+func jsonCompatibleValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		obj := map[string]interface{}{}
+		for key, item := range v {
+			var err error
+			if obj[fmt.Sprint(key)], err = jsonCompatibleValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return obj, nil
+	case []interface{}:
+		arr := make([]interface{}, len(v))
+		for idx, item := range v {
+			var err error
+			if arr[idx], err = jsonCompatibleValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	case cbor.Tag:
+		return nil, fmt.Errorf("unsupported CBOR tag %d", v.Number)
+	default: // []byte becomes base64 which is also how encoding/json encodes []byte
+		return v, nil
+	}
+}
+
+func deserializeTypeAndMetaCBOR(input string) (string, *EventMeta, error) {
+	wire := cborEvent{}
+	if err := cborDec.Unmarshal([]byte(input), &wire); err != nil {
+		return "", nil, fmt.Errorf("deserialize: meta: %v", err)
+	}
+
+	return wire.Type, &wire.Meta, nil
+}
@@ -0,0 +1,214 @@
+package ehevent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestCBORBatch(t *testing.T) {
+	batch, err := SerializeBatch(EncodingCBOR, testEvent, NewCredentialCreated("456", MetaSystemUser(t0Sensor)))
+	assert.Ok(t, err)
+
+	events, err := DeserializeBatch(batch)
+	assert.Ok(t, err)
+	assert.EqualInt(t, len(events), 2)
+
+	first, err := Deserialize(events[0], testEventTypes)
+	assert.Ok(t, err)
+	assert.EqualString(t, first.(*CredentialCreated).Id, "123")
+	assert.EqualString(t, first.Meta().UserIdOrEmptyIfSystem(), "u987")
+	assert.EqualString(t, first.Meta().Time().Format(time.RFC3339Nano), "2020-08-20T08:55:00.123Z")
+
+	second, err := Deserialize(events[1], testEventTypes)
+	assert.Ok(t, err)
+	assert.EqualString(t, second.(*CredentialCreated).Id, "456")
+	assert.EqualString(t, second.Meta().UserIdOrEmptyIfSystem(), "")
+
+	eventType, meta, err := DeserializeTypeAndMeta(events[1])
+	assert.Ok(t, err)
+	assert.EqualString(t, eventType, "credential.Created")
+	assert.Assert(t, meta.Time().Equal(t0Sensor))
+
+	_, err = Deserialize(events[0], Types{})
+	assert.EqualString(t, err.Error(), "unsupported event: credential.Created")
+}
+
+func TestCBORUpcasting(t *testing.T) {
+	upcasters := NewUpcasters(NewUpcaster("credential.Created", "credential.Created@3", func(payload json.RawMessage) (json.RawMessage, error) {
+		v1 := struct{ Id string }{}
+		if err := json.Unmarshal(payload, &v1); err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(credentialCreatedV3{CredentialId: v1.Id, Kind: "password"})
+	}))
+
+	types := Types{
+		"credential.Created@3": func() Event { return &credentialCreatedV3{} },
+	}
+
+	o, err := DeserializeUpcasting(serializeOneCBOR(t, testEvent), types, upcasters)
+	assert.Ok(t, err)
+
+	e := o.(*credentialCreatedV3)
+	assert.EqualString(t, e.CredentialId, "123")
+	assert.EqualString(t, e.Kind, "password")
+	assert.EqualString(t, e.Meta().UserIdOrEmptyIfSystem(), "u987")
+}
+
+func TestCBORStrict(t *testing.T) {
+	reading := sensorReadings()[3]
+
+	o, err := DeserializeStrict(serializeOneCBOR(t, reading), sensorTypes, nil)
+	assert.Ok(t, err)
+	assert.EqualString(t, fmt.Sprintf("%+v", o), fmt.Sprintf("%+v", reading))
+
+	fromNewerVersion := serializeOneCBOR(t, &credentialCreatedWithKind{
+		meta: MetaSystemUser(t0Sensor),
+		Id:   "123",
+		Kind: "password",
+	})
+
+	_, err = DeserializeStrict(fromNewerVersion, testEventTypes, nil)
+	assert.EqualString(t, err.Error(), `credential.Created: json: unknown field "Kind"`)
+
+	var unknownFields *ErrUnknownFields
+	assert.Assert(t, errors.As(err, &unknownFields))
+
+	// non-strict is forward compatible
+	o, err = Deserialize(fromNewerVersion, testEventTypes)
+	assert.Ok(t, err)
+	assert.EqualString(t, o.(*CredentialCreated).Id, "123")
+}
+
+func TestDeserializeBatchLineFormat(t *testing.T) {
+	batch, err := SerializeBatch(EncodingLines, testEvent, testEvent)
+	assert.Ok(t, err)
+
+	events, err := DeserializeBatch(batch)
+	assert.Ok(t, err)
+	assert.EqualInt(t, len(events), 2)
+	assert.EqualString(t, events[1], SerializeOne(testEvent))
+}
+
+func TestParseEncoding(t *testing.T) {
+	encoding, err := ParseEncoding("cbor")
+	assert.Ok(t, err)
+	assert.Assert(t, encoding == EncodingCBOR)
+
+	_, err = ParseEncoding("xml")
+	assert.EqualString(t, err.Error(), "unsupported encoding: xml")
+}
+
+// run with "$ go test -bench=. ./pkg/ehevent/"
+func BenchmarkSerializeLines(b *testing.B) {
+	benchmarkSerialize(b, EncodingLines)
+}
+
+func BenchmarkSerializeCBOR(b *testing.B) {
+	benchmarkSerialize(b, EncodingCBOR)
+}
+
+func BenchmarkDeserializeLines(b *testing.B) {
+	benchmarkDeserialize(b, EncodingLines)
+}
+
+func BenchmarkDeserializeCBOR(b *testing.B) {
+	benchmarkDeserialize(b, EncodingCBOR)
+}
+
+func benchmarkSerialize(b *testing.B, encoding Encoding) {
+	events := sensorReadings()
+
+	var batch []byte
+	for i := 0; i < b.N; i++ {
+		var err error
+		batch, err = SerializeBatch(encoding, events...)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportMetric(float64(len(batch))/float64(len(events)), "bytes/event")
+}
+
+func benchmarkDeserialize(b *testing.B, encoding Encoding) {
+	events := sensorReadings()
+
+	batch, err := SerializeBatch(encoding, events...)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		eventsSerialized, err := DeserializeBatch(batch)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for _, eventSerialized := range eventsSerialized {
+			if _, err := Deserialize(eventSerialized, sensorTypes); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.ReportMetric(float64(len(batch))/float64(len(events)), "bytes/event")
+}
+
+var t0Sensor = time.Date(2020, 8, 20, 8, 55, 0, 0, time.UTC)
+
+func sensorReadings() []Event {
+	events := []Event{}
+	for i := 0; i < 100; i++ {
+		events = append(events, &sensorReading{
+			meta:        MetaSystemUser(t0Sensor.Add(time.Duration(i) * time.Second)),
+			Sensor:      fmt.Sprintf("temp-%d", i%4),
+			Temperature: 21.5 + float64(i%10)/10,
+			Humidity:    40 + i%20,
+		})
+	}
+	return events
+}
+
+var sensorTypes = Types{
+	"sensor.Reading": func() Event { return &sensorReading{} },
+}
+
+type sensorReading struct {
+	meta        EventMeta
+	Sensor      string
+	Temperature float64
+	Humidity    int
+}
+
+func (e *sensorReading) MetaType() string { return "sensor.Reading" }
+func (e *sensorReading) Meta() *EventMeta { return &e.meta }
+
+func serializeOneCBOR(t *testing.T, event Event) string {
+	batch, err := SerializeBatch(EncodingCBOR, event)
+	assert.Ok(t, err)
+
+	events, err := DeserializeBatch(batch)
+	assert.Ok(t, err)
+	assert.EqualInt(t, len(events), 1)
+
+	return events[0]
+}
+
+// credential.Created as written by a newer version of the app
+type credentialCreatedWithKind struct {
+	meta EventMeta
+	Id   string
+	Kind string
+}
+
+func (e *credentialCreatedWithKind) MetaType() string { return "credential.Created" }
+func (e *credentialCreatedWithKind) Meta() *EventMeta { return &e.meta }
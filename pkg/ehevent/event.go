@@ -40,6 +40,42 @@ func MetaSystemUserBackdate(logical time.Time, recorded time.Time) EventMeta {
 	}
 }
 
+// for tracing workflows across streams. *correlationId* is shared by all events of one workflow,
+// *causationId* is the cursor (see eh.Cursor.Serialize()) of the event that caused this one.
+func MetaCorrelated(meta EventMeta, correlationId string, causationId string) EventMeta {
+	meta.DontUseCorrelationId = correlationId
+	meta.DontUseCausationId = causationId
+	return meta
+}
+
+// MetaCorrelated() for an event that was caused by *cause* (which is at *causeCursor*). the workflow
+// continues with cause's correlation ID, or if it had none, the cause starts the workflow.
+func MetaCausedBy(meta EventMeta, cause *EventMeta, causeCursor string) EventMeta {
+	correlationId := cause.CorrelationId()
+	if correlationId == "" {
+		correlationId = causeCursor
+	}
+
+	return MetaCorrelated(meta, correlationId, causeCursor)
+}
+
+// attaches arbitrary headers. keep them short, because they're stored with each event.
+func MetaWithHeaders(meta EventMeta, headers map[string]string) EventMeta {
+	merged := map[string]string{}
+	for key, value := range meta.DontUseHeaders {
+		merged[key] = value
+	}
+	for key, value := range headers {
+		merged[key] = value
+	}
+
+	if len(merged) > 0 {
+		meta.DontUseHeaders = merged
+	}
+
+	return meta
+}
+
 // type string => an allocator that returns pointers to concrete structs
 type Types map[string]func() Event
 
@@ -60,6 +96,10 @@ type EventMeta struct {
 	DontUseTimeLogical     time.Time  `json:"t"`
 	DontUseTimeOfRecording *time.Time `json:"tr,omitempty"`
 	DontUseUserId          string     `json:"u,omitempty"`
+	// optional tracing information, see MetaCorrelated() and MetaWithHeaders()
+	DontUseCorrelationId string            `json:"c,omitempty"`
+	DontUseCausationId   string            `json:"ca,omitempty"`
+	DontUseHeaders       map[string]string `json:"h,omitempty"`
 }
 
 // returns systemUserId if event was raised by "system", i.e. there's no explicit user
@@ -75,6 +115,26 @@ func (e *EventMeta) UserIdOrEmptyIfSystem() string {
 	return e.UserId("")
 }
 
+// empty if event isn't part of a traced workflow
+func (e *EventMeta) CorrelationId() string {
+	return e.DontUseCorrelationId
+}
+
+// cursor of the event that caused this one. empty if not known.
+func (e *EventMeta) CausationId() string {
+	return e.DontUseCausationId
+}
+
+// empty if header not set
+func (e *EventMeta) Header(key string) string {
+	return e.DontUseHeaders[key]
+}
+
+// nil if no headers. don't mutate the returned map.
+func (e *EventMeta) Headers() map[string]string {
+	return e.DontUseHeaders
+}
+
 // "When did this happen" - logical timestamp. most times you'll use this (as opposed to time of recording)
 func (e *EventMeta) Time() time.Time {
 	return e.DontUseTimeLogical
@@ -49,3 +49,33 @@ func TestTimestampRounding(t *testing.T) {
 	assert.EqualString(t, mk(500000), ".001")
 	assert.EqualString(t, mk(0), "")
 }
+
+func TestMetaCausedBy(t *testing.T) {
+	started := MetaSystemUser(tenOClock)
+	assert.EqualString(t, started.CorrelationId(), "")
+
+	// first effect starts the workflow
+	first := MetaCausedBy(MetaSystemUser(elevenOClock), &started, "/orders@3")
+	assert.EqualString(t, first.CorrelationId(), "/orders@3")
+	assert.EqualString(t, first.CausationId(), "/orders@3")
+	assert.Assert(t, first.Time().Equal(elevenOClock))
+
+	// .. which further effects continue
+	second := MetaCausedBy(Meta(elevenOClock, "u987"), &first, "/invoices@14")
+	assert.EqualString(t, second.CorrelationId(), "/orders@3")
+	assert.EqualString(t, second.CausationId(), "/invoices@14")
+	assert.EqualString(t, second.UserIdOrEmptyIfSystem(), "u987")
+}
+
+func TestMetaWithHeaders(t *testing.T) {
+	meta := MetaWithHeaders(MetaSystemUser(tenOClock), nil)
+	assert.Assert(t, meta.Headers() == nil)
+
+	meta = MetaWithHeaders(meta, map[string]string{"source": "mqtt", "trace": "abc"})
+	other := MetaWithHeaders(meta, map[string]string{"trace": "def"})
+
+	assert.EqualString(t, meta.Header("trace"), "abc") // original not mutated
+	assert.EqualString(t, other.Header("trace"), "def")
+	assert.EqualString(t, other.Header("source"), "mqtt")
+	assert.EqualString(t, other.Header("nonexistent"), "")
+}
@@ -1,6 +1,7 @@
 package ehevent
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -34,9 +35,29 @@ func (e *EventMeta) Serialize(payload Event) string {
 	return fmt.Sprintf("%s %s", metaJson, payloadJson)
 }
 
-// deserialized one event from the line format.
+// deserialized one event from the line format (or binary format, see DeserializeBatch()).
 // returns *ErrUnsupportedEvent* if event type not in *allocators*
 func Deserialize(input string, allocators Types) (Event, error) {
+	return DeserializeUpcasting(input, allocators, nil)
+}
+
+// same as Deserialize(), but events of older versions are first upcast to newer versions with
+// *upcasters*. *allocators* then only needs to know about the newest versions.
+func DeserializeUpcasting(input string, allocators Types, upcasters *Upcasters) (Event, error) {
+	return deserialize(input, allocators, upcasters, false)
+}
+
+// same as DeserializeUpcasting(), but returns *ErrUnknownFields* if the payload has fields that
+// the event struct doesn't have (usually means the event was written by a newer version of the app)
+func DeserializeStrict(input string, allocators Types, upcasters *Upcasters) (Event, error) {
+	return deserialize(input, allocators, upcasters, true)
+}
+
+func deserialize(input string, allocators Types, upcasters *Upcasters, strict bool) (Event, error) {
+	if isCBOR(input) {
+		return deserializeCBOR(input, allocators, upcasters, strict)
+	}
+
 	dec := json.NewDecoder(strings.NewReader(input))
 
 	// we would like to DisallowUnknownFields() for metadata, but since our input stream
@@ -48,28 +69,83 @@ func Deserialize(input string, allocators Types) (Event, error) {
 		return nil, fmt.Errorf("deserialize: meta: %v", err)
 	}
 
-	// intentionally not setting DisallowUnknownFields() for payload to be forward-compatible
+	payload := json.RawMessage{}
+	if err := dec.Decode(&payload); err != nil {
+		return nil, fmt.Errorf("deserialize: event: %v", err)
+	}
 
-	eventAllocator, found := allocators[metaWithType.Type]
+	event, err := deserializePayloadJSON(metaWithType.Type, payload, allocators, upcasters, strict)
+	if err != nil {
+		return nil, err
+	}
+
+	// assign metadata (mutating via reference is a bit of a hack..)
+	*event.Meta() = metaWithType.EventMeta
+
+	return event, nil
+}
+
+// upcasts (if needed) and decodes JSON payload into a new event. shared by both formats, because
+// upcasters and unknown field detection only work with JSON.
+func deserializePayloadJSON(
+	eventType string,
+	payload json.RawMessage,
+	allocators Types,
+	upcasters *Upcasters,
+	strict bool,
+) (Event, error) {
+	if upcasters.find(eventType) != nil {
+		var err error
+		eventType, payload, err = upcasters.upcast(eventType, payload)
+		if err != nil {
+			return nil, fmt.Errorf("deserialize: %w", err)
+		}
+	}
+
+	eventAllocator, found := allocators[eventType]
 	if !found {
 		// an event the processor doesn't recognize. it's important for the caller to detect this
 		// error because most callers won't want to treat this as an error (for forward compatibility)
-		return nil, &ErrUnsupportedEvent{kind: metaWithType.Type}
+		return nil, &ErrUnsupportedEvent{kind: eventType}
 	}
 
 	// initialize zero-valued struct for this event type that we can unmarshal JSON into
 	event := eventAllocator()
 
+	dec := json.NewDecoder(bytes.NewReader(payload))
+
+	// by default intentionally not setting DisallowUnknownFields() for payload to be forward-compatible
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+
 	if err := dec.Decode(event); err != nil {
+		// unfortunately encoding/json doesn't have a type for this error
+		if strict && strings.HasPrefix(err.Error(), "json: unknown field ") {
+			return nil, &ErrUnknownFields{kind: eventType, err: err}
+		}
+
 		return nil, fmt.Errorf("deserialize: event: %v", err)
 	}
 
-	// assign metadata (mutating via reference is a bit of a hack..)
-	*event.Meta() = metaWithType.EventMeta
-
 	return event, nil
 }
 
+// parses only event's type and metadata, so this works for types the caller doesn't know
+// about (statistics, debugging tools etc.)
+func DeserializeTypeAndMeta(input string) (string, *EventMeta, error) {
+	if isCBOR(input) {
+		return deserializeTypeAndMetaCBOR(input)
+	}
+
+	metaWithType := &eventMetaWithEventType{}
+	if err := json.NewDecoder(strings.NewReader(input)).Decode(metaWithType); err != nil {
+		return "", nil, fmt.Errorf("deserialize: meta: %v", err)
+	}
+
+	return metaWithType.Type, &metaWithType.EventMeta, nil
+}
+
 // type for JSON-serializing EventMeta with added type information
 type eventMetaWithEventType struct {
 	Type string `json:"_"`
@@ -95,3 +171,22 @@ var _ error = (*ErrUnsupportedEvent)(nil)
 func (e *ErrUnsupportedEvent) Error() string {
 	return fmt.Sprintf("unsupported event: %s", e.kind)
 }
+
+func (e *ErrUnsupportedEvent) Type() string {
+	return e.kind
+}
+
+type ErrUnknownFields struct {
+	kind string
+	err  error
+}
+
+var _ error = (*ErrUnknownFields)(nil)
+
+func (e *ErrUnknownFields) Error() string {
+	return fmt.Sprintf("%s: %v", e.kind, e.err)
+}
+
+func (e *ErrUnknownFields) Type() string {
+	return e.kind
+}
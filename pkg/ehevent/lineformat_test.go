@@ -16,6 +16,29 @@ func TestSerializationFormat(t *testing.T) {
 	assert.EqualString(t, SerializeOne(testEvent), `{"_":"credential.Created","t":"2020-08-20T08:55:00.123Z","u":"u987"} {"Id":"123"}`)
 }
 
+func TestSerializationFormatCorrelated(t *testing.T) {
+	meta := MetaWithHeaders(
+		MetaCorrelated(MetaSystemUser(time.Date(2020, 8, 20, 8, 55, 0, 0, time.UTC)), "/orders@3", "/invoices@14"),
+		map[string]string{"source": "mqtt"})
+
+	serialized := SerializeOne(NewCredentialCreated("123", meta))
+
+	assert.EqualString(t, serialized, `{"_":"credential.Created","t":"2020-08-20T08:55:00Z","c":"/orders@3","ca":"/invoices@14","h":{"source":"mqtt"}} {"Id":"123"}`)
+
+	batch, err := SerializeBatch(EncodingCBOR, NewCredentialCreated("123", meta))
+	assert.Ok(t, err)
+	cborSerialized, err := DeserializeBatch(batch)
+	assert.Ok(t, err)
+
+	for _, input := range []string{serialized, cborSerialized[0]} {
+		_, deserialized, err := DeserializeTypeAndMeta(input)
+		assert.Ok(t, err)
+		assert.EqualString(t, deserialized.CorrelationId(), "/orders@3")
+		assert.EqualString(t, deserialized.CausationId(), "/invoices@14")
+		assert.EqualString(t, deserialized.Header("source"), "mqtt")
+	}
+}
+
 func TestDeserialize(t *testing.T) {
 	o, err := Deserialize(SerializeOne(testEvent), testEventTypes)
 	assert.Ok(t, err)
@@ -33,6 +56,35 @@ func TestDeserializeUnknown(t *testing.T) {
 	assert.Assert(t, errors.As(err, &unsupp))
 }
 
+func TestDeserializeStrict(t *testing.T) {
+	o, err := DeserializeStrict(SerializeOne(testEvent), testEventTypes, nil)
+	assert.Ok(t, err)
+	assert.EqualString(t, o.(*CredentialCreated).Id, "123")
+
+	fromNewerVersion := `{"_":"credential.Created","t":"2020-08-20T08:55:00.123Z"} {"Id":"123","Kind":"password"}`
+
+	o, err = DeserializeStrict(fromNewerVersion, testEventTypes, nil)
+	assert.Assert(t, o == nil)
+	assert.EqualString(t, err.Error(), `credential.Created: json: unknown field "Kind"`)
+
+	var unknownFields *ErrUnknownFields
+	assert.Assert(t, errors.As(err, &unknownFields))
+
+	// non-strict is forward compatible
+	o, err = Deserialize(fromNewerVersion, testEventTypes)
+	assert.Ok(t, err)
+	assert.EqualString(t, o.(*CredentialCreated).Id, "123")
+}
+
+func TestDeserializeTypeAndMeta(t *testing.T) {
+	eventType, meta, err := DeserializeTypeAndMeta(SerializeOne(testEvent))
+	assert.Ok(t, err)
+
+	assert.EqualString(t, eventType, "credential.Created")
+	assert.EqualString(t, meta.UserIdOrEmptyIfSystem(), "u987")
+	assert.EqualString(t, meta.Time().Format(time.RFC3339Nano), "2020-08-20T08:55:00.123Z")
+}
+
 // structure for test event
 
 var testEventTypes = Types{
@@ -0,0 +1,123 @@
+package ehevent
+
+// Upcasting lets you evolve event payloads without keeping every historical struct around.
+// Event types can be versioned with "@" suffix: "user.Created@2". type without version
+// suffix is implicitly version 1, so events written before versioning can be upcast as well.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// transforms serialized payload from the previous version's format to the next version's format
+type UpcastFn func(payload json.RawMessage) (json.RawMessage, error)
+
+type Upcaster struct {
+	from   string // normalized "name@version"
+	to     string // as given, so that it matches the type in Types
+	upcast UpcastFn
+}
+
+// panics on programming errors (malformed types, different type names, not upgrading version)
+func NewUpcaster(from string, to string, upcast UpcastFn) Upcaster {
+	fromName, fromVersion := mustParseVersionedType(from)
+	toName, toVersion := mustParseVersionedType(to)
+
+	if fromName != toName {
+		panic(fmt.Errorf("NewUpcaster: type name mismatch: %s -> %s", from, to))
+	}
+
+	if toVersion <= fromVersion {
+		panic(fmt.Errorf("NewUpcaster: version not increasing: %s -> %s", from, to))
+	}
+
+	return Upcaster{
+		from:   versionedType(fromName, fromVersion),
+		to:     to,
+		upcast: upcast,
+	}
+}
+
+// registry of upcasters, by the type they upcast from
+type Upcasters struct {
+	byFrom map[string]Upcaster
+}
+
+// panics if there are multiple upcasters from same version
+func NewUpcasters(upcasters ...Upcaster) *Upcasters {
+	byFrom := map[string]Upcaster{}
+
+	for _, upcaster := range upcasters {
+		if _, duplicate := byFrom[upcaster.from]; duplicate {
+			panic(fmt.Errorf("NewUpcasters: multiple upcasters from %s", upcaster.from))
+		}
+
+		byFrom[upcaster.from] = upcaster
+	}
+
+	return &Upcasters{byFrom}
+}
+
+func (u *Upcasters) find(eventType string) *Upcaster {
+	if u == nil || len(u.byFrom) == 0 {
+		return nil
+	}
+
+	name, version, err := ParseVersionedType(eventType)
+	if err != nil {
+		return nil // not our business to validate types here
+	}
+
+	upcaster, found := u.byFrom[versionedType(name, version)]
+	if !found {
+		return nil
+	}
+
+	return &upcaster
+}
+
+// applies all upcasters (the chain can have many steps) to the payload of eventType.
+// returns the final type and its payload. versions always increase so the chain is finite.
+func (u *Upcasters) upcast(eventType string, payload json.RawMessage) (string, json.RawMessage, error) {
+	for upcaster := u.find(eventType); upcaster != nil; upcaster = u.find(eventType) {
+		var err error
+		payload, err = upcaster.upcast(payload)
+		if err != nil {
+			return "", nil, fmt.Errorf("upcast %s -> %s: %w", eventType, upcaster.to, err)
+		}
+
+		eventType = upcaster.to
+	}
+
+	return eventType, payload, nil
+}
+
+// "user.Created@2" => ("user.Created", 2). "user.Created" => ("user.Created", 1)
+func ParseVersionedType(eventType string) (string, int, error) {
+	atPos := strings.LastIndex(eventType, "@")
+	if atPos == -1 {
+		return eventType, 1, nil
+	}
+
+	version, err := strconv.Atoi(eventType[atPos+1:])
+	if err != nil || version < 1 {
+		return "", 0, fmt.Errorf("invalid version in event type: %s", eventType)
+	}
+
+	return eventType[:atPos], version, nil
+}
+
+func mustParseVersionedType(eventType string) (string, int) {
+	name, version, err := ParseVersionedType(eventType)
+	if err != nil {
+		panic(err)
+	}
+
+	return name, version
+}
+
+func versionedType(name string, version int) string {
+	return fmt.Sprintf("%s@%d", name, version)
+}
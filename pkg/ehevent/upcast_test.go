@@ -0,0 +1,91 @@
+package ehevent
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestDeserializeUpcasting(t *testing.T) {
+	// v1 had "Id", v2 renamed it to "CredentialId", v3 added "Kind"
+	upcasters := NewUpcasters(
+		NewUpcaster("credential.Created", "credential.Created@2", func(payload json.RawMessage) (json.RawMessage, error) {
+			v1 := struct{ Id string }{}
+			if err := json.Unmarshal(payload, &v1); err != nil {
+				return nil, err
+			}
+
+			return json.Marshal(struct{ CredentialId string }{v1.Id})
+		}),
+		NewUpcaster("credential.Created@2", "credential.Created@3", func(payload json.RawMessage) (json.RawMessage, error) {
+			v2 := map[string]interface{}{}
+			if err := json.Unmarshal(payload, &v2); err != nil {
+				return nil, err
+			}
+
+			v2["Kind"] = "password"
+
+			return json.Marshal(v2)
+		}))
+
+	types := Types{
+		"credential.Created@3": func() Event { return &credentialCreatedV3{} },
+	}
+
+	for _, serialized := range []string{
+		`{"_":"credential.Created","t":"2020-08-20T08:55:00.123Z","u":"u987"} {"Id":"123"}`,
+		`{"_":"credential.Created@2","t":"2020-08-20T08:55:00.123Z","u":"u987"} {"CredentialId":"123"}`,
+		`{"_":"credential.Created@3","t":"2020-08-20T08:55:00.123Z","u":"u987"} {"CredentialId":"123","Kind":"password"}`,
+	} {
+		o, err := DeserializeUpcasting(serialized, types, upcasters)
+		assert.Ok(t, err)
+
+		e := o.(*credentialCreatedV3)
+		assert.EqualString(t, e.CredentialId, "123")
+		assert.EqualString(t, e.Kind, "password")
+		assert.EqualString(t, e.Meta().UserIdOrEmptyIfSystem(), "u987")
+		assert.EqualString(t, e.Meta().Time().Format(time.RFC3339Nano), "2020-08-20T08:55:00.123Z")
+	}
+
+	// upcast into a type that isn't known
+	_, err := DeserializeUpcasting(SerializeOne(testEvent), Types{}, upcasters)
+	var unsupp *ErrUnsupportedEvent
+	assert.Assert(t, errors.As(err, &unsupp))
+	assert.EqualString(t, err.Error(), "unsupported event: credential.Created@3")
+}
+
+func TestDeserializeUpcastingFails(t *testing.T) {
+	upcasters := NewUpcasters(NewUpcaster("credential.Created@1", "credential.Created@2", func(payload json.RawMessage) (json.RawMessage, error) {
+		return nil, errors.New("no can do")
+	}))
+
+	_, err := DeserializeUpcasting(SerializeOne(testEvent), testEventTypes, upcasters)
+	assert.EqualString(t, err.Error(), "deserialize: upcast credential.Created -> credential.Created@2: no can do")
+}
+
+func TestParseVersionedType(t *testing.T) {
+	name, version, err := ParseVersionedType("user.Created@2")
+	assert.Ok(t, err)
+	assert.EqualString(t, name, "user.Created")
+	assert.EqualInt(t, version, 2)
+
+	name, version, err = ParseVersionedType("user.Created")
+	assert.Ok(t, err)
+	assert.EqualString(t, name, "user.Created")
+	assert.EqualInt(t, version, 1)
+
+	_, _, err = ParseVersionedType("user.Created@x")
+	assert.EqualString(t, err.Error(), "invalid version in event type: user.Created@x")
+}
+
+type credentialCreatedV3 struct {
+	meta         EventMeta
+	CredentialId string
+	Kind         string
+}
+
+func (e *credentialCreatedV3) MetaType() string { return "credential.Created@3" }
+func (e *credentialCreatedV3) Meta() *EventMeta { return &e.meta }
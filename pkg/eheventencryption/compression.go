@@ -3,35 +3,205 @@ package eheventencryption
 import (
 	"bytes"
 	"compress/flate"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/function61/gokit/sync/syncutil"
+	"github.com/klauspost/compress/zstd"
+)
+
+// how to compress plaintext before encrypting it
+type Compression struct {
+	Method     CompressionMethod // None | Deflate | Zstd
+	Dictionary []byte            // optional, only for zstd. see TrainDictionary()
+}
+
+var (
+	// what the data was compressed with before compression was configurable
+	DefaultCompression = Compression{Method: CompressionMethodDeflate}
 )
 
+// for data that isn't encrypted (encryption compresses by itself). opportunistic, like
+// encryption's compression. dictionaries are not supported.
+func Compress(input []byte, compression Compression) ([]byte, CompressionMethod, error) {
+	if compression.Dictionary != nil {
+		return nil, CompressionMethodNone, errors.New("Compress: dictionaries not supported")
+	}
+
+	return compressIfWellCompressible(input, compression)
+}
+
+// "method" is the one Compress() returned
+func Decompress(input []byte, method CompressionMethod) ([]byte, error) {
+	return decompress(input, method, nil)
+}
+
 // opportunistic compression: try compressing, and if it helped measurably, use it
-func compressIfWellCompressible(input []byte) ([]byte, CompressionMethod, error) {
-	compressed := &bytes.Buffer{}
-	if err := compressDeflate(bytes.NewReader(input), compressed); err != nil {
+func compressIfWellCompressible(input []byte, compression Compression) ([]byte, CompressionMethod, error) {
+	compressed, method, err := compress(input, compression)
+	if err != nil {
 		return nil, CompressionMethodNone, err
 	}
 
-	compressionRatio := float64(compressed.Len()) / float64(len(input))
-
+	compressionRatio := float64(len(compressed)) / float64(len(input))
 	wellCompressible := compressionRatio < 0.9
-
 	if wellCompressible {
-		return compressed.Bytes(), CompressionMethodDeflate, nil
+		return compressed, method, nil
 	} else {
 		return input, CompressionMethodNone, nil
 	}
 }
 
+// 2nd return is the method that was actually used
+func compress(input []byte, compression Compression) ([]byte, CompressionMethod, error) {
+	switch compression.Method {
+	case CompressionMethodNone:
+		return input, CompressionMethodNone, nil
+	case CompressionMethodDeflate:
+		compressed := &bytes.Buffer{}
+		if err := compressDeflate(bytes.NewReader(input), compressed); err != nil {
+			return nil, CompressionMethodNone, err
+		}
+
+		return compressed.Bytes(), CompressionMethodDeflate, nil
+	case CompressionMethodZstd, CompressionMethodZstdDictionary:
+		encoder, err := zstdCodecs.encoder(compression.Dictionary)
+		if err != nil {
+			return nil, CompressionMethodNone, err
+		}
+
+		method := CompressionMethodZstd
+		if compression.Dictionary != nil {
+			method = CompressionMethodZstdDictionary
+		}
+
+		return encoder.EncodeAll(input, nil), method, nil
+	default:
+		return nil, CompressionMethodNone, fmt.Errorf("unsupported CompressionMethod: %x", compression.Method)
+	}
+}
+
 func compressDeflate(input io.Reader, output io.Writer) error {
 	compress, err := flate.NewWriter(output, flate.BestCompression)
 	if err != nil {
 		return err
 	}
+
 	if _, err := io.Copy(compress, input); err != nil {
 		return err
 	}
 
 	return compress.Close()
 }
+
+func decompress(input []byte, method CompressionMethod, dictionary []byte) ([]byte, error) {
+	plaintextReader, err := func() (io.ReadCloser, error) {
+		switch method {
+		case CompressionMethodNone:
+			return ioutil.NopCloser(bytes.NewReader(input)), nil // as-is
+		case CompressionMethodDeflate:
+			return flate.NewReader(bytes.NewReader(input)), nil
+		case CompressionMethodZstd, CompressionMethodZstdDictionary:
+			decoder, err := zstdCodecs.decoder(dictionary)
+			if err != nil {
+				return nil, err
+			}
+
+			plaintext, err := decoder.DecodeAll(input, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			return ioutil.NopCloser(bytes.NewReader(plaintext)), nil
+		default:
+			return nil, fmt.Errorf("unsupported CompressionMethod: %x", method)
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := io.ReadAll(plaintextReader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := plaintextReader.Close(); err != nil {
+		return nil, err
+	}
+
+	return plaintext, nil
+}
+
+var zstdCodecs = &zstdCodecCache{
+	encoders: map[[sha256.Size]byte]*zstd.Encoder{},
+	decoders: map[[sha256.Size]byte]*zstd.Decoder{},
+}
+
+// zstd encoders & decoders are expensive to make, but EncodeAll() and DecodeAll() are safe for
+// concurrent use so we can share them. keyed by dictionary's content (not ID), because different
+// streams' dictionaries can have the same ID.
+type zstdCodecCache struct {
+	encoders map[[sha256.Size]byte]*zstd.Encoder
+	decoders map[[sha256.Size]byte]*zstd.Decoder
+	mu       sync.Mutex
+}
+
+func (z *zstdCodecCache) encoder(dictionary []byte) (*zstd.Encoder, error) {
+	defer lockAndUnlock(&z.mu)()
+
+	key := sha256.Sum256(dictionary)
+
+	if encoder, found := z.encoders[key]; found {
+		return encoder, nil
+	}
+
+	opts := []zstd.EOption{
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithEncoderCRC(false), // AEAD already detects corruption
+	}
+	if dictionary != nil {
+		opts = append(opts, zstd.WithEncoderDict(dictionary))
+	}
+
+	encoder, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("zstd: %w", err)
+	}
+
+	z.encoders[key] = encoder
+
+	return encoder, nil
+}
+
+func (z *zstdCodecCache) decoder(dictionary []byte) (*zstd.Decoder, error) {
+	defer lockAndUnlock(&z.mu)()
+
+	key := sha256.Sum256(dictionary)
+
+	if decoder, found := z.decoders[key]; found {
+		return decoder, nil
+	}
+
+	opts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+	if dictionary != nil {
+		opts = append(opts, zstd.WithDecoderDicts(dictionary))
+	}
+
+	decoder, err := zstd.NewReader(nil, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("zstd: %w", err)
+	}
+
+	z.decoders[key] = decoder
+
+	return decoder, nil
+}
+
+var (
+	lockAndUnlock = syncutil.LockAndUnlock // shorthand
+)
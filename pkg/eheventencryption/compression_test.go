@@ -0,0 +1,199 @@
+package eheventencryption
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestZstd(t *testing.T) {
+	dek := dummyDek()
+
+	batch := orderBatches(1, 3)[0]
+
+	encrypted, err := encryptWithRand(batch, dek, 0, Compression{Method: CompressionMethodZstd}, nullIv())
+	assert.Ok(t, err)
+
+	assert.Assert(t, CompressionMethod(encrypted[0]) == CompressionMethodZstd)
+
+	dictionaryID, err := CompressionDictionaryID(encrypted)
+	assert.Ok(t, err)
+	assert.Assert(t, dictionaryID == 0)
+
+	decrypted, err := Decrypt(encrypted, dek)
+	assert.Ok(t, err)
+	assert.EqualString(t, string(decrypted), string(batch))
+}
+
+func TestZstdDictionary(t *testing.T) {
+	dek := dummyDek()
+
+	batches := orderBatches(50, 1)
+
+	dictionary, err := TrainDictionary(40000, batches[:40], DefaultDictionarySize)
+	assert.Ok(t, err)
+
+	dictionaryID, err := DictionaryID(dictionary)
+	assert.Ok(t, err)
+	assert.Assert(t, dictionaryID == 40000)
+
+	batch := batches[45] // not one that the dictionary was trained with
+
+	withoutDictionary, err := EncryptWithCompression(batch, dek, 0, Compression{Method: CompressionMethodZstd})
+	assert.Ok(t, err)
+
+	encrypted, err := EncryptWithCompression(batch, dek, 0, Compression{
+		Method:     CompressionMethodZstd,
+		Dictionary: dictionary,
+	})
+	assert.Ok(t, err)
+
+	// for a small batch a dictionary makes all the difference
+	assert.Assert(t, len(encrypted) < len(withoutDictionary)/2)
+
+	assert.Assert(t, CompressionMethod(encrypted[0]) == CompressionMethodZstdDictionary)
+
+	dictionaryID, err = CompressionDictionaryID(encrypted)
+	assert.Ok(t, err)
+	assert.Assert(t, dictionaryID == 40000)
+
+	_, err = Decrypt(encrypted, dek)
+	assert.EqualString(t, err.Error(), "Decrypt: need compression dictionary 40000")
+
+	decrypted, err := DecryptWithDictionary(encrypted, dek, dictionary)
+	assert.Ok(t, err)
+	assert.EqualString(t, string(decrypted), string(batch))
+}
+
+func TestTrainDictionaryNotEnoughData(t *testing.T) {
+	_, err := TrainDictionary(40000, [][]byte{[]byte("foo")}, DefaultDictionarySize)
+	assert.EqualString(t, err.Error(), "TrainDictionary: not enough sample data (got 3 bytes)")
+}
+
+func TestPickCompression(t *testing.T) {
+	picked, results, err := PickCompression(orderBatches(100, 1), 40000)
+	assert.Ok(t, err)
+
+	assert.EqualInt(t, len(results), 3)
+	assert.EqualString(t, results[0].Name(), "zstd+dictionary")
+	assert.Assert(t, picked.Method == CompressionMethodZstd && picked.Dictionary != nil)
+
+	// small batches compress poorly without a dictionary
+	assert.Assert(t, results[0].Ratio() < 0.5)
+	assert.Assert(t, results[1].Ratio() > 0.5)
+}
+
+func TestParseCompressionMethod(t *testing.T) {
+	method, err := ParseCompressionMethod("zstd")
+	assert.Ok(t, err)
+	assert.Assert(t, method == CompressionMethodZstd)
+
+	_, err = ParseCompressionMethod("lzma")
+	assert.EqualString(t, err.Error(), "unsupported compression method: lzma")
+}
+
+// run with "$ go test -bench=. ./pkg/eheventencryption/". reports how big the data is after
+// compression, relative to the plaintext.
+func BenchmarkCompressionDeflate(b *testing.B) {
+	benchmarkCompression(b, func([][]byte) Compression {
+		return Compression{Method: CompressionMethodDeflate}
+	})
+}
+
+func BenchmarkCompressionZstd(b *testing.B) {
+	benchmarkCompression(b, func([][]byte) Compression {
+		return Compression{Method: CompressionMethodZstd}
+	})
+}
+
+func BenchmarkCompressionZstdDictionary(b *testing.B) {
+	benchmarkCompression(b, func(training [][]byte) Compression {
+		dictionary, err := TrainDictionary(40000, training, DefaultDictionarySize)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		return Compression{Method: CompressionMethodZstd, Dictionary: dictionary}
+	})
+}
+
+func benchmarkCompression(b *testing.B, makeCompression func(training [][]byte) Compression) {
+	for _, eventsPerBatch := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("%d-events-per-batch", eventsPerBatch), func(b *testing.B) {
+			batches := orderBatches(200, eventsPerBatch)
+
+			compression := makeCompression(batches[:100])
+
+			measuring := batches[100:]
+
+			b.ResetTimer()
+
+			var results []CompressionResult
+			for i := 0; i < b.N; i++ {
+				var err error
+				results, err = CompareCompression(measuring, []Compression{compression})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportMetric(results[0].Ratio(), "ratio")
+		})
+	}
+}
+
+// batches of plausible-looking events, like an application's stream would have
+func orderBatches(count int, eventsPerBatch int) [][]byte {
+	t0 := time.Date(2020, 8, 20, 8, 55, 0, 0, time.UTC)
+
+	products := []string{"Coffee beans, 1 kg", "Espresso machine", "Milk frother", "Grinder", "Descaler"}
+
+	batches := [][]byte{}
+	for i := 0; i < count; i++ {
+		events := []ehevent.Event{}
+
+		for j := 0; j < eventsPerBatch; j++ {
+			n := i*eventsPerBatch + j
+
+			events = append(events, &orderPlaced{
+				meta:       ehevent.Meta(t0.Add(time.Duration(n)*time.Minute), fmt.Sprintf("u%d", 100+n%17)),
+				OrderId:    fmt.Sprintf("ord-%06d", 31337+n),
+				CustomerId: fmt.Sprintf("cust-%04d", 1000+(n*7)%91),
+				Product:    products[n%len(products)],
+				Quantity:   1 + n%3,
+				PriceCents: 1990 + (n%5)*1000,
+				Currency:   "EUR",
+				Shipping: orderShipping{
+					Method:  []string{"pickup", "parcel", "express"}[n%3],
+					Country: []string{"FI", "SE", "DE", "EE"}[n%4],
+				},
+			})
+		}
+
+		batches = append(batches, ehevent.SerializeLines(ehevent.Serialize(events...)))
+	}
+
+	return batches
+}
+
+type orderPlaced struct {
+	meta       ehevent.EventMeta
+	OrderId    string
+	CustomerId string
+	Product    string
+	Quantity   int
+	PriceCents int
+	Currency   string
+	Shipping   orderShipping
+}
+
+type orderShipping struct {
+	Method  string
+	Country string
+}
+
+func (e *orderPlaced) MetaType() string         { return "order.Placed" }
+func (e *orderPlaced) Meta() *ehevent.EventMeta { return &e.meta }
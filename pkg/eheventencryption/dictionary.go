@@ -0,0 +1,251 @@
+package eheventencryption
+
+// Zstandard dictionaries. A small batch of events doesn't have much redundancy inside it, but
+// events of a stream look a lot like each other (same event types, same JSON field names etc.),
+// so a dictionary made from the stream's earlier data helps the compressor a lot.
+//
+// Dictionaries are in the standard zstd format, so `$ zstd --train` dictionaries also work.
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/klauspost/compress/huff0"
+)
+
+const (
+	DefaultDictionarySize = 16 * 1024 // zstd's default is 110 kB, but our batches are small
+
+	// https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md#dictionary_id
+	// IDs < 32768 are reserved for registration, and >= 2^31 are reserved
+	dictionaryIDMin = 32768
+	dictionaryIDMax = 1<<31 - 1
+)
+
+var zstdDictionaryMagic = []byte{0x37, 0xa4, 0x30, 0xec}
+
+// tells the ID of a zstd dictionary. the ID is also stored in zstd frames compressed with the
+// dictionary, so the decompressor knows which dictionary it needs.
+func DictionaryID(dictionary []byte) (uint32, error) {
+	if len(dictionary) < 8 || string(dictionary[:4]) != string(zstdDictionaryMagic) {
+		return 0, errors.New("DictionaryID: not a zstd dictionary")
+	}
+
+	return binary.LittleEndian.Uint32(dictionary[4:8]), nil
+}
+
+// random ID from the range that zstd designates for private use. random so dictionaries of
+// different streams don't usually have the same ID.
+func NewDictionaryID() (uint32, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(dictionaryIDMax-dictionaryIDMin+1))
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(dictionaryIDMin + n.Int64()), nil
+}
+
+// makes a zstd dictionary out of *samples* (plaintexts you'd give to Encrypt(), e.g. the stream's
+// recent event batches). Newest samples should be last.
+//
+// This is a simple trainer: dictionary content is as much of the newest samples as fits in
+// *maxSize*, and literals' Huffman table is built from the samples. Sequences use zstd's
+// default distributions. zstd's COVER algorithm would pick content more cleverly, but for
+// events of a single stream this gets most of the benefit.
+func TrainDictionary(id uint32, samples [][]byte, maxSize int) ([]byte, error) {
+	if id == 0 {
+		return nil, errors.New("TrainDictionary: ID 0 means no dictionary")
+	}
+
+	if len(samples) == 0 {
+		return nil, errors.New("TrainDictionary: no samples")
+	}
+
+	content := []byte{}
+
+	// walk backwards so the newest samples make it into the dictionary. zstd finds matches
+	// more cheaply from the end of the dictionary, so the newest samples are also last in it.
+	for i := len(samples) - 1; i >= 0 && len(content) < maxSize; i-- {
+		sample := samples[i]
+		if room := maxSize - len(content); len(sample) > room { // take what fits
+			sample = sample[len(sample)-room:]
+		}
+
+		content = append(append([]byte{}, sample...), content...)
+	}
+
+	if len(content) < dictionaryMinContent {
+		return nil, fmt.Errorf("TrainDictionary: not enough sample data (got %d bytes)", len(content))
+	}
+
+	literalsTable, err := huffmanTableFor(samples)
+	if err != nil {
+		return nil, fmt.Errorf("TrainDictionary: %w", err)
+	}
+
+	dictionary := append([]byte{}, zstdDictionaryMagic...)
+	dictionary = appendUint32LE(dictionary, id)
+	dictionary = append(dictionary, literalsTable...)
+
+	// order is specified in the format
+	for _, table := range []fseDefaultTable{offsetsDefault, matchLengthsDefault, literalLengthsDefault} {
+		dictionary, err = appendNormalizedCounts(dictionary, table.norm, table.tableLog)
+		if err != nil {
+			return nil, fmt.Errorf("TrainDictionary: %w", err)
+		}
+	}
+
+	// initial repeat offsets (the ones zstd uses when there's no dictionary)
+	for _, repeatOffset := range []uint32{1, 4, 8} {
+		dictionary = appendUint32LE(dictionary, repeatOffset)
+	}
+
+	return append(dictionary, content...), nil
+}
+
+const dictionaryMinContent = 8 // biggest initial repeat offset
+
+func huffmanTableFor(samples [][]byte) ([]byte, error) {
+	// every byte value at least once, so the table can encode literals that samples didn't have
+	literals := make([]byte, 256)
+	for i := range literals {
+		literals[i] = byte(i)
+	}
+
+	// newest samples, up to what huff0 takes in one go
+	for i := len(samples) - 1; i >= 0 && len(literals) < huff0.BlockSizeMax; i-- {
+		sample := samples[i]
+		if room := huff0.BlockSizeMax - len(literals); len(sample) > room {
+			sample = sample[:room]
+		}
+
+		literals = append(literals, sample...)
+	}
+
+	scratch := &huff0.Scratch{}
+	if _, _, err := huff0.Compress1X(literals, scratch); err != nil {
+		return nil, fmt.Errorf("samples not compressible: %w", err)
+	}
+
+	return scratch.OutTable, nil
+}
+
+// https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md#default-distributions
+type fseDefaultTable struct {
+	tableLog uint
+	norm     []int16
+}
+
+var (
+	literalLengthsDefault = fseDefaultTable{6, []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1}}
+	matchLengthsDefault = fseDefaultTable{6, []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1}}
+	offsetsDefault = fseDefaultTable{5, []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}}
+)
+
+// writes FSE table description. port of FSE_writeNCount() from the zstd reference implementation.
+// https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md#fse-table-description
+func appendNormalizedCounts(out []byte, norm []int16, tableLog uint) ([]byte, error) {
+	const minTableLog = 5
+
+	tableSize := 1 << tableLog
+	remaining := tableSize + 1 // +1 for extra accuracy
+	threshold := tableSize
+	nbBits := tableLog + 1
+
+	bitStream := uint32(tableLog - minTableLog)
+	bitCount := uint(4)
+
+	flush16 := func() {
+		out = append(out, byte(bitStream), byte(bitStream>>8))
+		bitStream >>= 16
+		bitCount -= 16
+	}
+
+	previousIs0 := false
+
+	for symbol := 0; symbol < len(norm) && remaining > 1; {
+		if previousIs0 {
+			start := symbol
+			for symbol < len(norm) && norm[symbol] == 0 {
+				symbol++
+			}
+			if symbol == len(norm) {
+				return nil, errors.New("appendNormalizedCounts: incorrect distribution")
+			}
+			for symbol >= start+24 {
+				start += 24
+				bitStream += 0xffff << bitCount
+				out = append(out, byte(bitStream), byte(bitStream>>8))
+				bitStream >>= 16
+			}
+			for symbol >= start+3 {
+				start += 3
+				bitStream += 3 << bitCount
+				bitCount += 2
+			}
+			bitStream += uint32(symbol-start) << bitCount
+			bitCount += 2
+			if bitCount > 16 {
+				flush16()
+			}
+		}
+
+		count := int(norm[symbol])
+		symbol++
+
+		max := (2*threshold - 1) - remaining
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		count++ // +1 for extra accuracy
+		if count >= threshold {
+			count += max
+		}
+		bitStream += uint32(count) << bitCount
+		bitCount += nbBits
+		if count < max {
+			bitCount--
+		}
+		previousIs0 = count == 1
+		if remaining < 1 {
+			return nil, errors.New("appendNormalizedCounts: incorrect distribution")
+		}
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+
+		if bitCount > 16 {
+			flush16()
+		}
+	}
+
+	if remaining != 1 {
+		return nil, errors.New("appendNormalizedCounts: incorrect distribution")
+	}
+
+	// flush remaining bits
+	remainingBits := []byte{byte(bitStream), byte(bitStream >> 8)}
+
+	return append(out, remainingBits[:(bitCount+7)/8]...), nil
+}
+
+func appendUint32LE(out []byte, value uint32) []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, value)
+	return append(out, buf...)
+}
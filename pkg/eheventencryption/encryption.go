@@ -3,22 +3,24 @@ package eheventencryption
 
 import (
 	"bytes"
-	"compress/flate"
 	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
-// format is: <reserved 0x0> <compression method> <dek version> <iv> <ciphertextMaybeCompressed>
+// format is: <reserved 0x0> <compression method> <dek version> [dictionary ID] <iv> <ciphertextMaybeCompressed>
 //
 // 1 byte     Header
 //            |- upper 4 bits reserved. if non-zero, assume incompatible format version & stop decoding!
-//            └- lowest 4 bits compression method (0x0 = uncompressed, 0x1 = deflate)
-// 1-n bytes  Reserved for DEK version (key rotation). N is defined by encoding/binary.Uvarint semantics
+//            └- lowest 4 bits compression method (0x0 = uncompressed, 0x1 = deflate, 0x2 = zstd,
+//               0x3 = zstd with dictionary)
+// 1-n bytes  DEK version (key rotation). N is defined by encoding/binary.Uvarint semantics
+// 1-n bytes  zstd dictionary ID (only if compression method 0x3). Uvarint like DEK version.
+//            it's outside of the ciphertext so the reader can resolve the dictionary beforehand.
 // 16 bytes   IV
 // rest       chacha20poly1305(plaintextMaybeCompressed, dek).
 //
@@ -38,25 +40,85 @@ import (
 type CompressionMethod byte
 
 const (
-	CompressionMethodNone    CompressionMethod = 0
-	CompressionMethodDeflate CompressionMethod = 1
+	CompressionMethodNone           CompressionMethod = 0
+	CompressionMethodDeflate        CompressionMethod = 1
+	CompressionMethodZstd           CompressionMethod = 2
+	CompressionMethodZstdDictionary CompressionMethod = 3 // only in ciphertext header. use Zstd + Dictionary
 )
 
+func (c CompressionMethod) String() string {
+	switch c {
+	case CompressionMethodNone:
+		return "none"
+	case CompressionMethodDeflate:
+		return "deflate"
+	case CompressionMethodZstd:
+		return "zstd"
+	case CompressionMethodZstdDictionary:
+		return "zstd+dictionary"
+	default:
+		return fmt.Sprintf("unknown(%x)", byte(c))
+	}
+}
+
+func ParseCompressionMethod(serialized string) (CompressionMethod, error) {
+	switch serialized {
+	case "none":
+		return CompressionMethodNone, nil
+	case "deflate":
+		return CompressionMethodDeflate, nil
+	case "zstd":
+		return CompressionMethodZstd, nil
+	default:
+		return CompressionMethodNone, fmt.Errorf("unsupported compression method: %s", serialized)
+	}
+}
+
+// encrypts with DEK v0 (= stream's DEK if it was never rotated)
 func Encrypt(plaintext []byte, dek []byte) ([]byte, error) {
-	return encryptWithRand(plaintext, dek, rand.Reader)
+	return encryptWithRand(plaintext, dek, 0, DefaultCompression, rand.Reader)
+}
+
+// use the stream's newest DEK. version is stored in the header so readers know which DEK to decrypt with
+func EncryptWithDEKVersion(plaintext []byte, dek []byte, dekVersion uint64) ([]byte, error) {
+	return encryptWithRand(plaintext, dek, dekVersion, DefaultCompression, rand.Reader)
 }
 
-func encryptWithRand(plaintext []byte, dek []byte, cryptoRand io.Reader) ([]byte, error) {
+// like EncryptWithDEKVersion(), but with chosen compression. if compression doesn't help
+// measurably, data is stored uncompressed.
+func EncryptWithCompression(plaintext []byte, dek []byte, dekVersion uint64, compression Compression) ([]byte, error) {
+	return encryptWithRand(plaintext, dek, dekVersion, compression, rand.Reader)
+}
+
+func encryptWithRand(
+	plaintext []byte,
+	dek []byte,
+	dekVersion uint64,
+	compression Compression,
+	cryptoRand io.Reader,
+) ([]byte, error) {
 	if len(plaintext) == 0 {
 		return nil, errors.New("Encrypt: no data")
 	}
 
 	plaintextMaybeCompressed, compressionMethod, err := compressIfWellCompressible(
-		plaintext)
+		plaintext,
+		compression)
 	if err != nil {
 		return nil, err
 	}
 
+	dictionaryIDBuf := []byte{}
+	if compressionMethod == CompressionMethodZstdDictionary {
+		dictionaryID, err := DictionaryID(compression.Dictionary)
+		if err != nil {
+			return nil, err
+		}
+
+		dictionaryIDBuf = make([]byte, binary.MaxVarintLen32)
+		dictionaryIDBuf = dictionaryIDBuf[:binary.PutUvarint(dictionaryIDBuf, uint64(dictionaryID))]
+	}
+
 	aead, err := chacha20poly1305.New(dek)
 	if err != nil {
 		return nil, err
@@ -66,55 +128,92 @@ func encryptWithRand(plaintext []byte, dek []byte, cryptoRand io.Reader) ([]byte
 	// so our header is basically compressionMethod
 	header := byte(compressionMethod)
 
-	// the 0x00 for "reserved" semantics amount to high bit=varuint fits in 1 byte, and next
-	// 7 bits being zero signals that we use DEK v0 (i.e. this is not a rotated DEK)
-	dekVersion := byte(0x00)
+	// DEK v0 encodes as 0x00, so data from before DEK rotation was implemented is compatible
+	dekVersionBuf := make([]byte, binary.MaxVarintLen64)
+	dekVersionLen := binary.PutUvarint(dekVersionBuf, dekVersion)
+
+	headerLen := 1 + dekVersionLen + len(dictionaryIDBuf)
 
 	// ___________  header ______________
-	// <reserved 0x0> <compressionMethod> <DEK version> <nonce> <ciphertext> <authtag>
-	buffer := make([]byte, 2+aead.NonceSize()+len(plaintextMaybeCompressed)+aead.Overhead())
+	// <reserved 0x0> <compressionMethod> <DEK version> [dictionary ID] <nonce> <ciphertext> <authtag>
+	buffer := make([]byte, headerLen+aead.NonceSize()+len(plaintextMaybeCompressed)+aead.Overhead())
 	buffer[0] = header
-	buffer[1] = dekVersion // TODO: when implemented, length of this is dynamic
+	copy(buffer[1:1+dekVersionLen], dekVersionBuf[:dekVersionLen])
+	copy(buffer[1+dekVersionLen:headerLen], dictionaryIDBuf)
 
-	nonce := buffer[2 : 2+aead.NonceSize()]
+	nonce := buffer[headerLen : headerLen+aead.NonceSize()]
 
 	if _, err := io.ReadFull(cryptoRand, nonce); err != nil {
 		return nil, err
 	}
 
-	aead.Seal(buffer[2:2+aead.NonceSize()], nonce, plaintextMaybeCompressed, nil)
+	aead.Seal(buffer[headerLen:headerLen+aead.NonceSize()], nonce, plaintextMaybeCompressed, nil)
 
 	return buffer, nil
 }
 
+// tells which version of the stream's DEK is needed to decrypt the ciphertext
+func DEKVersion(ciphertext []byte) (uint64, error) {
+	raw := bytes.NewReader(ciphertext)
+
+	if _, err := readHeader(raw); err != nil {
+		return 0, fmt.Errorf("DEKVersion: %w", err)
+	}
+
+	dekVersion, err := binary.ReadUvarint(raw)
+	if err != nil {
+		return 0, fmt.Errorf("DEKVersion: %w", err)
+	}
+
+	return dekVersion, nil
+}
+
+// tells which zstd dictionary is needed to decompress the plaintext. 0 if none.
+func CompressionDictionaryID(ciphertext []byte) (uint32, error) {
+	raw := bytes.NewReader(ciphertext)
+
+	compressionMethod, err := readHeader(raw)
+	if err != nil {
+		return 0, fmt.Errorf("CompressionDictionaryID: %w", err)
+	}
+
+	if _, err := binary.ReadUvarint(raw); err != nil {
+		return 0, fmt.Errorf("CompressionDictionaryID: DEK version: %w", err)
+	}
+
+	return readDictionaryID(raw, compressionMethod)
+}
+
+// "dek" must be the DEK version that DEKVersion() tells
 func Decrypt(ciphertext []byte, dek []byte) ([]byte, error) {
+	return DecryptWithDictionary(ciphertext, dek, nil)
+}
+
+// "dictionary" must be the one that CompressionDictionaryID() tells (nil if ID is 0)
+func DecryptWithDictionary(ciphertext []byte, dek []byte, dictionary []byte) ([]byte, error) {
 	raw := bytes.NewReader(ciphertext)
 
-	header, err := raw.ReadByte()
+	compressionMethod, err := readHeader(raw)
 	if err != nil {
 		return nil, fmt.Errorf("Decrypt: %w", err)
 	}
 
-	// upper 4 bits are reserved, and if any of them are set it indicates incompatible format
-	// that we don't know how to decode yet
-	if header&0xf0 != 0x00 {
-		return nil, fmt.Errorf(
-			"Decrypt: header reserved bits set - incompatible format: %x",
-			header&0xf0)
+	// we don't need the version here (caller chose the DEK based on it), but we need to get
+	// past it. if caller gave wrong DEK, the AEAD will catch it.
+	if _, err := binary.ReadUvarint(raw); err != nil {
+		return nil, fmt.Errorf("Decrypt: DEK version: %w", err)
 	}
 
-	compressionMethod := CompressionMethod(header & 0x0f)
-
-	// DEK rotation not yet implemented - for now just asserting this to be 0. when implemented
-	// we'd use encoding/binary.Uvarint, which is compatible with our stub approach because
-	// var-length byte spans guarantee highest bit being 1 when bytesLen >= 2
-	dekVersionReserved, err := raw.ReadByte()
+	dictionaryID, err := readDictionaryID(raw, compressionMethod)
 	if err != nil {
 		return nil, fmt.Errorf("Decrypt: %w", err)
 	}
 
-	if dekVersionReserved != 0x00 {
-		return nil, errors.New("Decrypt: DEK rotation not implemented")
+	if dictionaryID != 0 {
+		givenID, err := DictionaryID(dictionary)
+		if err != nil || givenID != dictionaryID {
+			return nil, fmt.Errorf("Decrypt: need compression dictionary %d", dictionaryID)
+		}
 	}
 
 	// after reading nonce, next reads contain only ciphertext
@@ -138,28 +237,40 @@ func Decrypt(ciphertext []byte, dek []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	plaintextReader, err := func() (io.ReadCloser, error) {
-		switch compressionMethod {
-		case CompressionMethodNone:
-			return ioutil.NopCloser(bytes.NewReader(plaintextMaybeCompressed)), nil // as-is
-		case CompressionMethodDeflate:
-			return flate.NewReader(bytes.NewReader(plaintextMaybeCompressed)), nil
-		default:
-			return nil, fmt.Errorf("unsupported CompressionMethod: %x", compressionMethod)
-		}
-	}()
+	plaintext, err := decompress(plaintextMaybeCompressed, compressionMethod, dictionary)
 	if err != nil {
 		return nil, fmt.Errorf("Decrypt: %w", err)
 	}
 
-	plaintext, err := io.ReadAll(plaintextReader)
+	return plaintext, nil
+}
+
+func readHeader(raw io.ByteReader) (CompressionMethod, error) {
+	header, err := raw.ReadByte()
 	if err != nil {
-		return nil, fmt.Errorf("Decrypt: %w", err)
+		return CompressionMethodNone, err
 	}
 
-	if err := plaintextReader.Close(); err != nil {
-		return nil, fmt.Errorf("Decrypt: %w", err)
+	// upper 4 bits are reserved, and if any of them are set it indicates incompatible format
+	// that we don't know how to decode yet
+	if header&0xf0 != 0x00 {
+		return CompressionMethodNone, fmt.Errorf(
+			"header reserved bits set - incompatible format: %x",
+			header&0xf0)
 	}
 
-	return plaintext, nil
+	return CompressionMethod(header & 0x0f), nil
+}
+
+func readDictionaryID(raw io.ByteReader, compressionMethod CompressionMethod) (uint32, error) {
+	if compressionMethod != CompressionMethodZstdDictionary {
+		return 0, nil
+	}
+
+	dictionaryID, err := binary.ReadUvarint(raw)
+	if err != nil {
+		return 0, fmt.Errorf("dictionary ID: %w", err)
+	}
+
+	return uint32(dictionaryID), nil
 }
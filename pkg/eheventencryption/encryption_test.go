@@ -12,7 +12,7 @@ import (
 func TestEncryptDecrypt(t *testing.T) {
 	dek := dummyDek()
 
-	encryptedEvents, err := encryptWithRand(ehevent.SerializeLines([]string{"foo", "bar"}), dek, nullIv())
+	encryptedEvents, err := encryptWithRand(ehevent.SerializeLines([]string{"foo", "bar"}), dek, 0, DefaultCompression, nullIv())
 	assert.Ok(t, err)
 
 	// IV is stored as prefix, which is now easy to spot as "AAA.."
@@ -33,6 +33,8 @@ func TestCompression(t *testing.T) {
 	encryptedEvents, err := encryptWithRand(
 		ehevent.SerializeLines([]string{"fooooooooooooooooooooooooooooooooooooooooooo"}),
 		dek,
+		0,
+		DefaultCompression,
 		nullIv())
 	assert.Ok(t, err)
 
@@ -48,6 +50,39 @@ func TestCompression(t *testing.T) {
 ]`)
 }
 
+func TestDEKVersion(t *testing.T) {
+	dek := dummyDek()
+
+	encryptedEvents, err := encryptWithRand(ehevent.SerializeLines([]string{"foo", "bar"}), dek, 300, DefaultCompression, nullIv())
+	assert.Ok(t, err)
+
+	// 300 doesn't fit in one byte, so DEK version takes two bytes (0xac 0x02)
+	assert.EqualJson(t, encryptedEvents[0:3], `"AKwC"`)
+
+	dekVersion, err := DEKVersion(encryptedEvents)
+	assert.Ok(t, err)
+	assert.Assert(t, dekVersion == 300)
+
+	events, err := Decrypt(encryptedEvents, dek)
+	assert.Ok(t, err)
+
+	assert.EqualJson(t, ehevent.DeserializeLines(events), `[
+  "foo",
+  "bar"
+]`)
+
+	// v0 (= DEK never rotated) is also what pre-rotation data has
+	encryptedEvents, err = Encrypt(ehevent.SerializeLines([]string{"foo"}), dek)
+	assert.Ok(t, err)
+
+	dekVersion, err = DEKVersion(encryptedEvents)
+	assert.Ok(t, err)
+	assert.Assert(t, dekVersion == 0)
+
+	_, err = DEKVersion([]byte{0x10})
+	assert.EqualString(t, err.Error(), "DEKVersion: header reserved bits set - incompatible format: 10")
+}
+
 // dangerous in production, but we'll use this in our test so the base64 is distinctive
 func nullIv() io.Reader {
 	return bytes.NewReader([]byte{
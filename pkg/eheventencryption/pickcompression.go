@@ -0,0 +1,131 @@
+package eheventencryption
+
+// Measuring compression methods against a stream's actual data, to pick the best one for it
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// how one compression fared in CompareCompression()
+type CompressionResult struct {
+	Compression Compression
+	InputBytes  int
+	OutputBytes int           // as it would be stored (= uncompressed if compression didn't help)
+	Duration    time.Duration // compressing + decompressing all the samples
+}
+
+func (c CompressionResult) Ratio() float64 {
+	return float64(c.OutputBytes) / float64(c.InputBytes)
+}
+
+func (c CompressionResult) Name() string {
+	if c.Compression.Dictionary != nil {
+		return CompressionMethodZstdDictionary.String()
+	}
+
+	return c.Compression.Method.String()
+}
+
+// compresses (and decompresses, to verify) each sample with each candidate. samples are
+// plaintexts you'd give to Encrypt(), i.e. event batches.
+func CompareCompression(samples [][]byte, candidates []Compression) ([]CompressionResult, error) {
+	results := []CompressionResult{}
+
+	for _, candidate := range candidates {
+		result := CompressionResult{Compression: candidate}
+
+		started := time.Now()
+
+		for _, sample := range samples {
+			compressed, method, err := compressIfWellCompressible(sample, candidate)
+			if err != nil {
+				return nil, fmt.Errorf("CompareCompression: %s: %w", result.Name(), err)
+			}
+
+			decompressed, err := decompress(compressed, method, candidate.Dictionary)
+			if err != nil {
+				return nil, fmt.Errorf("CompareCompression: %s: %w", result.Name(), err)
+			}
+
+			if !bytes.Equal(decompressed, sample) {
+				return nil, fmt.Errorf("CompareCompression: %s: roundtrip mismatch", result.Name())
+			}
+
+			result.InputBytes += len(sample)
+			result.OutputBytes += len(compressed)
+		}
+
+		result.Duration = time.Since(started)
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// picks the best compression for a stream based on its recent data (*samples*, newest last).
+//
+// Candidates are deflate, zstd and zstd with a dictionary (ID *dictionaryID*). The dictionary is
+// trained on the older half of the samples and measured on the newer half, so we don't
+// overestimate how well it works for data it hasn't seen. If it wins, the returned dictionary
+// is trained on all of the samples.
+//
+// Smallest output wins, but a candidate that is almost as small (within 2 %) and faster is preferred.
+// Picked one is first in the results.
+func PickCompression(samples [][]byte, dictionaryID uint32) (*Compression, []CompressionResult, error) {
+	if len(samples) < 2 {
+		return nil, nil, errors.New("PickCompression: need at least two samples")
+	}
+
+	training, measuring := samples[:len(samples)/2], samples[len(samples)/2:]
+
+	candidates := []Compression{
+		{Method: CompressionMethodDeflate},
+		{Method: CompressionMethodZstd},
+	}
+
+	// not all data is enough for a dictionary. then we just don't consider it.
+	if dictionary, err := TrainDictionary(dictionaryID, training, DefaultDictionarySize); err == nil {
+		candidates = append(candidates, Compression{
+			Method:     CompressionMethodZstd,
+			Dictionary: dictionary,
+		})
+	}
+
+	results, err := CompareCompression(measuring, candidates)
+	if err != nil {
+		return nil, nil, fmt.Errorf("PickCompression: %w", err)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].OutputBytes < results[j].OutputBytes
+	})
+
+	best := 0
+	for i := 1; i < len(results); i++ {
+		almostAsSmall := float64(results[i].OutputBytes) <= float64(results[0].OutputBytes)*1.02
+		if almostAsSmall && results[i].Duration < results[best].Duration {
+			best = i
+		}
+	}
+
+	// picked first, others by size
+	results = append(
+		[]CompressionResult{results[best]},
+		append(append([]CompressionResult{}, results[:best]...), results[best+1:]...)...)
+
+	picked := results[0].Compression
+
+	if picked.Dictionary != nil {
+		picked.Dictionary, err = TrainDictionary(dictionaryID, samples, DefaultDictionarySize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("PickCompression: %w", err)
+		}
+	}
+
+	return &picked, results, nil
+}
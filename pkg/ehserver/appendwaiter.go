@@ -0,0 +1,124 @@
+package ehserver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/gokit/sync/syncutil"
+)
+
+const (
+	// long-polls can't be held open forever (load balancers, Lambda etc. have timeouts)
+	maxReadWait = 60 * time.Second
+	// we only learn of writes that went through this server process. writes from other
+	// server instances are noticed by re-reading with this interval
+	readWaitRecheckInterval = 5 * time.Second
+)
+
+// lets readers wait for new data in a stream without hammering the event log. fed by
+// writerNotifierWrapper, so this works without a MQTT broker.
+type appendWaiter struct {
+	streams   map[string]*streamWaiters
+	streamsMu sync.Mutex
+}
+
+type streamWaiters struct {
+	nextAppend chan struct{}
+	waiters    int // when this drops to zero, we forget the stream
+}
+
+func newAppendWaiter() *appendWaiter {
+	return &appendWaiter{
+		streams: map[string]*streamWaiters{},
+	}
+}
+
+// returned channel gets closed on next successful write to the stream. call release() when
+// you stop waiting, so streams that nobody waits for don't pile up in memory.
+func (a *appendWaiter) nextAppend(stream eh.StreamName) (<-chan struct{}, func()) {
+	defer syncutil.LockAndUnlock(&a.streamsMu)()
+
+	key := stream.String()
+
+	waiters, found := a.streams[key]
+	if !found {
+		waiters = &streamWaiters{nextAppend: make(chan struct{})}
+		a.streams[key] = waiters
+	}
+
+	waiters.waiters++
+
+	release := func() {
+		defer syncutil.LockAndUnlock(&a.streamsMu)()
+
+		waiters.waiters--
+
+		// if an append happened, appended() already removed these waiters (and maybe someone
+		// started waiting for the next append), so only remove if these are still current
+		if waiters.waiters == 0 && a.streams[key] == waiters {
+			delete(a.streams, key)
+		}
+	}
+
+	return waiters.nextAppend, release
+}
+
+// wakes up everyone waiting for the stream
+func (a *appendWaiter) appended(stream eh.StreamName) {
+	defer syncutil.LockAndUnlock(&a.streamsMu)()
+
+	if waiters, found := a.streams[stream.String()]; found {
+		close(waiters.nextAppend)
+		delete(a.streams, stream.String())
+	}
+}
+
+// like Reader.Read(), but if there is no new data, waits up to "wait" for it to arrive.
+// returns an empty result if nothing arrived in time.
+func (a *appendWaiter) readWaiting(
+	ctx context.Context,
+	reader eh.Reader,
+	after eh.Cursor,
+	wait time.Duration,
+) (*eh.ReadResult, error) {
+	if wait <= 0 {
+		return reader.Read(ctx, after)
+	}
+
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+	recheck := time.NewTicker(readWaitRecheckInterval)
+	defer recheck.Stop()
+
+	// returns nil result if we should keep waiting
+	waitOnce := func() (*eh.ReadResult, error) {
+		// subscribe before reading, so a write landing between our read and wait is not missed
+		appended, release := a.nextAppend(after.Stream())
+		defer release()
+
+		res, err := reader.Read(ctx, after)
+		if err != nil || len(res.Entries) > 0 {
+			return res, err
+		}
+
+		select {
+		case <-appended:
+			return nil, nil
+		case <-recheck.C:
+			return nil, nil
+		case <-deadline.C:
+			return res, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	for {
+		if res, err := waitOnce(); err != nil || res != nil {
+			return res, err
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package ehserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient/ehclienttest"
+	"github.com/function61/gokit/testing/assert"
+)
+
+var (
+	chatRoom = eh.RootName.Child("chatrooms").Child("offtopic")
+)
+
+func TestReadWaitingWakesUpOnAppend(t *testing.T) {
+	ctx := context.Background()
+
+	eventLog := ehclienttest.NewEventLog()
+	waiter := newAppendWaiter()
+
+	_, err := eventLog.Append(ctx, chatRoom, eh.LogData{Kind: eh.LogDataKindEncryptedData, Raw: []byte("hello")})
+	assert.Ok(t, err)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+
+		if _, err := eventLog.Append(ctx, chatRoom, eh.LogData{Kind: eh.LogDataKindEncryptedData, Raw: []byte("world")}); err != nil {
+			panic(err)
+		}
+
+		waiter.appended(chatRoom)
+	}()
+
+	started := time.Now()
+
+	res, err := waiter.readWaiting(ctx, eventLog, chatRoom.At(0), maxReadWait)
+	assert.Ok(t, err)
+	assert.Assert(t, len(res.Entries) == 1)
+	assert.EqualString(t, string(res.Entries[0].Data.Raw), "world")
+	assert.EqualString(t, res.LastEntry.Serialize(), "/chatrooms/offtopic@1")
+
+	// woke up because of the append, not because of recheck interval
+	assert.Assert(t, time.Since(started) < readWaitRecheckInterval)
+
+	assert.EqualInt(t, len(waiter.streams), 0)
+}
+
+func TestReadWaitingReturnsExistingDataImmediately(t *testing.T) {
+	ctx := context.Background()
+
+	eventLog := ehclienttest.NewEventLog()
+	waiter := newAppendWaiter()
+
+	_, err := eventLog.Append(ctx, chatRoom, eh.LogData{Kind: eh.LogDataKindEncryptedData, Raw: []byte("hello")})
+	assert.Ok(t, err)
+
+	res, err := waiter.readWaiting(ctx, eventLog, chatRoom.Beginning(), maxReadWait)
+	assert.Ok(t, err)
+	assert.Assert(t, len(res.Entries) == 1)
+
+	assert.EqualInt(t, len(waiter.streams), 0)
+}
+
+func TestReadWaitingTimesOut(t *testing.T) {
+	ctx := context.Background()
+
+	eventLog := ehclienttest.NewEventLog()
+	waiter := newAppendWaiter()
+
+	_, err := eventLog.Append(ctx, chatRoom, eh.LogData{Kind: eh.LogDataKindEncryptedData, Raw: []byte("hello")})
+	assert.Ok(t, err)
+
+	res, err := waiter.readWaiting(ctx, eventLog, chatRoom.At(0), 10*time.Millisecond)
+	assert.Ok(t, err)
+	assert.Assert(t, len(res.Entries) == 0)
+	assert.EqualString(t, res.LastEntry.Serialize(), "/chatrooms/offtopic@0")
+
+	// stream that nobody waits for anymore is forgotten
+	assert.EqualInt(t, len(waiter.streams), 0)
+}
+
+func TestReadWaitingCancel(t *testing.T) {
+	eventLog := ehclienttest.NewEventLog()
+	waiter := newAppendWaiter()
+
+	_, err := eventLog.Append(context.Background(), chatRoom, eh.LogData{Kind: eh.LogDataKindEncryptedData, Raw: []byte("hello")})
+	assert.Ok(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = waiter.readWaiting(ctx, eventLog, chatRoom.At(0), maxReadWait)
+	assert.Assert(t, err == context.DeadlineExceeded)
+
+	assert.EqualInt(t, len(waiter.streams), 0)
+}
+
+func TestAppendWaiterRelease(t *testing.T) {
+	waiter := newAppendWaiter()
+
+	first, releaseFirst := waiter.nextAppend(chatRoom)
+	_, releaseSecond := waiter.nextAppend(chatRoom)
+	assert.EqualInt(t, len(waiter.streams), 1)
+
+	releaseFirst()
+	assert.EqualInt(t, len(waiter.streams), 1) // second one still waits
+
+	releaseSecond()
+	assert.EqualInt(t, len(waiter.streams), 0)
+
+	// release after append must not forget those who started waiting for the next append
+	_, releaseThird := waiter.nextAppend(chatRoom)
+	waiter.appended(chatRoom)
+	fourth, releaseFourth := waiter.nextAppend(chatRoom)
+	releaseThird()
+	assert.EqualInt(t, len(waiter.streams), 1)
+
+	select {
+	case <-fourth:
+		t.Fatal("fourth should not have been woken up")
+	default:
+	}
+
+	releaseFourth()
+	assert.EqualInt(t, len(waiter.streams), 0)
+
+	select {
+	case <-first:
+		t.Fatal("first should not have been woken up, as there were no appends while it waited")
+	default:
+	}
+}
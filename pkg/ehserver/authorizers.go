@@ -30,13 +30,14 @@ func (a *authorizedWriter) CreateStream(
 	ctx context.Context,
 	stream eh.StreamName,
 	dekEnvelope envelopeenc.Envelope,
+	keyGroupId string,
 	data *eh.LogData,
 ) (*eh.AppendResult, error) {
 	if err := a.policy.Authorize(eh.ActionStreamCreate, stream.ResourceName()); err != nil {
 		return nil, err
 	}
 
-	return a.inner.CreateStream(ctx, stream, dekEnvelope, data)
+	return a.inner.CreateStream(ctx, stream, dekEnvelope, keyGroupId, data)
 }
 
 func (a *authorizedWriter) Append(
@@ -63,6 +64,43 @@ func (a *authorizedWriter) AppendAfter(
 	return a.inner.AppendAfter(ctx, after, data)
 }
 
+// every stream has to be authorized, so one transaction can't be used to write where you can't
+func (a *authorizedWriter) AppendMany(
+	ctx context.Context,
+	appends []eh.AppendAfterItem,
+) ([]eh.AppendResult, error) {
+	for _, item := range appends {
+		if err := a.policy.Authorize(eh.ActionStreamAppend, item.After.Stream().ResourceName()); err != nil {
+			return nil, err
+		}
+	}
+
+	return a.inner.AppendMany(ctx, appends)
+}
+
+func (a *authorizedWriter) CloseStream(
+	ctx context.Context,
+	stream eh.StreamName,
+	reason string,
+) (*eh.AppendResult, error) {
+	if err := a.policy.Authorize(eh.ActionStreamClose, stream.ResourceName()); err != nil {
+		return nil, err
+	}
+
+	return a.inner.CloseStream(ctx, stream, reason)
+}
+
+func (a *authorizedWriter) ShredStream(
+	ctx context.Context,
+	stream eh.StreamName,
+) (*eh.AppendResult, error) {
+	if err := a.policy.Authorize(eh.ActionStreamShred, stream.ResourceName()); err != nil {
+		return nil, err
+	}
+
+	return a.inner.ShredStream(ctx, stream)
+}
+
 // wraps a Reader so that read ops are only called if the client is allowed to do so
 func wrapReaderWithAuthorizer(
 	inner eh.Reader,
@@ -110,11 +148,7 @@ func (a *authorizedSnapshotStore) ReadSnapshot(
 	ctx context.Context,
 	input eh.ReadSnapshotInput,
 ) (*eh.ReadSnapshotOutput, error) {
-	if err := a.policy.Authorize(eh.ActionSnapshotRead, input.Stream.ResourceName()); err != nil {
-		return nil, err
-	}
-
-	if err := a.policy.Authorize(eh.ActionSnapshotRead, perspectiveToResourceName(input.Perspective)); err != nil {
+	if err := authorizeSnapshot(a.policy, eh.ActionSnapshotRead, input.Stream, input.Perspective); err != nil {
 		return nil, err
 	}
 
@@ -125,31 +159,62 @@ func (a *authorizedSnapshotStore) WriteSnapshot(
 	ctx context.Context,
 	snapshot eh.PersistedSnapshot,
 ) error {
-	if err := a.policy.Authorize(eh.ActionSnapshotWrite, snapshot.Cursor.Stream().ResourceName()); err != nil {
+	if err := authorizeSnapshot(a.policy, eh.ActionSnapshotWrite, snapshot.Cursor.Stream(), snapshot.Perspective); err != nil {
 		return err
 	}
 
-	if err := a.policy.Authorize(eh.ActionSnapshotWrite, perspectiveToResourceName(snapshot.Perspective)); err != nil {
+	return a.inner.WriteSnapshot(ctx, snapshot)
+}
+
+func (a *authorizedSnapshotStore) DeleteSnapshot(
+	ctx context.Context,
+	stream eh.StreamName,
+	perspective eh.SnapshotPerspective,
+) error {
+	if err := authorizeSnapshot(a.policy, eh.ActionSnapshotDelete, stream, perspective); err != nil {
 		return err
 	}
 
-	return a.inner.WriteSnapshot(ctx, snapshot)
+	return a.inner.DeleteSnapshot(ctx, stream, perspective)
 }
 
-func (a *authorizedSnapshotStore) DeleteSnapshot(
+func (a *authorizedSnapshotStore) ListSnapshots(
 	ctx context.Context,
 	stream eh.StreamName,
 	perspective eh.SnapshotPerspective,
+) ([]eh.Cursor, error) {
+	if err := authorizeSnapshot(a.policy, eh.ActionSnapshotRead, stream, perspective); err != nil {
+		return nil, err
+	}
+
+	return a.inner.ListSnapshots(ctx, stream, perspective)
+}
+
+// deletes versions, so requires delete permission
+func (a *authorizedSnapshotStore) RollbackSnapshot(
+	ctx context.Context,
+	to eh.Cursor,
+	perspective eh.SnapshotPerspective,
 ) error {
-	if err := a.policy.Authorize(eh.ActionSnapshotDelete, stream.ResourceName()); err != nil {
+	if err := authorizeSnapshot(a.policy, eh.ActionSnapshotDelete, to.Stream(), perspective); err != nil {
 		return err
 	}
 
-	if err := a.policy.Authorize(eh.ActionSnapshotDelete, perspectiveToResourceName(perspective)); err != nil {
+	return a.inner.RollbackSnapshot(ctx, to, perspective)
+}
+
+// snapshot access requires permission to both the stream and the perspective
+func authorizeSnapshot(
+	userPolicy policy.Policy,
+	action policy.Action,
+	stream eh.StreamName,
+	perspective eh.SnapshotPerspective,
+) error {
+	if err := userPolicy.Authorize(action, stream.ResourceName()); err != nil {
 		return err
 	}
 
-	return a.inner.DeleteSnapshot(ctx, stream, perspective)
+	return userPolicy.Authorize(action, perspectiveToResourceName(perspective))
 }
 
 func perspectiveToResourceName(perspective eh.SnapshotPerspective) policy.ResourceName {
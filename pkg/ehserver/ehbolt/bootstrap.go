@@ -0,0 +1,25 @@
+package ehbolt
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/ehserver/ehbootstrap"
+)
+
+// creates core streams required for EventHorizon to work
+func Bootstrap(ctx context.Context, e *Client) error {
+	bootstrap, err := ehbootstrap.Generate(time.Now())
+	if err != nil {
+		return err
+	}
+
+	if err := e.writeEntries(bootstrap.Entries); err != nil {
+		return err
+	}
+
+	fmt.Printf("Cluster-wide key: %s\n", bootstrap.ClusterWideKeyBase64())
+
+	return nil
+}
@@ -0,0 +1,511 @@
+// Event log & snapshot storage in a local file (BoltDB), for running EventHorizon on a
+// single node without AWS (laptops, CI, small edge boxes)
+package ehbolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/crypto/envelopeenc"
+)
+
+// layout inside the file:
+//
+//	streams/<stream name>/<version as big-endian uint64> = <eh.LogDataKind> || <data>
+//	hashes/<stream name>/<version as big-endian uint64> = eh.EntryHash()
+//	snapshots/<stream name>/<perspective> = JSON([]snapshotRecord) (newest first)
+//	closed/<stream name> = "closed" | "shredded"
+//
+// big-endian keys so that Bolt's byte-sorted keys are also in version order
+var (
+	streamsBucket   = []byte("streams")
+	snapshotsBucket = []byte("snapshots")
+	closedBucket    = []byte("closed")
+	hashesBucket    = []byte("hashes") // separate from entries so files from before hash chaining stay readable
+)
+
+var (
+	closedStateClosed   = []byte("closed")
+	closedStateShredded = []byte("shredded")
+)
+
+const (
+	readPageSize = 100 // same as DynamoDB's page size, so clients see similar pagination behaviour
+)
+
+type Client struct {
+	db                *bolt.DB
+	snapshotRetention eh.SnapshotRetention
+}
+
+// interface assertions
+var _ eh.ReaderWriter = (*Client)(nil)
+var _ eh.SnapshotStore = (*Client)(nil)
+
+// opens (or creates if does not exist) an event log file
+func Open(path string) (*Client, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		Timeout: 3 * time.Second, // file is exclusively locked, so don't hang forever if someone else has it open
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ehbolt: %w", err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{streamsBucket, snapshotsBucket, closedBucket, hashesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ehbolt: %w", err)
+	}
+
+	return &Client{db, eh.DefaultSnapshotRetention}, nil
+}
+
+// defaults to eh.DefaultSnapshotRetention
+func (e *Client) SetSnapshotRetention(retention eh.SnapshotRetention) {
+	e.snapshotRetention = retention
+}
+
+func (e *Client) Close() error {
+	return e.db.Close()
+}
+
+// "lastKnown" is exclusive (i.e. the record pointed by it will not be returned)
+func (e *Client) Read(ctx context.Context, lastKnown eh.Cursor) (*eh.ReadResult, error) {
+	stream := lastKnown.Stream()
+
+	lastVersion := lastKnown.Version()
+	entries := []eh.LogEntry{}
+	moreData := false
+
+	if err := e.db.View(func(tx *bolt.Tx) error {
+		streamBucket := streamBucketFor(tx, stream)
+		if streamBucket == nil {
+			return fmt.Errorf("Read: non-existent stream: %s", stream.String())
+		}
+
+		streamHashes := tx.Bucket(hashesBucket).Bucket([]byte(stream.String())) // nil for streams from before hash chaining
+
+		cursor := streamBucket.Cursor()
+
+		// these are in chronological order
+		for key, value := cursor.Seek(versionKey(lastKnown.Version() + 1)); key != nil; key, value = cursor.Next() {
+			if len(entries) == readPageSize {
+				moreData = true
+				break
+			}
+
+			lastVersion = versionFromKey(key)
+
+			entry := unmarshalLogEntry(stream.At(lastVersion), value)
+			if streamHashes != nil {
+				entry.Hash = append([]byte(nil), streamHashes.Get(key)...)
+			}
+
+			entries = append(entries, entry)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return &eh.ReadResult{
+		Entries:   entries,
+		LastEntry: stream.At(lastVersion),
+		More:      moreData,
+	}, nil
+}
+
+// unlike DynamoDB, we don't need retries since resolving stream position and writing happen
+// inside the same transaction
+func (e *Client) Append(ctx context.Context, stream eh.StreamName, data eh.LogData) (*eh.AppendResult, error) {
+	var resultingCursor eh.Cursor
+
+	if err := e.db.Update(func(tx *bolt.Tx) error {
+		streamBucket := streamBucketFor(tx, stream)
+		if streamBucket == nil {
+			return fmt.Errorf("Append: non-existent stream: %s", stream.String())
+		}
+
+		after := stream.At(headVersion(streamBucket))
+
+		resultingCursor = after.Next()
+
+		return appendAfter(tx, streamBucket, after, data)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &eh.AppendResult{
+		Cursor: resultingCursor,
+	}, nil
+}
+
+// NOTE: returned error is *ErrOptimisticLockingFailed if stream had writes
+func (e *Client) AppendAfter(ctx context.Context, after eh.Cursor, data eh.LogData) (*eh.AppendResult, error) {
+	resultingCursor := after.Next()
+
+	if resultingCursor.Version() == 0 {
+		// see comment in DynamoDB implementation
+		return nil, errors.New("AppendAfter: refusing @0, since stream should start with StreamStarted")
+	}
+
+	if err := e.db.Update(func(tx *bolt.Tx) error {
+		streamBucket := streamBucketFor(tx, after.Stream())
+		if streamBucket == nil {
+			return fmt.Errorf("AppendAfter: non-existent stream: %s", after.Stream().String())
+		}
+
+		return appendAfter(tx, streamBucket, after, data)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &eh.AppendResult{
+		Cursor: resultingCursor,
+	}, nil
+}
+
+// all appends happen inside the same transaction, so either all of them succeed or none do
+func (e *Client) AppendMany(ctx context.Context, appends []eh.AppendAfterItem) ([]eh.AppendResult, error) {
+	if err := eh.ValidateAppendMany(appends); err != nil {
+		return nil, err
+	}
+
+	if err := e.db.Update(func(tx *bolt.Tx) error {
+		for _, item := range appends {
+			streamBucket := streamBucketFor(tx, item.After.Stream())
+			if streamBucket == nil {
+				return fmt.Errorf("AppendMany: non-existent stream: %s", item.After.Stream().String())
+			}
+
+			if err := appendAfter(tx, streamBucket, item.After, item.Data); err != nil {
+				return err // rolls back the appends we already did
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	results := []eh.AppendResult{}
+	for _, item := range appends {
+		results = append(results, eh.AppendResult{
+			Cursor: item.After.Next(),
+		})
+	}
+
+	return results, nil
+}
+
+func (e *Client) CreateStream(
+	ctx context.Context,
+	stream eh.StreamName,
+	dekEnvelope envelopeenc.Envelope,
+	keyGroupId string,
+	initialData *eh.LogData,
+) (*eh.AppendResult, error) {
+	parent := stream.Parent()
+	if parent == nil {
+		return nil, errors.New("cannot create root stream")
+	}
+
+	now := time.Now()
+
+	resultingCursor := func() eh.Cursor {
+		if initialData != nil {
+			return stream.At(1)
+		} else {
+			return stream.At(0)
+		}
+	}()
+
+	// parent's notification and child's creation are written atomically
+	if err := e.db.Update(func(tx *bolt.Tx) error {
+		parentBucket := streamBucketFor(tx, *parent)
+		if parentBucket == nil {
+			return fmt.Errorf("CreateStream: parent '%s' does not exist", parent.String())
+		}
+
+		if err := appendAfter(
+			tx,
+			parentBucket,
+			parent.At(headVersion(parentBucket)),
+			*eh.LogDataMeta(eh.NewStreamChildStreamCreated(stream, ehevent.MetaSystemUser(now))),
+		); err != nil {
+			return err
+		}
+
+		streamBucket, err := tx.Bucket(streamsBucket).CreateBucket([]byte(stream.String()))
+		if err != nil {
+			if err == bolt.ErrBucketExists {
+				return fmt.Errorf("CreateStream: already exists: %s", stream.String())
+			} else {
+				return err
+			}
+		}
+
+		if err := putEntry(tx, streamBucket, stream.At(0), *eh.LogDataMeta(
+			eh.NewStreamStarted(dekEnvelope, keyGroupId, ehevent.MetaSystemUser(now)),
+		)); err != nil {
+			return err
+		}
+
+		if initialData != nil {
+			return appendAfter(tx, streamBucket, stream.At(0), *initialData)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return &eh.AppendResult{
+		Cursor: resultingCursor,
+	}, nil
+}
+
+func (e *Client) CloseStream(ctx context.Context, stream eh.StreamName, reason string) (*eh.AppendResult, error) {
+	var resultingCursor eh.Cursor
+
+	if err := e.db.Update(func(tx *bolt.Tx) error {
+		streamBucket := streamBucketFor(tx, stream)
+		if streamBucket == nil {
+			return fmt.Errorf("CloseStream: non-existent stream: %s", stream.String())
+		}
+
+		after := stream.At(headVersion(streamBucket))
+
+		resultingCursor = after.Next()
+
+		if err := appendAfter(
+			tx,
+			streamBucket,
+			after,
+			*eh.LogDataMeta(eh.NewStreamClosed(reason, ehevent.MetaSystemUser(time.Now()))),
+		); err != nil {
+			return err
+		}
+
+		return tx.Bucket(closedBucket).Put([]byte(stream.String()), closedStateClosed)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &eh.AppendResult{
+		Cursor: resultingCursor,
+	}, nil
+}
+
+// NOTE: Bolt doesn't zero freed pages, so destroyed envelopes can linger in the file until
+// their pages get reused. compact the file if you need hard guarantees.
+func (e *Client) ShredStream(ctx context.Context, stream eh.StreamName) (*eh.AppendResult, error) {
+	var resultingCursor eh.Cursor
+
+	now := time.Now()
+
+	if err := e.db.Update(func(tx *bolt.Tx) error {
+		streamBucket := streamBucketFor(tx, stream)
+		if streamBucket == nil {
+			return fmt.Errorf("ShredStream: non-existent stream: %s", stream.String())
+		}
+
+		switch state := tx.Bucket(closedBucket).Get([]byte(stream.String())); {
+		case state == nil:
+			return fmt.Errorf("ShredStream: close stream first: %s", stream.String())
+		case bytes.Equal(state, closedStateShredded):
+			return fmt.Errorf("ShredStream: already shredded: %s", stream.String())
+		}
+
+		// collect first, because modifying a bucket while iterating it is not supported
+		shreddedEntries := map[int64]eh.LogData{}
+
+		if err := streamBucket.ForEach(func(key []byte, value []byte) error {
+			version := versionFromKey(key)
+
+			shredded, err := eh.ShredDEKEnvelopes(unmarshalLogEntry(stream.At(version), value).Data)
+			if err != nil {
+				return err
+			}
+
+			if shredded != nil {
+				shreddedEntries[version] = *shredded
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		// hashes are left alone. they only cover commitments to the envelopes, which shredding keeps.
+		for version, shredded := range shreddedEntries {
+			if err := streamBucket.Put(versionKey(version), marshalLogData(shredded)); err != nil {
+				return err
+			}
+		}
+
+		resultingCursor = stream.At(headVersion(streamBucket) + 1)
+
+		if err := putEntry(
+			tx,
+			streamBucket,
+			resultingCursor,
+			*eh.LogDataMeta(eh.NewStreamShredded(ehevent.MetaSystemUser(now))),
+		); err != nil {
+			return err
+		}
+
+		if err := tx.Bucket(closedBucket).Put([]byte(stream.String()), closedStateShredded); err != nil {
+			return err
+		}
+
+		// let parent know, unless it's closed itself
+		if parent := stream.Parent(); parent != nil && tx.Bucket(closedBucket).Get([]byte(parent.String())) == nil {
+			parentBucket := streamBucketFor(tx, *parent)
+
+			return appendAfter(
+				tx,
+				parentBucket,
+				parent.At(headVersion(parentBucket)),
+				*eh.LogDataMeta(eh.NewStreamChildStreamShredded(stream, ehevent.MetaSystemUser(now))))
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return &eh.AppendResult{
+		Cursor: resultingCursor,
+	}, nil
+}
+
+// writes entries with their explicit positions in a single transaction. only meant for
+// bootstrapping, since this does not do any consistency checks other than refusing to overwrite.
+func (e *Client) writeEntries(entries []eh.LogEntry) error {
+	return e.db.Update(func(tx *bolt.Tx) error {
+		for _, entry := range entries {
+			streamBucket, err := tx.Bucket(streamsBucket).CreateBucketIfNotExists(
+				[]byte(entry.Cursor.Stream().String()))
+			if err != nil {
+				return err
+			}
+
+			key := versionKey(entry.Cursor.Version())
+
+			if streamBucket.Get(key) != nil {
+				return fmt.Errorf("writeEntries: already exists: %s", entry.Cursor.Serialize())
+			}
+
+			if err := streamBucket.Put(key, marshalLogData(entry.Data)); err != nil {
+				return err
+			}
+
+			if len(entry.Hash) > 0 {
+				streamHashes, err := tx.Bucket(hashesBucket).CreateBucketIfNotExists(
+					[]byte(entry.Cursor.Stream().String()))
+				if err != nil {
+					return err
+				}
+
+				if err := streamHashes.Put(key, entry.Hash); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// the heart of optimistic locking: data can only be written if "after" is the stream's
+// current head (= writer has seen all the writes that happened before)
+func appendAfter(tx *bolt.Tx, streamBucket *bolt.Bucket, after eh.Cursor, data eh.LogData) error {
+	if tx.Bucket(closedBucket).Get([]byte(after.Stream().String())) != nil {
+		return eh.NewErrStreamClosed(after.Stream())
+	}
+
+	if actualHead := headVersion(streamBucket); actualHead != after.Version() {
+		return eh.NewErrOptimisticLockingFailed(fmt.Errorf(
+			"conflict: %s afterRequested=%d afterActual=%d",
+			after.Stream().String(),
+			after.Version(),
+			actualHead))
+	}
+
+	return putEntry(tx, streamBucket, after.Next(), data)
+}
+
+// writes the entry and its hash, which is chained to the previous entry's hash
+func putEntry(tx *bolt.Tx, streamBucket *bolt.Bucket, cursor eh.Cursor, data eh.LogData) error {
+	streamHashes, err := tx.Bucket(hashesBucket).CreateBucketIfNotExists([]byte(cursor.Stream().String()))
+	if err != nil {
+		return err
+	}
+
+	var prevHash []byte // stays nil for first entry or if previous entry is from before hash chaining
+	if cursor.Version() > 0 {
+		prevHash = streamHashes.Get(versionKey(cursor.Version() - 1))
+	}
+
+	if err := streamBucket.Put(versionKey(cursor.Version()), marshalLogData(data)); err != nil {
+		return err
+	}
+
+	return streamHashes.Put(versionKey(cursor.Version()), eh.EntryHash(prevHash, cursor, data))
+}
+
+// returns -1 for empty stream (shouldn't happen b/c existing stream always has StreamStarted)
+func headVersion(streamBucket *bolt.Bucket) int64 {
+	key, _ := streamBucket.Cursor().Last()
+	if key == nil {
+		return -1
+	}
+
+	return versionFromKey(key)
+}
+
+// returns nil if stream does not exist
+func streamBucketFor(tx *bolt.Tx, stream eh.StreamName) *bolt.Bucket {
+	return tx.Bucket(streamsBucket).Bucket([]byte(stream.String()))
+}
+
+func versionKey(version int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(version))
+	return key
+}
+
+func versionFromKey(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key))
+}
+
+func marshalLogData(data eh.LogData) []byte {
+	return append([]byte{byte(data.Kind)}, data.Raw...)
+}
+
+func unmarshalLogEntry(cursor eh.Cursor, kindAndData []byte) eh.LogEntry {
+	return eh.LogEntry{
+		Cursor: cursor,
+		Data: eh.LogData{
+			Kind: eh.LogDataKind(kindAndData[0]),
+			// Bolt's returned values are only valid for the life of the transaction
+			Raw: append([]byte(nil), kindAndData[1:]...),
+		},
+	}
+}
@@ -0,0 +1,414 @@
+package ehbolt
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/gokit/crypto/envelopeenc"
+	"github.com/function61/gokit/testing/assert"
+)
+
+var (
+	chatRooms = eh.RootName.Child("chatrooms")
+)
+
+func TestCreateStream(t *testing.T) {
+	client, ctx, cleanup := newTestingClient(t)
+	defer cleanup()
+
+	offtopic := chatRooms.Child("offtopic")
+
+	createResult, err := client.CreateStream(ctx, offtopic, envelopeenc.Envelope{}, "default", &eh.LogData{
+		Kind: eh.LogDataKindEncryptedData,
+		Raw:  []byte("hello"),
+	})
+	assert.Ok(t, err)
+	assert.EqualString(t, createResult.Cursor.Serialize(), "/chatrooms/offtopic@1")
+
+	_, err = client.CreateStream(ctx, offtopic, envelopeenc.Envelope{}, "default", nil)
+	assert.EqualString(t, err.Error(), "CreateStream: already exists: /chatrooms/offtopic")
+
+	_, err = client.CreateStream(ctx, eh.RootName.Child("nonexistent").Child("foo"), envelopeenc.Envelope{}, "default", nil)
+	assert.EqualString(t, err.Error(), "CreateStream: parent '/nonexistent' does not exist")
+
+	// parent got notified
+	parentRead, err := client.Read(ctx, chatRooms.At(0))
+	assert.Ok(t, err)
+	assert.Assert(t, len(parentRead.Entries) == 1)
+	assert.EqualString(t, parentRead.LastEntry.Serialize(), "/chatrooms@1")
+	assert.Assert(t, parentRead.Entries[0].Data.Kind == eh.LogDataKindMeta)
+
+	childRead, err := client.Read(ctx, offtopic.Beginning())
+	assert.Ok(t, err)
+	assert.Assert(t, len(childRead.Entries) == 2)
+	assert.Assert(t, childRead.Entries[0].Data.Kind == eh.LogDataKindMeta) // StreamStarted
+	assert.EqualString(t, string(childRead.Entries[1].Data.Raw), "hello")
+	assert.Assert(t, !childRead.More)
+
+	_, err = client.Read(ctx, eh.RootName.Child("nonexistent").Beginning())
+	assert.EqualString(t, err.Error(), "Read: non-existent stream: /nonexistent")
+}
+
+func TestAppendAfterConflict(t *testing.T) {
+	client, ctx, cleanup := newTestingClient(t)
+	defer cleanup()
+
+	res, err := client.AppendAfter(ctx, chatRooms.At(0), dummyData("first"))
+	assert.Ok(t, err)
+	assert.EqualString(t, res.Cursor.Serialize(), "/chatrooms@1")
+
+	// someone else already wrote after @0
+	_, err = client.AppendAfter(ctx, chatRooms.At(0), dummyData("conflicting"))
+	_, isOptimisticLocking := err.(*eh.ErrOptimisticLockingFailed)
+	assert.Assert(t, isOptimisticLocking)
+	assert.EqualString(t, err.Error(), "conflict: /chatrooms afterRequested=0 afterActual=1")
+
+	_, err = client.AppendAfter(ctx, chatRooms.Beginning(), dummyData("at zero"))
+	assert.EqualString(t, err.Error(), "AppendAfter: refusing @0, since stream should start with StreamStarted")
+
+	res, err = client.Append(ctx, chatRooms, dummyData("second"))
+	assert.Ok(t, err)
+	assert.EqualString(t, res.Cursor.Serialize(), "/chatrooms@2")
+}
+
+func TestAppendManyIsAtomic(t *testing.T) {
+	client, ctx, cleanup := newTestingClient(t)
+	defer cleanup()
+
+	// "/" has ChildStreamCreated for "/chatrooms"
+	results, err := client.AppendMany(ctx, []eh.AppendAfterItem{
+		{After: chatRooms.At(0), Data: dummyData("aggregate")},
+		{After: eh.RootName.At(1), Data: dummyData("index")},
+	})
+	assert.Ok(t, err)
+	assert.Assert(t, len(results) == 2)
+	assert.EqualString(t, results[0].Cursor.Serialize(), "/chatrooms@1")
+	assert.EqualString(t, results[1].Cursor.Serialize(), "/@2")
+
+	// first one would succeed, but the second one conflicts
+	_, err = client.AppendMany(ctx, []eh.AppendAfterItem{
+		{After: chatRooms.At(1), Data: dummyData("aggregate")},
+		{After: eh.RootName.At(1), Data: dummyData("index")},
+	})
+	_, isOptimisticLocking := err.(*eh.ErrOptimisticLockingFailed)
+	assert.Assert(t, isOptimisticLocking)
+	assert.EqualString(t, err.Error(), "conflict: / afterRequested=1 afterActual=2")
+
+	chatRoomsRead, err := client.Read(ctx, chatRooms.At(1))
+	assert.Ok(t, err)
+	assert.Assert(t, len(chatRoomsRead.Entries) == 0)
+
+	_, err = client.AppendMany(ctx, []eh.AppendAfterItem{
+		{After: chatRooms.At(1), Data: dummyData("first")},
+		{After: chatRooms.At(2), Data: dummyData("second")},
+	})
+	assert.EqualString(t, err.Error(), "AppendMany: stream more than once: /chatrooms")
+}
+
+func TestHashChain(t *testing.T) {
+	client, ctx, cleanup := newTestingClient(t)
+	defer cleanup()
+
+	offtopic := chatRooms.Child("offtopic")
+
+	_, err := client.CreateStream(ctx, offtopic, envelopeenc.Envelope{}, "default", nil)
+	assert.Ok(t, err)
+
+	_, err = client.Append(ctx, offtopic, dummyData("hello"))
+	assert.Ok(t, err)
+
+	result, err := eh.VerifyHashChain(ctx, offtopic, client)
+	assert.Ok(t, err)
+	assert.Assert(t, result.BrokenAt == nil)
+	assert.EqualInt(t, result.Entries, 2)
+
+	// root's StreamStarted was written without a hash, but its appends after that are chained
+	result, err = eh.VerifyHashChain(ctx, eh.RootName, client)
+	assert.Ok(t, err)
+	assert.Assert(t, result.BrokenAt == nil)
+	assert.EqualInt(t, result.Entries, 1)
+	assert.EqualInt(t, result.Unhashed, 1)
+
+	// tamper with the data behind the log's back
+	assert.Ok(t, client.db.Update(func(tx *bolt.Tx) error {
+		return streamBucketFor(tx, offtopic).Put(versionKey(1), marshalLogData(dummyData("HELLO")))
+	}))
+
+	result, err = eh.VerifyHashChain(ctx, offtopic, client)
+	assert.Ok(t, err)
+	assert.EqualString(t, result.BrokenAt.Serialize(), "/chatrooms/offtopic@1")
+}
+
+func TestReadPagination(t *testing.T) {
+	client, ctx, cleanup := newTestingClient(t)
+	defer cleanup()
+
+	for i := 0; i < 150; i++ {
+		_, err := client.Append(ctx, chatRooms, dummyData(fmt.Sprintf("msg %d", i)))
+		assert.Ok(t, err)
+	}
+
+	firstPage, err := client.Read(ctx, chatRooms.Beginning())
+	assert.Ok(t, err)
+	assert.Assert(t, len(firstPage.Entries) == 100)
+	assert.Assert(t, firstPage.More)
+	assert.EqualString(t, firstPage.LastEntry.Serialize(), "/chatrooms@99")
+
+	secondPage, err := client.Read(ctx, firstPage.LastEntry)
+	assert.Ok(t, err)
+	assert.Assert(t, len(secondPage.Entries) == 51)
+	assert.Assert(t, !secondPage.More)
+	assert.EqualString(t, secondPage.LastEntry.Serialize(), "/chatrooms@150")
+	assert.EqualString(t, string(secondPage.Entries[50].Data.Raw), "msg 149")
+
+	// realtime reached: no entries, cursor doesn't move
+	emptyPage, err := client.Read(ctx, secondPage.LastEntry)
+	assert.Ok(t, err)
+	assert.Assert(t, len(emptyPage.Entries) == 0)
+	assert.EqualString(t, emptyPage.LastEntry.Serialize(), "/chatrooms@150")
+}
+
+func TestSnapshots(t *testing.T) {
+	client, ctx, cleanup := newTestingClient(t)
+	defer cleanup()
+
+	perspective := eh.NewV1Perspective("chat")
+
+	readSnapshot := func() (*eh.ReadSnapshotOutput, error) {
+		return client.ReadSnapshot(ctx, eh.ReadSnapshotInput{
+			Stream:          chatRooms,
+			Perspective:     perspective,
+			PreferEagerRead: true,
+		})
+	}
+
+	_, err := readSnapshot()
+	assert.Assert(t, err == os.ErrNotExist)
+
+	_, err = client.Append(ctx, chatRooms, dummyData("after snapshot"))
+	assert.Ok(t, err)
+
+	assert.Ok(t, client.WriteSnapshot(ctx, *eh.NewSnapshot(chatRooms.At(0), []byte("v0"), perspective).Unencrypted()))
+
+	output, err := readSnapshot()
+	assert.Ok(t, err)
+	assert.EqualString(t, output.Snapshot.Cursor.Serialize(), "/chatrooms@0")
+	assert.Assert(t, len(output.EagerRead.Entries) == 1)
+
+	// older snapshot does not overwrite newer
+	assert.Ok(t, client.WriteSnapshot(ctx, *eh.NewSnapshot(chatRooms.At(1), []byte("v1"), perspective).Unencrypted()))
+	assert.Ok(t, client.WriteSnapshot(ctx, *eh.NewSnapshot(chatRooms.At(0), []byte("v0"), perspective).Unencrypted()))
+
+	output, err = readSnapshot()
+	assert.Ok(t, err)
+	assert.EqualString(t, output.Snapshot.Cursor.Serialize(), "/chatrooms@1")
+	assert.EqualString(t, string(output.Snapshot.RawData[1:]), "v1")
+
+	assert.Ok(t, client.DeleteSnapshot(ctx, chatRooms, perspective))
+	assert.Assert(t, client.DeleteSnapshot(ctx, chatRooms, perspective) == os.ErrNotExist)
+}
+
+func TestSnapshotHistory(t *testing.T) {
+	client, ctx, cleanup := newTestingClient(t)
+	defer cleanup()
+
+	client.SetSnapshotRetention(eh.SnapshotRetention{KeepVersions: 3})
+
+	perspective := eh.NewV1Perspective("chat")
+
+	versions := func() string {
+		cursors, err := client.ListSnapshots(ctx, chatRooms, perspective)
+		assert.Ok(t, err)
+
+		serialized := []string{}
+		for _, cursor := range cursors {
+			serialized = append(serialized, cursor.Serialize())
+		}
+
+		return strings.Join(serialized, ", ")
+	}
+
+	readAtOrBefore := func(version int64) string {
+		atOrBefore := chatRooms.At(version)
+
+		output, err := client.ReadSnapshot(ctx, eh.ReadSnapshotInput{
+			Stream:      chatRooms,
+			Perspective: perspective,
+			AtOrBefore:  &atOrBefore,
+		})
+		if err != nil {
+			return err.Error()
+		}
+
+		return string(output.Snapshot.RawData[1:])
+	}
+
+	for _, version := range []int64{2, 4, 6, 8} {
+		data := []byte(fmt.Sprintf("v%d", version))
+		assert.Ok(t, client.WriteSnapshot(ctx, *eh.NewSnapshot(chatRooms.At(version), data, perspective).Unencrypted()))
+	}
+
+	// oldest version fell out of retention
+	assert.EqualString(t, versions(), "/chatrooms@8, /chatrooms@6, /chatrooms@4")
+
+	// one key per version, and the expired one was deleted
+	assert.EqualString(t, snapshotKeysOf(t, client, chatRooms), "chat:v1#00000000000000000004, chat:v1#00000000000000000006, chat:v1#00000000000000000008")
+
+	assert.EqualString(t, readAtOrBefore(7), "v6")
+	assert.EqualString(t, readAtOrBefore(8), "v8")
+	assert.EqualString(t, readAtOrBefore(3), os.ErrNotExist.Error())
+
+	assert.Assert(t, client.RollbackSnapshot(ctx, chatRooms.At(5), perspective) == os.ErrNotExist)
+	assert.Ok(t, client.RollbackSnapshot(ctx, chatRooms.At(4), perspective))
+	assert.EqualString(t, versions(), "/chatrooms@4")
+
+	// after rollback, versions newer than the rolled-back-to one can be written again
+	assert.Ok(t, client.WriteSnapshot(ctx, *eh.NewSnapshot(chatRooms.At(5), []byte("v5"), perspective).Unencrypted()))
+	assert.EqualString(t, versions(), "/chatrooms@5, /chatrooms@4")
+
+	assert.Ok(t, client.DeleteSnapshot(ctx, chatRooms, perspective))
+	assert.EqualString(t, versions(), "")
+}
+
+func TestSnapshotFromBeforeHistory(t *testing.T) {
+	client, ctx, cleanup := newTestingClient(t)
+	defer cleanup()
+
+	perspective := eh.NewV1Perspective("chat")
+
+	assert.Ok(t, client.db.Update(func(tx *bolt.Tx) error {
+		perspectives, err := tx.Bucket(snapshotsBucket).CreateBucketIfNotExists([]byte(chatRooms.String()))
+		if err != nil {
+			return err
+		}
+
+		return perspectives.Put([]byte(perspective.String()), []byte(`{"v":3,"d":"AXYz"}`))
+	}))
+
+	assert.Ok(t, client.WriteSnapshot(ctx, *eh.NewSnapshot(chatRooms.At(4), []byte("v4"), perspective).Unencrypted()))
+
+	cursors, err := client.ListSnapshots(ctx, chatRooms, perspective)
+	assert.Ok(t, err)
+	assert.Assert(t, len(cursors) == 2)
+	assert.EqualString(t, cursors[1].Serialize(), "/chatrooms@3")
+
+	// migrated under its own key
+	assert.EqualString(t, snapshotKeysOf(t, client, chatRooms), "chat:v1#00000000000000000003, chat:v1#00000000000000000004")
+
+	atOrBefore := chatRooms.At(3)
+	output, err := client.ReadSnapshot(ctx, eh.ReadSnapshotInput{
+		Stream:      chatRooms,
+		Perspective: perspective,
+		AtOrBefore:  &atOrBefore,
+	})
+	assert.Ok(t, err)
+	assert.EqualString(t, string(output.Snapshot.RawData[1:]), "v3")
+}
+
+func snapshotKeysOf(t *testing.T, client *Client, stream eh.StreamName) string {
+	t.Helper()
+
+	keys := []string{}
+
+	assert.Ok(t, client.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(snapshotsBucket).Bucket([]byte(stream.String())).ForEach(func(key, _ []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+	}))
+
+	return strings.Join(keys, ", ")
+}
+
+func TestCloseAndShredStream(t *testing.T) {
+	client, ctx, cleanup := newTestingClient(t)
+	defer cleanup()
+
+	offtopic := chatRooms.Child("offtopic")
+
+	_, err := client.CreateStream(ctx, offtopic, envelopeenc.Envelope{}, "default", &eh.LogData{
+		Kind: eh.LogDataKindEncryptedData,
+		Raw:  []byte("hello"),
+	})
+	assert.Ok(t, err)
+
+	_, err = client.ShredStream(ctx, offtopic)
+	assert.EqualString(t, err.Error(), "ShredStream: close stream first: /chatrooms/offtopic")
+
+	closeResult, err := client.CloseStream(ctx, offtopic, "GDPR request")
+	assert.Ok(t, err)
+	assert.EqualString(t, closeResult.Cursor.Serialize(), "/chatrooms/offtopic@2")
+
+	_, err = client.Append(ctx, offtopic, dummyData("after close"))
+	_, isClosed := err.(*eh.ErrStreamClosed)
+	assert.Assert(t, isClosed)
+	assert.EqualString(t, err.Error(), "stream closed: /chatrooms/offtopic")
+
+	_, err = client.AppendAfter(ctx, closeResult.Cursor, dummyData("after close"))
+	_, isClosed = err.(*eh.ErrStreamClosed)
+	assert.Assert(t, isClosed)
+
+	_, err = client.CloseStream(ctx, offtopic, "again")
+	_, isClosed = err.(*eh.ErrStreamClosed)
+	assert.Assert(t, isClosed)
+
+	shredResult, err := client.ShredStream(ctx, offtopic)
+	assert.Ok(t, err)
+	assert.EqualString(t, shredResult.Cursor.Serialize(), "/chatrooms/offtopic@3")
+
+	_, err = client.ShredStream(ctx, offtopic)
+	assert.EqualString(t, err.Error(), "ShredStream: already shredded: /chatrooms/offtopic")
+
+	childRead, err := client.Read(ctx, offtopic.Beginning())
+	assert.Ok(t, err)
+	assert.Assert(t, len(childRead.Entries) == 4)
+	assert.EqualString(t, string(childRead.Entries[1].Data.Raw), "hello") // encrypted data is left alone
+
+	verifyResult, err := eh.VerifyHashChain(ctx, offtopic, client)
+	assert.Ok(t, err)
+	assert.Assert(t, verifyResult.BrokenAt == nil)
+	assert.EqualInt(t, verifyResult.Entries, 4)
+
+	// parent: ChildStreamCreated, ChildStreamShredded
+	parentRead, err := client.Read(ctx, chatRooms.At(0))
+	assert.Ok(t, err)
+	assert.EqualString(t, parentRead.LastEntry.Serialize(), "/chatrooms@2")
+}
+
+// gives a client with "/" and "/chatrooms" streams created
+func newTestingClient(t *testing.T) (*Client, context.Context, func()) {
+	dir, err := ioutil.TempDir("", "ehbolt")
+	assert.Ok(t, err)
+
+	client, err := Open(filepath.Join(dir, "eventhorizon.db"))
+	assert.Ok(t, err)
+
+	cleanup := func() {
+		client.Close()
+		os.RemoveAll(dir)
+	}
+
+	// contents of StreamStarted are not interesting for these tests
+	assert.Ok(t, client.writeEntries([]eh.LogEntry{
+		{Cursor: eh.RootName.At(0), Data: dummyData("root started")},
+	}))
+
+	_, err = client.CreateStream(context.Background(), chatRooms, envelopeenc.Envelope{}, "default", nil)
+	assert.Ok(t, err)
+
+	return client, context.Background(), cleanup
+}
+
+func dummyData(content string) eh.LogData {
+	return eh.LogData{
+		Kind: eh.LogDataKindEncryptedData,
+		Raw:  []byte(content),
+	}
+}
@@ -0,0 +1,301 @@
+package ehbolt
+
+// Each snapshot version is stored under its own key "<perspective>#<version>" (version zero-padded,
+// so keys sort by version) in the stream's bucket. Writing or pruning a version doesn't touch the
+// others.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+	"github.com/function61/eventhorizon/pkg/eh"
+)
+
+// format from before snapshot history: the only version, under key "<perspective>"
+type snapshotRecord struct {
+	Version int64  `json:"v"` // we conditionally put updates as not to overwrite advanced state
+	RawData []byte `json:"d"` // actual snapshot data, probably encrypted
+}
+
+func (e *Client) ReadSnapshot(
+	ctx context.Context,
+	input eh.ReadSnapshotInput,
+) (*eh.ReadSnapshotOutput, error) {
+	var snapshot *eh.PersistedSnapshot
+
+	if err := e.db.View(func(tx *bolt.Tx) error {
+		perspectives := tx.Bucket(snapshotsBucket).Bucket([]byte(input.Stream.String()))
+		if perspectives == nil {
+			return os.ErrNotExist
+		}
+
+		versions, err := snapshotVersions(perspectives, input.Perspective)
+		if err != nil {
+			return err
+		}
+
+		for _, version := range versions {
+			if !input.Accepts(version) {
+				continue
+			}
+
+			rawData, err := snapshotData(perspectives, input.Perspective, version)
+			if err != nil {
+				return err
+			}
+
+			snapshot = &eh.PersistedSnapshot{
+				Cursor:      input.Stream.At(version),
+				RawData:     rawData,
+				Perspective: input.Perspective,
+			}
+
+			return nil
+		}
+
+		return os.ErrNotExist
+	}); err != nil {
+		return nil, err
+	}
+
+	output := &eh.ReadSnapshotOutput{
+		Snapshot: snapshot,
+	}
+
+	// we have the event log at hand, so the eager read is cheap
+	if input.PreferEagerRead {
+		eagerRead, err := e.Read(ctx, output.Snapshot.Cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		output.EagerRead = eagerRead
+	}
+
+	return output, nil
+}
+
+func (e *Client) WriteSnapshot(ctx context.Context, snap eh.PersistedSnapshot) error {
+	return e.db.Update(func(tx *bolt.Tx) error {
+		perspectives, err := tx.Bucket(snapshotsBucket).CreateBucketIfNotExists([]byte(snap.Cursor.Stream().String()))
+		if err != nil {
+			return err
+		}
+
+		if err := migrateLegacySnapshot(perspectives, snap.Perspective); err != nil {
+			return err
+		}
+
+		versions, err := snapshotVersions(perspectives, snap.Perspective)
+		if err != nil {
+			return err
+		}
+
+		if len(versions) > 0 && versions[0] >= snap.Cursor.Version() {
+			return nil // not an error per se, since there was a newer version stored
+		}
+
+		if err := perspectives.Put(snapshotKey(snap.Perspective, snap.Cursor.Version()), snap.RawData); err != nil {
+			return err
+		}
+
+		for _, expired := range e.snapshotRetention.Expired(append([]int64{snap.Cursor.Version()}, versions...)) {
+			if err := perspectives.Delete(snapshotKey(snap.Perspective, expired)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (e *Client) DeleteSnapshot(
+	ctx context.Context,
+	stream eh.StreamName,
+	perspective eh.SnapshotPerspective,
+) error {
+	return e.db.Update(func(tx *bolt.Tx) error {
+		perspectives := tx.Bucket(snapshotsBucket).Bucket([]byte(stream.String()))
+		if perspectives == nil {
+			return os.ErrNotExist
+		}
+
+		if err := migrateLegacySnapshot(perspectives, perspective); err != nil {
+			return err
+		}
+
+		versions, err := snapshotVersions(perspectives, perspective)
+		if err != nil {
+			return err
+		}
+
+		if len(versions) == 0 {
+			return os.ErrNotExist
+		}
+
+		for _, version := range versions {
+			if err := perspectives.Delete(snapshotKey(perspective, version)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (e *Client) ListSnapshots(
+	ctx context.Context,
+	stream eh.StreamName,
+	perspective eh.SnapshotPerspective,
+) ([]eh.Cursor, error) {
+	cursors := []eh.Cursor{}
+
+	if err := e.db.View(func(tx *bolt.Tx) error {
+		perspectives := tx.Bucket(snapshotsBucket).Bucket([]byte(stream.String()))
+		if perspectives == nil {
+			return nil
+		}
+
+		versions, err := snapshotVersions(perspectives, perspective)
+		if err != nil {
+			return err
+		}
+
+		for _, version := range versions {
+			cursors = append(cursors, stream.At(version))
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return cursors, nil
+}
+
+func (e *Client) RollbackSnapshot(
+	ctx context.Context,
+	to eh.Cursor,
+	perspective eh.SnapshotPerspective,
+) error {
+	return e.db.Update(func(tx *bolt.Tx) error {
+		perspectives := tx.Bucket(snapshotsBucket).Bucket([]byte(to.Stream().String()))
+		if perspectives == nil {
+			return os.ErrNotExist
+		}
+
+		if err := migrateLegacySnapshot(perspectives, perspective); err != nil {
+			return err
+		}
+
+		if perspectives.Get(snapshotKey(perspective, to.Version())) == nil {
+			return os.ErrNotExist
+		}
+
+		versions, err := snapshotVersions(perspectives, perspective)
+		if err != nil {
+			return err
+		}
+
+		for _, version := range versions {
+			if version <= to.Version() {
+				break
+			}
+
+			if err := perspectives.Delete(snapshotKey(perspective, version)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func snapshotKey(perspective eh.SnapshotPerspective, version int64) []byte {
+	return []byte(fmt.Sprintf("%s#%020d", perspective.String(), version))
+}
+
+// newest first. includes the version from before snapshot history (if not migrated yet)
+func snapshotVersions(perspectives *bolt.Bucket, perspective eh.SnapshotPerspective) ([]int64, error) {
+	prefix := []byte(perspective.String() + "#")
+
+	versions := []int64{}
+
+	cursor := perspectives.Cursor()
+	for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+		version, err := strconv.ParseInt(string(key[len(prefix):]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("snapshotVersions: %w", err)
+		}
+
+		versions = append(versions, version)
+	}
+
+	// keys are oldest first
+	for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+		versions[i], versions[j] = versions[j], versions[i]
+	}
+
+	legacy, err := legacySnapshot(perspectives, perspective)
+	if err != nil {
+		return nil, err
+	}
+
+	if legacy != nil { // older than any version with own key, since it was written before them
+		versions = append(versions, legacy.Version)
+	}
+
+	return versions, nil
+}
+
+// returns a copy, since bolt's values are only valid for the transaction
+func snapshotData(perspectives *bolt.Bucket, perspective eh.SnapshotPerspective, version int64) ([]byte, error) {
+	if rawData := perspectives.Get(snapshotKey(perspective, version)); rawData != nil {
+		return append([]byte{}, rawData...), nil
+	}
+
+	legacy, err := legacySnapshot(perspectives, perspective)
+	if err != nil {
+		return nil, err
+	}
+
+	if legacy == nil || legacy.Version != version {
+		return nil, os.ErrNotExist
+	}
+
+	return legacy.RawData, nil
+}
+
+// nil if none
+func legacySnapshot(perspectives *bolt.Bucket, perspective eh.SnapshotPerspective) (*snapshotRecord, error) {
+	recordJson := perspectives.Get([]byte(perspective.String()))
+	if recordJson == nil {
+		return nil, nil
+	}
+
+	record := &snapshotRecord{}
+	if err := json.Unmarshal(recordJson, record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// moves the version from before snapshot history under its own key
+func migrateLegacySnapshot(perspectives *bolt.Bucket, perspective eh.SnapshotPerspective) error {
+	legacy, err := legacySnapshot(perspectives, perspective)
+	if err != nil || legacy == nil {
+		return err
+	}
+
+	if err := perspectives.Put(snapshotKey(perspective, legacy.Version), legacy.RawData); err != nil {
+		return err
+	}
+
+	return perspectives.Delete([]byte(perspective.String()))
+}
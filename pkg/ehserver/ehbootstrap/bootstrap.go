@@ -0,0 +1,222 @@
+// Generates the initial log entries for core streams required for EventHorizon to work.
+// Storage implementations are responsible for writing the entries atomically.
+package ehbootstrap
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"io/ioutil"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/eheventencryption"
+	"github.com/function61/eventhorizon/pkg/keyserver"
+	"github.com/function61/eventhorizon/pkg/policy"
+	"github.com/function61/eventhorizon/pkg/system/ehcreddomain"
+	"github.com/function61/eventhorizon/pkg/system/ehsettingsdomain"
+	"github.com/function61/gokit/crypto/cryptoutil"
+	"github.com/function61/gokit/crypto/envelopeenc"
+)
+
+type Output struct {
+	Entries        []eh.LogEntry // in order they should be written (but write them in one transaction)
+	ClusterWideKey [32]byte
+}
+
+func (o *Output) ClusterWideKeyBase64() string {
+	return base64.RawURLEncoding.EncodeToString(o.ClusterWideKey[:])
+}
+
+func Generate(now time.Time) (*Output, error) {
+	seqs := map[string]int64{}
+	cur := func(stream eh.StreamName) eh.Cursor {
+		curr := seqs[stream.String()] // zero value conveniently works
+		seqs[stream.String()] = curr + 1
+		return stream.At(curr + 1)
+	}
+
+	clusterWideKey, err := newClusterWideKey()
+	if err != nil {
+		return nil, err
+	}
+
+	cwkEncrypter := envelopeenc.NaclSecretBoxEncrypter(
+		clusterWideKey,
+		ehsettingsdomain.ClusterWideKeyId)
+
+	meta := ehevent.MetaSystemUser(now)
+
+	defaultKey, backupKey, defGroupId, settingsEvents := setupEncryptionAndKeyServers(meta)
+
+	defaultGroupEncrypters := []envelopeenc.SlotEncrypter{
+		defaultKey,
+		backupKey,
+	}
+
+	// some system streams need to be EventHorizon-accessable.
+	// that is: defaultGroupEncrypters + cluster-wide key
+	eventHorizonAccessable := []envelopeenc.SlotEncrypter{
+		defaultKey,
+		backupKey,
+		cwkEncrypter,
+	}
+
+	entries := []eh.LogEntry{}
+	for _, streamToCreate := range eh.InternalStreamsToCreate {
+		dek, err := keyserver.NewDEK()
+		if err != nil {
+			return nil, err
+		}
+
+		encrypters := func() []envelopeenc.SlotEncrypter {
+			switch {
+			case streamToCreate.Equal(eh.SysSettings), streamToCreate.Equal(eh.SysSubscribers):
+				return eventHorizonAccessable
+			default:
+				return defaultGroupEncrypters
+			}
+		}()
+
+		// TODO: make DEK envelope locally only for streams where we need to add encrypted data for
+		dekEnvelope, err := envelopeenc.EncryptDEK(streamToCreate.DEKResourceName(0).String(), dek, encrypters...)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, eh.LogEntry{
+			Cursor: streamToCreate.At(0),
+			Data:   *eh.LogDataMeta(eh.NewStreamStarted(*dekEnvelope, defGroupId, meta)),
+		})
+
+		// some streams have initial events
+		initialEvents := func() []ehevent.Event {
+			switch {
+			case streamToCreate.Equal(eh.SysSettings):
+				return settingsEvents
+			case streamToCreate.Equal(eh.SysCredentials):
+				return []ehevent.Event{fullAccessPolicyCreatedEvent(meta)}
+			default:
+				return nil
+			}
+		}()
+
+		if len(initialEvents) > 0 {
+			dataEncrypted, err := eheventencryption.Encrypt(
+				ehevent.SerializeLines(
+					ehevent.Serialize(initialEvents...)),
+				dek)
+			if err != nil {
+				return nil, err
+			}
+
+			entries = append(entries, eh.LogEntry{
+				Cursor: cur(streamToCreate),
+				Data: eh.LogData{
+					Kind: eh.LogDataKindEncryptedData,
+					Raw:  dataEncrypted,
+				},
+			})
+		}
+
+		parent := streamToCreate.Parent()
+		if parent != nil {
+			entries = append(entries, eh.LogEntry{
+				Cursor: cur(*parent),
+				Data:   *eh.LogDataMeta(eh.NewStreamChildStreamCreated(streamToCreate, meta)),
+			})
+		}
+	}
+
+	// entries are in order within each stream
+	prevHashes := map[string][]byte{}
+	for idx := range entries {
+		stream := entries[idx].Cursor.Stream().String()
+
+		entries[idx].Hash = eh.EntryHash(prevHashes[stream], entries[idx].Cursor, entries[idx].Data)
+		prevHashes[stream] = entries[idx].Hash
+	}
+
+	return &Output{
+		Entries:        entries,
+		ClusterWideKey: clusterWideKey,
+	}, nil
+}
+
+func setupEncryptionAndKeyServers(meta ehevent.EventMeta) (envelopeenc.SlotEncrypter, envelopeenc.SlotEncrypter, string, []ehevent.Event) {
+	// generate with:
+	// $ ssh-keygen -f default.key -m PEM -t rsa -b 4096
+	defaultPubPem, defaultPub, err := loadPublicKeyFromPrivateKey("default.key")
+	if err != nil {
+		panic(err)
+	}
+
+	backupPubPem, backupPub, err := loadPublicKeyFromPrivateKey("backup.key")
+	if err != nil {
+		panic(err)
+	}
+
+	defaultKey := envelopeenc.RsaOaepSha256Encrypter(defaultPub)
+	backupKey := envelopeenc.RsaOaepSha256Encrypter(backupPub)
+
+	defGroup := ehsettingsdomain.NewKeygroupCreated("default", "[internal]", []string{defaultKey.KekId(), backupKey.KekId()}, meta)
+
+	keyServer := ehsettingsdomain.NewKeyserverCreated("internal", "Internal", "", meta)
+
+	pubAdded := ehsettingsdomain.NewKekRegistered(defaultKey.KekId(), "rsa", "Default key", defaultPubPem, meta)
+
+	return defaultKey, backupKey, defGroup.ID, []ehevent.Event{
+		defGroup,
+		pubAdded,
+		ehsettingsdomain.NewKekRegistered(backupKey.KekId(), "rsa", "Backup key", backupPubPem, meta),
+		keyServer,
+		ehsettingsdomain.NewKeyserverKeyAttached(keyServer.ID, pubAdded.ID, meta),
+	}
+}
+
+func fullAccessPolicyCreatedEvent(meta ehevent.EventMeta) ehevent.Event {
+	fullAccessPolicy := policy.NewPolicy(policy.NewAllowStatement(
+		[]policy.Action{
+			eh.ActionStreamCreate,
+			eh.ActionStreamRead,
+			eh.ActionStreamAppend,
+			eh.ActionSnapshotRead,
+			eh.ActionSnapshotWrite,
+			eh.ActionSnapshotDelete,
+		},
+		eh.RootName.Child("*").ResourceName(),
+		eh.ResourceNameSnapshot.Child("*"),
+	))
+
+	fullAccessPolicyCreated := ehcreddomain.NewPolicyCreated(
+		ehcreddomain.NewPolicyID(),
+		ehcreddomain.PolicyKindStandalone,
+		"Full access",
+		fullAccessPolicy,
+		meta)
+
+	return fullAccessPolicyCreated
+}
+
+// to read & decrypt data in EventHorizon cluster, you need to know the cluster settings.
+// but like all streams, the cluster settings stream is encrypted. this key is used to
+// bootstrap knowledge for reading data from the cluster
+func newClusterWideKey() ([32]byte, error) {
+	var key [32]byte
+	_, err := rand.Read(key[:])
+	return key, err
+}
+
+func loadPublicKeyFromPrivateKey(filename string) (string, *rsa.PublicKey, error) {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	privKey, err := cryptoutil.ParsePemPkcs1EncodedRsaPrivateKey(bytes)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return string(cryptoutil.MarshalPemPkcs1EncodedRsaPublicKey(&privKey.PublicKey)), &privKey.PublicKey, nil
+}
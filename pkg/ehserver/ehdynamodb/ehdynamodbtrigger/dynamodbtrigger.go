@@ -36,9 +36,10 @@ func changedStreamsFromDynamoDbEvent(
 	discovered := ehsubscriptionactivity.NewDiscoveredMaxCursors()
 
 	for _, record := range event.Records {
-		// we're only expecting INSERT, because:
-		// - MODIFY doesn't happen for keys (we're subscribing to key-only stream)
+		// we're only interested in INSERT, because:
+		// - MODIFY only happens when shredding overwrites old entries (not new data)
 		// - REMOVE is not supported to be used with eventsourcing
+		// (closed stream's tombstone INSERT gets through, but it only makes readers check for new data)
 		if record.EventName != "INSERT" {
 			logger.Printf("unsupported event: %s", record.EventName)
 			continue
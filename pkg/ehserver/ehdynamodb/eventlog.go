@@ -2,6 +2,7 @@
 package ehdynamodb
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -18,6 +19,10 @@ import (
 	"github.com/function61/gokit/crypto/envelopeenc"
 )
 
+const (
+	maxTransactItems = 25 // DynamoDB's limit for TransactWriteItems
+)
+
 // somewhat the same design as: https://stackoverflow.com/questions/55763006/dynamodb-event-store-on-aws
 
 // Raw entry from DynamoDB
@@ -25,10 +30,14 @@ import (
 // - might contain a single meta event
 // - why most common attribute names shortened? DynamoDB charges for each byte in item attribute names..
 // - we have JSON marshalling defined but please consider it DynamoDB internal implementation
+// - closed stream has a tombstone after its last entry. it's not visible to readers, but it
+//   occupies the next version, so that appends fail with the same condition that detects conflicts
 type LogEntryRaw struct {
 	Stream      string `json:"s"` // stream + version form the composite key
 	Version     int64  `json:"v"`
-	KindAndData []byte `json:"d"` // first byte is eh.LogDataKind, the rest is data (combined to save space)
+	KindAndData []byte `json:"d"`           // first byte is eh.LogDataKind, the rest is data (combined to save space)
+	Tombstone   bool   `json:"t,omitempty"` // KindAndData is empty for tombstones
+	Hash        []byte `json:"h,omitempty"` // eh.EntryHash(). empty for tombstones and entries from before hash chaining
 }
 
 type DynamoDbOptions struct {
@@ -37,6 +46,16 @@ type DynamoDbOptions struct {
 	AccessKeyToken  string // AWS_SESSION_TOKEN (only needed in Lambda)
 	RegionId        string
 	TableName       string
+	Endpoint        string // optional. for pointing to DynamoDB Local etc.
+}
+
+func (o DynamoDbOptions) AwsConfig(creds *credentials.Credentials) *aws.Config {
+	conf := aws.NewConfig().WithCredentials(creds).WithRegion(o.RegionId)
+	if o.Endpoint != "" {
+		conf = conf.WithEndpoint(o.Endpoint)
+	}
+
+	return conf
 }
 
 type Client struct {
@@ -58,9 +77,7 @@ func New(opts DynamoDbOptions) *Client {
 		opts.AccessKeySecret,
 		opts.AccessKeyToken)
 
-	dynamo := dynamodb.New(
-		sess,
-		aws.NewConfig().WithCredentials(staticCreds).WithRegion(opts.RegionId))
+	dynamo := dynamodb.New(sess, opts.AwsConfig(staticCreds))
 
 	return &Client{dynamo, &opts.TableName}
 }
@@ -97,6 +114,10 @@ func (e *Client) Read(ctx context.Context, lastKnown eh.Cursor) (*eh.ReadResult,
 			return nil, err
 		}
 
+		if entryRaw.Tombstone { // always the last item
+			continue
+		}
+
 		lastVersion = entryRaw.Version
 
 		entries = append(entries, unmarshalLogEntryRaw(entryRaw))
@@ -119,12 +140,12 @@ func (e *Client) Read(ctx context.Context, lastKnown eh.Cursor) (*eh.ReadResult,
 func (e *Client) Append(ctx context.Context, stream eh.StreamName, data eh.LogData) (*eh.AppendResult, error) {
 	// this can fail, so retry a few times
 	for i := 0; i < 3; i++ {
-		at, err := e.resolveStreamPosition(ctx, stream)
+		at, atHash, err := e.resolveStreamPosition(ctx, stream)
 		if err != nil {
 			return nil, err
 		}
 
-		result, err := e.AppendAfter(ctx, *at, data)
+		result, err := e.appendAfter(ctx, *at, atHash, data)
 		if err != nil {
 			// I think this is a false positive lint message:
 			//     "when isAboutConcurrency is true, err can't be nil"
@@ -142,20 +163,34 @@ func (e *Client) Append(ctx context.Context, stream eh.StreamName, data eh.LogDa
 	return nil, fmt.Errorf("Append: retry times exceeded, stream=%s", stream)
 }
 
-// NOTE: be very sure that stream exists, since it is not validated (only happens if malicious Cursor provided)
-// NOTE: be sure that you don't set version into the future, since that will leave a gap
 // NOTE: returned error is *ErrOptimisticLockingFailed if stream had writes
 func (e *Client) AppendAfter(ctx context.Context, after eh.Cursor, data eh.LogData) (*eh.AppendResult, error) {
-	resultingCursor := after.Next()
-
-	if resultingCursor.Version() == 0 {
+	if resultingCursor := after.Next(); resultingCursor.Version() == 0 {
 		// usually an indication of trying to append to a stream that either doesn't exist,
 		// or its state has not been examined - which is conflicting since AppendAfter() by
 		// definition is state-aware.
 		return nil, errors.New("AppendAfter: refusing @0, since stream should start with StreamStarted")
 	}
 
-	logEntryInDynamo, err := dynamoutils.Marshal(mkLogEntryRaw(resultingCursor, data))
+	// we need previous entry's hash anyway, so this also validates that we don't leave a gap
+	prevHash, err := e.hashOfHead(ctx, after)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.appendAfter(ctx, after, prevHash, data)
+}
+
+// "prevHash" is hash of the entry at "after"
+func (e *Client) appendAfter(
+	ctx context.Context,
+	after eh.Cursor,
+	prevHash []byte,
+	data eh.LogData,
+) (*eh.AppendResult, error) {
+	resultingCursor := after.Next()
+
+	logEntryInDynamo, err := dynamoutils.Marshal(mkLogEntryRaw(resultingCursor, data, prevHash))
 	if err != nil {
 		return nil, err
 	}
@@ -168,6 +203,11 @@ func (e *Client) AppendAfter(ctx context.Context, after eh.Cursor, data eh.LogDa
 	})
 	if err != nil {
 		if err, ok := err.(awserr.Error); ok && err.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			// conflict might be due to tombstone. it's more helpful to report that.
+			if tombstone, errTombstone := e.isTombstone(ctx, resultingCursor); errTombstone == nil && tombstone {
+				return nil, eh.NewErrStreamClosed(after.Stream())
+			}
+
 			return nil, eh.NewErrOptimisticLockingFailed(err)
 		} else {
 			return nil, err
@@ -179,10 +219,74 @@ func (e *Client) AppendAfter(ctx context.Context, after eh.Cursor, data eh.LogDa
 	}, nil
 }
 
+// all appends are in one DynamoDB transaction, so this is limited by DynamoDB's transaction size
+func (e *Client) AppendMany(ctx context.Context, appends []eh.AppendAfterItem) ([]eh.AppendResult, error) {
+	if err := eh.ValidateAppendMany(appends); err != nil {
+		return nil, err
+	}
+
+	if len(appends) > maxTransactItems {
+		return nil, fmt.Errorf("AppendMany: too many appends (%d); max %d", len(appends), maxTransactItems)
+	}
+
+	items := []*dynamodb.TransactWriteItem{}
+	results := []eh.AppendResult{}
+
+	for _, item := range appends {
+		resultingCursor := item.After.Next()
+
+		prevHash, err := e.hashOfHead(ctx, item.After)
+		if err != nil {
+			return nil, err
+		}
+
+		put, err := e.entryAsTxPut(mkLogEntryRaw(resultingCursor, item.Data, prevHash))
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, put)
+		results = append(results, eh.AppendResult{
+			Cursor: resultingCursor,
+		})
+	}
+
+	if _, err := e.dynamo.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	}); err != nil {
+		canceled, ok := err.(*dynamodb.TransactionCanceledException)
+		if !ok {
+			return nil, err
+		}
+
+		// reasons are in the same order as the items. successful ones have code "None".
+		for idx, reason := range canceled.CancellationReasons {
+			if aws.StringValue(reason.Code) != "ConditionalCheckFailed" {
+				continue
+			}
+
+			// conflict might be due to tombstone. it's more helpful to report that.
+			if tombstone, errTombstone := e.isTombstone(ctx, results[idx].Cursor); errTombstone == nil && tombstone {
+				return nil, eh.NewErrStreamClosed(results[idx].Cursor.Stream())
+			}
+
+			return nil, eh.NewErrOptimisticLockingFailed(fmt.Errorf(
+				"conflict: %s: %w",
+				appends[idx].After.Stream().String(),
+				err))
+		}
+
+		return nil, err
+	}
+
+	return results, nil
+}
+
 func (e *Client) CreateStream(
 	ctx context.Context,
 	stream eh.StreamName,
 	dekEnvelope envelopeenc.Envelope,
+	keyGroupId string,
 	initialData *eh.LogData,
 ) (*eh.AppendResult, error) {
 	parent := stream.Parent()
@@ -190,21 +294,24 @@ func (e *Client) CreateStream(
 		return nil, errors.New("cannot create root stream")
 	}
 
-	parentAt, err := e.resolveStreamPosition(ctx, *parent)
+	parentAt, parentHash, err := e.resolveStreamPosition(ctx, *parent)
 	if err != nil {
 		return nil, err
 	}
 
 	now := time.Now()
 
-	itemInParent, err := e.entryAsTxPut(metaEntry(eh.NewStreamChildStreamCreated(stream, ehevent.MetaSystemUser(now)), parentAt.Next()))
+	itemInParent, err := e.entryAsTxPut(metaEntry(
+		eh.NewStreamChildStreamCreated(stream, ehevent.MetaSystemUser(now)),
+		parentAt.Next(),
+		parentHash))
 	if err != nil {
 		return nil, err
 	}
 
-	keyGroupId := "default"
+	creationEntry := streamCreationEntry(stream, dekEnvelope, keyGroupId, now)
 
-	itemInChild, err := e.entryAsTxPut(streamCreationEntry(stream, dekEnvelope, keyGroupId, now))
+	itemInChild, err := e.entryAsTxPut(creationEntry)
 	if err != nil {
 		return nil, err
 	}
@@ -215,7 +322,7 @@ func (e *Client) CreateStream(
 	}
 
 	if initialData != nil {
-		itemInitialEvents, err := e.entryAsTxPut(mkLogEntryRaw(stream.At(1), *initialData))
+		itemInitialEvents, err := e.entryAsTxPut(mkLogEntryRaw(stream.At(1), *initialData, creationEntry.Hash))
 		if err != nil {
 			return nil, err
 		}
@@ -244,10 +351,217 @@ func (e *Client) CreateStream(
 	}, nil
 }
 
+func (e *Client) CloseStream(ctx context.Context, stream eh.StreamName, reason string) (*eh.AppendResult, error) {
+	at, atHash, err := e.resolveStreamPosition(ctx, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	closedAt := at.Next()
+
+	closedEntry, err := e.entryAsTxPut(metaEntry(
+		eh.NewStreamClosed(reason, ehevent.MetaSystemUser(time.Now())),
+		closedAt,
+		atHash))
+	if err != nil {
+		return nil, err
+	}
+
+	tombstone, err := e.entryAsTxPut(tombstoneEntry(closedAt.Next()))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := e.dynamo.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{closedEntry, tombstone},
+	}); err != nil {
+		canceled, ok := err.(*dynamodb.TransactionCanceledException)
+		if !ok {
+			return nil, err
+		}
+
+		for _, reason := range canceled.CancellationReasons {
+			if aws.StringValue(reason.Code) != "ConditionalCheckFailed" {
+				continue
+			}
+
+			// someone closed the stream concurrently. it's more helpful to report that.
+			if tombstone, errTombstone := e.isTombstone(ctx, closedAt); errTombstone == nil && tombstone {
+				return nil, eh.NewErrStreamClosed(stream)
+			}
+
+			return nil, eh.NewErrOptimisticLockingFailed(fmt.Errorf("conflict: %s: %w", stream.String(), err))
+		}
+
+		return nil, err
+	}
+
+	return &eh.AppendResult{
+		Cursor: closedAt,
+	}, nil
+}
+
+// entries with DEK envelopes are overwritten (in batches, since a stream can have more of them
+// than fit in one transaction), and then the tombstone is replaced by $stream.Shredded and a new
+// tombstone is written after it. overwriting is idempotent, so if shredding fails midway it can
+// be re-run.
+func (e *Client) ShredStream(ctx context.Context, stream eh.StreamName) (*eh.AppendResult, error) {
+	head, err := e.mostRecentEntry(ctx, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	if !head.Tombstone {
+		return nil, fmt.Errorf("ShredStream: close stream first: %s", stream.String())
+	}
+
+	items := []*dynamodb.TransactWriteItem{}
+
+	var lastHash []byte // hash of $stream.Closed, which $stream.Shredded will be chained to
+
+	// tombstones are not visible to readers, so this reads the whole stream
+	for after := stream.Beginning(); ; {
+		res, err := e.Read(ctx, after)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range res.Entries {
+			if isShreddedEntry(entry) {
+				return nil, fmt.Errorf("ShredStream: already shredded: %s", stream.String())
+			}
+
+			lastHash = entry.Hash
+
+			shredded, err := eh.ShredDEKEnvelopes(entry.Data)
+			if err != nil {
+				return nil, err
+			}
+
+			if shredded == nil || bytes.Equal(shredded.Raw, entry.Data.Raw) { // latter = re-run
+				continue
+			}
+
+			// hash stays valid, because it only covers commitments to the envelopes (see eh.EntryHash())
+			overwrite, err := e.entryAsTxOverwrite(logEntryToRaw(eh.LogEntry{
+				Cursor: entry.Cursor,
+				Data:   *shredded,
+				Hash:   entry.Hash,
+			}))
+			if err != nil {
+				return nil, err
+			}
+
+			items = append(items, overwrite)
+
+			if len(items) == maxTransactItems {
+				if err := e.transactWrite(ctx, items); err != nil {
+					return nil, fmt.Errorf("ShredStream: %w", err)
+				}
+
+				items = []*dynamodb.TransactWriteItem{}
+			}
+		}
+
+		if !res.More {
+			break
+		}
+
+		after = res.LastEntry
+	}
+
+	now := time.Now()
+
+	shreddedAt := stream.At(head.Version)
+
+	shreddedEntry, err := e.entryAsTxOverwrite(metaEntry(
+		eh.NewStreamShredded(ehevent.MetaSystemUser(now)),
+		shreddedAt,
+		lastHash))
+	if err != nil {
+		return nil, err
+	}
+	// only replace the tombstone (if someone else shredded concurrently, this fails)
+	shreddedEntry.Put.ConditionExpression = aws.String("t = :true")
+	shreddedEntry.Put.ExpressionAttributeValues = dynamoutils.Record{
+		":true": {BOOL: aws.Bool(true)},
+	}
+
+	tombstone, err := e.entryAsTxPut(tombstoneEntry(shreddedAt.Next()))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(items) > maxTransactItems-3 { // room for $stream.Shredded, tombstone and parent's entry
+		if err := e.transactWrite(ctx, items); err != nil {
+			return nil, fmt.Errorf("ShredStream: %w", err)
+		}
+
+		items = []*dynamodb.TransactWriteItem{}
+	}
+
+	items = append(items, shreddedEntry, tombstone)
+
+	// let parent know, unless it's closed itself
+	if parent := stream.Parent(); parent != nil {
+		parentAt, parentHash, err := e.resolveStreamPosition(ctx, *parent)
+		if err != nil {
+			if _, parentClosed := err.(*eh.ErrStreamClosed); !parentClosed {
+				return nil, err
+			}
+		} else {
+			itemInParent, err := e.entryAsTxPut(metaEntry(
+				eh.NewStreamChildStreamShredded(stream, ehevent.MetaSystemUser(now)),
+				parentAt.Next(),
+				parentHash))
+			if err != nil {
+				return nil, err
+			}
+
+			items = append(items, itemInParent)
+		}
+	}
+
+	if err := e.transactWrite(ctx, items); err != nil {
+		return nil, err
+	}
+
+	return &eh.AppendResult{
+		Cursor: shreddedAt,
+	}, nil
+}
+
+func (e *Client) transactWrite(ctx context.Context, items []*dynamodb.TransactWriteItem) error {
+	_, err := e.dynamo.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	return err
+}
+
+// returns head of the stream and its hash (for chaining the next entry).
+// returns *eh.ErrStreamClosed for closed streams
 func (e *Client) resolveStreamPosition(
 	ctx context.Context,
 	stream eh.StreamName,
-) (*eh.Cursor, error) {
+) (*eh.Cursor, []byte, error) {
+	en, err := e.mostRecentEntry(ctx, stream)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if en.Tombstone {
+		return nil, nil, eh.NewErrStreamClosed(stream)
+	}
+
+	cur := stream.At(en.Version)
+	return &cur, en.Hash, nil
+}
+
+// can be a tombstone
+func (e *Client) mostRecentEntry(
+	ctx context.Context,
+	stream eh.StreamName,
+) (*LogEntryRaw, error) {
 	// grab the most recent entry
 	mostRecent, err := e.dynamo.QueryWithContext(ctx, &dynamodb.QueryInput{
 		TableName:              e.eventsTableName,
@@ -257,6 +571,7 @@ func (e *Client) resolveStreamPosition(
 		},
 		Limit:            aws.Int64(1),
 		ScanIndexForward: aws.Bool(false),
+		ConsistentRead:   aws.Bool(true), // stale head would fail the conditional put of the next entry
 	})
 	if err != nil {
 		return nil, err
@@ -272,8 +587,73 @@ func (e *Client) resolveStreamPosition(
 		return nil, err
 	}
 
-	cur := stream.At(en.Version)
-	return &cur, nil
+	return en, nil
+}
+
+func (e *Client) isTombstone(ctx context.Context, pos eh.Cursor) (bool, error) {
+	en, err := e.entryAt(ctx, pos)
+	if err != nil {
+		return false, err
+	}
+
+	return en != nil && en.Tombstone, nil
+}
+
+// hash of entry at "after", which should be the stream's head. returns *eh.ErrOptimisticLockingFailed
+// if "after" is beyond the head, and *eh.ErrStreamClosed if the stream is closed.
+//
+// this is a (consistent) read of the entry at "after" instead of querying for the head: if "after"
+// is not the head, the conditional put of the next entry fails, so we needn't check it here.
+func (e *Client) hashOfHead(ctx context.Context, after eh.Cursor) ([]byte, error) {
+	en, err := e.entryAt(ctx, after)
+	if err != nil {
+		return nil, err
+	}
+
+	if en == nil { // beyond the head. only the error message needs the actual head.
+		at, _, err := e.resolveStreamPosition(ctx, after.Stream())
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, eh.NewErrOptimisticLockingFailed(fmt.Errorf(
+			"conflict: %s afterRequested=%d afterActual=%d",
+			after.Stream().String(),
+			after.Version(),
+			at.Version()))
+	}
+
+	if en.Tombstone {
+		return nil, eh.NewErrStreamClosed(after.Stream())
+	}
+
+	return en.Hash, nil
+}
+
+// returns nil if entry does not exist
+func (e *Client) entryAt(ctx context.Context, pos eh.Cursor) (*LogEntryRaw, error) {
+	res, err := e.dynamo.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: e.eventsTableName,
+		Key: dynamoutils.Record{
+			"s": dynamoutils.String(pos.Stream().String()),
+			"v": dynamoutils.Number(int(pos.Version())),
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Item == nil {
+		return nil, nil
+	}
+
+	en := &LogEntryRaw{}
+	if err := dynamoutils.Unmarshal(res.Item, en); err != nil {
+		return nil, err
+	}
+
+	return en, nil
 }
 
 func (e *Client) entryAsTxPut(item LogEntryRaw) (*dynamodb.TransactWriteItem, error) {
@@ -291,6 +671,46 @@ func (e *Client) entryAsTxPut(item LogEntryRaw) (*dynamodb.TransactWriteItem, er
 	}, nil
 }
 
+// replaces existing entry
+func (e *Client) entryAsTxOverwrite(item LogEntryRaw) (*dynamodb.TransactWriteItem, error) {
+	itemDynamo, err := dynamoutils.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			TableName:           e.eventsTableName,
+			Item:                itemDynamo,
+			ConditionExpression: aws.String("attribute_exists(s) AND attribute_exists(v)"),
+		},
+	}, nil
+}
+
+func isShreddedEntry(entry eh.LogEntry) bool {
+	if entry.Data.Kind != eh.LogDataKindMeta {
+		return false
+	}
+
+	for _, line := range ehevent.DeserializeLines(entry.Data.Raw) {
+		if e, err := ehevent.Deserialize(line, eh.MetaTypes); err == nil {
+			if _, shredded := e.(*eh.StreamShredded); shredded {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func tombstoneEntry(pos eh.Cursor) LogEntryRaw {
+	return LogEntryRaw{
+		Stream:    pos.Stream().String(),
+		Version:   pos.Version(),
+		Tombstone: true,
+	}
+}
+
 func streamCreationEntry(
 	stream eh.StreamName,
 	dekEnvelope envelopeenc.Envelope,
@@ -299,22 +719,33 @@ func streamCreationEntry(
 ) LogEntryRaw {
 	return metaEntry(
 		eh.NewStreamStarted(dekEnvelope, keyGroupId, ehevent.MetaSystemUser(now)),
-		stream.At(0))
+		stream.At(0),
+		nil)
 }
 
-func metaEntry(metaEvent ehevent.Event, pos eh.Cursor) LogEntryRaw {
-	return mkLogEntryRaw(pos, *eh.LogDataMeta(metaEvent))
+func metaEntry(metaEvent ehevent.Event, pos eh.Cursor, prevHash []byte) LogEntryRaw {
+	return mkLogEntryRaw(pos, *eh.LogDataMeta(metaEvent), prevHash)
 }
 
-func metaEntry2(pos eh.Cursor, metaEvent ...ehevent.Event) LogEntryRaw {
-	return mkLogEntryRaw(pos, *eh.LogDataMeta(metaEvent...))
+func metaEntry2(pos eh.Cursor, prevHash []byte, metaEvent ...ehevent.Event) LogEntryRaw {
+	return mkLogEntryRaw(pos, *eh.LogDataMeta(metaEvent...), prevHash)
+}
+
+// "prevHash" is hash of the entry before "cursor"
+func mkLogEntryRaw(cursor eh.Cursor, data eh.LogData, prevHash []byte) LogEntryRaw {
+	return logEntryToRaw(eh.LogEntry{
+		Cursor: cursor,
+		Data:   data,
+		Hash:   eh.EntryHash(prevHash, cursor, data),
+	})
 }
 
-func mkLogEntryRaw(cursor eh.Cursor, data eh.LogData) LogEntryRaw {
+func logEntryToRaw(entry eh.LogEntry) LogEntryRaw {
 	return LogEntryRaw{
-		Stream:      cursor.Stream().String(),
-		Version:     cursor.Version(),
-		KindAndData: append([]byte{byte(data.Kind)}, data.Raw...),
+		Stream:      entry.Cursor.Stream().String(),
+		Version:     entry.Cursor.Version(),
+		KindAndData: append([]byte{byte(entry.Data.Kind)}, entry.Data.Raw...),
+		Hash:        entry.Hash,
 	}
 }
 
@@ -330,5 +761,6 @@ func unmarshalLogEntryRaw(entry LogEntryRaw) eh.LogEntry {
 			Kind: eh.LogDataKind(entry.KindAndData[0]),
 			Raw:  entry.KindAndData[1:],
 		},
+		Hash: entry.Hash,
 	}
 }
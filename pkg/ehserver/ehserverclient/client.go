@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 
 	"github.com/function61/eventhorizon/pkg/eh"
 	"github.com/function61/gokit/crypto/envelopeenc"
@@ -17,8 +18,42 @@ import (
 )
 
 type CreateStreamInput struct {
-	DEK  *envelopeenc.Envelope
-	Data *eh.LogData
+	DEK      *envelopeenc.Envelope
+	KeyGroup string // DEK's recipients are the key group's KEKs
+	Data     *eh.LogData
+}
+
+type AppendManyInput struct {
+	Appends []eh.AppendAfterItem
+}
+
+const (
+	// for AppendMany() HTTP 410 responses, tells which one of the streams was closed
+	ClosedStreamHeader = "x-eh-closed-stream"
+)
+
+type CloseStreamInput struct {
+	Reason string
+}
+
+const (
+	// JSON's base64 grows RawData by 4/3, and Lambda's response limit is 6 MB (eager read included)
+	SnapshotChunkSize = 3 * 1024 * 1024
+)
+
+// GET /snapshot response. Snapshot.RawData has the first chunk, the rest are fetched from /snapshot/chunk
+type ReadSnapshotResponse struct {
+	eh.ReadSnapshotOutput
+	Chunks int    `json:"Chunks,omitempty"`
+	Digest string `json:"Digest,omitempty"` // eh.SnapshotDigest() of the whole RawData
+}
+
+// PUT /snapshot body. if chunked, Snapshot.RawData has the first chunk and the rest were
+// uploaded to /snapshot/chunk beforehand
+type WriteSnapshotRequest struct {
+	eh.PersistedSnapshot
+	Chunks int    `json:"Chunks,omitempty"`
+	Digest string `json:"Digest,omitempty"` // eh.SnapshotDigest() of the whole RawData
 }
 
 type ReaderWriterSnapshotStore interface {
@@ -82,7 +117,11 @@ func (s *serverClient) Append(
 		ezhttp.SendJson(data),
 		ezhttp.RespondsJson(res, false),
 	); err != nil {
-		return nil, fmt.Errorf("Append: %w", err)
+		if ezhttp.ErrorIs(err, http.StatusGone) {
+			return nil, eh.NewErrStreamClosed(stream)
+		} else {
+			return nil, fmt.Errorf("Append: %w", err)
+		}
 	}
 
 	return res, nil
@@ -105,6 +144,8 @@ func (s *serverClient) AppendAfter(
 	); err != nil {
 		if ezhttp.ErrorIs(err, http.StatusConflict) {
 			return nil, eh.NewErrOptimisticLockingFailed(err)
+		} else if ezhttp.ErrorIs(err, http.StatusGone) {
+			return nil, eh.NewErrStreamClosed(after.Stream())
 		} else {
 			return nil, fmt.Errorf("AppendAfter: %w", err)
 		}
@@ -113,10 +154,44 @@ func (s *serverClient) AppendAfter(
 	return result, nil
 }
 
+func (s *serverClient) AppendMany(
+	ctx context.Context,
+	appends []eh.AppendAfterItem,
+) ([]eh.AppendResult, error) {
+	s.logl.Debug.Printf("AppendMany")
+
+	results := []eh.AppendResult{}
+	res, err := ezhttp.Post(
+		ctx,
+		s.baseUrl+"/append-many",
+		ezhttp.AuthBearer(s.authToken),
+		ezhttp.SendJson(AppendManyInput{
+			Appends: appends,
+		}),
+		ezhttp.RespondsJson(&results, false))
+	if err != nil {
+		if ezhttp.ErrorIs(err, http.StatusConflict) {
+			return nil, eh.NewErrOptimisticLockingFailed(err)
+		} else if ezhttp.ErrorIs(err, http.StatusGone) {
+			closedStream, errDeserialize := eh.DeserializeStreamName(res.Header.Get(ClosedStreamHeader))
+			if errDeserialize != nil {
+				return nil, fmt.Errorf("AppendMany: %w", err)
+			}
+
+			return nil, eh.NewErrStreamClosed(closedStream)
+		} else {
+			return nil, fmt.Errorf("AppendMany: %w", err)
+		}
+	}
+
+	return results, nil
+}
+
 func (s *serverClient) CreateStream(
 	ctx context.Context,
 	stream eh.StreamName,
 	dekEnvelope envelopeenc.Envelope,
+	keyGroupId string,
 	data *eh.LogData,
 ) (*eh.AppendResult, error) {
 	s.logl.Debug.Printf("CreateStream")
@@ -127,8 +202,9 @@ func (s *serverClient) CreateStream(
 		s.baseUrl+"/stream-create?stream="+url.QueryEscape(stream.String()),
 		ezhttp.AuthBearer(s.authToken),
 		ezhttp.SendJson(CreateStreamInput{
-			DEK:  &dekEnvelope,
-			Data: data,
+			DEK:      &dekEnvelope,
+			KeyGroup: keyGroupId,
+			Data:     data,
 		}),
 		ezhttp.RespondsJson(result, false),
 	); err != nil {
@@ -138,19 +214,70 @@ func (s *serverClient) CreateStream(
 	return result, nil
 }
 
+func (s *serverClient) CloseStream(
+	ctx context.Context,
+	stream eh.StreamName,
+	reason string,
+) (*eh.AppendResult, error) {
+	s.logl.Debug.Printf("CloseStream %s", stream.String())
+
+	result := &eh.AppendResult{}
+	if _, err := ezhttp.Post(
+		ctx,
+		s.baseUrl+"/stream-close?stream="+url.QueryEscape(stream.String()),
+		ezhttp.AuthBearer(s.authToken),
+		ezhttp.SendJson(CloseStreamInput{
+			Reason: reason,
+		}),
+		ezhttp.RespondsJson(result, false),
+	); err != nil {
+		if ezhttp.ErrorIs(err, http.StatusGone) {
+			return nil, eh.NewErrStreamClosed(stream)
+		} else {
+			return nil, fmt.Errorf("CloseStream: %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+func (s *serverClient) ShredStream(
+	ctx context.Context,
+	stream eh.StreamName,
+) (*eh.AppendResult, error) {
+	s.logl.Debug.Printf("ShredStream %s", stream.String())
+
+	result := &eh.AppendResult{}
+	if _, err := ezhttp.Post(
+		ctx,
+		s.baseUrl+"/stream-shred?stream="+url.QueryEscape(stream.String()),
+		ezhttp.AuthBearer(s.authToken),
+		ezhttp.RespondsJson(result, false),
+	); err != nil {
+		return nil, fmt.Errorf("ShredStream: %w", err)
+	}
+
+	return result, nil
+}
+
 func (s *serverClient) ReadSnapshot(
 	ctx context.Context,
 	input eh.ReadSnapshotInput,
 ) (*eh.ReadSnapshotOutput, error) {
 	s.logl.Debug.Printf("ReadSnapshot %s (%s)", input.Stream.String(), input.Perspective.String())
 
-	output := &eh.ReadSnapshotOutput{}
+	response := &ReadSnapshotResponse{}
+
+	atOrBefore := ""
+	if input.AtOrBefore != nil {
+		atOrBefore = "&atOrBefore=" + url.QueryEscape(input.AtOrBefore.Serialize())
+	}
 
 	if _, err := ezhttp.Get(
 		ctx,
-		s.baseUrl+"/snapshot?stream="+url.QueryEscape(input.Stream.String())+"&perspective="+url.QueryEscape(input.Perspective.String()),
+		s.baseUrl+"/snapshot?stream="+url.QueryEscape(input.Stream.String())+"&perspective="+url.QueryEscape(input.Perspective.String())+atOrBefore,
 		ezhttp.AuthBearer(s.authToken),
-		ezhttp.RespondsJson(output, false),
+		ezhttp.RespondsJson(response, false),
 	); err != nil {
 		if ezhttp.ErrorIs(err, http.StatusNotFound) {
 			return nil, os.ErrNotExist
@@ -159,7 +286,40 @@ func (s *serverClient) ReadSnapshot(
 		}
 	}
 
-	return output, nil
+	if response.Digest != "" { // from before chunking if empty
+		rawData, err := s.readSnapshotChunks(ctx, response)
+		if err != nil {
+			return nil, fmt.Errorf("ReadSnapshot(%s, %s): %w", input.Stream.String(), input.Perspective.String(), err)
+		}
+
+		response.Snapshot.RawData = rawData
+	}
+
+	return &response.ReadSnapshotOutput, nil
+}
+
+// fetches rest of the chunks and reassembles them
+func (s *serverClient) readSnapshotChunks(ctx context.Context, response *ReadSnapshotResponse) ([]byte, error) {
+	snap := response.Snapshot
+
+	chunks := [][]byte{snap.RawData}
+
+	for idx := 1; idx < response.Chunks; idx++ {
+		chunk := []byte{}
+
+		if _, err := ezhttp.Get(
+			ctx,
+			s.snapshotChunkUrl(snap.Cursor, snap.Perspective, response.Digest, idx),
+			ezhttp.AuthBearer(s.authToken),
+			ezhttp.RespondsJson(&chunk, false),
+		); err != nil {
+			return nil, fmt.Errorf("chunk %d: %w", idx, err)
+		}
+
+		chunks = append(chunks, chunk)
+	}
+
+	return eh.ReassembleSnapshotChunks(chunks, response.Digest)
 }
 
 func (s *serverClient) WriteSnapshot(
@@ -168,12 +328,7 @@ func (s *serverClient) WriteSnapshot(
 ) error {
 	s.logl.Debug.Printf("WriteSnapshot")
 
-	if _, err := ezhttp.Put(
-		ctx,
-		s.baseUrl+"/snapshot",
-		ezhttp.AuthBearer(s.authToken),
-		ezhttp.SendJson(snapshot),
-	); err != nil {
+	wrapErr := func(err error) error {
 		return fmt.Errorf(
 			"WriteSnapshot(%s, %s): %w",
 			snapshot.Cursor.Stream().String(),
@@ -181,9 +336,47 @@ func (s *serverClient) WriteSnapshot(
 			err)
 	}
 
+	request := WriteSnapshotRequest{PersistedSnapshot: snapshot}
+
+	// server commits the snapshot only after the reassembled chunks match the digest
+	if chunks := eh.SnapshotChunks(snapshot.RawData, SnapshotChunkSize); len(chunks) > 1 {
+		request.Chunks = len(chunks)
+		request.Digest = eh.SnapshotDigest(snapshot.RawData)
+		request.RawData = chunks[0]
+
+		for idx := 1; idx < len(chunks); idx++ {
+			if _, err := ezhttp.Put(
+				ctx,
+				s.snapshotChunkUrl(snapshot.Cursor, snapshot.Perspective, request.Digest, idx),
+				ezhttp.AuthBearer(s.authToken),
+				ezhttp.SendJson(chunks[idx]),
+			); err != nil {
+				return wrapErr(fmt.Errorf("chunk %d: %w", idx, err))
+			}
+		}
+	}
+
+	if _, err := ezhttp.Put(
+		ctx,
+		s.baseUrl+"/snapshot",
+		ezhttp.AuthBearer(s.authToken),
+		ezhttp.SendJson(request),
+	); err != nil {
+		return wrapErr(err)
+	}
+
 	return nil
 }
 
+func (s *serverClient) snapshotChunkUrl(
+	version eh.Cursor,
+	perspective eh.SnapshotPerspective,
+	digest string,
+	idx int,
+) string {
+	return s.baseUrl + "/snapshot/chunk?version=" + url.QueryEscape(version.Serialize()) + "&perspective=" + url.QueryEscape(perspective.String()) + "&digest=" + digest + "&chunk=" + strconv.Itoa(idx)
+}
+
 func (s *serverClient) DeleteSnapshot(
 	ctx context.Context,
 	stream eh.StreamName,
@@ -206,6 +399,49 @@ func (s *serverClient) DeleteSnapshot(
 	return nil
 }
 
+func (s *serverClient) ListSnapshots(
+	ctx context.Context,
+	stream eh.StreamName,
+	perspective eh.SnapshotPerspective,
+) ([]eh.Cursor, error) {
+	s.logl.Debug.Printf("ListSnapshots %s (%s)", stream.String(), perspective.String())
+
+	cursors := []eh.Cursor{}
+
+	if _, err := ezhttp.Get(
+		ctx,
+		s.baseUrl+"/snapshot/versions?stream="+url.QueryEscape(stream.String())+"&perspective="+url.QueryEscape(perspective.String()),
+		ezhttp.AuthBearer(s.authToken),
+		ezhttp.RespondsJson(&cursors, false),
+	); err != nil {
+		return nil, fmt.Errorf("ListSnapshots: %w", err)
+	}
+
+	return cursors, nil
+}
+
+func (s *serverClient) RollbackSnapshot(
+	ctx context.Context,
+	to eh.Cursor,
+	perspective eh.SnapshotPerspective,
+) error {
+	s.logl.Debug.Printf("RollbackSnapshot %s (%s)", to.Serialize(), perspective.String())
+
+	if _, err := ezhttp.Post(
+		ctx,
+		s.baseUrl+"/snapshot/rollback?to="+url.QueryEscape(to.Serialize())+"&perspective="+url.QueryEscape(perspective.String()),
+		ezhttp.AuthBearer(s.authToken),
+	); err != nil {
+		if ezhttp.ErrorIs(err, http.StatusNotFound) {
+			return os.ErrNotExist
+		} else {
+			return fmt.Errorf("RollbackSnapshot: %w", err)
+		}
+	}
+
+	return nil
+}
+
 // export EVENTHORIZON="http://:<apikey>@localhost"
 func SplitAuthTokenFromUrl(rawUrl string) (string, string, error) {
 	urlParsed, err := url.Parse(rawUrl)
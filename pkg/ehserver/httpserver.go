@@ -5,9 +5,13 @@ package ehserver
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/function61/eventhorizon/pkg/eh"
 	"github.com/function61/eventhorizon/pkg/ehclient"
@@ -17,6 +21,8 @@ import (
 	"github.com/function61/eventhorizon/pkg/policy"
 	"github.com/function61/eventhorizon/pkg/system/ehcred"
 	"github.com/function61/eventhorizon/pkg/system/ehsettings"
+	"github.com/function61/eventhorizon/pkg/system/ehstreamchildren"
+	"github.com/function61/eventhorizon/pkg/system/ehstreamstats"
 	"github.com/function61/gokit/crypto/envelopeenc"
 	"github.com/function61/gokit/log/logex"
 	"github.com/function61/gokit/net/http/httpauth"
@@ -68,26 +74,27 @@ func createHttpHandler(
 		return nil, nil, err
 	}
 
-	writerMaybeWithNotifier, notifier := func() (eh.Writer, SubscriptionNotifier) {
+	notifier := func() SubscriptionNotifier {
 		mqttConfig := pubSubState.State.MqttConfig()
 
 		if mqttConfig == nil {
-			return systemClient.EventLog, nil
+			return nil
 		} else {
-			notifier := newMqttNotifier(*mqttConfig, startMqttTask, logex.Prefix("mqtt", logger))
-
-			return wrapWriterWithNotifier(
-				systemClient.EventLog,
-				notifier,
-				systemClient,
-				logger), notifier
+			return newMqttNotifier(*mqttConfig, startMqttTask, logex.Prefix("mqtt", logger))
 		}
 	}()
 
+	appendWaiter := newAppendWaiter()
+
 	auth := &authenticator{
 		credentials: credState,
 
-		rawWriter:        writerMaybeWithNotifier,
+		rawWriter: wrapWriterWithNotifier(
+			systemClient.EventLog,
+			notifier,
+			appendWaiter,
+			systemClient,
+			logger),
 		rawReader:        systemClient.EventLog,
 		rawSnapshotStore: systemClient.SnapshotStore,
 
@@ -102,14 +109,19 @@ func createHttpHandler(
 	// routePrefix:=os.Getenv("HTTP_ROUTE_PREFIX")
 	routePrefix := "/api/eventhorizon"
 
-	return serverHandler(auth, keyServer, routePrefix), notifier, nil
+	return serverHandler(auth, keyServer, appendWaiter, pubSubState.State, systemClient, routePrefix), notifier, nil
 }
 
 func serverHandler(
 	auth *authenticator,
 	keyServer keyserver.Unsealer,
+	appendWaiter *appendWaiter,
+	settings *ehsettings.Store,
+	systemClient *ehclient.SystemClient,
 	prefix string,
 ) http.Handler {
+	snapshotChunks := newSnapshotChunkCache()
+
 	router := mux.NewRouter()
 	router.HandleFunc(prefix+"/read", func(w http.ResponseWriter, r *http.Request) {
 		cursor, err := eh.DeserializeCursor(r.URL.Query().Get("after"))
@@ -118,13 +130,20 @@ func serverHandler(
 			return
 		}
 
+		// optional long-poll: "?wait=30s" waits for new data if there is none right now
+		wait, err := parseReadWait(r.URL.Query().Get("wait"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		user, err := auth.AuthenticateRequest(r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
 
-		res, err := user.Reader.Read(r.Context(), cursor)
+		res, err := appendWaiter.readWaiting(r.Context(), user.Reader, cursor, wait)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -133,6 +152,47 @@ func serverHandler(
 		respondJson(w, res)
 	}).Methods(http.MethodGet)
 
+	router.HandleFunc(prefix+"/read-stream", func(w http.ResponseWriter, r *http.Request) {
+		// EventSource reconnects send the last seen event ID instead
+		afterSerialized := r.URL.Query().Get("after")
+		if afterSerialized == "" {
+			afterSerialized = r.Header.Get("Last-Event-ID")
+		}
+
+		cursor, err := eh.DeserializeCursor(afterSerialized)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user, err := auth.AuthenticateRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		enc := newStreamEncoder(r.Header.Get("Accept"))
+
+		if err := streamEntries(
+			r.Context(),
+			w,
+			flusher,
+			enc,
+			user.Reader,
+			appendWaiter,
+			cursor,
+		); err != nil && r.Context().Err() == nil {
+			// headers are already sent, so the error has to be delivered in-band
+			_ = enc.error(w, err)
+		}
+	}).Methods(http.MethodGet)
+
 	router.HandleFunc(prefix+"/stream-create", func(w http.ResponseWriter, r *http.Request) {
 		stream, err := eh.DeserializeStreamName(r.URL.Query().Get("stream"))
 		if err != nil {
@@ -152,10 +212,17 @@ func serverHandler(
 			return
 		}
 
+		keyGroupId, err := validateCreateStreamKeyGroup(*input, stream, settings)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		appendResult, err := user.Writer.CreateStream(
 			r.Context(),
 			stream,
 			*input.DEK,
+			keyGroupId,
 			input.Data)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -190,6 +257,8 @@ func serverHandler(
 		if err != nil {
 			if _, wasAboutLocking := err.(*eh.ErrOptimisticLockingFailed); wasAboutLocking {
 				http.Error(w, err.Error(), http.StatusConflict)
+			} else if _, closed := err.(*eh.ErrStreamClosed); closed {
+				http.Error(w, err.Error(), http.StatusGone)
 			} else {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 			}
@@ -224,15 +293,211 @@ func serverHandler(
 		if err != nil {
 			if _, isOptimisticLocking := err.(*eh.ErrOptimisticLockingFailed); isOptimisticLocking {
 				http.Error(w, err.Error(), http.StatusConflict)
+			} else if _, closed := err.(*eh.ErrStreamClosed); closed {
+				http.Error(w, err.Error(), http.StatusGone)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		respondJson(w, appendResult)
+	}).Methods(http.MethodPost)
+
+	router.HandleFunc(prefix+"/append-many", func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth.AuthenticateRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		input := ehserverclient.AppendManyInput{}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		appendResults, err := user.Writer.AppendMany(r.Context(), input.Appends)
+		if err != nil {
+			if _, isOptimisticLocking := err.(*eh.ErrOptimisticLockingFailed); isOptimisticLocking {
+				http.Error(w, err.Error(), http.StatusConflict)
+			} else if errClosed, closed := err.(*eh.ErrStreamClosed); closed {
+				// client needs to know which one of the streams
+				w.Header().Set(ehserverclient.ClosedStreamHeader, errClosed.Stream().String())
+				http.Error(w, err.Error(), http.StatusGone)
 			} else {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 			}
 			return
 		}
 
+		respondJson(w, appendResults)
+	}).Methods(http.MethodPost)
+
+	router.HandleFunc(prefix+"/stream-close", func(w http.ResponseWriter, r *http.Request) {
+		stream, err := eh.DeserializeStreamName(r.URL.Query().Get("stream"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user, err := auth.AuthenticateRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		input := &ehserverclient.CloseStreamInput{}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		appendResult, err := user.Writer.CloseStream(r.Context(), stream, input.Reason)
+		if err != nil {
+			if _, closed := err.(*eh.ErrStreamClosed); closed {
+				http.Error(w, err.Error(), http.StatusGone)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		respondJson(w, appendResult)
+	}).Methods(http.MethodPost)
+
+	router.HandleFunc(prefix+"/stream-shred", func(w http.ResponseWriter, r *http.Request) {
+		stream, err := eh.DeserializeStreamName(r.URL.Query().Get("stream"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user, err := auth.AuthenticateRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		appendResult, err := user.Writer.ShredStream(r.Context(), stream)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		respondJson(w, appendResult)
 	}).Methods(http.MethodPost)
 
+	router.HandleFunc(prefix+"/stream-stats", func(w http.ResponseWriter, r *http.Request) {
+		stream, err := eh.DeserializeStreamName(r.URL.Query().Get("stream"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		limit, err := parseChildStreamsLimit(r.URL.Query().Get("limit"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user, err := auth.AuthenticateRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		if err := user.Policy.Authorize(eh.ActionStreamRead, stream.ResourceName()); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		// computed with system privileges, because the projection is cached across users
+		stats, err := ehstreamstats.LoadUntilRealtime(r.Context(), stream, systemClient, ehstreamstats.GlobalCache)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respondJson(w, stats.State.Output(
+			r.URL.Query().Get("after"),
+			limit,
+			canReadEncryptedData(stream, stats.State.DEKVersions(), user.Policy)))
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc(prefix+"/stream-tree", func(w http.ResponseWriter, r *http.Request) {
+		root, err := eh.DeserializeStreamName(r.URL.Query().Get("stream"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		depth, err := parseTreeDepth(r.URL.Query().Get("depth"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		limit, err := parseTreeLimit(r.URL.Query().Get("limit"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var after *eh.StreamName // optional, last stream of the previous page
+		if afterSerialized := r.URL.Query().Get("after"); afterSerialized != "" {
+			afterStream, err := eh.DeserializeStreamName(afterSerialized)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			after = &afterStream
+		}
+
+		user, err := auth.AuthenticateRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		if err := user.Policy.Authorize(eh.ActionStreamRead, root.ResourceName()); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		output := ehstreamchildren.TreeOutput{
+			Streams: []eh.StreamName{},
+		}
+
+		// not cached, so large trees don't bloat the server's memory
+		output.More, err = ehstreamchildren.WalkTree(
+			r.Context(),
+			root,
+			ehstreamchildren.TreeQuery{
+				MaxDepth: depth,
+				Glob:     r.URL.Query().Get("glob"), // optional, uses same syntax as policy resources
+				After:    after,
+				Limit:    limit,
+				Filter: func(stream eh.StreamName) bool {
+					// don't reveal names of streams the user can't read
+					return user.Policy.Authorize(eh.ActionStreamRead, stream.ResourceName()) == nil
+				},
+			},
+			systemClient,
+			nil,
+			func(stream eh.StreamName, _ int) error {
+				output.Streams = append(output.Streams, stream)
+				return nil
+			})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respondJson(w, output)
+	}).Methods(http.MethodGet)
+
 	parsePerspectiveOrOutputHTTPError := func(serialized string, w http.ResponseWriter) *eh.SnapshotPerspective {
 		if serialized == "" {
 			http.Error(w, "snapshot context not defined", http.StatusBadRequest)
@@ -243,6 +508,37 @@ func serverHandler(
 		return &perspective
 	}
 
+	// returns nil version if HTTP error was output
+	parseSnapshotChunkOrOutputHTTPError := func(
+		r *http.Request,
+		w http.ResponseWriter,
+	) (*eh.Cursor, *eh.SnapshotPerspective, string, int) {
+		perspective := parsePerspectiveOrOutputHTTPError(r.URL.Query().Get("perspective"), w)
+		if perspective == nil {
+			return nil, nil, "", 0
+		}
+
+		version, err := eh.DeserializeCursor(r.URL.Query().Get("version"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, nil, "", 0
+		}
+
+		digest := r.URL.Query().Get("digest")
+		if err := validateSnapshotDigest(digest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, nil, "", 0
+		}
+
+		chunkIdx, err := strconv.Atoi(r.URL.Query().Get("chunk"))
+		if err != nil || chunkIdx < 0 || chunkIdx >= maxSnapshotChunks {
+			http.Error(w, "invalid chunk", http.StatusBadRequest)
+			return nil, nil, "", 0
+		}
+
+		return &version, perspective, digest, chunkIdx
+	}
+
 	router.HandleFunc(prefix+"/snapshot", func(w http.ResponseWriter, r *http.Request) {
 		perspective := parsePerspectiveOrOutputHTTPError(r.URL.Query().Get("perspective"), w)
 		if perspective == nil {
@@ -266,6 +562,16 @@ func serverHandler(
 			Perspective: *perspective,
 		}
 
+		if atOrBefore := r.URL.Query().Get("atOrBefore"); atOrBefore != "" {
+			cursor, err := eh.DeserializeCursor(atOrBefore)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			input.AtOrBefore = &cursor
+		}
+
 		snapOutput, err := user.Snapshots.ReadSnapshot(r.Context(), input)
 		if err != nil {
 			if os.IsNotExist(err) {
@@ -285,12 +591,117 @@ func serverHandler(
 			return
 		}
 
-		respondJson(w, eh.ReadSnapshotOutput{
-			Snapshot:  snap,
-			EagerRead: eagerRead,
+		chunks := eh.SnapshotChunks(snap.RawData, ehserverclient.SnapshotChunkSize)
+		digest := eh.SnapshotDigest(snap.RawData)
+
+		if len(chunks) > 1 { // client will ask for the rest
+			snapshotChunks.Put(*snap, digest, chunks, time.Now())
+		}
+
+		firstChunk := *snap
+		firstChunk.RawData = chunks[0]
+
+		respondJson(w, ehserverclient.ReadSnapshotResponse{
+			ReadSnapshotOutput: eh.ReadSnapshotOutput{
+				Snapshot:  &firstChunk,
+				EagerRead: eagerRead,
+			},
+			Chunks: len(chunks),
+			Digest: digest,
 		})
 	}).Methods(http.MethodGet)
 
+	router.HandleFunc(prefix+"/snapshot/chunk", func(w http.ResponseWriter, r *http.Request) {
+		version, perspective, digest, chunkIdx := parseSnapshotChunkOrOutputHTTPError(r, w)
+		if version == nil {
+			return // HTTP error was output
+		}
+
+		user, err := auth.AuthenticateRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		// explicit check, because the cache doesn't go through user.Snapshots
+		if err := authorizeSnapshot(user.Policy, eh.ActionSnapshotRead, version.Stream(), *perspective); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		chunks := snapshotChunks.Get(*version, *perspective, digest, time.Now())
+		if chunks == nil { // expired, or GET /snapshot was served by another instance
+			snapOutput, err := user.Snapshots.ReadSnapshot(r.Context(), eh.ReadSnapshotInput{
+				Stream:      version.Stream(),
+				Perspective: *perspective,
+				AtOrBefore:  version,
+			})
+			if err != nil {
+				if os.IsNotExist(err) {
+					http.NotFound(w, r)
+				} else {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+			snap := snapOutput.Snapshot // shorthand
+
+			// version was deleted (or rewritten) after the client read the first chunk
+			if !snap.Cursor.Equal(*version) || eh.SnapshotDigest(snap.RawData) != digest {
+				http.NotFound(w, r)
+				return
+			}
+
+			chunks = eh.SnapshotChunks(snap.RawData, ehserverclient.SnapshotChunkSize)
+
+			snapshotChunks.Put(*snap, digest, chunks, time.Now())
+		}
+
+		if chunkIdx >= len(chunks) {
+			http.Error(w, "chunk out of range", http.StatusBadRequest)
+			return
+		}
+
+		respondJson(w, chunks[chunkIdx])
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc(prefix+"/snapshot/chunk", func(w http.ResponseWriter, r *http.Request) {
+		version, perspective, digest, chunkIdx := parseSnapshotChunkOrOutputHTTPError(r, w)
+		if version == nil {
+			return // HTTP error was output
+		}
+
+		user, err := auth.AuthenticateRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		// explicit check, because staging uses the raw store
+		if err := authorizeSnapshot(user.Policy, eh.ActionSnapshotWrite, version.Stream(), *perspective); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		chunk := []byte{}
+		if err := json.NewDecoder(r.Body).Decode(&chunk); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := stageSnapshotChunk(
+			r.Context(),
+			auth.rawSnapshotStore,
+			*version,
+			*perspective,
+			digest,
+			chunkIdx,
+			chunk,
+		); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods(http.MethodPut)
+
 	router.HandleFunc(prefix+"/snapshot", func(w http.ResponseWriter, r *http.Request) {
 		user, err := auth.AuthenticateRequest(r)
 		if err != nil {
@@ -298,13 +709,41 @@ func serverHandler(
 			return
 		}
 
-		snapshot := &eh.PersistedSnapshot{}
-		if err := json.NewDecoder(r.Body).Decode(snapshot); err != nil {
+		request := &ehserverclient.WriteSnapshotRequest{}
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		if err := user.Snapshots.WriteSnapshot(r.Context(), *snapshot); err != nil {
+		snapshot := request.PersistedSnapshot // shorthand
+
+		if request.Digest != "" { // rest of the chunks were uploaded to /snapshot/chunk
+			if err := validateSnapshotDigest(request.Digest); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if request.Chunks < 2 || request.Chunks > maxSnapshotChunks {
+				http.Error(w, "invalid number of chunks", http.StatusBadRequest)
+				return
+			}
+
+			// explicit check, because staging uses the raw store
+			if err := authorizeSnapshot(user.Policy, eh.ActionSnapshotWrite, snapshot.Cursor.Stream(), snapshot.Perspective); err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			rawData, err := unstageSnapshotChunks(r.Context(), auth.rawSnapshotStore, snapshot, request.Digest, request.Chunks)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			snapshot.RawData = rawData
+		}
+
+		if err := user.Snapshots.WriteSnapshot(r.Context(), snapshot); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 	}).Methods(http.MethodPut)
@@ -336,6 +775,60 @@ func serverHandler(
 		}
 	}).Methods(http.MethodDelete)
 
+	router.HandleFunc(prefix+"/snapshot/versions", func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth.AuthenticateRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		perspective := parsePerspectiveOrOutputHTTPError(r.URL.Query().Get("perspective"), w)
+		if perspective == nil {
+			return // HTTP error was output
+		}
+
+		stream, err := eh.DeserializeStreamName(r.URL.Query().Get("stream"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cursors, err := user.Snapshots.ListSnapshots(r.Context(), stream, *perspective)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respondJson(w, cursors)
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc(prefix+"/snapshot/rollback", func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth.AuthenticateRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		perspective := parsePerspectiveOrOutputHTTPError(r.URL.Query().Get("perspective"), w)
+		if perspective == nil {
+			return // HTTP error was output
+		}
+
+		to, err := eh.DeserializeCursor(r.URL.Query().Get("to"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := user.Snapshots.RollbackSnapshot(r.Context(), to, *perspective); err != nil {
+			if err == os.ErrNotExist {
+				http.NotFound(w, r)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		}
+	}).Methods(http.MethodPost)
+
 	router.HandleFunc(prefix+"/keyserver/envelope-decrypt", func(w http.ResponseWriter, r *http.Request) {
 		user, err := auth.AuthenticateRequest(r)
 		if err != nil {
@@ -369,4 +862,128 @@ func serverHandler(
 	return router
 }
 
+// system privileges see into encrypted data, so the user must have access to the same DEKs
+// to see what's learned from it
+func canReadEncryptedData(stream eh.StreamName, dekVersions []uint64, userPolicy policy.Policy) bool {
+	for _, dekVersion := range dekVersions {
+		if err := userPolicy.Authorize(eh.ActionStreamRead, stream.DEKResourceName(int(dekVersion))); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// stream records its key group, so the DEK must actually be sealed for (only) the group's KEKs.
+// returns the key group ID (clients from before key groups don't send one, so they get the default).
+func validateCreateStreamKeyGroup(
+	input ehserverclient.CreateStreamInput,
+	stream eh.StreamName,
+	settings *ehsettings.Store,
+) (string, error) {
+	keyGroupId := input.KeyGroup
+	if keyGroupId == "" {
+		keyGroupId = settings.KeyGroupIDForStream(stream)
+	}
+
+	keyGroup := settings.KeyGroup(keyGroupId)
+	if keyGroup == nil {
+		return "", fmt.Errorf("key group not found: %s", keyGroupId)
+	}
+
+	if input.DEK == nil {
+		return "", errors.New("DEK envelope missing")
+	}
+
+	recipients := map[string]bool{}
+	for _, slot := range input.DEK.KeySlots {
+		recipients[slot.KekId] = true
+	}
+
+	for _, kekId := range keyGroup.KEKs {
+		if !recipients[kekId] {
+			return "", fmt.Errorf("DEK envelope not sealed for key group %s's KEK %s", keyGroupId, kekId)
+		}
+
+		delete(recipients, kekId)
+	}
+
+	for kekId := range recipients {
+		return "", fmt.Errorf("DEK envelope sealed for KEK %s which is not in key group %s", kekId, keyGroupId)
+	}
+
+	return keyGroupId, nil
+}
+
+// "" => 0 (no waiting)
+func parseReadWait(serialized string) (time.Duration, error) {
+	if serialized == "" {
+		return 0, nil
+	}
+
+	wait, err := time.ParseDuration(serialized)
+	if err != nil {
+		return 0, fmt.Errorf("wait: %w", err)
+	}
+
+	if wait < 0 || wait > maxReadWait {
+		return 0, fmt.Errorf("wait: must be between 0 and %s", maxReadWait)
+	}
+
+	return wait, nil
+}
+
+// "" => default
+func parseChildStreamsLimit(serialized string) (int, error) {
+	if serialized == "" {
+		return ehstreamstats.DefaultChildStreamsLimit, nil
+	}
+
+	limit, err := strconv.Atoi(serialized)
+	if err != nil {
+		return 0, fmt.Errorf("limit: %w", err)
+	}
+
+	if limit < 1 || limit > ehstreamstats.MaxChildStreamsLimit {
+		return 0, fmt.Errorf("limit: must be between 1 and %d", ehstreamstats.MaxChildStreamsLimit)
+	}
+
+	return limit, nil
+}
+
+// "" => default
+func parseTreeDepth(serialized string) (int, error) {
+	if serialized == "" {
+		return ehstreamchildren.DefaultTreeDepth, nil
+	}
+
+	depth, err := strconv.Atoi(serialized)
+	if err != nil {
+		return 0, fmt.Errorf("depth: %w", err)
+	}
+
+	if depth < 1 || depth > ehstreamchildren.MaxTreeDepth {
+		return 0, fmt.Errorf("depth: must be between 1 and %d", ehstreamchildren.MaxTreeDepth)
+	}
+
+	return depth, nil
+}
+
+func parseTreeLimit(serialized string) (int, error) {
+	if serialized == "" {
+		return ehstreamchildren.DefaultTreeLimit, nil
+	}
+
+	limit, err := strconv.Atoi(serialized)
+	if err != nil {
+		return 0, fmt.Errorf("limit: %w", err)
+	}
+
+	if limit < 1 || limit > ehstreamchildren.MaxTreeLimit {
+		return 0, fmt.Errorf("limit: must be between 1 and %d", ehstreamchildren.MaxTreeLimit)
+	}
+
+	return limit, nil
+}
+
 var respondJson = httputils.RespondJson // shorthand
@@ -0,0 +1,128 @@
+package ehserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehclient/ehclienttest"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/ehserver/ehserverclient"
+	"github.com/function61/eventhorizon/pkg/policy"
+	"github.com/function61/eventhorizon/pkg/system/ehsettings"
+	"github.com/function61/eventhorizon/pkg/system/ehstreamstats"
+	"github.com/function61/gokit/crypto/envelopeenc"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestParseReadWait(t *testing.T) {
+	wait, err := parseReadWait("")
+	assert.Ok(t, err)
+	assert.Assert(t, wait == 0)
+
+	wait, err = parseReadWait("30s")
+	assert.Ok(t, err)
+	assert.Assert(t, wait == 30*time.Second)
+
+	_, err = parseReadWait("2m")
+	assert.EqualString(t, err.Error(), "wait: must be between 0 and 1m0s")
+
+	_, err = parseReadWait("-1s")
+	assert.EqualString(t, err.Error(), "wait: must be between 0 and 1m0s")
+
+	_, err = parseReadWait("soon")
+	assert.EqualString(t, err.Error(), `wait: time: invalid duration "soon"`)
+}
+
+func TestValidateCreateStreamKeyGroup(t *testing.T) {
+	settings := ehsettings.New()
+	assert.Ok(t, settings.InstallSnapshot(eh.NewSnapshot(
+		eh.SysSettings.At(3),
+		[]byte(`{"KeyGroups": [{"ID": "default", "KEKs": ["a", "b"]}, {"ID": "secret", "KEKs": ["c"]}]}`),
+		settings.Perspective())))
+
+	stream := eh.RootName.Child("t-1")
+
+	validate := func(keyGroup string, kekIds ...string) string {
+		input := ehserverclient.CreateStreamInput{
+			DEK:      sealedFor(t, stream, kekIds...),
+			KeyGroup: keyGroup,
+		}
+
+		keyGroupId, err := validateCreateStreamKeyGroup(input, stream, settings)
+		if err != nil {
+			return err.Error()
+		}
+
+		return keyGroupId
+	}
+
+	assert.EqualString(t, validate("default", "a", "b"), "default")
+	assert.EqualString(t, validate("default", "b", "a"), "default")
+	assert.EqualString(t, validate("secret", "c"), "secret")
+	// from clients that predate key groups
+	assert.EqualString(t, validate("", "a", "b"), "default")
+
+	assert.EqualString(t, validate("nonexistent", "a"), "key group not found: nonexistent")
+	assert.EqualString(t, validate("default", "a"), "DEK envelope not sealed for key group default's KEK b")
+	assert.EqualString(t, validate("secret", "c", "a"), "DEK envelope sealed for KEK a which is not in key group secret")
+	assert.EqualString(t, validate("", "c"), "DEK envelope not sealed for key group default's KEK a")
+
+	_, err := validateCreateStreamKeyGroup(ehserverclient.CreateStreamInput{KeyGroup: "default"}, stream, settings)
+	assert.EqualString(t, err.Error(), "DEK envelope missing")
+}
+
+func TestStreamStatsWithoutDEKAccess(t *testing.T) {
+	ctx := context.Background()
+
+	stream := eh.RootName.Child("secrets")
+
+	eventLog := ehclienttest.NewEventLog()
+	systemClient := ehclient.NewSystemClient(
+		eventLog,
+		ehclienttest.NewSnapshotStore(),
+		ehclienttest.NewSystemConnector(eventLog),
+		nil)
+
+	_, err := systemClient.CreateStream(ctx, stream, "default", nil)
+	assert.Ok(t, err)
+
+	// the event type is not a meta event, it just happens to be a handy type
+	assert.Ok(t, systemClient.Append(ctx, stream, eh.NewStreamClosed("secret reason", ehevent.MetaSystemUser(time.Now()))))
+
+	stats, err := ehstreamstats.LoadUntilRealtime(ctx, stream, systemClient, ehstreamstats.NewCache())
+	assert.Ok(t, err)
+
+	output := func(userPolicy policy.Policy) ehstreamstats.Stats {
+		return stats.State.Output("", 10, canReadEncryptedData(stream, stats.State.DEKVersions(), userPolicy)).Stats
+	}
+
+	streamRead := policy.NewAllowStatement([]policy.Action{eh.ActionStreamRead}, stream.ResourceName())
+	dekRead := policy.NewAllowStatement([]policy.Action{eh.ActionStreamRead}, stream.DEKResourceName(0))
+
+	withDEK := output(policy.NewPolicy(streamRead, dekRead))
+	assert.Assert(t, withDEK.EventsByType["$stream.Started"] == 1)
+	assert.Assert(t, withDEK.EventsByType["$stream.Closed"] == 1)
+
+	withoutDEK := output(policy.NewPolicy(streamRead))
+	assert.Assert(t, withoutDEK.EventsByType["$stream.Started"] == 1)
+	assert.Assert(t, withoutDEK.EventsByType["$stream.Closed"] == 0)
+	assert.Assert(t, withoutDEK.LastEvent.Equal(*withoutDEK.FirstEvent))
+	// these are visible in the raw log anyway
+	assert.Assert(t, withoutDEK.EntriesByKind[eh.LogDataKindEncryptedData] == 1)
+}
+
+func sealedFor(t *testing.T, stream eh.StreamName, kekIds ...string) *envelopeenc.EnvelopeBundle {
+	slotEncrypters := []envelopeenc.SlotEncrypter{}
+	for _, kekId := range kekIds {
+		slotEncrypters = append(slotEncrypters, envelopeenc.NaclSecretBoxEncrypter(sha256.Sum256([]byte(kekId)), kekId))
+	}
+
+	dekEnvelope, err := envelopeenc.EncryptDEK(stream.DEKResourceName(0).String(), []byte("dek"), slotEncrypters...)
+	assert.Ok(t, err)
+
+	return dekEnvelope
+}
@@ -0,0 +1,123 @@
+package ehserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+)
+
+// how long each read waits for new data before we send a keepalive. this is shorter than
+// common idle timeouts (30 s - 60 s) of load balancers and proxies.
+const streamReadWait = 25 * time.Second
+
+// pushes log entries to the client as they get appended, until the client disconnects.
+// NOTE: doesn't work in Lambda, because API Gateway buffers the whole response.
+func streamEntries(
+	ctx context.Context,
+	w http.ResponseWriter,
+	flusher http.Flusher,
+	enc streamEncoder,
+	reader eh.Reader,
+	appendWaiter *appendWaiter,
+	after eh.Cursor,
+) error {
+	w.Header().Set("Content-Type", enc.contentType())
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		res, err := appendWaiter.readWaiting(ctx, reader, after, streamReadWait)
+		if err != nil {
+			return err
+		}
+
+		if len(res.Entries) == 0 {
+			if err := enc.keepalive(w); err != nil {
+				return err
+			}
+		}
+
+		for _, entry := range res.Entries {
+			if err := enc.entry(w, entry); err != nil {
+				return err
+			}
+		}
+
+		flusher.Flush()
+
+		after = res.LastEntry
+	}
+}
+
+type streamEncoder interface {
+	contentType() string
+	entry(w io.Writer, entry eh.LogEntry) error
+	keepalive(w io.Writer) error
+	error(w io.Writer, err error) error
+}
+
+// Server-Sent Events if client asks for it (browsers' EventSource does), NDJSON otherwise
+func newStreamEncoder(accept string) streamEncoder {
+	if strings.Contains(accept, "text/event-stream") {
+		return &sseEncoder{}
+	} else {
+		return &ndjsonEncoder{}
+	}
+}
+
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+type sseEncoder struct{}
+
+func (s *sseEncoder) contentType() string {
+	return "text/event-stream"
+}
+
+func (s *sseEncoder) entry(w io.Writer, entry eh.LogEntry) error {
+	entryJson, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// event ID lets EventSource resume from where it left off via "Last-Event-ID"
+	_, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", entry.Cursor.Serialize(), entryJson)
+	return err
+}
+
+func (s *sseEncoder) keepalive(w io.Writer) error {
+	_, err := io.WriteString(w, ": keepalive\n\n") // comment line, ignored by clients
+	return err
+}
+
+func (s *sseEncoder) error(w io.Writer, err error) error {
+	_, errWrite := fmt.Fprintf(w, "event: error\ndata: %s\n\n", strings.ReplaceAll(err.Error(), "\n", " "))
+	return errWrite
+}
+
+// one JSON-encoded eh.LogEntry per line. http://ndjson.org/
+type ndjsonEncoder struct{}
+
+func (n *ndjsonEncoder) contentType() string {
+	return "application/x-ndjson"
+}
+
+func (n *ndjsonEncoder) entry(w io.Writer, entry eh.LogEntry) error {
+	return json.NewEncoder(w).Encode(entry) // adds newline
+}
+
+func (n *ndjsonEncoder) keepalive(w io.Writer) error {
+	_, err := io.WriteString(w, "\n") // empty lines are to be ignored by clients
+	return err
+}
+
+func (n *ndjsonEncoder) error(w io.Writer, err error) error {
+	return json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
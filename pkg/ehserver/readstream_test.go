@@ -0,0 +1,61 @@
+package ehserver
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestNewStreamEncoder(t *testing.T) {
+	assert.EqualString(t, newStreamEncoder("text/event-stream").contentType(), "text/event-stream")
+	assert.EqualString(t, newStreamEncoder("application/x-ndjson").contentType(), "application/x-ndjson")
+	assert.EqualString(t, newStreamEncoder("").contentType(), "application/x-ndjson")
+}
+
+func TestSseEncoder(t *testing.T) {
+	output := &bytes.Buffer{}
+
+	enc := &sseEncoder{}
+
+	assert.Ok(t, enc.entry(output, testEntry()))
+	assert.Ok(t, enc.keepalive(output))
+	assert.Ok(t, enc.error(output, errors.New("multi\nline")))
+
+	assert.EqualString(t, output.String(), `id: /chatrooms/offtopic@3
+data: {"Cursor":{"Stream":"/chatrooms/offtopic","Version":3},"Data":{"Kind":2,"Raw":"aGVsbG8="}}
+
+: keepalive
+
+event: error
+data: multi line
+
+`)
+}
+
+func TestNdjsonEncoder(t *testing.T) {
+	output := &bytes.Buffer{}
+
+	enc := &ndjsonEncoder{}
+
+	assert.Ok(t, enc.entry(output, testEntry()))
+	assert.Ok(t, enc.keepalive(output))
+	assert.Ok(t, enc.error(output, errors.New("multi\nline")))
+
+	assert.EqualString(t, output.String(), `{"Cursor":{"Stream":"/chatrooms/offtopic","Version":3},"Data":{"Kind":2,"Raw":"aGVsbG8="}}
+
+{"error":"multi\nline"}
+`)
+}
+
+func testEntry() eh.LogEntry {
+	return eh.LogEntry{
+		Cursor: chatRoom.At(3),
+		Data: eh.LogData{
+			Kind: eh.LogDataKindEncryptedData,
+			Raw:  []byte("hello"),
+		},
+	}
+}
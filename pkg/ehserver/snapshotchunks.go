@@ -0,0 +1,186 @@
+package ehserver
+
+// Snapshots larger than ehserverclient.SnapshotChunkSize are transferred in chunks, because
+// a Lambda request or response can't hold them in one piece.
+//
+// Reads: GET /snapshot responds with the first chunk, the client fetches the rest from
+// /snapshot/chunk. The snapshot is kept in snapshotChunkCache for the following chunk requests.
+//
+// Writes: the client uploads the 2nd, 3rd, ... chunk to /snapshot/chunk, and then PUTs
+// /snapshot with the first chunk. Requests can land on different server instances, so the
+// uploaded chunks are staged in the snapshot store itself. The snapshot is committed only if
+// the reassembled chunks match the digest. Chunks of abandoned uploads are left behind.
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/gokit/sync/syncutil"
+)
+
+const (
+	snapshotChunkCacheItems = 4 // each can be tens of MB
+	snapshotChunkCacheTTL   = time.Minute
+	maxSnapshotChunks       = 1000
+)
+
+// recently read chunked snapshots, by digest
+type snapshotChunkCache struct {
+	items   []cachedSnapshotChunks // oldest first
+	itemsMu sync.Mutex
+}
+
+type cachedSnapshotChunks struct {
+	version     eh.Cursor
+	perspective eh.SnapshotPerspective
+	digest      string
+	chunks      [][]byte
+	added       time.Time
+}
+
+func newSnapshotChunkCache() *snapshotChunkCache {
+	return &snapshotChunkCache{
+		items: []cachedSnapshotChunks{},
+	}
+}
+
+func (s *snapshotChunkCache) Put(snap eh.PersistedSnapshot, digest string, chunks [][]byte, now time.Time) {
+	defer syncutil.LockAndUnlock(&s.itemsMu)()
+
+	s.items = append(s.valid(now), cachedSnapshotChunks{
+		version:     snap.Cursor,
+		perspective: snap.Perspective,
+		digest:      digest,
+		chunks:      chunks,
+		added:       now,
+	})
+
+	if len(s.items) > snapshotChunkCacheItems {
+		s.items = s.items[len(s.items)-snapshotChunkCacheItems:]
+	}
+}
+
+// nil if not cached
+func (s *snapshotChunkCache) Get(
+	version eh.Cursor,
+	perspective eh.SnapshotPerspective,
+	digest string,
+	now time.Time,
+) [][]byte {
+	defer syncutil.LockAndUnlock(&s.itemsMu)()
+
+	s.items = s.valid(now)
+
+	for _, item := range s.items {
+		if item.digest == digest && item.version.Equal(version) && item.perspective == perspective {
+			return item.chunks
+		}
+	}
+
+	return nil
+}
+
+// items that haven't expired
+func (s *snapshotChunkCache) valid(now time.Time) []cachedSnapshotChunks {
+	valid := []cachedSnapshotChunks{}
+	for _, item := range s.items {
+		if now.Sub(item.added) < snapshotChunkCacheTTL {
+			valid = append(valid, item)
+		}
+	}
+
+	return valid
+}
+
+// uploaded chunk *idx* is staged as a snapshot of this perspective (at the snapshot's version).
+// access is checked against the actual perspective before touching the staged ones.
+func snapshotUploadPerspective(perspective eh.SnapshotPerspective, digest string, idx int) eh.SnapshotPerspective {
+	return eh.NewPerspective("eh.upload."+perspective.AppID, fmt.Sprintf("%s-%s-%d", perspective.Version, digest, idx))
+}
+
+// digest ends up in perspective, so it can't be just any string
+func validateSnapshotDigest(digest string) error {
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != len(eh.SnapshotDigest(nil)) {
+		return errors.New("invalid digest")
+	}
+
+	return nil
+}
+
+// stores 2nd, 3rd, ... chunk of an upload
+func stageSnapshotChunk(
+	ctx context.Context,
+	store eh.SnapshotStore,
+	version eh.Cursor,
+	perspective eh.SnapshotPerspective,
+	digest string,
+	idx int,
+	chunk []byte,
+) error {
+	if idx < 1 || idx >= maxSnapshotChunks { // 1st chunk comes with the commit
+		return fmt.Errorf("chunk out of range: %d", idx)
+	}
+
+	return store.WriteSnapshot(ctx, eh.PersistedSnapshot{
+		Cursor:      version,
+		RawData:     chunk,
+		Perspective: snapshotUploadPerspective(perspective, digest, idx),
+	})
+}
+
+// joins *firstChunk* with the staged chunks and verifies them against the digest. the staged
+// chunks are deleted (also if verification fails, since the upload can't be completed anyway).
+func unstageSnapshotChunks(
+	ctx context.Context,
+	store eh.SnapshotStore,
+	firstChunk eh.PersistedSnapshot,
+	digest string,
+	numChunks int,
+) ([]byte, error) {
+	chunks := [][]byte{firstChunk.RawData}
+
+	errRead := func() error {
+		for idx := 1; idx < numChunks; idx++ {
+			version := firstChunk.Cursor // shorthand
+
+			staged, err := store.ReadSnapshot(ctx, eh.ReadSnapshotInput{
+				Stream:      version.Stream(),
+				Perspective: snapshotUploadPerspective(firstChunk.Perspective, digest, idx),
+				AtOrBefore:  &version,
+			})
+			if err != nil {
+				return fmt.Errorf("chunk %d: %w", idx, err)
+			}
+
+			if !staged.Snapshot.Cursor.Equal(version) {
+				return fmt.Errorf("chunk %d: not uploaded", idx)
+			}
+
+			chunks = append(chunks, staged.Snapshot.RawData)
+		}
+
+		return nil
+	}()
+
+	for idx := 1; idx < numChunks; idx++ {
+		if err := store.DeleteSnapshot(
+			ctx,
+			firstChunk.Cursor.Stream(),
+			snapshotUploadPerspective(firstChunk.Perspective, digest, idx),
+		); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	if errRead != nil {
+		return nil, errRead
+	}
+
+	return eh.ReassembleSnapshotChunks(chunks, digest)
+}
@@ -0,0 +1,153 @@
+package ehserver
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehclient/ehclienttest"
+	"github.com/function61/eventhorizon/pkg/ehserver/ehserverclient"
+	"github.com/function61/eventhorizon/pkg/system/ehcred"
+	"github.com/function61/eventhorizon/pkg/system/ehsettings"
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestSnapshotChunksOverHTTP(t *testing.T) {
+	ctx := context.Background()
+
+	chatRooms := eh.RootName.Child("chatrooms")
+	perspective := eh.NewV1Perspective("chat")
+
+	snapshots := ehclienttest.NewSnapshotStore()
+
+	client, closeServer := testServerClient(t, snapshots, chatRooms)
+	defer closeServer()
+
+	// 3 chunks, and every chunk differs from the others
+	rawData := make([]byte, 2*ehserverclient.SnapshotChunkSize+100)
+	for i := range rawData {
+		rawData[i] = byte(i % 251)
+	}
+
+	assert.Ok(t, client.WriteSnapshot(ctx, eh.PersistedSnapshot{
+		Cursor:      chatRooms.At(0),
+		RawData:     rawData,
+		Perspective: perspective,
+	}))
+
+	stored, err := snapshots.ReadSnapshot(ctx, eh.ReadSnapshotInput{
+		Stream:      chatRooms,
+		Perspective: perspective,
+	})
+	assert.Ok(t, err)
+	assert.Assert(t, bytes.Equal(stored.Snapshot.RawData, rawData))
+
+	// staged chunks were cleaned up
+	for idx := 1; idx < 3; idx++ {
+		staged, err := snapshots.ListSnapshots(ctx, chatRooms, snapshotUploadPerspective(perspective, eh.SnapshotDigest(rawData), idx))
+		assert.Ok(t, err)
+		assert.EqualInt(t, len(staged), 0)
+	}
+
+	readOpsBefore := snapshots.Stats().ReadOps
+
+	output, err := client.ReadSnapshot(ctx, eh.ReadSnapshotInput{
+		Stream:      chatRooms,
+		Perspective: perspective,
+	})
+	assert.Ok(t, err)
+	assert.EqualString(t, output.Snapshot.Cursor.Serialize(), "/chatrooms@0")
+	assert.Assert(t, bytes.Equal(output.Snapshot.RawData, rawData))
+
+	// rest of the chunks were served from the cache
+	assert.EqualInt(t, snapshots.Stats().ReadOps-readOpsBefore, 1)
+}
+
+func TestUnstageSnapshotChunksDigestMismatch(t *testing.T) {
+	ctx := context.Background()
+
+	chatRooms := eh.RootName.Child("chatrooms")
+	perspective := eh.NewV1Perspective("chat")
+
+	snapshots := ehclienttest.NewSnapshotStore()
+
+	digest := eh.SnapshotDigest([]byte("hello world"))
+
+	assert.Ok(t, stageSnapshotChunk(ctx, snapshots, chatRooms.At(3), perspective, digest, 1, []byte(" there")))
+
+	_, err := unstageSnapshotChunks(ctx, snapshots, eh.PersistedSnapshot{
+		Cursor:      chatRooms.At(3),
+		RawData:     []byte("hello"),
+		Perspective: perspective,
+	}, digest, 2)
+	assert.Assert(t, strings.HasPrefix(err.Error(), "ReassembleSnapshotChunks: digest mismatch (2 chunks)"))
+
+	// staged chunk is gone even if the upload failed
+	staged, err := snapshots.ListSnapshots(ctx, chatRooms, snapshotUploadPerspective(perspective, digest, 1))
+	assert.Ok(t, err)
+	assert.EqualInt(t, len(staged), 0)
+
+	// chunk that was never uploaded
+	_, err = unstageSnapshotChunks(ctx, snapshots, eh.PersistedSnapshot{
+		Cursor:      chatRooms.At(3),
+		RawData:     []byte("hello"),
+		Perspective: perspective,
+	}, digest, 2)
+	assert.EqualString(t, err.Error(), "chunk 1: file does not exist")
+}
+
+// HTTP server backed by *snapshots* (with *streams* created), and a client with access to all
+// snapshots. 2nd return closes the server.
+func testServerClient(
+	t *testing.T,
+	snapshots eh.SnapshotStore,
+	streams ...eh.StreamName,
+) (ehserverclient.ReaderWriterSnapshotStore, func()) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	eventLog := ehclienttest.NewEventLog()
+	systemClient := ehclient.NewSystemClient(
+		eventLog,
+		snapshots,
+		ehclienttest.NewSystemConnector(eventLog),
+		nil)
+
+	for _, stream := range append(streams, eh.SysCredentials) {
+		_, err := systemClient.CreateStream(ctx, stream, "default", nil)
+		assert.Ok(t, err)
+	}
+
+	assert.Ok(t, snapshots.WriteSnapshot(ctx, *eh.NewSnapshot(eh.SysCredentials.At(0), []byte(`{
+	"Users": [{"ID": "u1", "PolicyIDs": ["p1"], "AccessKeys": [{"ID": "key", "Secret": "secret"}]}],
+	"Policies": {"p1": {"ID": "p1", "Content": {"statements": [{
+		"effect": "allow",
+		"actions": ["eventhorizon:snapshot:Read", "eventhorizon:snapshot:Write", "eventhorizon:stream:Read"],
+		"resources": ["*"]
+	}]}}}
+}`), ehcred.New().Perspective()).Unencrypted()))
+
+	credentials, err := ehcred.LoadUntilRealtime(ctx, systemClient)
+	assert.Ok(t, err)
+
+	auth := &authenticator{
+		credentials:      credentials,
+		rawReader:        eventLog,
+		rawWriter:        eventLog,
+		rawSnapshotStore: snapshots,
+		logl:             logex.Levels(logex.Discard),
+	}
+
+	server := httptest.NewServer(serverHandler(auth, nil, newAppendWaiter(), ehsettings.New(), systemClient, "/api"))
+
+	client, err := ehserverclient.New(strings.Replace(server.URL, "http://", "http://:key.secret@", 1)+"/api", nil)
+	assert.Ok(t, err)
+
+	return client, server.Close
+}
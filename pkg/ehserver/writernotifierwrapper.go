@@ -2,7 +2,10 @@ package ehserver
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"os"
 
 	"github.com/function61/eventhorizon/pkg/eh"
 	"github.com/function61/eventhorizon/pkg/ehclient"
@@ -26,23 +29,29 @@ type SubscriptionNotifier interface {
 
 type writerNotifierWrapper struct {
 	innerWriter  eh.Writer
-	notifier     SubscriptionNotifier
+	notifier     SubscriptionNotifier // can be nil
+	appendWaiter *appendWaiter
 	systemClient *ehclient.SystemClient
 	logl         *logex.Leveled
 }
 
 // wraps a Writer so that successfull writes:
+// - wake up local readers waiting for new data in the stream
 // - resolve which subscribers are subscribed to the stream that was written into
-// - invoker noficiation for each subscriber
+// - invoker noficiation for each subscriber (only if notifier given)
+//
+// also shredding deletes the stream's metadata snapshot, since it contains the destroyed DEK envelopes.
 func wrapWriterWithNotifier(
 	innerWriter eh.Writer,
 	notifier SubscriptionNotifier,
+	appendWaiter *appendWaiter,
 	systemClient *ehclient.SystemClient,
 	logger *log.Logger,
 ) eh.Writer {
 	return &writerNotifierWrapper{
 		innerWriter:  innerWriter,
 		notifier:     notifier,
+		appendWaiter: appendWaiter,
 		systemClient: systemClient,
 		logl:         logex.Levels(logger),
 	}
@@ -52,12 +61,18 @@ func (w *writerNotifierWrapper) CreateStream(
 	ctx context.Context,
 	stream eh.StreamName,
 	dekEnvelope envelopeenc.Envelope,
+	keyGroupId string,
 	initialData *eh.LogData,
 ) (*eh.AppendResult, error) {
-	result, err := w.innerWriter.CreateStream(ctx, stream, dekEnvelope, initialData)
+	result, err := w.innerWriter.CreateStream(ctx, stream, dekEnvelope, keyGroupId, initialData)
 
 	if err == nil {
-		w.logIfNotifyError(w.notifySubscribers(ctx, result))
+		// parent got $stream.ChildStreamCreated, but we don't know its cursor
+		if parent := stream.Parent(); parent != nil {
+			w.appendWaiter.appended(*parent)
+		}
+
+		w.written(ctx, result)
 	}
 
 	return result, err
@@ -71,7 +86,7 @@ func (w *writerNotifierWrapper) Append(
 	result, err := w.innerWriter.Append(ctx, stream, data)
 
 	if err == nil {
-		w.logIfNotifyError(w.notifySubscribers(ctx, result))
+		w.written(ctx, result)
 	}
 
 	return result, err
@@ -85,12 +100,75 @@ func (w *writerNotifierWrapper) AppendAfter(
 	result, err := w.innerWriter.AppendAfter(ctx, after, data)
 
 	if err == nil {
-		w.logIfNotifyError(w.notifySubscribers(ctx, result))
+		w.written(ctx, result)
+	}
+
+	return result, err
+}
+
+func (w *writerNotifierWrapper) AppendMany(
+	ctx context.Context,
+	appends []eh.AppendAfterItem,
+) ([]eh.AppendResult, error) {
+	results, err := w.innerWriter.AppendMany(ctx, appends)
+
+	if err == nil {
+		for i := range results {
+			w.written(ctx, &results[i])
+		}
+	}
+
+	return results, err
+}
+
+func (w *writerNotifierWrapper) CloseStream(
+	ctx context.Context,
+	stream eh.StreamName,
+	reason string,
+) (*eh.AppendResult, error) {
+	result, err := w.innerWriter.CloseStream(ctx, stream, reason)
+
+	if err == nil {
+		w.written(ctx, result)
 	}
 
 	return result, err
 }
 
+func (w *writerNotifierWrapper) ShredStream(
+	ctx context.Context,
+	stream eh.StreamName,
+) (*eh.AppendResult, error) {
+	result, err := w.innerWriter.ShredStream(ctx, stream)
+
+	if err == nil {
+		if err := w.systemClient.SnapshotStore.DeleteSnapshot(
+			ctx,
+			stream,
+			eh.StreamMetaPerspective,
+		); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("ShredStream: DeleteSnapshot: %w", err)
+		}
+
+		// parent got $stream.ChildStreamShredded, but we don't know its cursor
+		if parent := stream.Parent(); parent != nil {
+			w.appendWaiter.appended(*parent)
+		}
+
+		w.written(ctx, result)
+	}
+
+	return result, err
+}
+
+func (w *writerNotifierWrapper) written(ctx context.Context, result *eh.AppendResult) {
+	w.appendWaiter.appended(result.Cursor.Stream())
+
+	if w.notifier != nil {
+		w.logIfNotifyError(w.notifySubscribers(ctx, result))
+	}
+}
+
 func (w *writerNotifierWrapper) notifySubscribers(ctx context.Context, result *eh.AppendResult) error {
 	streamMeta, err := ehstreammeta.LoadUntilRealtime(
 		ctx,
@@ -0,0 +1,54 @@
+package ehserver
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehclient/ehclienttest"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestShredDeletesStreamMetaSnapshot(t *testing.T) {
+	ctx := context.Background()
+
+	eventLog := ehclienttest.NewEventLog()
+	snapshotStore := ehclienttest.NewSnapshotStore()
+	connector := ehclienttest.NewSystemConnector(eventLog)
+
+	writer := wrapWriterWithNotifier(
+		eventLog,
+		nil,
+		newAppendWaiter(),
+		ehclient.NewSystemClient(eventLog, snapshotStore, connector, nil),
+		nil)
+
+	stream := eh.RootName.Child("t-1")
+
+	dekEnvelope, err := connector.DEKv0EnvelopeForNewStream(ctx, stream, "default")
+	assert.Ok(t, err)
+
+	_, err = writer.CreateStream(ctx, stream, *dekEnvelope, "default", nil)
+	assert.Ok(t, err)
+
+	// contents don't matter, only that it's there
+	assert.Ok(t, snapshotStore.WriteSnapshot(ctx, eh.PersistedSnapshot{
+		Cursor:      stream.At(0),
+		RawData:     []byte{byte(eh.PersistedSnapshotKindUnencrypted)},
+		Perspective: eh.StreamMetaPerspective,
+	}))
+
+	_, err = writer.CloseStream(ctx, stream, "test")
+	assert.Ok(t, err)
+
+	_, err = writer.ShredStream(ctx, stream)
+	assert.Ok(t, err)
+
+	_, err = snapshotStore.ReadSnapshot(ctx, eh.ReadSnapshotInput{
+		Stream:      stream,
+		Perspective: eh.StreamMetaPerspective,
+	})
+	assert.Assert(t, os.IsNotExist(err))
+}
@@ -51,6 +51,12 @@ func (p *Statement) matches(action string, resource string) bool {
 	return false
 }
 
+// same matching that is used for policy resources, for other uses like searching for streams.
+// "*" matches any sequence of characters (including "/").
+func WildcardMatches(subject string, maybePattern string) bool {
+	return stringMaybeWildcardEquals(subject, maybePattern)
+}
+
 // the "subject" cannot contain wildcards
 func stringMaybeWildcardEquals(subject string, maybePattern string) bool {
 	if !strings.Contains(maybePattern, "*") { // fast path
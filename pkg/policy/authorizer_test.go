@@ -36,3 +36,11 @@ func TestAuthorize(t *testing.T) {
 	// .. but not this
 	disallowed(policy.Authorize(act("eventhorizon:Read"), eventHorizonRn.Child("/_sys")))
 }
+
+func TestWildcardMatches(t *testing.T) {
+	assert.Assert(t, WildcardMatches("/t-1/users/joonas", "/t-*/users/*"))
+	assert.Assert(t, WildcardMatches("/t-1/users", "/t-1/users"))
+	assert.Assert(t, !WildcardMatches("/t-1/users", "/t-*/users/*"))
+	assert.Assert(t, !WildcardMatches("/t-1/settings/foo", "/t-*/users/*"))
+	assert.Assert(t, !WildcardMatches("/t-1/users/joonas", "/t-1/users"))
+}
@@ -11,7 +11,10 @@ import (
 	"github.com/function61/eventhorizon/pkg/eh"
 	"github.com/function61/eventhorizon/pkg/ehclient"
 	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/policy"
 	"github.com/function61/eventhorizon/pkg/system/ehsettingsdomain"
+	"github.com/function61/gokit/crypto/cryptoutil"
+	"github.com/function61/gokit/crypto/envelopeenc"
 	"github.com/function61/gokit/sliceutil"
 	"github.com/function61/gokit/sync/syncutil"
 )
@@ -21,6 +24,7 @@ type stateFormat struct {
 	KeyServers []*KeyServer
 	Keks       []*KEK
 	KeyGroups  []KeyGroup
+	Encodings  []EventEncodingRule `json:",omitempty"`
 }
 
 type KeyServer struct {
@@ -34,6 +38,7 @@ type KeyServer struct {
 type KEK struct {
 	Id         string
 	Registered time.Time
+	Retired    *time.Time `json:",omitempty"`
 	Kind       string
 	Label      string
 	PublicKey  string
@@ -47,6 +52,11 @@ type KeyGroup struct {
 	KEKs []string // which KEKs should control access to the stream's data
 }
 
+type EventEncodingRule struct {
+	Streams  string // stream name or a pattern
+	Encoding ehevent.Encoding
+}
+
 func newStateFormat() stateFormat {
 	return stateFormat{
 		KeyServers: []*KeyServer{},
@@ -92,6 +102,19 @@ func (s *Store) KeyGroupIDForStream(stream eh.StreamName) string {
 	return "default"
 }
 
+// encoding for events appended to the stream. the last matching rule wins.
+func (s *Store) EventEncodingForStream(stream eh.StreamName) ehevent.Encoding {
+	defer lockAndUnlock(&s.mu)()
+
+	for i := len(s.state.Encodings) - 1; i >= 0; i-- {
+		if policy.WildcardMatches(stream.String(), s.state.Encodings[i].Streams) {
+			return s.state.Encodings[i].Encoding
+		}
+	}
+
+	return ehevent.EncodingLines
+}
+
 func (s *Store) Data() stateFormat {
 	defer lockAndUnlock(&s.mu)()
 
@@ -113,13 +136,7 @@ func (s *Store) KeyGroup(id string) *KeyGroup {
 func (s *Store) KEK(kekId string) *KEK {
 	defer lockAndUnlock(&s.mu)()
 
-	for _, kek := range s.state.Keks {
-		if kek.Id == kekId {
-			return kek
-		}
-	}
-
-	return nil
+	return s.kekById(kekId)
 }
 
 func (s *Store) KEKs() []KEK {
@@ -133,6 +150,37 @@ func (s *Store) KEKs() []KEK {
 	return keks
 }
 
+// encrypters for sealing DEK envelopes for given KEKs. retired KEKs are not allowed.
+func (s *Store) SlotEncrypters(kekIds []string) ([]envelopeenc.SlotEncrypter, error) {
+	defer lockAndUnlock(&s.mu)()
+
+	slotEncrypters := []envelopeenc.SlotEncrypter{}
+
+	for _, kekId := range kekIds {
+		kek := s.kekById(kekId)
+		if kek == nil {
+			return nil, fmt.Errorf("KEK '%s' not found", kekId)
+		}
+
+		if kek.Retired != nil {
+			return nil, fmt.Errorf("KEK '%s' is retired", kekId)
+		}
+
+		if kek.Kind != "rsa" {
+			return nil, fmt.Errorf("KEK '%s' has unsupported kind: %s", kekId, kek.Kind)
+		}
+
+		pubKey, err := cryptoutil.ParsePemPkcs1EncodedRsaPublicKey([]byte(kek.PublicKey))
+		if err != nil {
+			return nil, fmt.Errorf("KEK '%s' public key parsing: %w", kekId, err)
+		}
+
+		slotEncrypters = append(slotEncrypters, envelopeenc.RsaOaepSha256Encrypter(pubKey))
+	}
+
+	return slotEncrypters, nil
+}
+
 func (s *Store) KeyServers() []KeyServer {
 	defer lockAndUnlock(&s.mu)()
 
@@ -216,6 +264,18 @@ func (s *Store) processEvent(ev ehevent.Event) error {
 			Label:      e.Label,
 			PublicKey:  e.PublicKey,
 		})
+	case *ehsettingsdomain.KekRetired:
+		kek := s.kekById(e.ID)
+		if kek == nil {
+			return fmt.Errorf("KEK %s not found", e.ID)
+		}
+
+		retired := e.Meta().Time()
+		kek.Retired = &retired
+
+		for idx := range s.state.KeyGroups {
+			s.state.KeyGroups[idx].KEKs = sliceutil.FilterString(s.state.KeyGroups[idx].KEKs, func(item string) bool { return item != e.ID })
+		}
 	case *ehsettingsdomain.KeyserverCreated:
 		s.state.KeyServers = append(s.state.KeyServers, &KeyServer{
 			Id:             e.ID,
@@ -246,6 +306,28 @@ func (s *Store) processEvent(ev ehevent.Event) error {
 			Name: e.Name,
 			KEKs: e.KEKs,
 		})
+	case *ehsettingsdomain.KeygroupKekAdded:
+		keyGroup, err := s.keyGroupById(e.Group)
+		if err != nil {
+			return err
+		}
+
+		keyGroup.KEKs = sliceutil.FilterString(keyGroup.KEKs, func(item string) bool { return item != e.Kek })
+
+		keyGroup.KEKs = append(keyGroup.KEKs, e.Kek)
+	case *ehsettingsdomain.EventEncodingSet:
+		encoding, err := ehevent.ParseEncoding(e.Encoding)
+		if err != nil {
+			// set by a newer version that we can't write in. failing here would make the whole
+			// settings stream unreadable, so we write in the default encoding instead.
+			encoding = ehevent.EncodingLines
+		}
+
+		// re-setting a pattern moves it last (= highest precedence)
+		s.state.Encodings = append(removeEncodingRule(s.state.Encodings, e.Streams), EventEncodingRule{
+			Streams:  e.Streams,
+			Encoding: encoding,
+		})
 	default:
 		return ehclient.UnsupportedEventTypeErr(ev)
 	}
@@ -253,6 +335,36 @@ func (s *Store) processEvent(ev ehevent.Event) error {
 	return nil
 }
 
+func removeEncodingRule(rules []EventEncodingRule, streams string) []EventEncodingRule {
+	remaining := []EventEncodingRule{}
+	for _, rule := range rules {
+		if rule.Streams != streams {
+			remaining = append(remaining, rule)
+		}
+	}
+	return remaining
+}
+
+func (s *Store) kekById(id string) *KEK {
+	for _, kek := range s.state.Keks {
+		if kek.Id == id {
+			return kek
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) keyGroupById(id string) (*KeyGroup, error) {
+	for idx := range s.state.KeyGroups {
+		if s.state.KeyGroups[idx].ID == id {
+			return &s.state.KeyGroups[idx], nil
+		}
+	}
+
+	return nil, fmt.Errorf("KeyGroup %s not found", id)
+}
+
 func (s *Store) keyServerById(id string) (*KeyServer, error) {
 	for _, ks := range s.state.KeyServers {
 		if ks.Id == id {
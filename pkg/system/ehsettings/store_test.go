@@ -0,0 +1,126 @@
+package ehsettings
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/system/ehsettingsdomain"
+	"github.com/function61/gokit/crypto/cryptoutil"
+	"github.com/function61/gokit/crypto/envelopeenc"
+	"github.com/function61/gokit/testing/assert"
+)
+
+var (
+	t0 = time.Date(2020, 9, 1, 10, 0, 0, 0, time.UTC)
+)
+
+func TestKekRetired(t *testing.T) {
+	store, kekIds := newStoreWithKeks(t, 3)
+
+	assert.Ok(t, store.processEvent(ehsettingsdomain.NewKeygroupCreated("default", "Default", kekIds[:2], meta())))
+	assert.Ok(t, store.processEvent(ehsettingsdomain.NewKeygroupCreated("other", "Other", kekIds[1:], meta())))
+
+	assert.Ok(t, store.processEvent(ehsettingsdomain.NewKekRetired(kekIds[1], "compromised", meta())))
+
+	// removed from all key groups
+	assert.EqualString(t, strings.Join(store.KeyGroup("default").KEKs, ", "), strings.Join(kekIds[:1], ", "))
+	assert.EqualString(t, strings.Join(store.KeyGroup("other").KEKs, ", "), strings.Join(kekIds[2:], ", "))
+
+	assert.Assert(t, store.KEK(kekIds[1]).Retired.Equal(t0))
+	assert.Assert(t, store.KEK(kekIds[0]).Retired == nil)
+
+	assert.EqualString(
+		t,
+		store.processEvent(ehsettingsdomain.NewKekRetired("nonexistent", "", meta())).Error(),
+		"KEK nonexistent not found")
+}
+
+func TestKeygroupKekAdded(t *testing.T) {
+	store, kekIds := newStoreWithKeks(t, 2)
+
+	assert.Ok(t, store.processEvent(ehsettingsdomain.NewKeygroupCreated("default", "Default", kekIds[:1], meta())))
+
+	assert.Ok(t, store.processEvent(ehsettingsdomain.NewKeygroupKekAdded("default", kekIds[1], meta())))
+	// adding again doesn't duplicate
+	assert.Ok(t, store.processEvent(ehsettingsdomain.NewKeygroupKekAdded("default", kekIds[1], meta())))
+
+	assert.EqualString(t, strings.Join(store.KeyGroup("default").KEKs, ", "), strings.Join(kekIds, ", "))
+
+	assert.Assert(t, store.processEvent(ehsettingsdomain.NewKeygroupKekAdded("nonexistent", kekIds[1], meta())) != nil)
+}
+
+func TestSlotEncrypters(t *testing.T) {
+	store, kekIds := newStoreWithKeks(t, 2)
+
+	slotEncrypters, err := store.SlotEncrypters(kekIds)
+	assert.Ok(t, err)
+	assert.EqualInt(t, len(slotEncrypters), 2)
+	assert.EqualString(t, slotEncrypters[0].KekId(), kekIds[0])
+
+	// envelope sealed with them can be opened with the private key
+	envelope, err := envelopeenc.EncryptDEK("test", []byte("dek"), slotEncrypters...)
+	assert.Ok(t, err)
+	assert.EqualInt(t, len(envelope.KeySlots), 2)
+
+	_, err = store.SlotEncrypters([]string{"nonexistent"})
+	assert.EqualString(t, err.Error(), "KEK 'nonexistent' not found")
+
+	assert.Ok(t, store.processEvent(ehsettingsdomain.NewKekRetired(kekIds[1], "expiring", meta())))
+
+	_, err = store.SlotEncrypters(kekIds)
+	assert.EqualString(t, err.Error(), "KEK '"+kekIds[1]+"' is retired")
+
+	assert.Ok(t, store.processEvent(ehsettingsdomain.NewKekRegistered("secretbox", "nacl-secretbox", "", "", meta())))
+
+	_, err = store.SlotEncrypters([]string{"secretbox"})
+	assert.EqualString(t, err.Error(), "KEK 'secretbox' has unsupported kind: nacl-secretbox")
+}
+
+func TestEventEncodingForStream(t *testing.T) {
+	store := New()
+
+	assert.Ok(t, store.processEvent(ehsettingsdomain.NewEventEncodingSet("/sensors/*", "cbor", meta())))
+	assert.Ok(t, store.processEvent(ehsettingsdomain.NewEventEncodingSet("/sensors/legacy", "lines", meta())))
+
+	assert.Assert(t, store.EventEncodingForStream(eh.RootName.Child("sensors").Child("temp")) == ehevent.EncodingCBOR)
+	assert.Assert(t, store.EventEncodingForStream(eh.RootName.Child("sensors").Child("legacy")) == ehevent.EncodingLines)
+	assert.Assert(t, store.EventEncodingForStream(eh.RootName.Child("users")) == ehevent.EncodingLines)
+
+	// encoding we don't know (set by a newer version) falls back to lines instead of erroring
+	assert.Ok(t, store.processEvent(ehsettingsdomain.NewEventEncodingSet("/sensors/*", "protobuf", meta())))
+
+	assert.Assert(t, store.EventEncodingForStream(eh.RootName.Child("sensors").Child("temp")) == ehevent.EncodingLines)
+}
+
+// registers "count" RSA KEKs. returns their IDs.
+func newStoreWithKeks(t *testing.T, count int) (*Store, []string) {
+	store := New()
+
+	kekIds := []string{}
+	for i := 0; i < count; i++ {
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.Ok(t, err)
+
+		kekId := envelopeenc.RsaOaepSha256Encrypter(&privateKey.PublicKey).KekId()
+
+		assert.Ok(t, store.processEvent(ehsettingsdomain.NewKekRegistered(
+			kekId,
+			"rsa",
+			"Test key",
+			string(cryptoutil.MarshalPemPkcs1EncodedRsaPublicKey(&privateKey.PublicKey)),
+			meta())))
+
+		kekIds = append(kekIds, kekId)
+	}
+
+	return store, kekIds
+}
+
+func meta() ehevent.EventMeta {
+	return ehevent.MetaSystemUser(t0)
+}
@@ -12,10 +12,13 @@ const (
 var Types = ehevent.Types{
 	"mqtt.ConfigUpdated":    func() ehevent.Event { return &MqttConfigUpdated{} },
 	"keygroup.Created":      func() ehevent.Event { return &KeygroupCreated{} },
+	"keygroup.KekAdded":     func() ehevent.Event { return &KeygroupKekAdded{} },
 	"kek.Registered":        func() ehevent.Event { return &KekRegistered{} },
+	"kek.Retired":           func() ehevent.Event { return &KekRetired{} },
 	"keyserver.Created":     func() ehevent.Event { return &KeyserverCreated{} },
 	"keyserver.KeyAttached": func() ehevent.Event { return &KeyserverKeyAttached{} },
 	"keyserver.KeyDetached": func() ehevent.Event { return &KeyserverKeyDetached{} },
+	"eventencoding.Set":     func() ehevent.Event { return &EventEncodingSet{} },
 }
 
 // ------
@@ -46,6 +49,29 @@ func NewKeygroupCreated(
 
 // ------
 
+type KeygroupKekAdded struct {
+	meta  ehevent.EventMeta
+	Group string
+	Kek   string
+}
+
+func (e *KeygroupKekAdded) MetaType() string         { return "keygroup.KekAdded" }
+func (e *KeygroupKekAdded) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewKeygroupKekAdded(
+	group string,
+	kek string,
+	meta ehevent.EventMeta,
+) *KeygroupKekAdded {
+	return &KeygroupKekAdded{
+		meta:  meta,
+		Group: group,
+		Kek:   kek,
+	}
+}
+
+// ------
+
 type KekRegistered struct {
 	meta      ehevent.EventMeta
 	ID        string // same as envelopeenc's slot's KEK ID
@@ -75,6 +101,32 @@ func NewKekRegistered(
 
 // ------
 
+// retired KEK is removed from all key groups and it doesn't get access to new DEKs. the
+// re-wrapping job re-wraps existing DEK envelopes without it and rotates DEKs it had access to.
+// old envelopes stay in the log though, so data encrypted before that stays readable with it.
+type KekRetired struct {
+	meta   ehevent.EventMeta
+	ID     string
+	Reason string // "compromised" | "expiring" | ...
+}
+
+func (e *KekRetired) MetaType() string         { return "kek.Retired" }
+func (e *KekRetired) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewKekRetired(
+	id string,
+	reason string,
+	meta ehevent.EventMeta,
+) *KekRetired {
+	return &KekRetired{
+		meta:   meta,
+		ID:     id,
+		Reason: reason,
+	}
+}
+
+// ------
+
 type KeyserverCreated struct {
 	meta  ehevent.EventMeta
 	ID    string
@@ -173,3 +225,27 @@ func NewMqttConfigUpdated(
 		Namespace:                namespace,
 	}
 }
+
+// ------
+
+// how events get serialized when appending to matching streams. later rules take precedence.
+type EventEncodingSet struct {
+	meta     ehevent.EventMeta
+	Streams  string // stream name or a pattern, like "/sensors/*"
+	Encoding string // "lines" | "cbor"
+}
+
+func (e *EventEncodingSet) MetaType() string         { return "eventencoding.Set" }
+func (e *EventEncodingSet) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewEventEncodingSet(
+	streams string,
+	encoding string,
+	meta ehevent.EventMeta,
+) *EventEncodingSet {
+	return &EventEncodingSet{
+		meta:     meta,
+		Streams:  streams,
+		Encoding: encoding,
+	}
+}
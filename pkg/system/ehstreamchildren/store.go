@@ -0,0 +1,186 @@
+// Complete child stream index for a given stream. Only reads the stream's unencrypted metadata,
+// so this is cheap to load for walking large stream trees.
+package ehstreamchildren
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/sync/syncutil"
+)
+
+//go:generate genny -in=../../cachegen/cache.go -out=cache.gen.go -pkg=ehstreamchildren gen CacheItemType=*App
+
+var (
+	GlobalCache = NewCache()
+)
+
+type stateFormat struct {
+	Children []string // child base names (to conserve space), sorted for pagination. unlike ehstreammeta, not capped.
+}
+
+func newStateFormat() stateFormat {
+	return stateFormat{
+		Children: []string{},
+	}
+}
+
+type Store struct {
+	version eh.Cursor
+	mu      sync.Mutex
+	state   stateFormat // for easy snapshotting
+}
+
+func New(stream eh.StreamName) *Store {
+	return &Store{
+		version: stream.Beginning(),
+		state:   newStateFormat(),
+	}
+}
+
+// paginated in alphabetical order. "after" is base name of the last child of the previous page
+// ("" for first page). 2nd return tells if there are more pages.
+func (s *Store) ChildStreams(after string, limit int) ([]eh.StreamName, bool) {
+	defer lockAndUnlock(&s.mu)()
+
+	ourName := s.version.Stream()
+
+	start := 0
+	if after != "" {
+		start = sort.Search(len(s.state.Children), func(i int) bool {
+			return s.state.Children[i] > after
+		})
+	}
+
+	end := start + limit
+	if end > len(s.state.Children) {
+		end = len(s.state.Children)
+	}
+
+	children := []eh.StreamName{}
+	for _, childName := range s.state.Children[start:end] {
+		children = append(children, ourName.Child(childName))
+	}
+
+	return children, end < len(s.state.Children)
+}
+
+func (s *Store) Version() eh.Cursor {
+	defer lockAndUnlock(&s.mu)()
+
+	return s.version
+}
+
+func (s *Store) InstallSnapshot(snap *eh.Snapshot) error {
+	defer lockAndUnlock(&s.mu)()
+
+	s.version = snap.Cursor
+	s.state = newStateFormat()
+
+	return json.Unmarshal(snap.Data, &s.state)
+}
+
+func (s *Store) Snapshot() (*eh.Snapshot, error) {
+	defer lockAndUnlock(&s.mu)()
+
+	data, err := json.MarshalIndent(s.state, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	return eh.NewSnapshot(s.version, data, s.Perspective()), nil
+}
+
+func (s *Store) Perspective() eh.SnapshotPerspective {
+	return eh.NewV1Perspective("eh.streamchildren")
+}
+
+func (s *Store) GetEventTypes() []ehclient.LogDataKindDeserializer {
+	// only meta entries, so encrypted data is never touched
+	return ehclient.MetaDeserializer2(ehevent.Types{
+		"$stream.ChildStreamCreated":  func() ehevent.Event { return &eh.StreamChildStreamCreated{} },
+		"$stream.ChildStreamShredded": func() ehevent.Event { return &eh.StreamChildStreamShredded{} },
+	})
+}
+
+func (s *Store) ProcessEvents(_ context.Context, processAndCommit ehclient.EventProcessorHandler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return processAndCommit(
+		s.version,
+		func(ev ehevent.Event) error { return s.processEvent(ev) },
+		func(version eh.Cursor) error {
+			s.version = version
+			return nil
+		})
+}
+
+func (s *Store) processEvent(ev ehevent.Event) error {
+	switch e := ev.(type) {
+	case *eh.StreamChildStreamCreated:
+		s.state.Children = insertSorted(s.state.Children, e.Stream.Base())
+	case *eh.StreamChildStreamShredded:
+		s.state.Children = removeSorted(s.state.Children, e.Stream.Base())
+	}
+
+	return nil
+}
+
+type App struct {
+	State  *Store
+	Reader *ehclient.Reader
+}
+
+// nil cache = not cached (for one-off walks of large trees that would bloat the cache)
+func LoadUntilRealtime(
+	ctx context.Context,
+	stream eh.StreamName,
+	client *ehclient.SystemClient,
+	cache *Cache,
+) (*App, error) {
+	app := cache.Get(stream.String(), func() *App {
+		store := New(stream)
+
+		reader := ehclient.NewReader(store, client)
+		reader.AddLogPrefix("(streamchildren)")
+
+		return &App{
+			store,
+			reader}
+	})
+
+	return app, app.Reader.LoadUntilRealtimeIfStale(ctx, 5*time.Second)
+}
+
+var (
+	lockAndUnlock = syncutil.LockAndUnlock // shorthand
+)
+
+func insertSorted(sorted []string, item string) []string {
+	idx := sort.SearchStrings(sorted, item)
+	if idx < len(sorted) && sorted[idx] == item {
+		return sorted // already exists
+	}
+
+	sorted = append(sorted, "")
+	copy(sorted[idx+1:], sorted[idx:])
+	sorted[idx] = item
+
+	return sorted
+}
+
+func removeSorted(sorted []string, item string) []string {
+	idx := sort.SearchStrings(sorted, item)
+	if idx == len(sorted) || sorted[idx] != item {
+		return sorted
+	}
+
+	return append(sorted[:idx], sorted[idx+1:]...)
+}
@@ -0,0 +1,163 @@
+package ehstreamchildren
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/policy"
+)
+
+const (
+	DefaultTreeDepth = 3
+	MaxTreeDepth     = 10
+	DefaultTreeLimit = 1000
+	MaxTreeLimit     = 10000
+	childrenPageSize = 1000
+)
+
+// response format of the HTTP endpoint
+type TreeOutput struct {
+	Streams []eh.StreamName
+	More    bool // continue with the last stream as "after"
+}
+
+type TreeQuery struct {
+	MaxDepth int            // 1 = only direct children
+	Glob     string         // optional. same syntax as policy resources
+	After    *eh.StreamName // optional. last stream of the previous page
+	Limit    int            // how many streams to visit. 0 = no limit
+	// optional. streams for which this returns false are not visited (nor counted towards Limit),
+	// but their descendants can be.
+	Filter func(stream eh.StreamName) bool
+}
+
+var errPageFull = errors.New("page full")
+
+// calls visit() for each descendant of root (depth-first, children in alphabetical order) that the
+// query matches. root itself is not visited. returns true if the walk stopped because of Limit.
+// subtrees that can't contain matches for Glob (or are before After) are not loaded at all.
+func WalkTree(
+	ctx context.Context,
+	root eh.StreamName,
+	query TreeQuery,
+	client *ehclient.SystemClient,
+	cache *Cache,
+	visit func(stream eh.StreamName, depth int) error,
+) (bool, error) {
+	if query.MaxDepth < 1 || query.MaxDepth > MaxTreeDepth {
+		return false, fmt.Errorf("depth must be between 1 and %d", MaxTreeDepth)
+	}
+
+	visited := 0
+
+	var walk func(stream eh.StreamName, depth int) error
+	walk = func(stream eh.StreamName, depth int) error {
+		children, err := LoadUntilRealtime(ctx, stream, client, cache)
+		if err != nil {
+			return fmt.Errorf("%s: %w", stream.String(), err)
+		}
+
+		after := ""
+		for {
+			page, more := children.State.ChildStreams(after, childrenPageSize)
+
+			for _, child := range page {
+				visitChild, descend := query.decide(child)
+
+				if visitChild {
+					if query.Limit != 0 && visited == query.Limit {
+						return errPageFull
+					}
+					visited++
+
+					if err := visit(child, depth); err != nil {
+						return err
+					}
+				}
+
+				if descend && depth < query.MaxDepth {
+					if err := walk(child, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+
+			if !more {
+				return nil
+			}
+
+			after = page[len(page)-1].Base()
+		}
+	}
+
+	if err := walk(root, 1); err != nil {
+		if err == errPageFull {
+			return true, nil
+		}
+
+		return false, err
+	}
+
+	return false, nil
+}
+
+// returns whether to visit the stream and whether its descendants might need visiting
+func (q TreeQuery) decide(stream eh.StreamName) (bool, bool) {
+	if q.After != nil {
+		switch {
+		case isSelfOrAncestor(stream, *q.After): // visited on an earlier page, but its descendants might not
+			return false, true
+		case compareWalkOrder(stream, *q.After) < 0: // visited on an earlier page, as were its descendants
+			return false, false
+		}
+	}
+
+	visit := (q.Glob == "" || policy.WildcardMatches(stream.String(), q.Glob)) &&
+		(q.Filter == nil || q.Filter(stream))
+
+	return visit, q.Glob == "" || descendantsMightMatch(stream, q.Glob)
+}
+
+// "*" matches also "/", so only the glob's literal prefix can rule out a subtree
+func descendantsMightMatch(stream eh.StreamName, glob string) bool {
+	descendantsPrefix := strings.TrimSuffix(stream.String(), "/") + "/"
+
+	idx := strings.Index(glob, "*")
+	if idx == -1 { // exact name
+		return strings.HasPrefix(glob, descendantsPrefix)
+	}
+
+	literalPrefix := glob[:idx]
+
+	return strings.HasPrefix(literalPrefix, descendantsPrefix) || strings.HasPrefix(descendantsPrefix, literalPrefix)
+}
+
+func isSelfOrAncestor(stream eh.StreamName, of eh.StreamName) bool {
+	return stream.Equal(of) || strings.HasPrefix(of.String(), strings.TrimSuffix(stream.String(), "/")+"/")
+}
+
+// order of the depth-first walk: name components compared one by one, parent before its children
+func compareWalkOrder(a eh.StreamName, b eh.StreamName) int {
+	aComponents, bComponents := components(a), components(b)
+
+	for i := 0; i < len(aComponents) && i < len(bComponents); i++ {
+		if cmp := strings.Compare(aComponents[i], bComponents[i]); cmp != 0 {
+			return cmp
+		}
+	}
+
+	return len(aComponents) - len(bComponents)
+}
+
+func components(stream eh.StreamName) []string {
+	trimmed := strings.Trim(stream.String(), "/")
+	if trimmed == "" {
+		return []string{}
+	}
+
+	return strings.Split(trimmed, "/")
+}
@@ -0,0 +1,171 @@
+package ehstreamchildren
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehclient/ehclienttest"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/crypto/envelopeenc"
+	"github.com/function61/gokit/testing/assert"
+)
+
+var (
+	t0 = time.Date(2020, 10, 10, 12, 0, 0, 0, time.UTC)
+)
+
+func TestWalkTree(t *testing.T) {
+	client, eventLog := newTestClient(t,
+		"/a",
+		"/a/x",
+		"/a/x/deep",
+		"/a/y",
+		"/b",
+		"/b/x",
+		"/c")
+
+	walk := func(query TreeQuery) string {
+		t.Helper()
+
+		visited := []string{}
+
+		more, err := WalkTree(context.Background(), eh.RootName, query, client, nil, func(stream eh.StreamName, depth int) error {
+			visited = append(visited, fmt.Sprintf("%s(%d)", stream.String(), depth))
+			return nil
+		})
+		assert.Ok(t, err)
+
+		if more {
+			visited = append(visited, "...")
+		}
+
+		return strings.Join(visited, " ")
+	}
+
+	assert.EqualString(t, walk(TreeQuery{MaxDepth: 3}), "/a(1) /a/x(2) /a/x/deep(3) /a/y(2) /b(1) /b/x(2) /c(1)")
+	assert.EqualString(t, walk(TreeQuery{MaxDepth: 1}), "/a(1) /b(1) /c(1)")
+
+	// pages continue from the last stream of the previous page
+	assert.EqualString(t, walk(TreeQuery{MaxDepth: 3, Limit: 3}), "/a(1) /a/x(2) /a/x/deep(3) ...")
+	assert.EqualString(t, walk(TreeQuery{MaxDepth: 3, Limit: 3, After: stream("/a/x/deep")}), "/a/y(2) /b(1) /b/x(2) ...")
+	assert.EqualString(t, walk(TreeQuery{MaxDepth: 3, Limit: 3, After: stream("/b/x")}), "/c(1)")
+	assert.EqualString(t, walk(TreeQuery{MaxDepth: 3, Limit: 3, After: stream("/c")}), "")
+
+	// filtered-out streams don't count towards the limit, but their children are still visited
+	assert.EqualString(t, walk(TreeQuery{
+		MaxDepth: 3,
+		Limit:    2,
+		Filter:   func(candidate eh.StreamName) bool { return !candidate.Equal(*stream("/a")) },
+	}), "/a/x(2) /a/x/deep(3) ...")
+
+	eventLog.streamsRead = map[string]bool{}
+
+	assert.EqualString(t, walk(TreeQuery{MaxDepth: 3, Glob: "/b/*"}), "/b/x(2)")
+
+	// subtrees that can't contain matches are not loaded
+	assert.EqualString(t, eventLog.StreamsRead(), "/, /b, /b/x")
+
+	eventLog.streamsRead = map[string]bool{}
+
+	assert.EqualString(t, walk(TreeQuery{MaxDepth: 3, Glob: "/a/*/deep"}), "/a/x/deep(3)")
+	assert.EqualString(t, eventLog.StreamsRead(), "/, /a, /a/x, /a/y")
+
+	assert.EqualString(t, walk(TreeQuery{MaxDepth: 3, Glob: "*/x"}), "/a/x(2) /b/x(2)")
+
+	_, err := WalkTree(context.Background(), eh.RootName, TreeQuery{MaxDepth: 11}, client, nil, nil)
+	assert.EqualString(t, err.Error(), "depth must be between 1 and 10")
+}
+
+func TestCompareWalkOrder(t *testing.T) {
+	assert.Assert(t, compareWalkOrder(*stream("/a"), *stream("/a/x")) < 0)
+	assert.Assert(t, compareWalkOrder(*stream("/a/x"), *stream("/b")) < 0)
+	assert.Assert(t, compareWalkOrder(*stream("/a-b"), *stream("/a/b")) > 0) // "-" < "/" as a string, but not as a component
+	assert.Assert(t, compareWalkOrder(*stream("/b"), *stream("/b")) == 0)
+	assert.Assert(t, compareWalkOrder(eh.RootName, *stream("/a")) < 0)
+}
+
+func TestDescendantsMightMatch(t *testing.T) {
+	assert.Assert(t, descendantsMightMatch(eh.RootName, "/t-1/*"))
+	assert.Assert(t, descendantsMightMatch(*stream("/t-1"), "/t-1/*"))
+	assert.Assert(t, descendantsMightMatch(*stream("/t-1/users"), "/t-*/users"))
+	assert.Assert(t, descendantsMightMatch(*stream("/t-2"), "*/users"))
+	assert.Assert(t, !descendantsMightMatch(*stream("/t-2"), "/t-1/*"))
+	assert.Assert(t, !descendantsMightMatch(*stream("/t-1"), "/t-1"))
+}
+
+func stream(name string) *eh.StreamName {
+	streamName, err := eh.DeserializeStreamName(name)
+	if err != nil {
+		panic(err)
+	}
+
+	return &streamName
+}
+
+// creates root and given streams (parents before children)
+func newTestClient(t *testing.T, streams ...string) (*ehclient.SystemClient, *readRecordingEventLog) {
+	ctx := context.Background()
+
+	eventLog := &readRecordingEventLog{
+		EventLog:    ehclienttest.NewEventLog(),
+		streamsRead: map[string]bool{},
+	}
+
+	create := func(stream eh.StreamName) {
+		_, err := eventLog.CreateStream(ctx, stream, envelopeenc.Envelope{}, "default", nil)
+		assert.Ok(t, err)
+
+		if parent := stream.Parent(); parent != nil {
+			_, err := eventLog.Append(ctx, *parent, *eh.LogDataMeta(eh.NewStreamChildStreamCreated(
+				stream,
+				ehevent.MetaSystemUser(t0))))
+			assert.Ok(t, err)
+		}
+	}
+
+	create(eh.RootName)
+
+	for _, name := range streams {
+		create(*stream(name))
+	}
+
+	return ehclient.NewSystemClient(
+		eventLog,
+		ehclienttest.NewSnapshotStore(),
+		ehclienttest.NewSystemConnector(eventLog.EventLog),
+		nil), eventLog
+}
+
+type readRecordingEventLog struct {
+	*ehclienttest.EventLog
+	streamsRead   map[string]bool
+	streamsReadMu sync.Mutex
+}
+
+func (r *readRecordingEventLog) Read(ctx context.Context, lastKnown eh.Cursor) (*eh.ReadResult, error) {
+	r.streamsReadMu.Lock()
+	r.streamsRead[lastKnown.Stream().String()] = true
+	r.streamsReadMu.Unlock()
+
+	return r.EventLog.Read(ctx, lastKnown)
+}
+
+func (r *readRecordingEventLog) StreamsRead() string {
+	r.streamsReadMu.Lock()
+	defer r.streamsReadMu.Unlock()
+
+	read := []string{}
+	for stream := range r.streamsRead {
+		read = append(read, stream)
+	}
+	sort.Strings(read)
+
+	return strings.Join(read, ", ")
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/function61/eventhorizon/pkg/eh"
 	"github.com/function61/eventhorizon/pkg/ehclient"
 	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/eheventencryption"
 	"github.com/function61/gokit/crypto/envelopeenc"
 	"github.com/function61/gokit/sync/syncutil"
 )
@@ -26,16 +27,30 @@ var (
 
 type stateFormat struct {
 	Created       time.Time
+	KeyGroup      string `json:",omitempty"` // empty for streams created before key groups were recorded
 	Subscriptions []eh.SubscriberID
-	DEKv0         *envelopeenc.EnvelopeBundle // work has to be done once we implement key rotation
-	ChildStreams  []string                    // child base names to conserve space
+	DEKv0         *envelopeenc.EnvelopeBundle
+	DEKsRotated   map[uint64]*envelopeenc.EnvelopeBundle // DEKs v1 onwards
+	ChildStreams  []string                               // child base names to conserve space
 	TotalBytes    int64
+	Closed        *time.Time `json:",omitempty"`
+	Shredded      *time.Time `json:",omitempty"`
+	// nil = eheventencryption.DefaultCompression
+	Compression *compressionState `json:",omitempty"`
+	// all the stream's dictionaries (older data might need older ones). encrypted with stream's DEK.
+	CompressionDictionaries map[uint32][]byte `json:",omitempty"`
+}
+
+type compressionState struct {
+	Method       eheventencryption.CompressionMethod
+	DictionaryID uint32 `json:",omitempty"`
 }
 
 func newStateFormat() stateFormat {
 	return stateFormat{
 		Subscriptions: []eh.SubscriberID{},
 		DEKv0:         nil,
+		DEKsRotated:   map[uint64]*envelopeenc.EnvelopeBundle{},
 		ChildStreams:  []string{},
 	}
 }
@@ -70,6 +85,74 @@ func (s *Store) Subscriptions() []eh.SubscriberID {
 	return s.state.Subscriptions
 }
 
+// closed streams don't accept appends. shredded streams are also closed.
+func (s *Store) Closed() bool {
+	defer lockAndUnlock(&s.mu)()
+
+	return s.state.Closed != nil
+}
+
+// stream's DEKs are destroyed, so its encrypted data is unreadable
+func (s *Store) Shredded() bool {
+	defer lockAndUnlock(&s.mu)()
+
+	return s.state.Shredded != nil
+}
+
+// key group whose KEKs control access to the stream's data
+func (s *Store) KeyGroupID() string {
+	defer lockAndUnlock(&s.mu)()
+
+	return s.state.KeyGroup
+}
+
+// how data appended to the stream should be compressed. dictionary ID 0 = no dictionary.
+func (s *Store) Compression() (eheventencryption.CompressionMethod, uint32) {
+	defer lockAndUnlock(&s.mu)()
+
+	if s.state.Compression == nil {
+		return eheventencryption.DefaultCompression.Method, 0
+	}
+
+	return s.state.Compression.Method, s.state.Compression.DictionaryID
+}
+
+// returns nil if dictionary with given ID doesn't exist. dictionary is encrypted with the stream's DEK.
+func (s *Store) CompressionDictionary(id uint32) []byte {
+	defer lockAndUnlock(&s.mu)()
+
+	return s.state.CompressionDictionaries[id]
+}
+
+// returns nil if DEK with given version doesn't exist
+func (s *Store) DEK(version uint64) *envelopeenc.EnvelopeBundle {
+	defer lockAndUnlock(&s.mu)()
+
+	if version == 0 {
+		return s.state.DEKv0
+	}
+
+	return s.state.DEKsRotated[version]
+}
+
+// version of the DEK that new data should be encrypted with
+func (s *Store) NewestDEKVersion() uint64 {
+	defer lockAndUnlock(&s.mu)()
+
+	return s.newestDEKVersion()
+}
+
+func (s *Store) newestDEKVersion() uint64 {
+	newest := uint64(0)
+	for version := range s.state.DEKsRotated {
+		if version > newest {
+			newest = version
+		}
+	}
+
+	return newest
+}
+
 func (s *Store) Subscribed(id eh.SubscriberID) bool {
 	defer lockAndUnlock(&s.mu)()
 
@@ -126,7 +209,7 @@ func (s *Store) Snapshot() (*eh.Snapshot, error) {
 }
 
 func (s *Store) Perspective() eh.SnapshotPerspective {
-	return eh.NewV1Perspective("eh.streammeta") // change if persisted stateFormat changes in backwards-incompat way
+	return eh.StreamMetaPerspective // change if persisted stateFormat changes in backwards-incompat way
 }
 
 func (s *Store) GetEventTypes() []ehclient.LogDataKindDeserializer {
@@ -157,6 +240,38 @@ func (s *Store) processEvent(ev ehevent.Event) error {
 	case *eh.StreamStarted:
 		s.state.Created = e.Meta().Time()
 		s.state.DEKv0 = &e.DEKv0
+		s.state.KeyGroup = e.KeyGroup
+	case *eh.StreamDEKRotated:
+		// concurrent rotations can race for same version. first one wins.
+		if e.Version > s.newestDEKVersion() {
+			if s.state.DEKsRotated == nil { // snapshot from before rotation support
+				s.state.DEKsRotated = map[uint64]*envelopeenc.EnvelopeBundle{}
+			}
+
+			s.state.DEKsRotated[e.Version] = &e.DEK
+		}
+	case *eh.StreamDEKRewrapped:
+		if e.Version == 0 {
+			s.state.DEKv0 = &e.DEK
+		} else if _, exists := s.state.DEKsRotated[e.Version]; exists {
+			s.state.DEKsRotated[e.Version] = &e.DEK
+		}
+	case *eh.StreamCompressionSet:
+		s.state.Compression = &compressionState{
+			Method:       e.Method,
+			DictionaryID: e.DictionaryID,
+		}
+
+		if e.DictionaryID != 0 {
+			if s.state.CompressionDictionaries == nil {
+				s.state.CompressionDictionaries = map[uint32][]byte{}
+			}
+
+			// same dictionary can be taken back into use without repeating it
+			if e.Dictionary != nil {
+				s.state.CompressionDictionaries[e.DictionaryID] = e.Dictionary
+			}
+		}
 	case *eh.SubscriptionSubscribed:
 		s.state.Subscriptions = append(s.state.Subscriptions, e.ID)
 	case *eh.SubscriptionUnsubscribed:
@@ -167,6 +282,17 @@ func (s *Store) processEvent(ev ehevent.Event) error {
 		if len(s.state.ChildStreams) > maxKeepTrackOfChildren {
 			s.state.ChildStreams = s.state.ChildStreams[1 : 1+maxKeepTrackOfChildren]
 		}
+	case *eh.StreamChildStreamShredded:
+		s.state.ChildStreams = removeString(s.state.ChildStreams, e.Stream.Base())
+	case *eh.StreamClosed:
+		closed := e.Meta().Time()
+		s.state.Closed = &closed
+	case *eh.StreamShredded:
+		shredded := e.Meta().Time()
+		s.state.Shredded = &shredded
+		// storage destroyed these from the log already, but they might have come from a snapshot
+		s.state.DEKv0 = nil
+		s.state.DEKsRotated = map[uint64]*envelopeenc.EnvelopeBundle{}
 	case *syntheticStatisticsEvent: // not actually present in the stream
 		s.state.TotalBytes += int64(e.NumBytes)
 	}
@@ -208,6 +334,16 @@ var (
 	lockAndUnlock = syncutil.LockAndUnlock // shorthand
 )
 
+func removeString(input []string, remove string) []string {
+	removed := []string{}
+	for _, item := range input {
+		if item != remove {
+			removed = append(removed, item)
+		}
+	}
+	return removed
+}
+
 func remove(input []eh.SubscriberID, remove eh.SubscriberID) []eh.SubscriberID {
 	removed := []eh.SubscriberID{}
 	for _, item := range input {
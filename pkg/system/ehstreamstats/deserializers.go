@@ -0,0 +1,134 @@
+package ehstreamstats
+
+import (
+	"context"
+	"errors"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/eheventencryption"
+)
+
+// meta events that we need in full (not only type and metadata)
+var childStreamTypes = ehevent.Types{
+	"$stream.ChildStreamCreated":  func() ehevent.Event { return &eh.StreamChildStreamCreated{} },
+	"$stream.ChildStreamShredded": func() ehevent.Event { return &eh.StreamChildStreamShredded{} },
+}
+
+// we don't know the types of the stream's events, so we synthesize events that describe
+// the log entries and the events inside them
+func statisticsDeserializers() []ehclient.LogDataKindDeserializer {
+	return []ehclient.LogDataKindDeserializer{
+		{
+			Kind:       eh.LogDataKindEncryptedData,
+			Encryption: true, // our snapshots contain information about encrypted data
+			Deserializer: func(ctx context.Context, entry *eh.LogEntry, client *ehclient.SystemClient) ([]ehevent.Event, error) {
+				dekVersion, err := eheventencryption.DEKVersion(entry.Data.Raw)
+				if err != nil {
+					return nil, err
+				}
+
+				eventsSerialized, err := client.Decrypt(ctx, entry.Cursor.Stream(), entry.Data.Raw)
+				if err != nil {
+					// we can still count the entry if we don't have access to the DEK. other errors
+					// (cancellation, timeouts etc.) must not end up in the snapshot as undecryptable.
+					var dekUnavailable *eh.ErrDEKUnavailable
+					if errors.As(err, &dekUnavailable) {
+						observed := newEntryObserved(entry, true)
+						observed.DEKVersion = dekVersion
+
+						return []ehevent.Event{observed}, nil
+					}
+
+					return nil, err
+				}
+
+				eventsSplit, err := ehevent.DeserializeBatch(eventsSerialized)
+				if err != nil {
+					return nil, err
+				}
+
+				events, err := observeEvents(entry, eventsSplit)
+				if err != nil {
+					return nil, err
+				}
+
+				events[0].(*entryObserved).DEKVersion = dekVersion
+
+				return events, nil
+			},
+		},
+		{
+			Kind: eh.LogDataKindMeta,
+			Deserializer: func(ctx context.Context, entry *eh.LogEntry, client *ehclient.SystemClient) ([]ehevent.Event, error) {
+				lines := ehevent.DeserializeLines(entry.Data.Raw)
+
+				events, err := observeEvents(entry, lines)
+				if err != nil {
+					return nil, err
+				}
+
+				for _, line := range lines {
+					childStreamEvent, err := ehevent.Deserialize(line, childStreamTypes)
+					if err != nil {
+						continue // not interesting (errors were already caught by observeEvents())
+					}
+
+					events = append(events, childStreamEvent)
+				}
+
+				return events, nil
+			},
+		},
+	}
+}
+
+func observeEvents(entry *eh.LogEntry, lines []string) ([]ehevent.Event, error) {
+	events := []ehevent.Event{newEntryObserved(entry, false)}
+
+	for _, line := range lines {
+		eventType, meta, err := ehevent.DeserializeTypeAndMeta(line)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, &eventObserved{
+			meta:      *meta,
+			Type:      eventType,
+			Encrypted: entry.Data.Kind == eh.LogDataKindEncryptedData,
+		})
+	}
+
+	return events, nil
+}
+
+func newEntryObserved(entry *eh.LogEntry, undecryptable bool) *entryObserved {
+	return &entryObserved{
+		Kind:          entry.Data.Kind,
+		NumBytes:      len(entry.Data.Raw),
+		Undecryptable: undecryptable,
+	}
+}
+
+// one per log entry. not actually present in the stream.
+type entryObserved struct {
+	meta          ehevent.EventMeta
+	Kind          eh.LogDataKind
+	NumBytes      int
+	Undecryptable bool
+	DEKVersion    uint64 // only for encrypted entries
+}
+
+func (e *entryObserved) MetaType() string         { return "entryObserved" }
+func (e *entryObserved) Meta() *ehevent.EventMeta { return &e.meta }
+
+// one per event inside a log entry. not actually present in the stream.
+type eventObserved struct {
+	meta      ehevent.EventMeta
+	Type      string
+	Encrypted bool // came from encrypted entry
+}
+
+func (e *eventObserved) MetaType() string         { return "eventObserved" }
+func (e *eventObserved) Meta() *ehevent.EventMeta { return &e.meta }
@@ -0,0 +1,331 @@
+// Statistics (event counts, timestamps, bytes, complete child stream index) for a given stream.
+package ehstreamstats
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/sync/syncutil"
+)
+
+//go:generate genny -in=../../cachegen/cache.go -out=cache.gen.go -pkg=ehstreamstats gen CacheItemType=*App
+
+const (
+	DefaultChildStreamsLimit = 100
+	MaxChildStreamsLimit     = 1000
+)
+
+var (
+	GlobalCache = NewCache()
+)
+
+type Stats struct {
+	EventsByType         map[string]int64         // by MetaType. encrypted events are only counted if we could decrypt them
+	FirstEvent           *time.Time               `json:",omitempty"` // logical timestamps of counted events
+	LastEvent            *time.Time               `json:",omitempty"`
+	EntriesByKind        map[eh.LogDataKind]int64 // log entries (one entry can contain many events)
+	BytesByKind          map[eh.LogDataKind]int64
+	UndecryptableEntries int64 // encrypted entries whose events we couldn't count (no access to DEK)
+	TotalChildStreams    int
+}
+
+// response format of the HTTP endpoint
+type Output struct {
+	Version          eh.Cursor
+	Stats            Stats
+	ChildStreams     []eh.StreamName // one page
+	MoreChildStreams bool
+}
+
+type stateFormat struct {
+	Stats
+	Unencrypted  unencryptedStats // subset of Stats that doesn't reveal anything about encrypted data
+	DEKVersions  []uint64         // sorted. DEKs needed for reading the encrypted data we counted.
+	ChildStreams []string         // child base names (to conserve space), sorted for pagination. unlike ehstreammeta, not capped.
+}
+
+// counted only from unencrypted (meta) entries
+type unencryptedStats struct {
+	EventsByType map[string]int64
+	FirstEvent   *time.Time `json:",omitempty"`
+	LastEvent    *time.Time `json:",omitempty"`
+}
+
+func newStateFormat() stateFormat {
+	return stateFormat{
+		Stats: Stats{
+			EventsByType:  map[string]int64{},
+			EntriesByKind: map[eh.LogDataKind]int64{},
+			BytesByKind:   map[eh.LogDataKind]int64{},
+		},
+		Unencrypted: unencryptedStats{
+			EventsByType: map[string]int64{},
+		},
+		DEKVersions:  []uint64{},
+		ChildStreams: []string{},
+	}
+}
+
+type Store struct {
+	version eh.Cursor
+	mu      sync.Mutex
+	state   stateFormat // for easy snapshotting
+}
+
+func New(stream eh.StreamName) *Store {
+	return &Store{
+		version: stream.Beginning(),
+		state:   newStateFormat(),
+	}
+}
+
+func (s *Store) Stats() Stats {
+	defer lockAndUnlock(&s.mu)()
+
+	// copy maps so caller can't race with our updates
+	stats := s.state.Stats
+	stats.EventsByType = copyTypeCounts(s.state.EventsByType)
+	stats.EntriesByKind = copyKindCounts(s.state.EntriesByKind)
+	stats.BytesByKind = copyKindCounts(s.state.BytesByKind)
+
+	return stats
+}
+
+// Stats() without anything learned from encrypted data, for those who don't have access to
+// the stream's DEKs. entry counts and sizes are not secret (they're visible in the raw log).
+func (s *Store) UnencryptedStats() Stats {
+	stats := s.Stats()
+
+	defer lockAndUnlock(&s.mu)()
+
+	stats.EventsByType = copyTypeCounts(s.state.Unencrypted.EventsByType)
+	stats.FirstEvent = s.state.Unencrypted.FirstEvent
+	stats.LastEvent = s.state.Unencrypted.LastEvent
+
+	return stats
+}
+
+// versions of the stream's DEKs that the encrypted data in Stats() was encrypted with
+func (s *Store) DEKVersions() []uint64 {
+	defer lockAndUnlock(&s.mu)()
+
+	return append([]uint64{}, s.state.DEKVersions...)
+}
+
+// paginated in alphabetical order. "after" is base name of the last child of the previous page
+// ("" for first page). 2nd return tells if there are more pages.
+func (s *Store) ChildStreams(after string, limit int) ([]eh.StreamName, bool) {
+	defer lockAndUnlock(&s.mu)()
+
+	ourName := s.version.Stream()
+
+	start := 0
+	if after != "" {
+		start = sort.Search(len(s.state.ChildStreams), func(i int) bool {
+			return s.state.ChildStreams[i] > after
+		})
+	}
+
+	end := start + limit
+	if end > len(s.state.ChildStreams) {
+		end = len(s.state.ChildStreams)
+	}
+
+	children := []eh.StreamName{}
+	for _, childName := range s.state.ChildStreams[start:end] {
+		children = append(children, ourName.Child(childName))
+	}
+
+	return children, end < len(s.state.ChildStreams)
+}
+
+// *includeEncrypted* = false leaves out what's learned from encrypted data (see UnencryptedStats())
+func (s *Store) Output(childStreamsAfter string, childStreamsLimit int, includeEncrypted bool) Output {
+	childStreams, more := s.ChildStreams(childStreamsAfter, childStreamsLimit)
+
+	stats := s.Stats()
+	if !includeEncrypted {
+		stats = s.UnencryptedStats()
+	}
+
+	return Output{
+		Version:          s.Version(),
+		Stats:            stats,
+		ChildStreams:     childStreams,
+		MoreChildStreams: more,
+	}
+}
+
+func (s *Store) Version() eh.Cursor {
+	defer lockAndUnlock(&s.mu)()
+
+	return s.version
+}
+
+func (s *Store) InstallSnapshot(snap *eh.Snapshot) error {
+	defer lockAndUnlock(&s.mu)()
+
+	s.version = snap.Cursor
+	s.state = newStateFormat()
+
+	return json.Unmarshal(snap.Data, &s.state)
+}
+
+func (s *Store) Snapshot() (*eh.Snapshot, error) {
+	defer lockAndUnlock(&s.mu)()
+
+	data, err := json.MarshalIndent(s.state, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	return eh.NewSnapshot(s.version, data, s.Perspective()), nil
+}
+
+func (s *Store) Perspective() eh.SnapshotPerspective {
+	return eh.NewPerspective("eh.streamstats", "v2")
+}
+
+func (s *Store) GetEventTypes() []ehclient.LogDataKindDeserializer {
+	return statisticsDeserializers()
+}
+
+func (s *Store) ProcessEvents(_ context.Context, processAndCommit ehclient.EventProcessorHandler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return processAndCommit(
+		s.version,
+		func(ev ehevent.Event) error { return s.processEvent(ev) },
+		func(version eh.Cursor) error {
+			s.version = version
+			return nil
+		})
+}
+
+func (s *Store) processEvent(ev ehevent.Event) error {
+	switch e := ev.(type) {
+	case *entryObserved:
+		s.state.EntriesByKind[e.Kind]++
+		s.state.BytesByKind[e.Kind] += int64(e.NumBytes)
+
+		if e.Undecryptable {
+			s.state.UndecryptableEntries++
+		}
+
+		if e.Kind == eh.LogDataKindEncryptedData {
+			s.state.DEKVersions = insertSortedUint64(s.state.DEKVersions, e.DEKVersion)
+		}
+	case *eventObserved:
+		s.state.EventsByType[e.Type]++
+
+		ts := e.Meta().Time()
+		if s.state.FirstEvent == nil {
+			s.state.FirstEvent = &ts
+		}
+		s.state.LastEvent = &ts
+
+		if !e.Encrypted {
+			s.state.Unencrypted.EventsByType[e.Type]++
+
+			if s.state.Unencrypted.FirstEvent == nil {
+				s.state.Unencrypted.FirstEvent = &ts
+			}
+			s.state.Unencrypted.LastEvent = &ts
+		}
+	case *eh.StreamChildStreamCreated:
+		s.state.ChildStreams = insertSorted(s.state.ChildStreams, e.Stream.Base())
+		s.state.TotalChildStreams = len(s.state.ChildStreams)
+	case *eh.StreamChildStreamShredded:
+		s.state.ChildStreams = removeSorted(s.state.ChildStreams, e.Stream.Base())
+		s.state.TotalChildStreams = len(s.state.ChildStreams)
+	}
+
+	return nil
+}
+
+type App struct {
+	State  *Store
+	Reader *ehclient.Reader
+}
+
+func LoadUntilRealtime(
+	ctx context.Context,
+	stream eh.StreamName,
+	client *ehclient.SystemClient,
+	cache *Cache,
+) (*App, error) {
+	app := cache.Get(stream.String(), func() *App {
+		store := New(stream)
+
+		reader := ehclient.NewReader(store, client)
+		reader.AddLogPrefix("(streamstats)")
+
+		return &App{
+			store,
+			reader}
+	})
+
+	return app, app.Reader.LoadUntilRealtimeIfStale(ctx, 5*time.Second)
+}
+
+var (
+	lockAndUnlock = syncutil.LockAndUnlock // shorthand
+)
+
+func insertSorted(sorted []string, item string) []string {
+	idx := sort.SearchStrings(sorted, item)
+	if idx < len(sorted) && sorted[idx] == item {
+		return sorted // already exists
+	}
+
+	sorted = append(sorted, "")
+	copy(sorted[idx+1:], sorted[idx:])
+	sorted[idx] = item
+
+	return sorted
+}
+
+func insertSortedUint64(sorted []uint64, item uint64) []uint64 {
+	idx := sort.Search(len(sorted), func(i int) bool { return sorted[i] >= item })
+	if idx < len(sorted) && sorted[idx] == item {
+		return sorted // already exists
+	}
+
+	sorted = append(sorted, 0)
+	copy(sorted[idx+1:], sorted[idx:])
+	sorted[idx] = item
+
+	return sorted
+}
+
+func removeSorted(sorted []string, item string) []string {
+	idx := sort.SearchStrings(sorted, item)
+	if idx == len(sorted) || sorted[idx] != item {
+		return sorted
+	}
+
+	return append(sorted[:idx], sorted[idx+1:]...)
+}
+
+func copyTypeCounts(counts map[string]int64) map[string]int64 {
+	copied := map[string]int64{}
+	for eventType, count := range counts {
+		copied[eventType] = count
+	}
+	return copied
+}
+
+func copyKindCounts(counts map[eh.LogDataKind]int64) map[eh.LogDataKind]int64 {
+	copied := map[eh.LogDataKind]int64{}
+	for kind, count := range counts {
+		copied[kind] = count
+	}
+	return copied
+}
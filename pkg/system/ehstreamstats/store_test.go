@@ -0,0 +1,126 @@
+package ehstreamstats
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/eh"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehclient/ehclienttest"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/eheventencryption"
+	"github.com/function61/gokit/testing/assert"
+)
+
+var (
+	t0 = time.Date(2020, 10, 10, 12, 0, 0, 0, time.UTC)
+)
+
+func TestStats(t *testing.T) {
+	chatRooms := eh.RootName.Child("chatrooms")
+
+	store := New(chatRooms)
+
+	eventLog := ehclienttest.NewEventLog()
+	// the stream isn't created in the event log, so there's no DEK for it
+	client := ehclient.NewSystemClient(
+		eventLog,
+		ehclienttest.NewSnapshotStore(),
+		ehclienttest.NewSystemConnector(eventLog),
+		nil)
+
+	deserialize := func(entry eh.LogEntry) ([]ehevent.Event, error) {
+		for _, deserializer := range statisticsDeserializers() {
+			if deserializer.Kind == entry.Data.Kind {
+				return deserializer.Deserializer(context.Background(), &entry, client)
+			}
+		}
+
+		return nil, nil
+	}
+
+	process := func(entry eh.LogEntry) {
+		t.Helper()
+
+		events, err := deserialize(entry)
+		assert.Ok(t, err)
+
+		for _, event := range events {
+			assert.Ok(t, store.processEvent(event))
+		}
+	}
+
+	process(eh.LogEntry{
+		Cursor: chatRooms.At(0),
+		Data:   *eh.LogDataMeta(eh.NewStreamClosed("archived", ehevent.MetaSystemUser(t0))),
+	})
+
+	for _, child := range []string{"offtopic", "general", "random"} {
+		process(eh.LogEntry{
+			Cursor: chatRooms.At(1),
+			Data: *eh.LogDataMeta(eh.NewStreamChildStreamCreated(
+				chatRooms.Child(child),
+				ehevent.MetaSystemUser(t0.Add(time.Hour)))),
+		})
+	}
+
+	process(eh.LogEntry{
+		Cursor: chatRooms.At(4),
+		Data: *eh.LogDataMeta(eh.NewStreamChildStreamShredded(
+			chatRooms.Child("random"),
+			ehevent.MetaSystemUser(t0.Add(2*time.Hour)))),
+	})
+
+	encrypted, err := eheventencryption.Encrypt([]byte("hello"), make([]byte, 32))
+	assert.Ok(t, err)
+
+	// we don't have the DEK, so this can't be decrypted
+	process(eh.LogEntry{
+		Cursor: chatRooms.At(5),
+		Data: eh.LogData{
+			Kind: eh.LogDataKindEncryptedData,
+			Raw:  encrypted,
+		},
+	})
+
+	// other errors than not having the DEK are not undecryptable entries
+	_, err = deserialize(eh.LogEntry{
+		Cursor: chatRooms.At(6),
+		Data: eh.LogData{
+			Kind: eh.LogDataKindEncryptedData,
+			Raw:  []byte("garbage"),
+		},
+	})
+	assert.Assert(t, err != nil)
+
+	stats := store.Stats()
+
+	assert.Assert(t, stats.EventsByType["$stream.Closed"] == 1)
+	assert.Assert(t, stats.EventsByType["$stream.ChildStreamCreated"] == 3)
+	assert.Assert(t, stats.EventsByType["$stream.ChildStreamShredded"] == 1)
+	assert.Assert(t, stats.EntriesByKind[eh.LogDataKindMeta] == 5)
+	assert.Assert(t, stats.EntriesByKind[eh.LogDataKindEncryptedData] == 1)
+	assert.Assert(t, stats.BytesByKind[eh.LogDataKindEncryptedData] == int64(len(encrypted)))
+	assert.Assert(t, stats.UndecryptableEntries == 1)
+	assert.Assert(t, stats.FirstEvent.Equal(t0))
+	assert.Assert(t, stats.LastEvent.Equal(t0.Add(2*time.Hour)))
+	assert.EqualInt(t, stats.TotalChildStreams, 2)
+
+	firstPage, more := store.ChildStreams("", 1)
+	assert.EqualString(t, serializeStreams(firstPage), "/chatrooms/general")
+	assert.Assert(t, more)
+
+	secondPage, more := store.ChildStreams(firstPage[0].Base(), 1)
+	assert.EqualString(t, serializeStreams(secondPage), "/chatrooms/offtopic")
+	assert.Assert(t, !more)
+}
+
+func serializeStreams(streams []eh.StreamName) string {
+	serialized := []string{}
+	for _, stream := range streams {
+		serialized = append(serialized, stream.String())
+	}
+	return strings.Join(serialized, ", ")
+}